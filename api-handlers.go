@@ -5,93 +5,201 @@ import (
     "github.com/gorilla/mux"
     "net/http"
     "strconv"
+    "strings"
 )
 
 func apiCreateDocument(w http.ResponseWriter, r *http.Request) {
+    user := currentUser(r)
+    if user == nil {
+        RespondError(w, http.StatusUnauthorized, "Not logged in")
+        return
+    }
+
     var doc Document
     err := json.NewDecoder(r.Body).Decode(&doc)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        RespondAPIError(w, http.StatusBadRequest, err)
         return
     }
 
+    doctype, err := getDoctypeByName(doc.DoctypeName)
+    if err != nil {
+        RespondAPIError(w, http.StatusInternalServerError, err)
+        return
+    }
+    err = checkDocumentWrite(user, doctype, doc.Data)
+    if err != nil {
+        RespondAPIError(w, http.StatusForbidden, err)
+        return
+    }
+
+    doc.ModifiedBy = username(user)
     err = createDocument(&doc)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        RespondAPIError(w, http.StatusInternalServerError, err)
         return
     }
 
-    w.WriteHeader(http.StatusCreated)
-    RespondJSON(w, http.StatusOK, doc)
+    RespondJSON(w, http.StatusCreated, hideSecretFields(doc))
 }
 
 func apiGetDocument(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    doctype := vars["doctype"]
-    id := vars["id"]
+    user := currentUser(r)
+    if user == nil {
+        RespondError(w, http.StatusUnauthorized, "Not logged in")
+        return
+    }
 
-    doc, err := getDocumentByID(doctype, id)
+    doctype, err := getDoctypeByName(vars["doctype"])
     if err != nil {
-        http.Error(w, "Document not found", http.StatusNotFound)
+        RespondAPIError(w, http.StatusInternalServerError, err)
+        return
+    }
+    if !canReadDoctype(user, doctype) {
+        RespondAPIError(w, http.StatusForbidden, &PermissionError{})
         return
     }
-    RespondJSON(w, http.StatusOK, doc)
 
-    // json.NewEncoder(w).Encode(doc)
+    doc, err := getDocumentByID(doctype.Name, vars["id"])
+    if err != nil {
+        RespondAPIError(w, http.StatusInternalServerError, err)
+        return
+    }
+    RespondJSON(w, http.StatusOK, hideSecretFields(doc))
 }
 
 func apiUpdateDocument(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    doctype := vars["doctype"]
-    idStr := vars["id"]
+    user := currentUser(r)
+    if user == nil {
+        RespondError(w, http.StatusUnauthorized, "Not logged in")
+        return
+    }
 
-    id, err := strconv.Atoi(idStr)
+    id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        http.Error(w, "Invalid ID", http.StatusBadRequest)
+        RespondError(w, http.StatusBadRequest, "Invalid ID")
+        return
+    }
+
+    doctype, err := getDoctypeByName(vars["doctype"])
+    if err != nil {
+        RespondAPIError(w, http.StatusInternalServerError, err)
         return
     }
 
     var updatedDoc Document
     err = json.NewDecoder(r.Body).Decode(&updatedDoc)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        RespondAPIError(w, http.StatusBadRequest, err)
+        return
+    }
+
+    err = checkDocumentWrite(user, doctype, updatedDoc.Data)
+    if err != nil {
+        RespondAPIError(w, http.StatusForbidden, err)
         return
     }
 
     updatedDoc.ID = id
-    updatedDoc.DoctypeName = doctype
+    updatedDoc.DoctypeName = doctype.Name
+    updatedDoc.ModifiedBy = username(user)
 
     err = updateDocument(&updatedDoc)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        RespondAPIError(w, http.StatusInternalServerError, err)
         return
     }
 
-    RespondJSON(w, http.StatusOK, updatedDoc)
+    RespondJSON(w, http.StatusOK, hideSecretFields(updatedDoc))
 }
 
 func apiDeleteDocument(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    doctype := vars["doctype"]
-    id := vars["id"]
+    user := currentUser(r)
+    if user == nil {
+        RespondError(w, http.StatusUnauthorized, "Not logged in")
+        return
+    }
 
-    err := deleteDocument(doctype, id)
+    doctype, err := getDoctypeByName(vars["doctype"])
+    if err != nil {
+        RespondAPIError(w, http.StatusInternalServerError, err)
+        return
+    }
+    err = checkDocumentWrite(user, doctype, nil)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        RespondAPIError(w, http.StatusForbidden, err)
+        return
+    }
+
+    err = deleteDocument(doctype.Name, vars["id"])
+    if err != nil {
+        RespondAPIError(w, http.StatusInternalServerError, err)
         return
     }
 
     w.WriteHeader(http.StatusNoContent)
 }
 
+// apiListDocuments lists documents. Optional parameters pick the fields
+// (fields=a,b), filter (filters=JSON), sort (order_by=field&order=desc) and
+// page (limit, offset) the list; the number of matches is returned in the
+// X-Total-Count header.
 func apiListDocuments(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
-    doctype := vars["doctype"]
+    doctype, err := getDoctypeByName(vars["doctype"])
+    if err != nil {
+        RespondAPIError(w, http.StatusInternalServerError, err)
+        return
+    }
+    user := currentUser(r)
+    if user == nil {
+        RespondError(w, http.StatusUnauthorized, "Not logged in")
+        return
+    }
+    if !canReadDoctype(user, doctype) {
+        RespondAPIError(w, http.StatusForbidden, &PermissionError{})
+        return
+    }
+
+    query := r.URL.Query()
+    fields := visibleFields(doctype, doctype.Fields)
+    if f := query.Get("fields"); f != "" {
+        fields, err = resolveFields(doctype, strings.Split(f, ","))
+        if err != nil {
+            RespondAPIError(w, http.StatusBadRequest, err)
+            return
+        }
+    }
+    filters, err := parseFilters(query.Get("filters"))
+    if err != nil {
+        RespondAPIError(w, http.StatusBadRequest, err)
+        return
+    }
+    limit, offset := 0, 0
+    if l := query.Get("limit"); l != "" {
+        limit, err = strconv.Atoi(l)
+        if err != nil || limit < 1 {
+            RespondError(w, http.StatusBadRequest, "limit must be a positive number")
+            return
+        }
+        limit = pageSize(limit)
+    }
+    if o := query.Get("offset"); o != "" {
+        offset, err = strconv.Atoi(o)
+        if err != nil || offset < 0 {
+            RespondError(w, http.StatusBadRequest, "offset must be zero or more")
+            return
+        }
+    }
 
-    docs, err := getDocuments(doctype)
+    docs, total, err := listDocuments(doctype, fields, filters, query.Get("order_by"), query.Get("order"), limit, offset)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        RespondAPIError(w, http.StatusBadRequest, err)
         return
     }
+    w.Header().Set("X-Total-Count", strconv.Itoa(total))
     RespondJSON(w, http.StatusOK, docs)
 }
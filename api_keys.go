@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix starts every API key so keys are easy to spot in config
+// files and logs.
+const apiKeyPrefix = "fgk_"
+
+// apiKeyUseInterval is how often the last use of a key is written. A key
+// used again within the interval keeps its earlier time, so busy keys do
+// not write on every request.
+const apiKeyUseInterval = time.Minute
+
+// apiKeyUserKey is the request context key holding the user of the
+// request's API key, or nil if the key is not valid.
+type apiKeyUserKey struct{}
+
+// APIKey lets a program call the API as a user without a session. Only a
+// hash of the key is stored; the key itself is returned once, when it is
+// created.
+type APIKey struct {
+	ID         int64  `json:"id"`
+	UserID     int    `json:"user_id"`
+	Name       string `json:"name"`
+	Hint       string `json:"hint"`
+	Key        string `json:"key,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at,omitempty"`
+}
+
+func createAPIKeyTables() error {
+	createAPIKeyTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		hint TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		last_used_at TEXT NOT NULL DEFAULT ''
+	);`
+
+	_, err := db.Exec(createAPIKeyTable)
+	return err
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAPIKey generates a key for the user and fills in k.Key.
+func createAPIKey(k *APIKey) error {
+	k.Name = strings.TrimSpace(k.Name)
+	if k.Name == "" {
+		return &ValidationError{Fields: map[string]string{"name": "is required"}}
+	}
+
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	k.Key = apiKeyPrefix + hex.EncodeToString(b)
+	k.Hint = k.Key[len(k.Key)-4:]
+	k.CreatedAt = nowTimestamp()
+
+	result, err := db.Exec("INSERT INTO api_keys (user_id, name, key_hash, hint, created_at) VALUES (?, ?, ?, ?, ?)",
+		k.UserID, k.Name, hashAPIKey(k.Key), k.Hint, k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	k.ID, _ = result.LastInsertId()
+	return nil
+}
+
+func getAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := db.Query("SELECT id, user_id, name, hint, created_at, last_used_at FROM api_keys WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.Hint, &k.CreatedAt, &k.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func deleteAPIKey(userID int, id int64) error {
+	result, err := db.Exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &NotFoundError{What: "API key"}
+	}
+	return nil
+}
+
+// userForAPIKey returns the user an API key belongs to and records that
+// the key was used, unless it was already recorded within
+// apiKeyUseInterval.
+func userForAPIKey(key string) (*Document, error) {
+	var id int64
+	var userID int
+	var lastUsed string
+	err := db.QueryRow("SELECT id, user_id, last_used_at FROM api_keys WHERE key_hash = ?", hashAPIKey(key)).Scan(&id, &userID, &lastUsed)
+	if err == sql.ErrNoRows {
+		return nil, &NotFoundError{What: "API key"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if lastUsed < now.Add(-apiKeyUseInterval).Format(timestampLayout) {
+		_, err = db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now.Format(timestampLayout), id)
+		if err != nil {
+			log.Printf("Failed to record use of API key %d: %v", id, err)
+		}
+	}
+	return getUserByID(userID)
+}
+
+// apiKeyMiddleware looks up the user of the request's API key once and
+// keeps it in the request context, where currentUser finds it.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := requestAPIKey(r); key != "" {
+			user, _ := userForAPIKey(key)
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyUserKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestAPIKey returns the API key sent in an "Authorization: Bearer"
+// header, if any.
+func requestAPIKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// keyManagementUser returns the user managing their API keys. Keys are
+// managed only from a logged-in session, so a leaked key cannot be used to
+// make more keys or to remove the owner's.
+func keyManagementUser(w http.ResponseWriter, r *http.Request) (*Document, bool) {
+	if requestAPIKey(r) != "" {
+		RespondAPIError(w, http.StatusForbidden, &PermissionError{Message: "API keys can only be managed from a logged-in session"})
+		return nil, false
+	}
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return nil, false
+	}
+	return user, true
+}
+
+func apiListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := keyManagementUser(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := getAPIKeys(user.ID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, keys)
+}
+
+// apiCreateAPIKey creates a key for the current user. The response is the
+// only time the key is shown.
+func apiCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := keyManagementUser(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key := APIKey{UserID: user.ID, Name: body.Name}
+	err = createAPIKey(&key)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusCreated, key)
+}
+
+func apiDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := keyManagementUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	err = deleteAPIKey(user.ID, id)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
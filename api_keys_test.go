@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyLastUsed(t *testing.T) {
+	user := createTestUser(t, "User", false)
+	key := createTestAPIKey(t, user)
+	lastUsed := func() string {
+		t.Helper()
+		var at string
+		err := db.QueryRow("SELECT last_used_at FROM api_keys WHERE key_hash = ?", hashAPIKey(key)).Scan(&at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	setLastUsed := func(at time.Time) string {
+		t.Helper()
+		stamp := at.UTC().Format(timestampLayout)
+		_, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE key_hash = ?", stamp, hashAPIKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stamp
+	}
+
+	expectStatus(t, apiRequest(t, "GET", "/api/notifications", key, ""), http.StatusOK)
+	if lastUsed() == "" {
+		t.Fatal("first use not recorded")
+	}
+	recent := setLastUsed(time.Now().Add(-apiKeyUseInterval / 2))
+	expectStatus(t, apiRequest(t, "GET", "/api/notifications", key, ""), http.StatusOK)
+	if got := lastUsed(); got != recent {
+		t.Errorf("last_used_at = %s, want %s kept within the interval", got, recent)
+	}
+	old := setLastUsed(time.Now().Add(-2 * apiKeyUseInterval))
+	expectStatus(t, apiRequest(t, "GET", "/api/notifications", key, ""), http.StatusOK)
+	if got := lastUsed(); got <= old {
+		t.Errorf("last_used_at = %s, want it moved on from %s", got, old)
+	}
+}
+
+func TestAPIKeyResolvedOncePerRequest(t *testing.T) {
+	user := createTestUser(t, "User", false)
+	key := createTestAPIKey(t, user)
+	var users []*Document
+	handler := apiKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users = append(users, currentUser(r))
+		// Later lookups use the user found when the request came in
+		_, err := db.Exec("DELETE FROM api_keys WHERE key_hash = ?", hashAPIKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, currentUser(r))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newAPIRequest("GET", "/api/notifications", key, ""))
+	if len(users) != 2 || users[0] == nil || users[1] != users[0] {
+		t.Errorf("users = %v, want the key's user twice", users)
+	}
+
+	// An unknown key stays unknown for the whole request
+	handler = apiKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := currentUser(r); user != nil {
+			t.Errorf("user = %v for an unknown key", user.Data["username"])
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), newAPIRequest("GET", "/api/notifications", key, ""))
+}
+
+func TestAPIKeyManagementNeedsSession(t *testing.T) {
+	user := createTestUser(t, "User", false)
+	key := createTestAPIKey(t, user)
+	keys, err := getAPIKeys(user.ID)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("keys = %v, %v", keys, err)
+	}
+
+	expectAPIError(t, apiRequest(t, "POST", "/api/api-keys", key, `{"name": "more"}`), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "GET", "/api/api-keys", key, ""), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "DELETE", fmt.Sprintf("/api/api-keys/%d", keys[0].ID), key, ""), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "POST", "/api/api-keys", "", `{"name": "more"}`), http.StatusUnauthorized, ErrCodeUnauthorized)
+	if keys, _ := getAPIKeys(user.ID); len(keys) != 1 {
+		t.Errorf("%d keys after key requests, want 1", len(keys))
+	}
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	s := newTestSession(t, server, user)
+	resp, err := s.client.Post(server.URL+"/api/api-keys", "application/json", strings.NewReader(`{"name": "more"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var created APIKey
+	json.NewDecoder(resp.Body).Decode(&created)
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(created.Key, apiKeyPrefix) {
+		t.Errorf("status = %d, key = %+v; want a new key", resp.StatusCode, created)
+	}
+}
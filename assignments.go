@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Assignment gives a user responsibility for a document.
+type Assignment struct {
+	ID         int64  `json:"id"`
+	Doctype    string `json:"doctype"`
+	DocID      int    `json:"doc_id"`
+	User       string `json:"user"`
+	AssignedBy string `json:"assigned_by"`
+	CreatedAt  string `json:"created_at"`
+}
+
+func init() {
+	registerDocumentHook(assignmentCleanupHook)
+}
+
+func createAssignmentTables() error {
+	createAssignmentTable := `
+	CREATE TABLE IF NOT EXISTS document_assignments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		doc_id INTEGER NOT NULL,
+		user TEXT NOT NULL,
+		assigned_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		UNIQUE (doctype, doc_id, user)
+	);`
+
+	_, err := db.Exec(createAssignmentTable)
+	return err
+}
+
+// assignDocument assigns the document to a user and notifies them. Assigning
+// a document to the same user twice is a no-op.
+func assignDocument(a *Assignment) error {
+	if _, err := getUserByUsername(a.User); err != nil {
+		return &ValidationError{Fields: map[string]string{"user": "unknown user"}}
+	}
+
+	a.CreatedAt = nowTimestamp()
+	result, err := db.Exec("INSERT OR IGNORE INTO document_assignments (doctype, doc_id, user, assigned_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		a.Doctype, a.DocID, a.User, a.AssignedBy, a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return db.QueryRow("SELECT id, assigned_by, created_at FROM document_assignments WHERE doctype = ? AND doc_id = ? AND user = ?",
+			a.Doctype, a.DocID, a.User).Scan(&a.ID, &a.AssignedBy, &a.CreatedAt)
+	}
+	a.ID, _ = result.LastInsertId()
+
+	if a.User != a.AssignedBy {
+		logNotifyError(notifyUser(&Notification{
+			ForUser:  a.User,
+			Type:     NotificationAssignment,
+			Subject:  fmt.Sprintf("%s assigned %s %d to you", a.AssignedBy, a.Doctype, a.DocID),
+			Doctype:  a.Doctype,
+			DocID:    a.DocID,
+			FromUser: a.AssignedBy,
+		}))
+	}
+	return nil
+}
+
+func unassignDocument(doctypeName string, docID int, user string) error {
+	result, err := db.Exec("DELETE FROM document_assignments WHERE doctype = ? AND doc_id = ? AND user = ?", doctypeName, docID, user)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &NotFoundError{What: "assignment"}
+	}
+	return nil
+}
+
+func getAssignments(doctypeName string, docID int) ([]Assignment, error) {
+	rows, err := db.Query("SELECT id, doctype, doc_id, user, assigned_by, created_at FROM document_assignments WHERE doctype = ? AND doc_id = ? ORDER BY id",
+		doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assignments := []Assignment{}
+	for rows.Next() {
+		var a Assignment
+		if err := rows.Scan(&a.ID, &a.Doctype, &a.DocID, &a.User, &a.AssignedBy, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
+
+// assignmentCleanupHook removes the assignments of deleted documents.
+func assignmentCleanupHook(event string, doc *Document) error {
+	if event != DocEventDelete {
+		return nil
+	}
+	_, err := db.Exec("DELETE FROM document_assignments WHERE doctype = ? AND doc_id = ?", doc.DoctypeName, doc.ID)
+	return err
+}
+
+func documentAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	docID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user := currentUser(r)
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if remove := r.FormValue("remove"); remove != "" {
+		err = unassignDocument(name, docID, remove)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		a := Assignment{Doctype: name, DocID: docID, User: r.FormValue("user"), AssignedBy: username(user)}
+		err = assignDocument(&a)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/document/%d", name, docID), http.StatusSeeOther)
+}
+
+func apiListAssignments(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	assignments, err := getAssignments(mux.Vars(r)["doctype"], docID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, assignments)
+}
+
+func apiAssignDocument(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	var body struct {
+		User string `json:"user"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	a := Assignment{Doctype: mux.Vars(r)["doctype"], DocID: docID, User: body.User, AssignedBy: username(currentUser(r))}
+	err = assignDocument(&a)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusCreated, a)
+}
+
+func apiUnassignDocument(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	err = unassignDocument(mux.Vars(r)["doctype"], docID, mux.Vars(r)["user"])
+	if err != nil {
+		RespondAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
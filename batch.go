@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Batch operations
+const (
+	BatchOpInsert = "insert"
+	BatchOpUpdate = "update"
+	BatchOpDelete = "delete"
+)
+
+// Batch result statuses. When an operation fails, the ones before it are
+// rolled back and the ones after it are not attempted.
+const (
+	BatchStatusOK         = "ok"
+	BatchStatusError      = "error"
+	BatchStatusRolledBack = "rolled_back"
+	BatchStatusSkipped    = "skipped"
+)
+
+const maxBatchOperations = 500
+
+// BatchOperation is one write in a batch. An insert can name the new
+// document with Ref so later operations can use its ID, written as
+// {"$ref": "name"} in place of an ID or a field value.
+type BatchOperation struct {
+	Op      string                 `json:"op"`
+	Doctype string                 `json:"doctype"`
+	ID      interface{}            `json:"id,omitempty"`
+	Ref     string                 `json:"ref,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// BatchResult is the outcome of one operation in a batch.
+type BatchResult struct {
+	Index   int                    `json:"index"`
+	Op      string                 `json:"op"`
+	Doctype string                 `json:"doctype"`
+	ID      int                    `json:"id,omitempty"`
+	Ref     string                 `json:"ref,omitempty"`
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// batchHookEvent is a document hook held back until the batch commits, so
+// hooks never see writes that are later rolled back.
+type batchHookEvent struct {
+	event string
+	doc   *Document
+}
+
+// runBatch applies the operations in a single transaction. If one fails,
+// nothing is written and its index is returned along with the HTTP status
+// for the failure.
+func runBatch(user *Document, ops []BatchOperation) ([]BatchResult, int, int, error) {
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = BatchResult{Index: i, Op: op.Op, Doctype: op.Doctype, Ref: op.Ref, Status: BatchStatusSkipped}
+	}
+
+	fail := func(index, status int, err error) ([]BatchResult, int, int, error) {
+		for i := 0; i < index; i++ {
+			results[i].Status = BatchStatusRolledBack
+			results[i].Data = nil
+			if results[i].Op == BatchOpInsert {
+				results[i].ID = 0
+			}
+		}
+		results[index].Status = BatchStatusError
+		results[index].Error = err.Error()
+		return results, index, status, err
+	}
+
+	// Look up every doctype and check every operation, as the single
+	// document API would, before starting to write
+	doctypes := map[string]Doctype{}
+	refs := map[string]bool{}
+	for i, op := range ops {
+		switch op.Op {
+		case BatchOpInsert, BatchOpUpdate, BatchOpDelete:
+		default:
+			return fail(i, http.StatusBadRequest, fmt.Errorf("unknown op %q", op.Op))
+		}
+		if op.Ref != "" {
+			if op.Op != BatchOpInsert {
+				return fail(i, http.StatusBadRequest, fmt.Errorf("ref can only name an insert"))
+			}
+			if refs[op.Ref] {
+				return fail(i, http.StatusBadRequest, fmt.Errorf("duplicate ref %q", op.Ref))
+			}
+			refs[op.Ref] = true
+		}
+		doctype, ok := doctypes[op.Doctype]
+		if !ok {
+			var err error
+			doctype, err = getDoctypeByName(op.Doctype)
+			if err != nil {
+				return fail(i, http.StatusNotFound, fmt.Errorf("doctype %q not found", op.Doctype))
+			}
+			doctypes[op.Doctype] = doctype
+		}
+		data := op.Data
+		if op.Op == BatchOpDelete {
+			data = nil
+		}
+		if err := checkDocumentWrite(user, doctype, data); err != nil {
+			return fail(i, http.StatusForbidden, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fail(0, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback()
+
+	var events []batchHookEvent
+	ids := map[string]int{}
+	for i, op := range ops {
+		doc, opEvents, status, err := applyBatchOperation(tx, user, doctypes[op.Doctype], op, ids)
+		if err != nil {
+			return fail(i, status, err)
+		}
+		if op.Ref != "" {
+			ids[op.Ref] = doc.ID
+		}
+		for _, event := range opEvents {
+			events = append(events, batchHookEvent{event: event, doc: doc})
+		}
+
+		results[i].ID = doc.ID
+		results[i].Status = BatchStatusOK
+		if op.Op != BatchOpDelete {
+			stored, err := readDocument(tx, doctypes[op.Doctype], strconv.Itoa(doc.ID))
+			if err != nil {
+				return fail(i, http.StatusInternalServerError, err)
+			}
+			results[i].Data = hideSecretFields(stored).Data
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fail(len(ops)-1, http.StatusInternalServerError, err)
+	}
+
+	for _, e := range events {
+		runDocumentHooks(e.event, e.doc)
+	}
+	return results, -1, http.StatusOK, nil
+}
+
+// applyBatchOperation writes one operation in the batch transaction and
+// returns the document and the hook events to run once it commits. The
+// operation's permissions have already been checked by runBatch.
+func applyBatchOperation(tx *sql.Tx, user *Document, doctype Doctype, op BatchOperation, ids map[string]int) (*Document, []string, int, error) {
+	data := map[string]interface{}{}
+	for name, value := range op.Data {
+		if getFieldByName(doctype.Fields, name) == nil {
+			return nil, nil, http.StatusBadRequest, fmt.Errorf("unknown field %q", name)
+		}
+		resolved, err := resolveBatchValue(value, ids)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, err
+		}
+		data[name] = resolved
+	}
+
+	if op.Op == BatchOpInsert {
+		doc := &Document{DoctypeName: doctype.Name, Data: data, ModifiedBy: username(user)}
+		err := insertDocument(tx, doctype, doc)
+		if err != nil {
+			return nil, nil, statusForError(err, http.StatusInternalServerError), err
+		}
+		return doc, []string{DocEventInsert}, http.StatusOK, nil
+	}
+
+	id, err := resolveBatchID(op.ID, ids)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	stored, err := readDocument(tx, doctype, strconv.Itoa(id))
+	if err != nil {
+		return nil, nil, http.StatusNotFound, err
+	}
+
+	if op.Op == BatchOpDelete {
+		stored.ModifiedBy = username(user)
+		query := fmt.Sprintf("DELETE FROM `%s` WHERE id = ?", doctype.Name)
+		_, err = tx.Exec(query, id)
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, err
+		}
+		return &stored, []string{DocEventDelete}, http.StatusOK, nil
+	}
+
+	doc := &Document{ID: id, DoctypeName: doctype.Name, Data: data, ModifiedBy: username(user)}
+	events, err := writeDocumentUpdate(tx, doctype, doc)
+	if err != nil {
+		return nil, nil, statusForError(err, http.StatusInternalServerError), err
+	}
+	return doc, events, http.StatusOK, nil
+}
+
+// resolveBatchValue replaces a {"$ref": "name"} value with the ID of the
+// document inserted under that name earlier in the batch.
+func resolveBatchValue(value interface{}, ids map[string]int) (interface{}, error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return value, nil
+	}
+	ref, ok := m["$ref"].(string)
+	if !ok || len(m) != 1 {
+		return nil, fmt.Errorf("object values must be references like {\"$ref\": \"name\"}")
+	}
+	id, ok := ids[ref]
+	if !ok {
+		return nil, fmt.Errorf("ref %q does not name an earlier insert", ref)
+	}
+	return id, nil
+}
+
+func resolveBatchID(value interface{}, ids map[string]int) (int, error) {
+	if value == nil {
+		return 0, fmt.Errorf("id is required")
+	}
+	value, err := resolveBatchValue(value, ids)
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	case string:
+		if id, err := strconv.Atoi(v); err == nil {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid id %v", value)
+}
+
+// apiBatch runs a list of insert, update and delete operations across
+// doctypes with all-or-nothing semantics.
+func apiBatch(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	var body struct {
+		Operations []BatchOperation `json:"operations"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(body.Operations) == 0 {
+		RespondError(w, http.StatusBadRequest, "operations are required")
+		return
+	}
+	if len(body.Operations) > maxBatchOperations {
+		RespondError(w, http.StatusBadRequest, fmt.Sprintf("a batch can have at most %d operations", maxBatchOperations))
+		return
+	}
+
+	results, failed, status, err := runBatch(user, body.Operations)
+	if err != nil {
+		status, body := apiErrorFor(w, status, err)
+		RespondJSON(w, status, struct {
+			APIError
+			Index   int           `json:"index"`
+			Results []BatchResult `json:"results"`
+		}{body, failed, results})
+		return
+	}
+	RespondJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// batchResponse is the body of a batch response, successful or not.
+type batchResponse struct {
+	Code    string        `json:"code"`
+	Index   int           `json:"index"`
+	Results []BatchResult `json:"results"`
+}
+
+func runTestBatch(t *testing.T, key, body string, status int) batchResponse {
+	t.Helper()
+	w := apiRequest(t, "POST", "/api/batch", key, body)
+	expectStatus(t, w, status)
+	var resp batchResponse
+	err := json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func countTestDocuments(t *testing.T, doctype string) int {
+	t.Helper()
+	var n int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s`", doctype)).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestBatchRefs(t *testing.T) {
+	parent := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	child := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "parent", Type: "integer", Label: "Parent"},
+	)
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	body := fmt.Sprintf(`{"operations": [
+		{"op": "insert", "doctype": %q, "ref": "p", "data": {"title": "draft"}},
+		{"op": "insert", "doctype": %q, "ref": "c", "data": {"title": "line", "parent": {"$ref": "p"}}},
+		{"op": "update", "doctype": %q, "id": {"$ref": "p"}, "data": {"title": "final"}}
+	]}`, parent.Name, child.Name, parent.Name)
+	resp := runTestBatch(t, key, body, http.StatusOK)
+	if len(resp.Results) != 3 {
+		t.Fatalf("results = %+v", resp.Results)
+	}
+	p, c := resp.Results[0], resp.Results[1]
+	if p.ID == 0 || p.Ref != "p" || c.Status != BatchStatusOK || fmt.Sprint(c.Data["parent"]) != fmt.Sprint(p.ID) {
+		t.Errorf("results = %+v, want the child linked to the parent", resp.Results)
+	}
+	stored, err := getDocumentByID(parent.Name, fmt.Sprint(p.ID))
+	if err != nil || stored.Data["title"] != "final" {
+		t.Errorf("parent = %v, %v; want it updated through its ref", stored.Data, err)
+	}
+
+	for _, ops := range []string{
+		fmt.Sprintf(`[{"op": "update", "doctype": %q, "id": {"$ref": "later"}, "data": {"title": "x"}}]`, parent.Name),
+		fmt.Sprintf(`[{"op": "insert", "doctype": %q, "ref": "a"}, {"op": "insert", "doctype": %q, "ref": "a"}]`, parent.Name, parent.Name),
+		fmt.Sprintf(`[{"op": "update", "doctype": %q, "id": %d, "ref": "b", "data": {"title": "x"}}]`, parent.Name, p.ID),
+		fmt.Sprintf(`[{"op": "insert", "doctype": %q, "data": {"title": {"nested": true}}}]`, parent.Name),
+	} {
+		w := apiRequest(t, "POST", "/api/batch", key, `{"operations": `+ops+`}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", ops, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "keep"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	body := fmt.Sprintf(`{"operations": [
+		{"op": "insert", "doctype": %q, "data": {"title": "new"}},
+		{"op": "update", "doctype": %q, "id": %d, "data": {"title": "changed"}},
+		{"op": "delete", "doctype": %q, "id": 999999},
+		{"op": "delete", "doctype": %q, "id": %d}
+	]}`, dt.Name, dt.Name, doc.ID, dt.Name, dt.Name, doc.ID)
+	resp := runTestBatch(t, key, body, http.StatusNotFound)
+	var statuses []string
+	for _, r := range resp.Results {
+		statuses = append(statuses, r.Status)
+	}
+	if resp.Index != 2 || fmt.Sprint(statuses) != "[rolled_back rolled_back error skipped]" || resp.Results[0].ID != 0 {
+		t.Errorf("index = %d, results = %+v", resp.Index, resp.Results)
+	}
+	if n := countTestDocuments(t, dt.Name); n != 1 {
+		t.Errorf("%d documents, want the insert rolled back", n)
+	}
+	stored, err := getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil || stored.Data["title"] != "keep" {
+		t.Errorf("document = %v, %v; want the update rolled back", stored.Data, err)
+	}
+	versions, err := getVersions(dt.Name, doc.ID)
+	if err != nil || len(versions) != 1 {
+		t.Errorf("%d versions, %v; want no hooks run for the rolled back update", len(versions), err)
+	}
+}
+
+func TestBatchPermissions(t *testing.T) {
+	open := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "salary", Type: "string", Label: "Salary", Permissions: []string{"Manager"}},
+	)
+	private := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	secret := Document{DoctypeName: private.Name, Data: map[string]interface{}{"title": "secret"}}
+	err := createDocument(&secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+	insert := fmt.Sprintf(`{"op": "insert", "doctype": %q, "data": {"title": "a"}}`, open.Name)
+
+	for name, op := range map[string]string{
+		"delete":           fmt.Sprintf(`{"op": "delete", "doctype": %q, "id": %d}`, private.Name, secret.ID),
+		"insert":           fmt.Sprintf(`{"op": "insert", "doctype": %q, "data": {"title": "b"}}`, private.Name),
+		"restricted field": fmt.Sprintf(`{"op": "insert", "doctype": %q, "data": {"title": "b", "salary": "1"}}`, open.Name),
+	} {
+		resp := runTestBatch(t, key, `{"operations": [`+insert+`, `+op+`]}`, http.StatusForbidden)
+		if resp.Index != 1 || resp.Code != ErrCodePermissionDenied {
+			t.Errorf("%s: response = %+v", name, resp)
+		}
+	}
+	if n := countTestDocuments(t, open.Name); n != 0 {
+		t.Errorf("%d documents written by denied batches", n)
+	}
+	if _, err := getDocumentByID(private.Name, fmt.Sprint(secret.ID)); err != nil {
+		t.Errorf("document deleted by a denied batch: %v", err)
+	}
+
+	managerKey := createTestAPIKey(t, createTestUser(t, "Manager", false))
+	runTestBatch(t, managerKey, fmt.Sprintf(`{"operations": [{"op": "insert", "doctype": %q, "data": {"salary": "1"}}]}`, open.Name), http.StatusOK)
+	expectStatus(t, apiRequest(t, "POST", "/api/batch", "", `{"operations": [`+insert+`]}`), http.StatusUnauthorized)
+}
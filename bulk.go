@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Bulk actions. Each is applied to the selected documents one by one
+// through the normal document write path, so validation and document hooks
+// run as for a single edit.
+const (
+	BulkActionSetValue = "set_value"
+	BulkActionDelete   = "delete"
+	BulkActionSubmit   = "submit"
+	BulkActionCancel   = "cancel"
+	BulkActionAssign   = "assign"
+	BulkActionAddTag   = "add_tag"
+)
+
+// Bulk operation statuses
+const (
+	BulkStatusQueued    = "Queued"
+	BulkStatusRunning   = "Running"
+	BulkStatusCompleted = "Completed"
+	BulkStatusPartial   = "Completed with errors"
+	BulkStatusFailed    = "Failed"
+)
+
+const (
+	// Selections up to bulkInlineLimit documents are processed during the
+	// request; larger ones run as a background job.
+	bulkInlineLimit    = 20
+	maxBulkDocuments   = 10000
+	bulkProgressEveryN = 100
+)
+
+// BulkOperation is a bulk action on a set of documents.
+type BulkOperation struct {
+	ID           int64  `json:"id"`
+	Doctype      string `json:"doctype"`
+	Action       string `json:"action"`
+	Field        string `json:"field,omitempty"`
+	Value        string `json:"value,omitempty"`
+	AssignTo     string `json:"assign_to,omitempty"`
+	Tag          string `json:"tag,omitempty"`
+	DocIDs       []int  `json:"doc_ids"`
+	Status       string `json:"status"`
+	Total        int    `json:"total"`
+	SuccessCount int    `json:"success_count"`
+	ErrorCount   int    `json:"error_count"`
+	CreatedBy    string `json:"created_by"`
+	CreatedAt    string `json:"created_at"`
+	FinishedAt   string `json:"finished_at,omitempty"`
+}
+
+// BulkOperationLog records the outcome for a single document.
+type BulkOperationLog struct {
+	DocID   int    `json:"doc_id"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// BulkOperationJob is the payload of the background job that runs a bulk
+// operation.
+type BulkOperationJob struct {
+	OperationID int64 `json:"operation_id"`
+}
+
+// Bulk operations are not safe to repeat, so they run once.
+var bulkOperationJob JobType[BulkOperationJob]
+
+func init() {
+	bulkOperationJob = defineJob("bulk_operation", JobOptions{Queue: JobQueueLong, MaxAttempts: 1, Timeout: time.Hour}, runBulkOperation)
+}
+
+func createBulkTables() error {
+	createBulkTable := `
+	CREATE TABLE IF NOT EXISTS bulk_operations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		action TEXT NOT NULL,
+		field TEXT NOT NULL DEFAULT '',
+		value TEXT NOT NULL DEFAULT '',
+		assign_to TEXT NOT NULL DEFAULT '',
+		tag TEXT NOT NULL DEFAULT '',
+		doc_ids TEXT NOT NULL,
+		status TEXT NOT NULL,
+		total INTEGER NOT NULL DEFAULT 0,
+		success_count INTEGER NOT NULL DEFAULT 0,
+		error_count INTEGER NOT NULL DEFAULT 0,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		finished_at TEXT NOT NULL DEFAULT ''
+	);`
+
+	_, err := db.Exec(createBulkTable)
+	if err != nil {
+		return err
+	}
+
+	createBulkLogTable := `
+	CREATE TABLE IF NOT EXISTS bulk_operation_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		operation_id INTEGER NOT NULL,
+		doc_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (operation_id) REFERENCES bulk_operations(id)
+	);`
+
+	_, err = db.Exec(createBulkLogTable)
+	return err
+}
+
+// checkBulkOperation checks the action and its parameters, and that the
+// user may make the change to documents of the doctype.
+func checkBulkOperation(user *Document, doctype Doctype, op BulkOperation) error {
+	if !canReadDoctype(user, doctype) {
+		return &PermissionError{}
+	}
+	if len(op.DocIDs) == 0 {
+		return fmt.Errorf("no documents selected")
+	}
+	if len(op.DocIDs) > maxBulkDocuments {
+		return fmt.Errorf("at most %d documents can be changed at once", maxBulkDocuments)
+	}
+
+	switch op.Action {
+	case BulkActionSetValue:
+		field := getFieldByName(doctype.Fields, op.Field)
+		if field == nil {
+			return fmt.Errorf("unknown field %q", op.Field)
+		}
+		if field.Name == "docstatus" {
+			return fmt.Errorf("use submit or cancel to change the document status")
+		}
+		if !canEditField(user, doctype, *field) {
+			return &PermissionError{Message: fmt.Sprintf("permission denied for field %s", field.Name)}
+		}
+	case BulkActionSubmit, BulkActionCancel:
+		field := getFieldByName(doctype.Fields, "docstatus")
+		if field == nil {
+			return fmt.Errorf("%s documents cannot be submitted", doctype.Name)
+		}
+		if !canEditField(user, doctype, *field) {
+			return &PermissionError{Message: "permission denied for field docstatus"}
+		}
+	case BulkActionAssign:
+		if _, err := getUserByUsername(op.AssignTo); err != nil {
+			return fmt.Errorf("unknown user %q", op.AssignTo)
+		}
+	case BulkActionAddTag:
+		if op.Tag == "" {
+			return fmt.Errorf("tag is required")
+		}
+	case BulkActionDelete:
+	default:
+		return fmt.Errorf("unknown action %q", op.Action)
+	}
+	return nil
+}
+
+func createBulkOperation(op *BulkOperation) error {
+	ids, err := json.Marshal(op.DocIDs)
+	if err != nil {
+		return err
+	}
+
+	op.Status = BulkStatusQueued
+	op.Total = len(op.DocIDs)
+	op.CreatedAt = nowTimestamp()
+
+	result, err := db.Exec(`INSERT INTO bulk_operations
+		(doctype, action, field, value, assign_to, tag, doc_ids, status, total, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		op.Doctype, op.Action, op.Field, op.Value, op.AssignTo, op.Tag, string(ids), op.Status, op.Total,
+		op.CreatedBy, op.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	op.ID, err = result.LastInsertId()
+	return err
+}
+
+func getBulkOperation(id int64) (BulkOperation, error) {
+	var op BulkOperation
+	var ids string
+	err := db.QueryRow(`SELECT id, doctype, action, field, value, assign_to, tag, doc_ids, status,
+		total, success_count, error_count, created_by, created_at, finished_at
+		FROM bulk_operations WHERE id = ?`, id).Scan(&op.ID, &op.Doctype, &op.Action, &op.Field, &op.Value,
+		&op.AssignTo, &op.Tag, &ids, &op.Status, &op.Total, &op.SuccessCount, &op.ErrorCount,
+		&op.CreatedBy, &op.CreatedAt, &op.FinishedAt)
+	if err != nil {
+		return op, err
+	}
+	err = json.Unmarshal([]byte(ids), &op.DocIDs)
+	return op, err
+}
+
+func getBulkOperationLogs(id int64, failedOnly bool) ([]BulkOperationLog, error) {
+	query := "SELECT doc_id, status, message FROM bulk_operation_logs WHERE operation_id = ?"
+	if failedOnly {
+		query += " AND status = 'Error'"
+	}
+	query += " ORDER BY id"
+
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []BulkOperationLog{}
+	for rows.Next() {
+		var l BulkOperationLog
+		err := rows.Scan(&l.DocID, &l.Status, &l.Message)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// startBulkOperation stores the operation and runs it, in the background
+// unless the selection is small.
+func startBulkOperation(op *BulkOperation) error {
+	err := createBulkOperation(op)
+	if err != nil {
+		return err
+	}
+
+	if op.Total <= bulkInlineLimit {
+		err = runBulkOperation(context.Background(), BulkOperationJob{OperationID: op.ID})
+	} else {
+		_, err = bulkOperationJob.Enqueue(BulkOperationJob{OperationID: op.ID})
+	}
+	if err != nil {
+		return err
+	}
+
+	*op, err = getBulkOperation(op.ID)
+	return err
+}
+
+func setBulkOperationProgress(id int64, status string, success, failed int, finished bool) {
+	finishedAt := ""
+	if finished {
+		finishedAt = nowTimestamp()
+	}
+	_, err := db.Exec("UPDATE bulk_operations SET status = ?, success_count = ?, error_count = ?, finished_at = ? WHERE id = ?",
+		status, success, failed, finishedAt, id)
+	if err != nil {
+		log.Printf("Error updating bulk operation %d: %v", id, err)
+	}
+}
+
+// runBulkOperation applies the action to each document, recording the
+// outcome for each, and stops early if the job times out. Permissions are
+// checked again as the user may have lost them since queueing.
+func runBulkOperation(ctx context.Context, p BulkOperationJob) error {
+	id := p.OperationID
+	op, err := getBulkOperation(id)
+	if err != nil {
+		return err
+	}
+
+	doctype, err := getDoctypeByName(op.Doctype)
+	if err == nil {
+		var user Document
+		user, err = getUserByUsername(op.CreatedBy)
+		if err == nil {
+			err = checkBulkOperation(&user, doctype, op)
+		}
+	}
+	if err != nil {
+		setBulkOperationProgress(id, BulkStatusFailed, 0, 0, true)
+		return err
+	}
+
+	setBulkOperationProgress(id, BulkStatusRunning, 0, 0, false)
+
+	success, failed := 0, 0
+	for i, docID := range op.DocIDs {
+		if ctx.Err() != nil {
+			setBulkOperationProgress(id, BulkStatusFailed, success, failed, true)
+			return ctx.Err()
+		}
+
+		entry := BulkOperationLog{DocID: docID, Status: "Success"}
+		if err := applyBulkAction(op, docID); err != nil {
+			entry.Status = "Error"
+			entry.Message = err.Error()
+			failed++
+		} else {
+			success++
+		}
+
+		_, err = db.Exec("INSERT INTO bulk_operation_logs (operation_id, doc_id, status, message) VALUES (?, ?, ?, ?)",
+			id, entry.DocID, entry.Status, entry.Message)
+		if err != nil {
+			log.Printf("Error writing bulk operation log %d: %v", id, err)
+		}
+
+		if (i+1)%bulkProgressEveryN == 0 {
+			setBulkOperationProgress(id, BulkStatusRunning, success, failed, false)
+		}
+	}
+
+	status := BulkStatusCompleted
+	if failed > 0 && success == 0 {
+		status = BulkStatusFailed
+	} else if failed > 0 {
+		status = BulkStatusPartial
+	}
+	setBulkOperationProgress(id, status, success, failed, true)
+	return nil
+}
+
+// applyBulkAction applies the operation's action to one document.
+func applyBulkAction(op BulkOperation, docID int) error {
+	doc, err := getDocumentByID(op.Doctype, strconv.Itoa(docID))
+	if err != nil {
+		return err
+	}
+
+	switch op.Action {
+	case BulkActionSetValue:
+		return updateDocument(&Document{
+			ID:          docID,
+			DoctypeName: op.Doctype,
+			Data:        map[string]interface{}{op.Field: op.Value},
+			ModifiedBy:  op.CreatedBy,
+		})
+	case BulkActionDelete:
+		return deleteDocument(op.Doctype, strconv.Itoa(docID))
+	case BulkActionSubmit:
+		if docStatusValue(doc.Data["docstatus"]) != DocStatusDraft {
+			return fmt.Errorf("only drafts can be submitted")
+		}
+		return updateDocument(&Document{
+			ID:          docID,
+			DoctypeName: op.Doctype,
+			Data:        map[string]interface{}{"docstatus": DocStatusSubmitted},
+			ModifiedBy:  op.CreatedBy,
+		})
+	case BulkActionCancel:
+		if docStatusValue(doc.Data["docstatus"]) != DocStatusSubmitted {
+			return fmt.Errorf("only submitted documents can be cancelled")
+		}
+		return updateDocument(&Document{
+			ID:          docID,
+			DoctypeName: op.Doctype,
+			Data:        map[string]interface{}{"docstatus": DocStatusCancelled},
+			ModifiedBy:  op.CreatedBy,
+		})
+	case BulkActionAssign:
+		return assignDocument(&Assignment{Doctype: op.Doctype, DocID: docID, User: op.AssignTo, AssignedBy: op.CreatedBy})
+	case BulkActionAddTag:
+		return addDocumentTag(&DocumentTag{Doctype: op.Doctype, DocID: docID, Tag: op.Tag, AddedBy: op.CreatedBy})
+	}
+	return fmt.Errorf("unknown action %q", op.Action)
+}
+
+// bulkDocumentIDs returns the documents a bulk request applies to: every
+// document matching the filters when all is set, else the IDs given.
+func bulkDocumentIDs(doctype Doctype, ids []int, all bool, filters []Filter) ([]int, error) {
+	if !all {
+		return ids, nil
+	}
+	docs, _, err := listDocuments(doctype, nil, filters, "", "", maxBulkDocuments+1, 0)
+	if err != nil {
+		return nil, err
+	}
+	ids = make([]int, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.ID
+	}
+	return ids, nil
+}
+
+// canViewBulkOperation reports whether the user may see an operation: its
+// creator and admins can.
+func canViewBulkOperation(user *Document, op BulkOperation) bool {
+	return isAdminUser(user) || op.CreatedBy == username(user)
+}
+
+// bulkHandler applies the action chosen on the list page to the selected
+// documents. Exports are written straight back; other actions are recorded
+// as a bulk operation whose progress page the user is sent to.
+func bulkHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	doctype, err := getDoctypeByName(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	var ids []int
+	for _, v := range r.Form["id"] {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	ids, err = bulkDocumentIDs(doctype, ids, r.FormValue("all") != "", listViewConfigFromForm(r.Form).Filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ids) == 0 {
+		http.Error(w, "No documents selected", http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("action") == "export" {
+		writeBulkExport(w, doctype, r.FormValue("format"), ids)
+		return
+	}
+
+	op := BulkOperation{
+		Doctype:   doctype.Name,
+		Action:    r.FormValue("action"),
+		Field:     r.FormValue("field"),
+		Value:     r.FormValue("value"),
+		AssignTo:  r.FormValue("assign_to"),
+		Tag:       r.FormValue("tag"),
+		DocIDs:    ids,
+		CreatedBy: username(user),
+	}
+	err = checkBulkOperation(user, doctype, op)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = startBulkOperation(&op)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/bulk/%d", op.ID), http.StatusSeeOther)
+}
+
+// writeBulkExport exports the selected documents with all their fields.
+func writeBulkExport(w http.ResponseWriter, doctype Doctype, format string, ids []int) {
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	filters := []Filter{{Field: "id", Operator: "in", Value: values}}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", doctype.Name, format))
+
+	bw := bufio.NewWriter(w)
+	err := exportDocuments(bw, format, doctype, doctype.Fields, filters)
+	if err != nil {
+		// Headers are already sent, so all we can do is log and stop
+		log.Printf("Error exporting %s: %v", doctype.Name, err)
+		return
+	}
+	bw.Flush()
+}
+
+// loadBulkOperation reads the operation named in the URL and checks the
+// user may see it.
+func loadBulkOperation(r *http.Request) (BulkOperation, int, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return BulkOperation{}, http.StatusBadRequest, fmt.Errorf("invalid ID")
+	}
+	op, err := getBulkOperation(id)
+	if err == sql.ErrNoRows {
+		return op, http.StatusNotFound, fmt.Errorf("bulk operation not found")
+	}
+	if err != nil {
+		return op, http.StatusInternalServerError, err
+	}
+	if !canViewBulkOperation(currentUser(r), op) {
+		return op, http.StatusForbidden, fmt.Errorf("permission denied")
+	}
+	return op, http.StatusOK, nil
+}
+
+func bulkOperationHandler(w http.ResponseWriter, r *http.Request) {
+	op, status, err := loadBulkOperation(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	logs, err := getBulkOperationLogs(op.ID, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: fmt.Sprintf("Bulk %s on %s", op.Action, op.Doctype),
+		Content: struct {
+			Operation BulkOperation
+			Errors    []BulkOperationLog
+			Running   bool
+		}{
+			Operation: op,
+			Errors:    logs,
+			Running:   op.Status == BulkStatusQueued || op.Status == BulkStatusRunning,
+		},
+	}
+	renderTemplate(w, r, "bulk.html", data)
+}
+
+// apiCreateBulkOperation starts a bulk operation. The body names the
+// action and the documents, either by ID or as every document matching
+// filters: {"action": "set_value", "field": "status", "value": "Closed",
+// "ids": [1, 2]} or {..., "all": true, "filters": [["status", "=", "Open"]]}.
+func apiCreateBulkOperation(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	doctype, err := getDoctypeByName(mux.Vars(r)["doctype"])
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	var body struct {
+		Action   string          `json:"action"`
+		Field    string          `json:"field"`
+		Value    interface{}     `json:"value"`
+		AssignTo string          `json:"assign_to"`
+		Tag      string          `json:"tag"`
+		IDs      []int           `json:"ids"`
+		All      bool            `json:"all"`
+		Filters  json.RawMessage `json:"filters"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var filters []Filter
+	if len(body.Filters) > 0 {
+		filters, err = parseFilters(string(body.Filters))
+		if err != nil {
+			RespondAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	ids, err := bulkDocumentIDs(doctype, body.IDs, body.All, filters)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	op := BulkOperation{
+		Doctype:   doctype.Name,
+		Action:    body.Action,
+		Field:     body.Field,
+		AssignTo:  body.AssignTo,
+		Tag:       body.Tag,
+		DocIDs:    ids,
+		CreatedBy: username(user),
+	}
+	if body.Value != nil {
+		op.Value = fmt.Sprint(body.Value)
+	}
+	err = checkBulkOperation(user, doctype, op)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = startBulkOperation(&op)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	status := http.StatusAccepted
+	if op.FinishedAt != "" {
+		status = http.StatusOK
+	}
+	respondBulkOperation(w, status, op)
+}
+
+func apiGetBulkOperation(w http.ResponseWriter, r *http.Request) {
+	op, status, err := loadBulkOperation(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+	respondBulkOperation(w, http.StatusOK, op)
+}
+
+// respondBulkOperation writes an operation with its per-document failures.
+func respondBulkOperation(w http.ResponseWriter, status int, op BulkOperation) {
+	logs, err := getBulkOperationLogs(op.ID, true)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, status, struct {
+		BulkOperation
+		Errors []BulkOperationLog `json:"errors"`
+	}{op, logs})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// bulkResult is the body of a bulk operation response.
+type bulkResult struct {
+	BulkOperation
+	Errors []BulkOperationLog `json:"errors"`
+}
+
+func runTestBulk(t *testing.T, key, doctype, body string, status int) bulkResult {
+	t.Helper()
+	w := apiRequest(t, "POST", "/api/documents/"+doctype+"/bulk", key, body)
+	expectStatus(t, w, status)
+	var result bulkResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result
+}
+
+func TestBulkFailuresPerDocument(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "docstatus", Type: "integer", Label: "Status"},
+	)
+	var ids []int
+	for _, status := range []int{DocStatusDraft, DocStatusSubmitted, DocStatusDraft} {
+		doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a", "docstatus": status}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	body := fmt.Sprintf(`{"action": "submit", "ids": [%d, %d, %d, 999999]}`, ids[0], ids[1], ids[2])
+	result := runTestBulk(t, key, dt.Name, body, http.StatusOK)
+	if result.Status != BulkStatusPartial || result.SuccessCount != 2 || result.ErrorCount != 2 {
+		t.Errorf("operation = %+v, want 2 of 4 submitted", result.BulkOperation)
+	}
+	failed := map[int]string{}
+	for _, e := range result.Errors {
+		failed[e.DocID] = e.Message
+	}
+	if len(failed) != 2 || failed[ids[1]] != "only drafts can be submitted" || failed[999999] == "" {
+		t.Errorf("errors = %+v", result.Errors)
+	}
+	for _, id := range []int{ids[0], ids[2]} {
+		doc, err := getDocumentByID(dt.Name, fmt.Sprint(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if docStatusValue(doc.Data["docstatus"]) != DocStatusSubmitted {
+			t.Errorf("document %d = %v, want submitted", id, doc.Data)
+		}
+	}
+
+	result = runTestBulk(t, key, dt.Name, `{"action": "add_tag", "tag": "late", "ids": [999999]}`, http.StatusOK)
+	if result.Status != BulkStatusFailed || result.ErrorCount != 1 {
+		t.Errorf("operation = %+v, want failed", result.BulkOperation)
+	}
+	if tags, _ := getDocumentTags(dt.Name, 999999); len(tags) != 0 {
+		t.Errorf("tagged a missing document: %+v", tags)
+	}
+}
+
+func TestBulkChecks(t *testing.T) {
+	dt := createTestDoctype(t, []string{"HR"},
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "salary", Type: "string", Label: "Salary", Permissions: []string{"Manager"}},
+	)
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := createTestAPIKey(t, createTestUser(t, "HR", false))
+
+	for _, tt := range []struct {
+		key    string
+		body   string
+		status int
+	}{
+		{createTestAPIKey(t, createTestUser(t, "User", false)), `{"action": "delete", "ids": [1]}`, http.StatusForbidden},
+		{key, fmt.Sprintf(`{"action": "set_value", "field": "salary", "value": "1", "ids": [%d]}`, doc.ID), http.StatusForbidden},
+		{key, fmt.Sprintf(`{"action": "set_value", "field": "missing", "value": "1", "ids": [%d]}`, doc.ID), http.StatusBadRequest},
+		{key, fmt.Sprintf(`{"action": "explode", "ids": [%d]}`, doc.ID), http.StatusBadRequest},
+		{key, `{"action": "delete", "ids": []}`, http.StatusBadRequest},
+	} {
+		runTestBulk(t, tt.key, dt.Name, tt.body, tt.status)
+	}
+
+	// Selecting by filter applies to every match
+	result := runTestBulk(t, key, dt.Name, `{"action": "set_value", "field": "title", "value": "b", "all": true, "filters": {"title": "a"}}`, http.StatusOK)
+	if result.Status != BulkStatusCompleted || result.Total != 1 {
+		t.Errorf("operation = %+v", result.BulkOperation)
+	}
+	stored, err := getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil || stored.Data["title"] != "b" {
+		t.Errorf("stored = %v, %v; want title b", stored.Data, err)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CalendarViewDoctype holds calendar configurations. A calendar shows the
+// documents of a doctype as events placed by a date or datetime start field
+// and an optional end field. The title field names the event and the color
+// field, if set, holds a CSS color such as #3c8dbc or "teal".
+const CalendarViewDoctype = "Calendar View"
+
+// maxCalendarRange bounds the range the events API returns at once.
+const maxCalendarRange = 366 * 24 * time.Hour
+
+var calendarLayouts = map[string]bool{"month": true, "week": true, "day": true}
+
+var calendarColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// CalendarView is a parsed Calendar View document.
+type CalendarView struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Doctype    string `json:"doctype"`
+	StartField string `json:"start_field"`
+	EndField   string `json:"end_field,omitempty"`
+	TitleField string `json:"title_field,omitempty"`
+	ColorField string `json:"color_field,omitempty"`
+	// AllDay is set when the start field is a date rather than a datetime.
+	AllDay bool `json:"all_day"`
+}
+
+// CalendarEvent is a document placed on a calendar. Start and End are the
+// stored field values; End is empty when the document has no end.
+type CalendarEvent struct {
+	ID     int    `json:"id"`
+	Title  string `json:"title"`
+	Start  string `json:"start"`
+	End    string `json:"end,omitempty"`
+	AllDay bool   `json:"all_day"`
+	Color  string `json:"color,omitempty"`
+
+	// from and to are the span the event covers, to being exclusive. An
+	// event without an end that has a time covers only its start.
+	from, to time.Time
+}
+
+// Time is the start time shown next to events that are not all day.
+func (e CalendarEvent) Time() string {
+	if e.AllDay {
+		return ""
+	}
+	return e.from.Format("15:04")
+}
+
+// overlaps reports whether the event falls within [from, to).
+func (e CalendarEvent) overlaps(from, to time.Time) bool {
+	return e.from.Before(to) && (e.to.After(from) || !e.from.Before(from))
+}
+
+// CalendarDay is one day cell of the calendar page.
+type CalendarDay struct {
+	Date    string
+	Day     int
+	Weekday string
+	InRange bool
+	Today   bool
+	Events  []CalendarEvent
+}
+
+// createCalendarViewDoctype creates the Calendar View doctype unless it
+// already exists.
+func createCalendarViewDoctype() error {
+	if _, err := getDoctypeByName(CalendarViewDoctype); err == nil {
+		return nil
+	}
+
+	viewDoctype := Doctype{
+		Name: CalendarViewDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "document_type", Type: "string", Label: "Document Type", Required: true},
+			{Name: "start_field", Type: "string", Label: "Start Field (a date or datetime field)", Required: true},
+			{Name: "end_field", Type: "string", Label: "End Field", Required: false},
+			{Name: "title_field", Type: "string", Label: "Title Field", Required: false},
+			{Name: "color_field", Type: "string", Label: "Color Field", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+
+	return createDoctype(&viewDoctype)
+}
+
+// parseCalendarView reads a Calendar View document and checks it against
+// the doctype it shows.
+func parseCalendarView(doc Document) (CalendarView, Doctype, error) {
+	view := CalendarView{
+		ID:         doc.ID,
+		Name:       ruleString(doc, "name"),
+		Doctype:    ruleString(doc, "document_type"),
+		StartField: ruleString(doc, "start_field"),
+		EndField:   ruleString(doc, "end_field"),
+		TitleField: ruleString(doc, "title_field"),
+		ColorField: ruleString(doc, "color_field"),
+	}
+
+	doctype, err := getDoctypeByName(view.Doctype)
+	if err != nil {
+		return view, doctype, fmt.Errorf("doctype %q not found", view.Doctype)
+	}
+	start := getFieldByName(doctype.Fields, view.StartField)
+	if start == nil || (start.Type != "date" && start.Type != "datetime") {
+		return view, doctype, fmt.Errorf("start field %q must be a date or datetime field of %s", view.StartField, view.Doctype)
+	}
+	view.AllDay = start.Type == "date"
+	if view.EndField != "" {
+		end := getFieldByName(doctype.Fields, view.EndField)
+		if end == nil || end.Type != start.Type {
+			return view, doctype, fmt.Errorf("end field %q must be a %s field of %s", view.EndField, start.Type, view.Doctype)
+		}
+	}
+	for _, name := range []string{view.TitleField, view.ColorField} {
+		if name != "" && getFieldByName(doctype.Fields, name) == nil {
+			return view, doctype, fmt.Errorf("unknown field %q", name)
+		}
+	}
+	return view, doctype, nil
+}
+
+// getCalendarViews returns the calendars of a doctype and the problems
+// found with any that could not be parsed.
+func getCalendarViews(doctypeName string) ([]CalendarView, []string, error) {
+	docs, err := getDocuments(CalendarViewDoctype)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var views []CalendarView
+	var problems []string
+	for _, doc := range docs {
+		if ruleString(doc, "document_type") != doctypeName {
+			continue
+		}
+		view, _, err := parseCalendarView(doc)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Calendar %s: %v", view.Name, err))
+			continue
+		}
+		views = append(views, view)
+	}
+	return views, problems, nil
+}
+
+// getCalendarView finds a calendar by name.
+func getCalendarView(name string) (CalendarView, Doctype, error) {
+	docs, err := getDocuments(CalendarViewDoctype)
+	if err != nil {
+		return CalendarView{}, Doctype{}, err
+	}
+	for _, doc := range docs {
+		if ruleString(doc, "name") == name {
+			return parseCalendarView(doc)
+		}
+	}
+	return CalendarView{}, Doctype{}, sql.ErrNoRows
+}
+
+// parseEventTime reads a stored date or datetime value.
+func parseEventTime(value interface{}) (time.Time, bool) {
+	s, ok := exportValue(value).(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true
+	}
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// calendarEvent turns a document into an event, or returns false if its
+// start is not set.
+func calendarEvent(view CalendarView, doc Document) (CalendarEvent, bool) {
+	start, ok := parseEventTime(doc.Data[view.StartField])
+	if !ok {
+		return CalendarEvent{}, false
+	}
+	e := CalendarEvent{
+		ID:     doc.ID,
+		Title:  fmt.Sprintf("#%d", doc.ID),
+		Start:  fmt.Sprint(exportValue(doc.Data[view.StartField])),
+		AllDay: view.AllDay,
+		from:   start,
+		to:     start,
+	}
+	if end, ok := parseEventTime(doc.Data[view.EndField]); view.EndField != "" && ok && !end.Before(start) {
+		e.End = fmt.Sprint(exportValue(doc.Data[view.EndField]))
+		e.to = end
+	}
+	if view.AllDay {
+		e.to = e.to.AddDate(0, 0, 1)
+	}
+	if title := exportValue(doc.Data[view.TitleField]); view.TitleField != "" && !isEmptyValue(title) {
+		e.Title = fmt.Sprint(title)
+	}
+	if color, ok := exportValue(doc.Data[view.ColorField]).(string); view.ColorField != "" && ok && calendarColor.MatchString(color) {
+		e.Color = color
+	}
+	return e, true
+}
+
+// getCalendarEvents returns the events that fall within [from, to), ordered
+// by start. Only documents starting within the range, or starting before it
+// and ending within or after it, are read.
+func getCalendarEvents(view CalendarView, doctype Doctype, from, to time.Time) ([]CalendarEvent, error) {
+	fields, err := resolveFields(doctype, []string{view.StartField, view.EndField, view.TitleField, view.ColorField})
+	if err != nil {
+		return nil, err
+	}
+	start, end := from.Format("2006-01-02"), to.Format("2006-01-02")
+	queries := [][]Filter{{
+		{Field: view.StartField, Operator: ">=", Value: start},
+		{Field: view.StartField, Operator: "<", Value: end},
+	}}
+	if view.EndField != "" {
+		queries = append(queries, []Filter{
+			{Field: view.StartField, Operator: "<", Value: start},
+			{Field: view.StartField, Operator: "is", Value: "set"},
+			{Field: view.EndField, Operator: ">=", Value: start},
+		})
+	}
+
+	var events []CalendarEvent
+	for _, filters := range queries {
+		err = streamDocuments(doctype, fields, filters, func(doc Document) error {
+			if e, ok := calendarEvent(view, doc); ok && e.overlaps(from, to) {
+				events = append(events, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].from.Before(events[j].from) })
+	return events, nil
+}
+
+// calendarRange returns the days shown by a layout around the given date,
+// and the first and last day that belong to the month, week or day itself.
+func calendarRange(layout string, date time.Time) (from, to, first, last time.Time) {
+	switch layout {
+	case "day":
+		return date, date.AddDate(0, 0, 1), date, date.AddDate(0, 0, 1)
+	case "week":
+		from = periodStart(date, "week")
+		return from, from.AddDate(0, 0, 7), from, from.AddDate(0, 0, 7)
+	}
+	first = periodStart(date, "month")
+	last = first.AddDate(0, 1, 0)
+	from = periodStart(first, "week")
+	to = periodStart(last.AddDate(0, 0, -1), "week").AddDate(0, 0, 7)
+	return from, to, first, last
+}
+
+// calendarTitle names the month, week or day shown.
+func calendarTitle(layout string, date time.Time) string {
+	switch layout {
+	case "day":
+		return date.Format("Monday 2 January 2006")
+	case "week":
+		return "Week of " + periodStart(date, "week").Format("2 January 2006")
+	}
+	return date.Format("January 2006")
+}
+
+// moveCalendarEvent reschedules a document to a new start. The end moves by
+// the same amount so the event keeps its length. The change goes through
+// updateDocument, so it is validated and runs the document hooks like any
+// other edit.
+func moveCalendarEvent(user *Document, view CalendarView, doc Document, start string) error {
+	newStart, ok := parseEventTime(start)
+	if !ok {
+		return &ValidationError{Fields: map[string]string{view.StartField: "must be a date or date and time"}}
+	}
+	data := map[string]interface{}{view.StartField: start}
+
+	oldStart, hasStart := parseEventTime(doc.Data[view.StartField])
+	oldEnd, hasEnd := parseEventTime(doc.Data[view.EndField])
+	if view.EndField != "" && hasStart && hasEnd {
+		end := oldEnd.Add(newStart.Sub(oldStart))
+		if view.AllDay {
+			data[view.EndField] = end.Format("2006-01-02")
+		} else {
+			data[view.EndField] = end.Format("2006-01-02T15:04:05")
+		}
+	}
+
+	return updateDocument(&Document{
+		ID:          doc.ID,
+		DoctypeName: view.Doctype,
+		Data:        data,
+		ModifiedBy:  username(user),
+	})
+}
+
+// canMoveCalendarEvents reports whether the user may change the fields a
+// move writes.
+func canMoveCalendarEvents(user *Document, view CalendarView, doctype Doctype) bool {
+	for _, name := range []string{view.StartField, view.EndField} {
+		if field := getFieldByName(doctype.Fields, name); field != nil && !canEditField(user, doctype, *field) {
+			return false
+		}
+	}
+	return true
+}
+
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	doctype, err := getDoctypeByName(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	views, problems, err := getCalendarViews(doctype.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isAdminUser(user) {
+		problems = nil
+	}
+
+	query := r.URL.Query()
+	layout := query.Get("layout")
+	if !calendarLayouts[layout] {
+		layout = "month"
+	}
+	today := periodStart(time.Now().UTC(), "day")
+	date := today
+	if d := query.Get("date"); d != "" {
+		date, err = time.Parse("2006-01-02", d)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Show the calendar asked for, or the first one
+	var view *CalendarView
+	name := query.Get("view")
+	for i := range views {
+		if name == "" || views[i].Name == name {
+			view = &views[i]
+			break
+		}
+	}
+
+	var days []CalendarDay
+	canMove := false
+	if view != nil {
+		from, to, first, last := calendarRange(layout, date)
+		events, err := getCalendarEvents(*view, doctype, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for d := from; d.Before(to); d = d.AddDate(0, 0, 1) {
+			day := CalendarDay{
+				Date:    d.Format("2006-01-02"),
+				Day:     d.Day(),
+				Weekday: d.Format("Mon"),
+				InRange: !d.Before(first) && d.Before(last),
+				Today:   d.Equal(today),
+			}
+			for _, e := range events {
+				if e.overlaps(d, d.AddDate(0, 0, 1)) {
+					day.Events = append(day.Events, e)
+				}
+			}
+			days = append(days, day)
+		}
+		canMove = canMoveCalendarEvents(user, *view, doctype)
+	}
+
+	data := PageData{
+		Title: doctype.Name + " Calendar",
+		Content: struct {
+			Doctype  Doctype
+			Views    []CalendarView
+			View     *CalendarView
+			Layout   string
+			Heading  string
+			Date     string
+			Prev     string
+			Next     string
+			Today    string
+			Days     []CalendarDay
+			CanMove  bool
+			IsAdmin  bool
+			Problems []string
+		}{
+			Doctype:  doctype,
+			Views:    views,
+			View:     view,
+			Layout:   layout,
+			Heading:  calendarTitle(layout, date),
+			Date:     date.Format("2006-01-02"),
+			Prev:     addPeriods(date, layout, -1).Format("2006-01-02"),
+			Next:     addPeriods(date, layout, 1).Format("2006-01-02"),
+			Today:    today.Format("2006-01-02"),
+			Days:     days,
+			CanMove:  canMove,
+			IsAdmin:  isAdminUser(user),
+			Problems: problems,
+		},
+	}
+	renderTemplate(w, r, "calendar.html", data)
+}
+
+// loadCalendarViewForUser finds the calendar named in the URL and checks
+// the user may read its doctype, responding with an error if not.
+func loadCalendarViewForUser(w http.ResponseWriter, r *http.Request) (CalendarView, Doctype, bool) {
+	view, doctype, err := getCalendarView(mux.Vars(r)["view"])
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "Calendar not found")
+		return view, doctype, false
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return view, doctype, false
+	}
+	if !canReadDoctype(currentUser(r), doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return view, doctype, false
+	}
+	return view, doctype, true
+}
+
+// apiCalendarEvents returns the events of a calendar between start and end
+// (YYYY-MM-DD, end exclusive).
+func apiCalendarEvents(w http.ResponseWriter, r *http.Request) {
+	view, doctype, ok := loadCalendarViewForUser(w, r)
+	if !ok {
+		return
+	}
+
+	from, err := time.Parse("2006-01-02", r.URL.Query().Get("start"))
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "start must be a date (YYYY-MM-DD)")
+		return
+	}
+	to, err := time.Parse("2006-01-02", r.URL.Query().Get("end"))
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "end must be a date (YYYY-MM-DD)")
+		return
+	}
+	if !to.After(from) || to.Sub(from) > maxCalendarRange {
+		RespondError(w, http.StatusBadRequest, "end must be after start and at most a year later")
+		return
+	}
+
+	events, err := getCalendarEvents(view, doctype, from, to)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if events == nil {
+		events = []CalendarEvent{}
+	}
+	RespondJSON(w, http.StatusOK, map[string]interface{}{"calendar": view, "events": events})
+}
+
+// apiCalendarMove reschedules a document on a calendar. The body names the
+// document and its new start: {"id": 3, "start": "2024-05-06T09:00"}.
+func apiCalendarMove(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	view, doctype, ok := loadCalendarViewForUser(w, r)
+	if !ok {
+		return
+	}
+	if !canMoveCalendarEvents(user, view, doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	var body struct {
+		ID    int    `json:"id"`
+		Start string `json:"start"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	doc, err := getDocumentByID(view.Doctype, fmt.Sprint(body.ID))
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Document not found")
+		return
+	}
+
+	err = moveCalendarEvent(user, view, doc, strings.TrimSpace(body.Start))
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	doc, err = getDocumentByID(view.Doctype, fmt.Sprint(body.ID))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	e, _ := calendarEvent(view, doc)
+	RespondJSON(w, http.StatusOK, e)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+// createTestCalendar creates a Calendar View with the given fields set and
+// returns its name.
+func createTestCalendar(t *testing.T, doctype string, data map[string]interface{}) string {
+	t.Helper()
+	name := uniqueName("calendar")
+	view := Document{DoctypeName: CalendarViewDoctype, Data: map[string]interface{}{
+		"name":          name,
+		"document_type": doctype,
+		"start_field":   "starts",
+		"title_field":   "title",
+	}}
+	for k, v := range data {
+		view.Data[k] = v
+	}
+	err := createDocument(&view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestCalendarEvents(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "starts", Type: "datetime", Label: "Starts"},
+		Field{Name: "ends", Type: "datetime", Label: "Ends"},
+	)
+	for _, data := range []map[string]interface{}{
+		{"title": "ended before", "starts": "2024-05-01T10:00:00", "ends": "2024-05-02T10:00:00"},
+		{"title": "point before", "starts": "2024-05-05T23:00:00"},
+		{"title": "spanning", "starts": "2024-05-04T09:00:00", "ends": "2024-05-07T09:00:00"},
+		{"title": "inside", "starts": "2024-05-08T09:00:00"},
+		{"title": "last day", "starts": "2024-05-12T23:59:00", "ends": "2024-05-14T08:00:00"},
+		{"title": "after", "starts": "2024-05-13T00:00:00"},
+		{"title": "unscheduled"},
+	} {
+		doc := Document{DoctypeName: dt.Name, Data: data}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+	events := func(view string) string {
+		t.Helper()
+		w := apiRequest(t, "GET", "/api/calendar/"+view+"/events?start=2024-05-06&end=2024-05-13", key, "")
+		expectStatus(t, w, http.StatusOK)
+		var body struct {
+			Events []CalendarEvent `json:"events"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		var titles []string
+		for _, e := range body.Events {
+			titles = append(titles, e.Title)
+		}
+		sort.Strings(titles)
+		return fmt.Sprint(titles)
+	}
+
+	withEnd := createTestCalendar(t, dt.Name, map[string]interface{}{"end_field": "ends"})
+	if got := events(withEnd); got != "[inside last day spanning]" {
+		t.Errorf("events with ends = %s", got)
+	}
+	// Without an end every event covers only its start
+	if got := events(createTestCalendar(t, dt.Name, nil)); got != "[inside last day]" {
+		t.Errorf("events without ends = %s", got)
+	}
+
+	for _, query := range []string{"start=2024-05-06", "start=2024-05-06&end=2024-05-06", "start=2024-01-01&end=2025-06-01", "start=May&end=2024-05-13"} {
+		w := apiRequest(t, "GET", "/api/calendar/"+withEnd+"/events?"+query, key, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCalendarMove(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "starts", Type: "date", Label: "Starts"},
+		Field{Name: "ends", Type: "date", Label: "Ends", Permissions: []string{"Manager"}},
+	)
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "trip", "starts": "2024-05-06", "ends": "2024-05-08"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/calendar/" + createTestCalendar(t, dt.Name, map[string]interface{}{"end_field": "ends"}) + "/move"
+	body := fmt.Sprintf(`{"id": %d, "start": "2024-05-20"}`, doc.ID)
+
+	expectStatus(t, apiRequest(t, "POST", path, createTestAPIKey(t, createTestUser(t, "User", false)), body), http.StatusForbidden)
+	managerKey := createTestAPIKey(t, createTestUser(t, "Manager", false))
+	expectStatus(t, apiRequest(t, "POST", path, managerKey, fmt.Sprintf(`{"id": %d, "start": "soon"}`, doc.ID)), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "POST", path, managerKey, body), http.StatusOK)
+
+	stored, err := getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(exportValue(stored.Data["starts"]), " ", exportValue(stored.Data["ends"])) != "2024-05-20 2024-05-22" {
+		t.Errorf("stored data = %v, want the trip moved with its length kept", stored.Data)
+	}
+}
@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Batch operations
+const (
+	BatchInsert = "insert"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// Batch result statuses. When an operation fails, the ones before it are
+// rolled back and the ones after it are not attempted.
+const (
+	BatchStatusOK         = "ok"
+	BatchStatusError      = "error"
+	BatchStatusRolledBack = "rolled_back"
+	BatchStatusSkipped    = "skipped"
+)
+
+// BatchOperation is one write in a batch. An insert can name the new
+// document with Ref so later operations in the batch can use its ID, by
+// passing Ref(name) in place of an ID or a field value.
+type BatchOperation struct {
+	Op      string                 `json:"op"`
+	Doctype string                 `json:"doctype"`
+	ID      interface{}            `json:"id,omitempty"`
+	Ref     string                 `json:"ref,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Ref stands for the ID of the document inserted earlier in the batch under
+// name.
+func Ref(name string) interface{} {
+	return map[string]string{"$ref": name}
+}
+
+// InsertOp returns an operation that creates a document.
+func InsertOp(doctype, ref string, data map[string]interface{}) BatchOperation {
+	return BatchOperation{Op: BatchInsert, Doctype: doctype, Ref: ref, Data: data}
+}
+
+// UpdateOp returns an operation that changes fields of a document. id is an
+// int or a Ref.
+func UpdateOp(doctype string, id interface{}, data map[string]interface{}) BatchOperation {
+	return BatchOperation{Op: BatchUpdate, Doctype: doctype, ID: id, Data: data}
+}
+
+// DeleteOp returns an operation that removes a document. id is an int or a
+// Ref.
+func DeleteOp(doctype string, id interface{}) BatchOperation {
+	return BatchOperation{Op: BatchDelete, Doctype: doctype, ID: id}
+}
+
+// BatchResult is the outcome of one operation in a batch.
+type BatchResult struct {
+	Index   int                    `json:"index"`
+	Op      string                 `json:"op"`
+	Doctype string                 `json:"doctype"`
+	ID      int                    `json:"id,omitempty"`
+	Ref     string                 `json:"ref,omitempty"`
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// BatchError is returned when an operation of a batch fails and the batch
+// is rolled back. It unwraps to the *Error for the failed operation.
+type BatchError struct {
+	Err     *Error
+	Index   int
+	Results []BatchResult
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d failed: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batch runs the operations in one transaction: either all of them are
+// written or none are.
+func (c *Client) Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error) {
+	var out struct {
+		Results []BatchResult `json:"results"`
+	}
+	body := map[string]interface{}{"operations": ops}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/batch", body: body}, &out)
+	if err != nil {
+		return nil, batchError(err)
+	}
+	return out.Results, nil
+}
+
+// batchError turns the error response for a failed operation into a
+// *BatchError.
+func batchError(err error) error {
+	e, ok := err.(*Error)
+	if !ok || e.body == nil {
+		return err
+	}
+	var failure struct {
+		Index   *int          `json:"index"`
+		Results []BatchResult `json:"results"`
+	}
+	if json.Unmarshal(e.body, &failure) != nil || failure.Index == nil {
+		return err
+	}
+	return &BatchError{Err: e, Index: *failure.Index, Results: failure.Results}
+}
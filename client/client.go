@@ -0,0 +1,293 @@
+// Package client is a Go client for the frappe-go REST API.
+//
+// A Client authenticates with an API key or with a username and password,
+// which starts a session:
+//
+//	c := client.New("http://localhost:8080")
+//	c.APIKey = os.Getenv("FRAPPE_API_KEY")
+//
+//	docs, err := c.List(ctx, "Task", &client.ListOptions{
+//		Filters: client.Where("status", client.OpEq, "Open"),
+//	})
+//
+// Errors returned by the server are *Error values carrying the code and
+// request ID from the response.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for new clients.
+const (
+	DefaultMaxRetries = 2
+	DefaultRetryWait  = 500 * time.Millisecond
+	DefaultTimeout    = 30 * time.Second
+)
+
+// Client calls the API of one server.
+type Client struct {
+	// BaseURL is the server address, such as "http://localhost:8080".
+	BaseURL string
+
+	// HTTPClient sends the requests. Session login needs it to have a
+	// cookie jar.
+	HTTPClient *http.Client
+
+	// APIKey, if set, is sent as a bearer token with every request.
+	APIKey string
+
+	// MaxRetries is how many times a request that can safely be repeated
+	// is retried after a network error or a 429, 502, 503 or 504 response.
+	MaxRetries int
+
+	// RetryWait is the wait before the first retry. It doubles with each
+	// retry, unless the server asks for a wait with Retry-After.
+	RetryWait time.Duration
+
+	// UserAgent is sent in the User-Agent header.
+	UserAgent string
+}
+
+// New returns a client for the server at baseURL with a cookie jar for
+// session login and the default retry settings.
+func New(baseURL string) *Client {
+	jar, _ := cookiejar.New(nil)
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Jar: jar, Timeout: DefaultTimeout},
+		MaxRetries: DefaultMaxRetries,
+		RetryWait:  DefaultRetryWait,
+		UserAgent:  "frappe-go-client",
+	}
+}
+
+// Login starts a session as the user. Later requests are made as that user
+// until Logout, unless APIKey is set.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	if c.HTTPClient == nil || c.HTTPClient.Jar == nil {
+		return errors.New("client: session login needs an HTTP client with a cookie jar")
+	}
+
+	// The login form is protected by a CSRF token tied to the session, so
+	// load it first to get both
+	token, err := c.loginToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"username": {username}, "password": {password}, "csrf_token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	// The server answers a good login with a redirect and a bad one with
+	// the login page again, so look at the first response only
+	resp, err := c.withoutRedirects().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusSeeOther && resp.Header.Get("Location") != "/login":
+		return nil
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusSeeOther:
+		return &Error{StatusCode: http.StatusUnauthorized, Code: ErrCodeUnauthorized, Message: "invalid username or password"}
+	}
+	return &Error{StatusCode: resp.StatusCode, Code: codeForStatus(resp.StatusCode), Message: "login failed: " + resp.Status}
+}
+
+// csrfField matches the hidden CSRF token field the server adds to forms.
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// loginToken loads the login page, which starts a session, and returns the
+// CSRF token from its form.
+func (c *Client) loginToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/login", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	m := csrfField.FindSubmatch(page)
+	if resp.StatusCode != http.StatusOK || m == nil {
+		return "", &Error{StatusCode: resp.StatusCode, Code: codeForStatus(resp.StatusCode), Message: "login failed: no login form at " + req.URL.String()}
+	}
+	return html.UnescapeString(string(m[1])), nil
+}
+
+// Logout ends the session started by Login.
+func (c *Client) Logout(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/logout", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+	resp, err := c.withoutRedirects().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// withoutRedirects returns a copy of the HTTP client that returns redirect
+// responses instead of following them.
+func (c *Client) withoutRedirects() *http.Client {
+	var hc http.Client
+	if c.HTTPClient != nil {
+		hc = *c.HTTPClient
+	}
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &hc
+}
+
+// request describes one API call.
+type request struct {
+	method      string
+	path        string
+	query       url.Values
+	body        interface{}
+	contentType string
+
+	// idempotent requests are retried. GET, PUT and DELETE always are.
+	idempotent bool
+}
+
+// do sends the request, retrying it if it is safe to, and decodes a
+// successful JSON response into out, if out is not nil.
+func (c *Client) do(ctx context.Context, r request, out interface{}) (*http.Response, error) {
+	var body []byte
+	if r.body != nil {
+		var err error
+		body, err = json.Marshal(r.body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u := c.BaseURL + "/api" + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+
+	retry := r.idempotent || r.method == http.MethodGet || r.method == http.MethodPut || r.method == http.MethodDelete
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, r, u, body)
+		if !retry || attempt >= c.MaxRetries || !shouldRetry(resp, err) {
+			if err != nil {
+				return nil, err
+			}
+			return resp, c.decode(resp, out)
+		}
+
+		delay := wait
+		if resp != nil {
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+				delay = time.Duration(s) * time.Second
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		wait *= 2
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, r request, u string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+	if body != nil {
+		contentType := r.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return hc.Do(req)
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		// Do not retry when the caller gave up
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// decode reads the response body into out, or into an *Error if the
+// response is an error.
+func (c *Client) decode(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return newError(resp, data)
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	err = json.Unmarshal(data, out)
+	if err != nil {
+		return fmt.Errorf("client: decoding response: %w", err)
+	}
+	return nil
+}
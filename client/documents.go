@@ -0,0 +1,262 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Document is a record of a doctype.
+type Document struct {
+	ID      int                    `json:"id"`
+	Doctype string                 `json:"doctype_name"`
+	Data    map[string]interface{} `json:"data"`
+}
+
+// Filter operators understood by the server.
+const (
+	OpEq      = "="
+	OpNe      = "!="
+	OpGt      = ">"
+	OpLt      = "<"
+	OpGte     = ">="
+	OpLte     = "<="
+	OpLike    = "like"
+	OpNotLike = "not like"
+	OpIn      = "in"
+	OpNotIn   = "not in"
+	OpIs      = "is"
+)
+
+// Filter is one condition on a field. For OpIn and OpNotIn the value is a
+// slice, and for OpIs it is "set" or "not set".
+type Filter struct {
+	Field    string
+	Operator string
+	Value    interface{}
+}
+
+// MarshalJSON writes the filter as the [field, operator, value] triple the
+// server reads.
+func (f Filter) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{f.Field, f.Operator, f.Value})
+}
+
+// Filters are conditions that must all hold.
+type Filters []Filter
+
+// Where starts a list of filters.
+func Where(field, operator string, value interface{}) Filters {
+	return Filters{{Field: field, Operator: operator, Value: value}}
+}
+
+// And adds a condition to the filters.
+func (f Filters) And(field, operator string, value interface{}) Filters {
+	return append(f, Filter{Field: field, Operator: operator, Value: value})
+}
+
+// ListOptions narrow and order a document list. The zero value lists the
+// server's default page of documents with all fields.
+type ListOptions struct {
+	Fields  []string
+	Filters Filters
+	OrderBy string
+	// Order is "asc" or "desc".
+	Order  string
+	Limit  int
+	Offset int
+}
+
+func (o *ListOptions) query() (url.Values, error) {
+	q := url.Values{}
+	if o == nil {
+		return q, nil
+	}
+	if len(o.Fields) > 0 {
+		q.Set("fields", strings.Join(o.Fields, ","))
+	}
+	if len(o.Filters) > 0 {
+		b, err := json.Marshal(o.Filters)
+		if err != nil {
+			return nil, err
+		}
+		q.Set("filters", string(b))
+	}
+	if o.OrderBy != "" {
+		q.Set("order_by", o.OrderBy)
+	}
+	if o.Order != "" {
+		q.Set("order", o.Order)
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	return q, nil
+}
+
+// DocumentList is one page of documents and the number of documents that
+// match the filters across all pages.
+type DocumentList struct {
+	Documents []Document
+	Total     int
+}
+
+func documentPath(doctype string, id int) string {
+	return fmt.Sprintf("/documents/%s/%d", url.PathEscape(doctype), id)
+}
+
+// List returns a page of the documents of a doctype.
+func (c *Client) List(ctx context.Context, doctype string, opts *ListOptions) (*DocumentList, error) {
+	q, err := opts.query()
+	if err != nil {
+		return nil, err
+	}
+
+	list := &DocumentList{}
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/documents/" + url.PathEscape(doctype), query: q}, &list.Documents)
+	if err != nil {
+		return nil, err
+	}
+	list.Total, _ = strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	return list, nil
+}
+
+// Get returns a document.
+func (c *Client) Get(ctx context.Context, doctype string, id int) (*Document, error) {
+	doc := &Document{}
+	_, err := c.do(ctx, request{method: http.MethodGet, path: documentPath(doctype, id)}, doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Create stores a new document and returns it with its ID.
+func (c *Client) Create(ctx context.Context, doctype string, data map[string]interface{}) (*Document, error) {
+	doc := &Document{}
+	body := Document{Doctype: doctype, Data: data}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/documents", body: body}, doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Update changes the given fields of a document and returns the whole
+// stored document. A nil value clears the field.
+func (c *Client) Update(ctx context.Context, doctype string, id int, data map[string]interface{}) (*Document, error) {
+	doc := &Document{}
+	r := request{
+		method:      http.MethodPatch,
+		path:        documentPath(doctype, id),
+		body:        map[string]interface{}{"data": data},
+		contentType: "application/merge-patch+json",
+		// Applying the same merge patch twice gives the same document
+		idempotent: true,
+	}
+	_, err := c.do(ctx, r, doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Delete removes a document.
+func (c *Client) Delete(ctx context.Context, doctype string, id int) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: documentPath(doctype, id)}, nil)
+	return err
+}
+
+// DefaultPageSize is the page size Iterate uses when the options have no
+// Limit.
+const DefaultPageSize = 100
+
+// DocumentIterator walks the documents of a list page by page:
+//
+//	it := c.Iterate(ctx, "Task", nil)
+//	for it.Next() {
+//		doc := it.Document()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type DocumentIterator struct {
+	client  *Client
+	ctx     context.Context
+	doctype string
+	opts    ListOptions
+
+	page  []Document
+	index int
+	total int
+	done  bool
+	err   error
+}
+
+// Iterate returns an iterator over all the documents that match the
+// options, starting at opts.Offset. opts.Limit sets the page size. Sort
+// the list by a unique field, such as id, so that documents do not move
+// between pages.
+func (c *Client) Iterate(ctx context.Context, doctype string, opts *ListOptions) *DocumentIterator {
+	it := &DocumentIterator{client: c, ctx: ctx, doctype: doctype, index: -1}
+	if opts != nil {
+		it.opts = *opts
+	}
+	if it.opts.Limit <= 0 {
+		it.opts.Limit = DefaultPageSize
+	}
+	return it
+}
+
+// Next moves to the next document, fetching the next page when needed. It
+// returns false at the end of the list or on an error.
+func (it *DocumentIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.index++
+	if it.index < len(it.page) {
+		return true
+	}
+	if it.done {
+		return false
+	}
+
+	list, err := it.client.List(it.ctx, it.doctype, &it.opts)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.page = list.Documents
+	it.index = 0
+	it.total = list.Total
+	it.opts.Offset += len(list.Documents)
+	// The server may cap the page size below Limit, so a short page does
+	// not mean the end of the list; the total does
+	it.done = len(list.Documents) == 0 || it.opts.Offset >= list.Total
+	return len(it.page) > 0
+}
+
+// Document returns the current document.
+func (it *DocumentIterator) Document() Document {
+	return it.page[it.index]
+}
+
+// Total returns the number of documents that match the filters, as of the
+// last page fetched.
+func (it *DocumentIterator) Total() int {
+	return it.total
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *DocumentIterator) Err() error {
+	return it.err
+}
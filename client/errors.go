@@ -0,0 +1,122 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes sent by the server. They match the codes of the server's
+// API error responses.
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeValidation       = "validation_failed"
+	ErrCodeNotFound         = "not_found"
+	ErrCodePermissionDenied = "permission_denied"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodeDuplicate        = "duplicate"
+	ErrCodeUnsupportedMedia = "unsupported_media_type"
+	ErrCodeInternal         = "internal_error"
+)
+
+// Error is an error response from the API.
+type Error struct {
+	StatusCode int               `json:"-"`
+	Message    string            `json:"error"`
+	Code       string            `json:"code"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	RequestID  string            `json:"request_id,omitempty"`
+
+	// body is the raw response, for errors with more members
+	body []byte
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Code)
+	if e.RequestID != "" {
+		msg += " [request " + e.RequestID + "]"
+	}
+	return msg
+}
+
+// newError reads an error response. Responses that are not in the API's
+// error format, such as those from a proxy, get a code from their status.
+func newError(resp *http.Response, body []byte) error {
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e = &Error{Message: strings.TrimSpace(string(body)), Code: codeForStatus(resp.StatusCode)}
+		if e.Message == "" || len(e.Message) > 200 {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	e.StatusCode = resp.StatusCode
+	e.body = body
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	return e
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodePermissionDenied
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	case http.StatusConflict:
+		return ErrCodeConflict
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupportedMedia
+	}
+	if status >= http.StatusInternalServerError {
+		return ErrCodeInternal
+	}
+	return ErrCodeBadRequest
+}
+
+// ErrorCode returns the API error code of err, or "" if err is not an
+// error response.
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// IsNotFound reports whether err says the record does not exist.
+func IsNotFound(err error) bool {
+	return ErrorCode(err) == ErrCodeNotFound
+}
+
+// IsValidation reports whether err says the data sent was invalid. The
+// *Error's Fields give the reason for each field.
+func IsValidation(err error) bool {
+	return ErrorCode(err) == ErrCodeValidation
+}
+
+// IsPermissionDenied reports whether err says the user may not do what was
+// asked.
+func IsPermissionDenied(err error) bool {
+	return ErrorCode(err) == ErrCodePermissionDenied
+}
+
+// IsUnauthorized reports whether err says the request was not logged in.
+func IsUnauthorized(err error) bool {
+	return ErrorCode(err) == ErrCodeUnauthorized
+}
+
+// IsConflict reports whether err says the write clashed with the stored
+// record, including writes of duplicate values.
+func IsConflict(err error) bool {
+	code := ErrorCode(err)
+	return code == ErrCodeConflict || code == ErrCodeDuplicate
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"frappe-go/client"
+)
+
+func TestClientAPIKey(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	ctx := context.Background()
+
+	user := createTestUser(t, "User", false)
+	key := APIKey{UserID: user.ID, Name: "test"}
+	err := createAPIKey(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+
+	c := client.New(server.URL)
+	_, err = c.Create(ctx, dt.Name, map[string]interface{}{"title": "a"})
+	if !client.IsUnauthorized(err) {
+		t.Fatalf("create without a key: err = %v, want unauthorized", err)
+	}
+
+	c.APIKey = key.Key
+	doc, err := c.Create(ctx, dt.Name, map[string]interface{}{"title": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get(ctx, dt.Name, doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Data["title"] != "a" {
+		t.Errorf("got %v, want the created document", got.Data)
+	}
+
+	err = deleteAPIKey(user.ID, key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(ctx, dt.Name, doc.ID)
+	if !client.IsUnauthorized(err) {
+		t.Errorf("get with a revoked key: err = %v, want unauthorized", err)
+	}
+}
+
+func TestClientIterate(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	ctx := context.Background()
+
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	var ids []int
+	for i := 0; i < 7; i++ {
+		doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": fmt.Sprint(i)}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+
+	c := client.New(server.URL)
+	c.APIKey = createTestAPIKey(t, createTestUser(t, "User", false))
+	it := c.Iterate(ctx, dt.Name, &client.ListOptions{OrderBy: "id", Limit: 3})
+	var got []int
+	for it.Next() {
+		got = append(got, it.Document().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ids) || it.Total() != len(ids) {
+		t.Errorf("iterated %v (total %d), want %v", got, it.Total(), ids)
+	}
+}
+
+func TestDocumentReadsNeedLogin(t *testing.T) {
+	admin := createTestUser(t, "Admin", true)
+	path := fmt.Sprintf("/api/documents/User/%d", admin.ID)
+
+	expectStatus(t, apiRequest(t, "GET", path, "", ""), http.StatusUnauthorized)
+	expectStatus(t, apiRequest(t, "GET", "/api/documents/User", "", ""), http.StatusUnauthorized)
+	userKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	expectStatus(t, apiRequest(t, "GET", path, userKey, ""), http.StatusForbidden)
+
+	// Admins can read users, but never their password hashes
+	adminKey := createTestAPIKey(t, admin)
+	for _, p := range []string{path, "/api/documents/User", "/api/documents/User/export?format=json"} {
+		w := apiRequest(t, "GET", p, adminKey, "")
+		expectStatus(t, w, http.StatusOK)
+		if body := w.Body.String(); !strings.Contains(body, username(admin)) || strings.Contains(body, "password") || strings.Contains(body, "$2a$") {
+			t.Errorf("GET %s: body %s, want users without passwords", p, body)
+		}
+	}
+	filters := url.QueryEscape(`[["password", "like", "$2a$%"]]`)
+	expectStatus(t, apiRequest(t, "GET", "/api/documents/User?filters="+filters, adminKey, ""), http.StatusBadRequest)
+}
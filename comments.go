@@ -0,0 +1,435 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Comment is a remark left by a user on a document.
+type Comment struct {
+	ID         int64  `json:"id"`
+	Doctype    string `json:"doctype"`
+	DocID      int    `json:"doc_id"`
+	Content    string `json:"content"`
+	Owner      string `json:"owner"`
+	CreatedAt  string `json:"created_at"`
+	ModifiedAt string `json:"modified_at"`
+}
+
+// TimelineEntry is one item in a document's activity timeline.
+type TimelineEntry struct {
+	Type      string        `json:"type"`
+	User      string        `json:"user"`
+	Timestamp string        `json:"timestamp"`
+	Comment   *Comment      `json:"comment,omitempty"`
+	Event     string        `json:"event,omitempty"`
+	Changes   []FieldChange `json:"changes,omitempty"`
+}
+
+var mentionPattern = regexp.MustCompile(`(^|[^\w@])@([A-Za-z0-9_.-]+)`)
+
+func createCommentTables() error {
+	createCommentTable := `
+	CREATE TABLE IF NOT EXISTS comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		doc_id INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		modified_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createCommentTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_comments_doc ON comments (doctype, doc_id)")
+	return err
+}
+
+// parseMentions returns the distinct usernames mentioned with @ in text.
+func parseMentions(text string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(m[2], ".-")
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// notifyMentions creates a notification for every existing user mentioned in
+// the comment, other than its author, who may read the document.
+func notifyMentions(c *Comment, previous string) {
+	already := make(map[string]bool)
+	for _, name := range parseMentions(previous) {
+		already[name] = true
+	}
+	doctype, err := getDoctypeByName(c.Doctype)
+	if err != nil {
+		log.Printf("Error loading doctype %s for mentions: %v", c.Doctype, err)
+		return
+	}
+
+	for _, name := range parseMentions(c.Content) {
+		if already[name] || name == c.Owner {
+			continue
+		}
+		user, err := getUserByUsername(name)
+		if err != nil || !canReadDoctype(&user, doctype) {
+			continue
+		}
+
+		err = notifyUser(&Notification{
+			ForUser:  name,
+			Type:     NotificationMention,
+			Subject:  fmt.Sprintf("%s mentioned you in a comment on %s %d", c.Owner, c.Doctype, c.DocID),
+			Doctype:  c.Doctype,
+			DocID:    c.DocID,
+			FromUser: c.Owner,
+		})
+		if err != nil {
+			log.Printf("Error creating mention notification for %s: %v", name, err)
+		}
+	}
+}
+
+func addComment(c *Comment) error {
+	c.Content = strings.TrimSpace(c.Content)
+	if c.Content == "" {
+		return &ValidationError{Fields: map[string]string{"content": "is required"}}
+	}
+
+	c.CreatedAt = nowTimestamp()
+	c.ModifiedAt = c.CreatedAt
+	result, err := db.Exec("INSERT INTO comments (doctype, doc_id, content, owner, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?)",
+		c.Doctype, c.DocID, c.Content, c.Owner, c.CreatedAt, c.ModifiedAt)
+	if err != nil {
+		return err
+	}
+
+	c.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	notifyMentions(c, "")
+	return nil
+}
+
+func updateComment(c *Comment, content string) error {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return &ValidationError{Fields: map[string]string{"content": "is required"}}
+	}
+
+	previous := c.Content
+	c.Content = content
+	c.ModifiedAt = nowTimestamp()
+	_, err := db.Exec("UPDATE comments SET content = ?, modified_at = ? WHERE id = ?", c.Content, c.ModifiedAt, c.ID)
+	if err != nil {
+		return err
+	}
+
+	notifyMentions(c, previous)
+	return nil
+}
+
+func deleteComment(id int64) error {
+	_, err := db.Exec("DELETE FROM comments WHERE id = ?", id)
+	return err
+}
+
+func scanComment(scanner interface{ Scan(...interface{}) error }) (Comment, error) {
+	var c Comment
+	err := scanner.Scan(&c.ID, &c.Doctype, &c.DocID, &c.Content, &c.Owner, &c.CreatedAt, &c.ModifiedAt)
+	return c, err
+}
+
+func getComment(id int64) (Comment, error) {
+	c, err := scanComment(db.QueryRow("SELECT id, doctype, doc_id, content, owner, created_at, modified_at FROM comments WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return c, &NotFoundError{What: "comment"}
+	}
+	return c, err
+}
+
+// getComments returns the comments on a document, oldest first.
+func getComments(doctypeName string, docID int) ([]Comment, error) {
+	rows, err := db.Query("SELECT id, doctype, doc_id, content, owner, created_at, modified_at FROM comments WHERE doctype = ? AND doc_id = ? ORDER BY id",
+		doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// getTimeline merges comments and versions of a document, newest first.
+func getTimeline(doctypeName string, docID int) ([]TimelineEntry, error) {
+	comments, err := getComments(doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := getVersions(doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := []TimelineEntry{}
+	for i := range comments {
+		timeline = append(timeline, TimelineEntry{
+			Type:      "comment",
+			User:      comments[i].Owner,
+			Timestamp: comments[i].CreatedAt,
+			Comment:   &comments[i],
+		})
+	}
+	for _, v := range versions {
+		timeline = append(timeline, TimelineEntry{
+			Type:      "version",
+			User:      v.User,
+			Timestamp: v.CreatedAt,
+			Event:     v.Event,
+			Changes:   v.Changes,
+		})
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Timestamp > timeline[j].Timestamp
+	})
+	return timeline, nil
+}
+
+// canEditComment reports whether the user may change or remove the comment.
+func canEditComment(user *Document, c Comment) bool {
+	return user != nil && (c.Owner == username(user) || isAdminUser(user))
+}
+
+// loadDocumentForComments checks that the document exists and the user may
+// read it.
+func loadDocumentForComments(r *http.Request) (int, int, error) {
+	vars := mux.Vars(r)
+	docID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("invalid ID")
+	}
+
+	doctype, err := getDoctypeByName(vars["doctype"])
+	if err != nil {
+		return 0, http.StatusNotFound, fmt.Errorf("doctype not found")
+	}
+	user := currentUser(r)
+	if user == nil {
+		return 0, http.StatusUnauthorized, fmt.Errorf("Not logged in")
+	}
+	if !canReadDoctype(user, doctype) {
+		return 0, http.StatusForbidden, &PermissionError{}
+	}
+	if _, err := getDocumentByID(doctype.Name, vars["id"]); err != nil {
+		return 0, http.StatusNotFound, fmt.Errorf("document not found")
+	}
+	return docID, 0, nil
+}
+
+func documentCommentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	docID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return
+	}
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	if _, err := readDocument(db, doctype, vars["id"]); err != nil {
+		http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if deleteID := r.FormValue("delete"); deleteID != "" {
+		commentID, _ := strconv.ParseInt(deleteID, 10, 64)
+		c, err := getComment(commentID)
+		if err != nil || c.Doctype != name || c.DocID != docID {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		if !canEditComment(user, c) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+		err = deleteComment(c.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		c := Comment{Doctype: name, DocID: docID, Content: r.FormValue("content"), Owner: username(user)}
+		err = addComment(&c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/document/%d", name, docID), http.StatusSeeOther)
+}
+
+func apiListComments(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	comments, err := getComments(mux.Vars(r)["doctype"], docID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, comments)
+}
+
+func apiAddComment(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	var body struct {
+		Content string `json:"content"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c := Comment{Doctype: mux.Vars(r)["doctype"], DocID: docID, Content: body.Content, Owner: username(currentUser(r))}
+	err = addComment(&c)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusCreated, c)
+}
+
+func apiTimeline(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	timeline, err := getTimeline(mux.Vars(r)["doctype"], docID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, timeline)
+}
+
+// loadCommentForChange fetches the comment named in the URL and checks the
+// user may change it.
+func loadCommentForChange(w http.ResponseWriter, r *http.Request) (Comment, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return Comment{}, false
+	}
+	c, err := getComment(id)
+	if err != nil {
+		RespondAPIError(w, http.StatusNotFound, err)
+		return c, false
+	}
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return c, false
+	}
+	if !canEditComment(user, c) {
+		RespondAPIError(w, http.StatusForbidden, &PermissionError{})
+		return c, false
+	}
+	return c, true
+}
+
+func apiUpdateComment(w http.ResponseWriter, r *http.Request) {
+	c, ok := loadCommentForChange(w, r)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Content string `json:"content"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = updateComment(&c, body.Content)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, c)
+}
+
+func apiDeleteComment(w http.ResponseWriter, r *http.Request) {
+	c, ok := loadCommentForChange(w, r)
+	if !ok {
+		return
+	}
+
+	err := deleteComment(c.ID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"@alice please look", []string{"alice"}},
+		{"cc @alice, @bob.", []string{"alice", "bob"}},
+		{"@alice @alice", []string{"alice"}},
+		{"mail alice@example.com", nil},
+		{"(@j.doe-)", []string{"j.doe"}},
+	}
+	for _, tt := range tests {
+		got := parseMentions(tt.text)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseMentions(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCommentMentions(t *testing.T) {
+	dt := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author := createTestUser(t, "HR", false)
+	reader := createTestUser(t, "HR", false)
+	outsider := createTestUser(t, "User", false)
+
+	body := fmt.Sprintf(`{"content": "@%s and @%s, see this. @nobody"}`, username(reader), username(outsider))
+	w := apiRequest(t, "POST", fmt.Sprintf("/api/documents/%s/%d/comments", dt.Name, doc.ID), createTestAPIKey(t, author), body)
+	expectStatus(t, w, http.StatusCreated)
+
+	for user, want := range map[*Document]int{reader: 1, outsider: 0, author: 0} {
+		notifications, err := getNotifications(username(user), false, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != want {
+			t.Errorf("%s has %d notifications, want %d", username(user), len(notifications), want)
+		}
+	}
+}
+
+func TestCommentsNeedDocument(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	hidden := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: hidden.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := createTestUser(t, "User", false)
+	key := createTestAPIKey(t, user)
+
+	w := apiRequest(t, "POST", fmt.Sprintf("/api/documents/%s/999999/comments", dt.Name), key, `{"content": "hi"}`)
+	expectStatus(t, w, http.StatusNotFound)
+	hiddenPath := fmt.Sprintf("/api/documents/%s/%d/comments", hidden.Name, doc.ID)
+	expectAPIError(t, apiRequest(t, "GET", hiddenPath, key, ""), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "GET", hiddenPath, "", ""), http.StatusUnauthorized, ErrCodeUnauthorized)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	s := newTestSession(t, server, user)
+	resp := s.post(fmt.Sprintf("/doctype/%s/document/999999/comments", dt.Name), url.Values{"content": {"hi"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	comments, err := getComments(dt.Name, 999999)
+	if err != nil || len(comments) != 0 {
+		t.Errorf("comments = %v, %v; want none", comments, err)
+	}
+
+	// A session whose user is gone cannot comment
+	_, err = db.Exec("DELETE FROM User WHERE id = ?", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = s.post(fmt.Sprintf("/doctype/%s/document/%d/comments", hidden.Name, doc.ID), url.Values{"content": {"hi"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("comment without a user: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestCommentChanges(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	otherKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	adminKey := createTestAPIKey(t, createTestUser(t, "User", true))
+
+	w := apiRequest(t, "POST", fmt.Sprintf("/api/documents/%s/%d/comments", dt.Name, doc.ID), ownerKey, `{"content": "first"}`)
+	expectStatus(t, w, http.StatusCreated)
+	var c Comment
+	json.Unmarshal(w.Body.Bytes(), &c)
+	path := "/api/comments/" + strconv.FormatInt(c.ID, 10)
+
+	expectAPIError(t, apiRequest(t, "PUT", path, otherKey, `{"content": "mine now"}`), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "PUT", path, "", `{"content": "mine now"}`), http.StatusUnauthorized, ErrCodeUnauthorized)
+	expectStatus(t, apiRequest(t, "PUT", path, ownerKey, `{"content": " "}`), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "PUT", path, ownerKey, `{"content": "edited"}`), http.StatusOK)
+
+	w = apiRequest(t, "GET", fmt.Sprintf("/api/documents/%s/%d/timeline", dt.Name, doc.ID), ownerKey, "")
+	expectStatus(t, w, http.StatusOK)
+	var timeline []TimelineEntry
+	json.Unmarshal(w.Body.Bytes(), &timeline)
+	if len(timeline) != 2 || timeline[0].Type != "comment" || timeline[0].Comment.Content != "edited" || timeline[1].Event != DocEventInsert {
+		t.Errorf("timeline = %+v, want the comment then the insert", timeline)
+	}
+
+	expectStatus(t, apiRequest(t, "DELETE", path, adminKey, ""), http.StatusNoContent)
+	expectStatus(t, apiRequest(t, "DELETE", path, ownerKey, ""), http.StatusNotFound)
+}
+
+func TestVersionsHideSecretFields(t *testing.T) {
+	user := createTestUser(t, "User", false)
+	err := updateDocument(&Document{ID: user.ID, DoctypeName: "User", Data: map[string]interface{}{"password": "changed", "role": "HR"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := getVersions("User", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("%d versions, want 2", len(versions))
+	}
+	for _, v := range versions {
+		if _, ok := v.Data["password"]; ok {
+			t.Errorf("version %d keeps the password", v.ID)
+		}
+		for _, change := range v.Changes {
+			if change.Field == "password" {
+				t.Errorf("version %d records a password change", v.ID)
+			}
+		}
+	}
+}
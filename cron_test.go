@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field string
+		want  []int // nil if the field is invalid
+	}{
+		{"5", []int{5}},
+		{"1-3", []int{1, 2, 3}},
+		{"1,3,5-6", []int{1, 3, 5, 6}},
+		{"*/15", []int{0, 15, 30, 45}},
+		{"10-20/5", []int{10, 15, 20}},
+		{"40/7", []int{40, 47, 54}},
+		{"58-59,*/30", []int{0, 30, 58, 59}},
+		{"60", nil},
+		{"5-1", nil},
+		{"*/0", nil},
+		{"1-", nil},
+		{"x", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		bits, err := parseCronField(tt.field, 0, 59)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseCronField(%q) = %b, want an error", tt.field, bits)
+			}
+			continue
+		}
+		var want uint64
+		for _, v := range tt.want {
+			want |= 1 << uint(v)
+		}
+		if err != nil || bits != want {
+			t.Errorf("parseCronField(%q) = %b, %v; want %b", tt.field, bits, err, want)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	for _, spec := range []string{"* * * *", "0 24 * * *", "0 0 0 * *", "0 0 * 13 *", "0 0 * * 8", "@every 10s", "@every soon"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+
+	s, err := parseSchedule("@every 90m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := s.Next(from); !got.Equal(from.Add(90 * time.Minute)) {
+		t.Errorf("@every 90m: Next = %v", got)
+	}
+
+	sunday0, _ := parseSchedule("0 0 * * 0")
+	sunday7, _ := parseSchedule("0 0 * * 7")
+	if sunday0.(cronSchedule).dow != sunday7.(cronSchedule).dow&^(1<<7) {
+		t.Errorf("day of week 7 is not Sunday")
+	}
+}
+
+func TestCronDayMatches(t *testing.T) {
+	// 2026-11-13 is a Friday
+	tests := []struct {
+		spec string
+		day  int
+		want bool
+	}{
+		{"0 0 13 * *", 13, true},
+		{"0 0 13 * *", 20, false},
+		{"0 0 * * 5", 20, true},
+		{"0 0 * * 5", 14, false},
+		// With both fields restricted a day matching either one fires
+		{"0 0 1 * 5", 1, true},
+		{"0 0 1 * 5", 20, true},
+		{"0 0 1 * 5", 2, false},
+		// A step makes a field restricted only when it is not *
+		{"0 0 */2 * 5", 2, false},
+		{"0 0 1-31/2 * 5", 20, true},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		day := time.Date(2026, 11, tt.day, 0, 0, 0, 0, time.UTC)
+		if got := s.(cronSchedule).dayMatches(day); got != tt.want {
+			t.Errorf("%q on %s: dayMatches = %v, want %v", tt.spec, day.Format("Mon Jan 2"), got, tt.want)
+		}
+	}
+}
+
+// newYorkSchedule parses a cron expression matched in New York time.
+func newYorkSchedule(t *testing.T, spec string) cronSchedule {
+	t.Helper()
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := parseSchedule(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := s.(cronSchedule)
+	cs.loc = loc
+	return cs
+}
+
+func parseTestTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse("2006-01-02 15:04 -0700", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// Clocks in New York go forward at 2:00 on 2026-03-08 and back at 2:00
+	// on 2026-11-01
+	tests := []struct {
+		name, spec, from, want string
+	}{
+		{"step", "*/15 * * * *", "2026-06-10 10:07 -0400", "2026-06-10 10:15 -0400"},
+		{"on the minute", "*/15 * * * *", "2026-06-10 10:15 -0400", "2026-06-10 10:30 -0400"},
+		{"weekdays", "0 9 * * 1-5", "2026-10-16 17:00 -0400", "2026-10-19 09:00 -0400"},
+		{"list of hours", "0 8,12,18 * * *", "2026-10-19 12:00 -0400", "2026-10-19 18:00 -0400"},
+		{"next month", "0 0 1 * *", "2026-01-31 12:00 -0500", "2026-02-01 00:00 -0500"},
+		{"leap day", "0 0 29 2 *", "2026-03-01 00:00 -0500", "2028-02-29 00:00 -0500"},
+		{"day of month or week", "0 0 1 * 5", "2026-11-01 00:00 -0400", "2026-11-06 00:00 -0500"},
+		{"time skipped by DST", "30 2 * * *", "2026-03-07 02:30 -0500", "2026-03-08 03:00 -0400"},
+		{"after the skipped time", "30 2 * * *", "2026-03-08 03:00 -0400", "2026-03-09 02:30 -0400"},
+		{"time repeated by DST", "30 1 * * *", "2026-11-01 01:30 -0400", "2026-11-02 01:30 -0500"},
+		{"during the repeated hour", "*/30 * * * *", "2026-11-01 01:10 -0500", "2026-11-01 02:00 -0500"},
+	}
+	for _, tt := range tests {
+		s := newYorkSchedule(t, tt.spec)
+		got := s.Next(parseTestTime(t, tt.from))
+		want := parseTestTime(t, tt.want)
+		if !got.Equal(want) {
+			t.Errorf("%s: %q from %s: Next = %v, want %v", tt.name, tt.spec, tt.from, got, want)
+		}
+	}
+
+	if got := newYorkSchedule(t, "0 0 30 2 *").Next(time.Now()); !got.IsZero() {
+		t.Errorf("February 30th: Next = %v, want zero", got)
+	}
+}
+
+func TestCronScheduleCatchUpAcrossDST(t *testing.T) {
+	tests := []struct {
+		spec, from, to string
+		want           []string
+	}{
+		{"30 2 * * *", "2026-03-07 02:30 -0500", "2026-03-10 00:00 -0400",
+			[]string{"2026-03-08 03:00 -0400", "2026-03-09 02:30 -0400"}},
+		{"30 1 * * *", "2026-10-31 01:30 -0400", "2026-11-03 00:00 -0500",
+			[]string{"2026-11-01 01:30 -0400", "2026-11-02 01:30 -0500"}},
+		{"0 * * * *", "2026-11-01 00:30 -0400", "2026-11-01 03:30 -0500",
+			[]string{"2026-11-01 01:00 -0400", "2026-11-01 02:00 -0500", "2026-11-01 03:00 -0500"}},
+		{"*/20 * * * *", "2026-03-08 01:30 -0500", "2026-03-08 03:30 -0400",
+			[]string{"2026-03-08 01:40 -0500", "2026-03-08 03:00 -0400", "2026-03-08 03:20 -0400"}},
+	}
+	for _, tt := range tests {
+		s := newYorkSchedule(t, tt.spec)
+		to := parseTestTime(t, tt.to)
+		// As the scheduler makes missed runs
+		var got []string
+		for next := s.Next(parseTestTime(t, tt.from)); !next.IsZero() && !next.After(to); next = s.Next(next) {
+			got = append(got, next.Format("2006-01-02 15:04 -0700"))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q from %s: runs %q, want %q", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// The CSRF token is kept in the session and must come back with every
+// form post, in the csrf_token field or the X-CSRF-Token header.
+const (
+	csrfSessionKey = "csrf_token"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// maxFormPostSize bounds the form body csrfMiddleware reads to find the
+// token: the largest upload any form takes, with room for the other fields.
+const maxFormPostSize = maxImportFileSize + 1<<20
+
+const csrfErrorMessage = "Invalid or missing CSRF token. Reload the page and try again."
+
+// postFormTag matches the opening tag of a form that posts.
+var postFormTag = regexp.MustCompile(`(?i)<form\b[^>]*\bmethod\s*=\s*["']?post\b[^>]*>`)
+
+// csrfToken returns the CSRF token of the session, creating and saving one
+// if the session has none yet.
+func csrfToken(w http.ResponseWriter, r *http.Request, session *sessions.Session) string {
+	if token, ok := session.Values[csrfSessionKey].(string); ok && token != "" {
+		return token
+	}
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	session.Values[csrfSessionKey] = token
+	session.Save(r, w)
+	return token
+}
+
+// injectCSRFToken adds a hidden field with the token to every form in the
+// page that posts, so templates need not add it themselves.
+func injectCSRFToken(page []byte, token string) []byte {
+	field := `<input type="hidden" name="` + csrfFormField + `" value="` + html.EscapeString(token) + `">`
+	return postFormTag.ReplaceAllFunc(page, func(tag []byte) []byte {
+		return append(append([]byte{}, tag...), field...)
+	})
+}
+
+// csrfMiddleware rejects requests that change state without the session's
+// CSRF token. API routes are left out: they are called with an API key or
+// by scripts on our own pages, and the session cookie is SameSite so other
+// sites cannot send it with a request.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, _ := store.Get(r, "session-name")
+		expected, _ := session.Values[csrfSessionKey].(string)
+		if expected == "" {
+			// Without a token in the session no post can pass, so do not
+			// read the body at all
+			http.Error(w, csrfErrorMessage, http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			// The token comes in the form, so the form has to be parsed
+			// here, before the handler can set its own limits
+			r.Body = http.MaxBytesReader(w, r.Body, maxFormPostSize)
+			err := parseDocumentForm(r)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			token = r.PostFormValue(csrfFormField)
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			http.Error(w, csrfErrorMessage, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	s := newTestSession(t, server, createTestUser(t, "User", false))
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	path := fmt.Sprintf("/doctype/%s/document/new", dt.Name)
+
+	// A form on another site can make the browser post with the session
+	// cookie, but cannot know the token
+	for name, token := range map[string]string{"no token": "", "wrong token": "0123"} {
+		form := url.Values{"title": {"cross-site"}}
+		if token != "" {
+			form.Set(csrfFormField, token)
+		}
+		resp, err := s.client.PostForm(server.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", name, resp.StatusCode)
+		}
+	}
+
+	resp := s.post(path, url.Values{"title": {"same-site"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("post with the token: status %d, want 303", resp.StatusCode)
+	}
+
+	// The token can also come in a header or a multipart form
+	req, _ := http.NewRequest("POST", server.URL+path, bytes.NewBufferString("title=header"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(csrfHeader, s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("token in the header: status %d, want 303", resp.StatusCode)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("title", "multipart")
+	mw.WriteField(csrfFormField, s.token)
+	mw.Close()
+	resp, err = s.client.Post(server.URL+path, mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("multipart post with the token: status %d, want 303", resp.StatusCode)
+	}
+}
+
+func TestCSRFMiddlewareLimitsBody(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	s := newTestSession(t, server, createTestUser(t, "User", false))
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField(csrfFormField, s.token)
+	part, _ := mw.CreateFormFile("file", "big.bin")
+	part.Write(make([]byte, maxFormPostSize))
+	mw.Close()
+	resp, err := s.client.Post(server.URL+fmt.Sprintf("/doctype/%s/document/new", dt.Name), mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", resp.StatusCode)
+	}
+}
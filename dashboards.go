@@ -0,0 +1,587 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DashboardChartDoctype holds chart definitions. A chart counts, sums or
+// averages documents of a doctype, optionally filtered (filters use the
+// JSON form accepted by the document API), and either:
+//
+//   - shows a single number (chart type "number"),
+//   - groups by a field (group_by), or
+//   - buckets by a date field (time_field) per day, week, month or year
+//     over the last few periods.
+const DashboardChartDoctype = "Dashboard Chart"
+
+// DashboardDoctype holds dashboards, each a list of chart names shown
+// together. Dashboards are shown on the home page to users with one of
+// their roles; a dashboard without roles is shown to everyone.
+const DashboardDoctype = "Dashboard"
+
+// Chart types
+const (
+	ChartNumber = "number"
+	ChartBar    = "bar"
+	ChartLine   = "line"
+)
+
+const (
+	// chartCacheTTL is how long chart data is reused. Writes to a chart's
+	// doctype clear its cached data sooner.
+	chartCacheTTL = 5 * time.Minute
+
+	defaultChartPeriods = 12
+	maxChartPeriods     = 366
+	maxChartGroups      = 20
+)
+
+// chartIntervals maps each time series interval to the SQL expression
+// giving the start of the period a date falls in.
+var chartIntervals = map[string]string{
+	"day":   "date(%s)",
+	"week":  "date(%s, 'weekday 0', '-6 days')",
+	"month": "strftime('%%Y-%%m-01', %s)",
+	"year":  "strftime('%%Y-01-01', %s)",
+}
+
+// DashboardChart is a parsed Dashboard Chart document.
+type DashboardChart struct {
+	ID         int
+	Name       string
+	Doctype    string
+	Type       string
+	Function   string
+	ValueField string
+	GroupBy    string
+	TimeField  string
+	Interval   string
+	Periods    int
+	Filters    []Filter
+}
+
+// ChartPoint is one bar or point of a chart. Percent is the value relative
+// to the largest value in the chart.
+type ChartPoint struct {
+	Label   string  `json:"label"`
+	Value   float64 `json:"value"`
+	Display string  `json:"-"`
+	Percent float64 `json:"-"`
+}
+
+// ChartData is the computed data of a chart.
+type ChartData struct {
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	Doctype   string       `json:"doctype"`
+	Value     float64      `json:"value"`
+	Display   string       `json:"display"`
+	Points    []ChartPoint `json:"points"`
+	Polyline  string       `json:"-"`
+	UpdatedAt string       `json:"updated_at"`
+}
+
+// Dashboard is a parsed Dashboard document.
+type Dashboard struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Charts []string `json:"charts"`
+	Roles  []string `json:"roles"`
+}
+
+// DashboardView is a dashboard with the data of the charts the user can
+// see.
+type DashboardView struct {
+	Dashboard
+	Cards  []ChartData `json:"cards"`
+	Charts []ChartData `json:"charts"`
+	Errors []string    `json:"errors,omitempty"`
+}
+
+func init() {
+	registerDocumentHook(chartCacheHook)
+}
+
+// createDashboardDoctypes creates the Dashboard Chart and Dashboard
+// doctypes unless they already exist.
+func createDashboardDoctypes() error {
+	if _, err := getDoctypeByName(DashboardChartDoctype); err != nil {
+		chartDoctype := Doctype{
+			Name: DashboardChartDoctype,
+			Fields: []Field{
+				{Name: "name", Type: "string", Label: "Name", Required: true},
+				{Name: "document_type", Type: "string", Label: "Document Type", Required: true},
+				{Name: "chart_type", Type: "string", Label: "Chart Type (number, bar or line)", Required: true},
+				{Name: "function", Type: "string", Label: "Function (count, sum or avg)", Required: false},
+				{Name: "value_field", Type: "string", Label: "Value Field (for sum and avg)", Required: false},
+				{Name: "group_by", Type: "string", Label: "Group By Field", Required: false},
+				{Name: "time_field", Type: "string", Label: "Time Series Date Field", Required: false},
+				{Name: "interval", Type: "string", Label: "Interval (day, week, month or year)", Required: false},
+				{Name: "periods", Type: "integer", Label: "Number of Periods", Required: false},
+				{Name: "filters", Type: "text", Label: "Filters (JSON)", Required: false},
+			},
+			Permissions: []string{"admin"},
+		}
+		if err := createDoctype(&chartDoctype); err != nil {
+			return err
+		}
+	}
+
+	if _, err := getDoctypeByName(DashboardDoctype); err == nil {
+		return nil
+	}
+	dashboardDoctype := Doctype{
+		Name: DashboardDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "charts", Type: "text", Label: "Charts (one chart name per line)", Required: true},
+			{Name: "roles", Type: "string", Label: "Roles (space separated, blank for everyone)", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+	return createDoctype(&dashboardDoctype)
+}
+
+// parseDashboardChart reads a Dashboard Chart document and checks it
+// against the doctype it charts.
+func parseDashboardChart(doc Document) (DashboardChart, Doctype, error) {
+	c := DashboardChart{
+		ID:         doc.ID,
+		Name:       ruleString(doc, "name"),
+		Doctype:    ruleString(doc, "document_type"),
+		Type:       strings.ToLower(ruleString(doc, "chart_type")),
+		Function:   strings.ToLower(ruleString(doc, "function")),
+		ValueField: ruleString(doc, "value_field"),
+		GroupBy:    ruleString(doc, "group_by"),
+		TimeField:  ruleString(doc, "time_field"),
+		Interval:   strings.ToLower(ruleString(doc, "interval")),
+	}
+	if c.Function == "" {
+		c.Function = "count"
+	}
+	if c.Interval == "" {
+		c.Interval = "month"
+	}
+	if n, ok := doc.Data["periods"].(int64); ok && n > 0 {
+		c.Periods = int(n)
+	}
+	if c.Periods == 0 {
+		c.Periods = defaultChartPeriods
+	}
+	if c.Periods > maxChartPeriods {
+		c.Periods = maxChartPeriods
+	}
+
+	doctype, err := getDoctypeByName(c.Doctype)
+	if err != nil {
+		return c, doctype, fmt.Errorf("doctype %q not found", c.Doctype)
+	}
+
+	c.Filters, err = parseFilters(ruleString(doc, "filters"))
+	if err != nil {
+		return c, doctype, err
+	}
+
+	switch c.Type {
+	case ChartNumber:
+	case ChartBar, ChartLine:
+		if (c.GroupBy == "") == (c.TimeField == "") {
+			return c, doctype, fmt.Errorf("a %s chart needs either a group by field or a time series field", c.Type)
+		}
+	default:
+		return c, doctype, fmt.Errorf("unknown chart type %q", c.Type)
+	}
+	if c.Function != "count" && c.Function != "sum" && c.Function != "avg" {
+		return c, doctype, fmt.Errorf("unsupported function %q", c.Function)
+	}
+	if c.GroupBy != "" && !isDocumentColumn(doctype, c.GroupBy) {
+		return c, doctype, fmt.Errorf("unknown group by field %q", c.GroupBy)
+	}
+	if c.TimeField != "" {
+		field := getFieldByName(doctype.Fields, c.TimeField)
+		if field == nil || (field.Type != "date" && field.Type != "datetime") {
+			return c, doctype, fmt.Errorf("time series field %q must be a date or datetime field", c.TimeField)
+		}
+		if _, ok := chartIntervals[c.Interval]; !ok {
+			return c, doctype, fmt.Errorf("unknown interval %q", c.Interval)
+		}
+	}
+	return c, doctype, nil
+}
+
+// getDashboardChart finds a chart definition by name.
+func getDashboardChart(name string) (DashboardChart, Doctype, error) {
+	docs, err := getDocuments(DashboardChartDoctype)
+	if err != nil {
+		return DashboardChart{}, Doctype{}, err
+	}
+	for _, doc := range docs {
+		if ruleString(doc, "name") == name {
+			return parseDashboardChart(doc)
+		}
+	}
+	return DashboardChart{}, Doctype{}, sql.ErrNoRows
+}
+
+// chartAggregate returns the SQL aggregate expression of a chart, checked
+// the same way as report aggregates.
+func chartAggregate(doctype Doctype, c DashboardChart) (string, error) {
+	expr, _, err := aggregateExpression(doctype, ReportAggregate{Function: c.Function, Field: c.ValueField})
+	return expr, err
+}
+
+// periodStart returns the start of the period t falls in. Weeks start on
+// Monday, matching the SQL used to bucket dates.
+func periodStart(t time.Time, interval string) time.Time {
+	t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "week":
+		return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
+
+func addPeriods(t time.Time, interval string, n int) time.Time {
+	switch interval {
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "month":
+		return t.AddDate(0, n, 0)
+	case "year":
+		return t.AddDate(n, 0, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
+
+func periodLabel(t time.Time, interval string) string {
+	switch interval {
+	case "month":
+		return t.Format("Jan 2006")
+	case "year":
+		return t.Format("2006")
+	}
+	return t.Format("2006-01-02")
+}
+
+// chartValue converts an aggregate result to a number. NULL, such as the
+// sum of no rows, is zero.
+func chartValue(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	case []byte:
+		f, _ := strconv.ParseFloat(string(n), 64)
+		return f
+	case string:
+		f, _ := strconv.ParseFloat(n, 64)
+		return f
+	}
+	return 0
+}
+
+func formatChartValue(v float64) string {
+	if v == float64(int64(v)) {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// computeChart runs the query of a chart.
+func computeChart(doctype Doctype, c DashboardChart, now time.Time) (ChartData, error) {
+	data := ChartData{Name: c.Name, Type: c.Type, Doctype: c.Doctype, Points: []ChartPoint{}, UpdatedAt: nowTimestamp()}
+
+	agg, err := chartAggregate(doctype, c)
+	if err != nil {
+		return data, err
+	}
+	where, args, err := buildWhereClause(doctype, c.Filters)
+	if err != nil {
+		return data, err
+	}
+
+	if c.Type == ChartNumber {
+		var value interface{}
+		err = db.QueryRow(fmt.Sprintf("SELECT %s FROM `%s`%s", agg, doctype.Name, where), args...).Scan(&value)
+		data.Value = chartValue(value)
+		data.Display = formatChartValue(data.Value)
+		return data, err
+	}
+
+	var query string
+	var start time.Time
+	if c.TimeField != "" {
+		start = addPeriods(periodStart(now, c.Interval), c.Interval, 1-c.Periods)
+		condition := fmt.Sprintf("`%s` >= ?", c.TimeField)
+		if where == "" {
+			where = " WHERE " + condition
+		} else {
+			where += " AND " + condition
+		}
+		args = append(args, start.Format("2006-01-02"))
+		period := fmt.Sprintf(chartIntervals[c.Interval], fmt.Sprintf("`%s`", c.TimeField))
+		query = fmt.Sprintf("SELECT %s AS period, %s FROM `%s`%s GROUP BY period ORDER BY period", period, agg, doctype.Name, where)
+	} else {
+		query = fmt.Sprintf("SELECT `%s`, %s AS value FROM `%s`%s GROUP BY `%s` ORDER BY value DESC LIMIT %d",
+			c.GroupBy, agg, doctype.Name, where, c.GroupBy, maxChartGroups)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+
+	values := map[string]float64{}
+	for rows.Next() {
+		var key, value interface{}
+		if err := rows.Scan(&key, &value); err != nil {
+			return data, err
+		}
+		label := "(not set)"
+		if k := exportValue(key); k != nil && fmt.Sprint(k) != "" {
+			label = fmt.Sprint(k)
+		}
+		if c.TimeField != "" {
+			values[label] = chartValue(value)
+		} else {
+			data.Points = append(data.Points, ChartPoint{Label: label, Value: chartValue(value)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	// Time series show every period, including those without documents
+	if c.TimeField != "" {
+		for i := 0; i < c.Periods; i++ {
+			t := addPeriods(start, c.Interval, i)
+			data.Points = append(data.Points, ChartPoint{Label: periodLabel(t, c.Interval), Value: values[t.Format("2006-01-02")]})
+		}
+	}
+
+	scaleChart(&data)
+	return data, nil
+}
+
+// scaleChart fills in the display values of the points, their size
+// relative to the largest, and the points of the SVG line for line charts
+// (in a 100 by 40 view box).
+func scaleChart(data *ChartData) {
+	max := 0.0
+	for _, p := range data.Points {
+		if p.Value > max {
+			max = p.Value
+		}
+	}
+
+	var line []string
+	for i := range data.Points {
+		p := &data.Points[i]
+		p.Display = formatChartValue(p.Value)
+		if max > 0 {
+			p.Percent = p.Value / max * 100
+		}
+		x := 50.0
+		if len(data.Points) > 1 {
+			x = float64(i) * 100 / float64(len(data.Points)-1)
+		}
+		line = append(line, fmt.Sprintf("%.2f,%.2f", x, 40-p.Percent*0.4))
+	}
+	data.Polyline = strings.Join(line, " ")
+}
+
+// chartCache keeps computed chart data by chart name.
+var chartCache = struct {
+	sync.Mutex
+	entries map[string]chartCacheEntry
+}{entries: map[string]chartCacheEntry{}}
+
+type chartCacheEntry struct {
+	data    ChartData
+	doctype string
+	expires time.Time
+}
+
+// getChartData returns the data of a chart, from the cache when it is
+// fresh.
+func getChartData(doctype Doctype, c DashboardChart, refresh bool) (ChartData, error) {
+	chartCache.Lock()
+	entry, ok := chartCache.entries[c.Name]
+	chartCache.Unlock()
+	if ok && !refresh && time.Now().Before(entry.expires) {
+		return entry.data, nil
+	}
+
+	data, err := computeChart(doctype, c, time.Now().UTC())
+	if err != nil {
+		return data, err
+	}
+
+	chartCache.Lock()
+	chartCache.entries[c.Name] = chartCacheEntry{data: data, doctype: c.Doctype, expires: time.Now().Add(chartCacheTTL)}
+	chartCache.Unlock()
+	return data, nil
+}
+
+// chartCacheHook drops cached chart data when a document the chart counts
+// changes, and all of it when a chart definition changes.
+func chartCacheHook(event string, doc *Document) error {
+	chartCache.Lock()
+	defer chartCache.Unlock()
+	for name, entry := range chartCache.entries {
+		if doc.DoctypeName == DashboardChartDoctype || entry.doctype == doc.DoctypeName {
+			delete(chartCache.entries, name)
+		}
+	}
+	return nil
+}
+
+// getDashboards lists the dashboards shown to the user.
+func getDashboards(user *Document) ([]Dashboard, error) {
+	docs, err := getDocuments(DashboardDoctype)
+	if err != nil {
+		return nil, err
+	}
+
+	dashboards := []Dashboard{}
+	for _, doc := range docs {
+		d := Dashboard{
+			ID:     doc.ID,
+			Name:   ruleString(doc, "name"),
+			Charts: []string{},
+			Roles:  strings.Fields(ruleString(doc, "roles")),
+		}
+		for _, line := range strings.Split(ruleString(doc, "charts"), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				d.Charts = append(d.Charts, line)
+			}
+		}
+		if canViewDashboard(user, d) {
+			dashboards = append(dashboards, d)
+		}
+	}
+	return dashboards, nil
+}
+
+func canViewDashboard(user *Document, d Dashboard) bool {
+	if user == nil {
+		return false
+	}
+	if isAdminUser(user) || len(d.Roles) == 0 {
+		return true
+	}
+	role := userRole(user)
+	for _, r := range d.Roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildDashboardView computes the charts of a dashboard. Charts of
+// doctypes the user cannot read are left out; broken chart definitions are
+// reported to admins.
+func buildDashboardView(user *Document, d Dashboard, refresh bool) DashboardView {
+	view := DashboardView{Dashboard: d, Cards: []ChartData{}, Charts: []ChartData{}}
+	for _, name := range d.Charts {
+		c, doctype, err := getDashboardChart(name)
+		if err == nil && !canReadDoctype(user, doctype) {
+			continue
+		}
+		var data ChartData
+		if err == nil {
+			data, err = getChartData(doctype, c, refresh)
+		}
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("not found")
+		}
+		if err != nil {
+			if isAdminUser(user) {
+				view.Errors = append(view.Errors, fmt.Sprintf("Chart %s: %v", name, err))
+			}
+			continue
+		}
+		if data.Type == ChartNumber {
+			view.Cards = append(view.Cards, data)
+		} else {
+			view.Charts = append(view.Charts, data)
+		}
+	}
+	return view
+}
+
+// getDashboardViews computes every dashboard shown to the user.
+func getDashboardViews(user *Document, refresh bool) ([]DashboardView, error) {
+	dashboards, err := getDashboards(user)
+	if err != nil {
+		return nil, err
+	}
+	views := []DashboardView{}
+	for _, d := range dashboards {
+		views = append(views, buildDashboardView(user, d, refresh))
+	}
+	return views, nil
+}
+
+// chartRefresh reports whether the request asks for chart data to be
+// recomputed. Only admins may bypass the cache; other users get the cached
+// data, which writes to the charted doctypes keep current.
+func chartRefresh(r *http.Request, user *Document) bool {
+	return r.URL.Query().Get("refresh") != "" && isAdminUser(user)
+}
+
+func apiListDashboards(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	views, err := getDashboardViews(user, chartRefresh(r, user))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, views)
+}
+
+// apiChartData returns the data of one chart. Admins may pass refresh=1 to
+// recompute it instead of using the cache.
+func apiChartData(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	c, doctype, err := getDashboardChart(mux.Vars(r)["name"])
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "Chart not found")
+		return
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	data, err := getChartData(doctype, c, chartRefresh(r, user))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, data)
+}
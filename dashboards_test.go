@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// createTestChart creates a Dashboard Chart with the given fields set and
+// returns its name.
+func createTestChart(t *testing.T, doctype string, data map[string]interface{}) string {
+	t.Helper()
+	name := uniqueName("chart")
+	chart := Document{DoctypeName: DashboardChartDoctype, Data: map[string]interface{}{
+		"name":          name,
+		"document_type": doctype,
+		"chart_type":    ChartNumber,
+	}}
+	for k, v := range data {
+		chart.Data[k] = v
+	}
+	err := createDocument(&chart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func getTestChartData(t *testing.T, key, name, query string) ChartData {
+	t.Helper()
+	w := apiRequest(t, "GET", "/api/dashboard-charts/"+name+"/data"+query, key, "")
+	expectStatus(t, w, http.StatusOK)
+	var data ChartData
+	err := json.Unmarshal(w.Body.Bytes(), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestChartCache(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	name := createTestChart(t, dt.Name, nil)
+	userKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	adminKey := createTestAPIKey(t, createTestUser(t, "User", true))
+
+	if data := getTestChartData(t, userKey, name, ""); data.Value != 0 {
+		t.Fatalf("value = %v, want 0", data.Value)
+	}
+	// Rows added behind the application's back are not seen until the
+	// cache expires or an admin refreshes it
+	_, err := db.Exec(fmt.Sprintf("INSERT INTO `%s` (title) VALUES ('a')", dt.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := getTestChartData(t, userKey, name, "?refresh=1"); data.Value != 0 {
+		t.Errorf("value = %v after a user refresh, want the cached 0", data.Value)
+	}
+	if data := getTestChartData(t, adminKey, name, "?refresh=1"); data.Value != 1 {
+		t.Errorf("value = %v after an admin refresh, want 1", data.Value)
+	}
+
+	// Documents saved through the application clear the cache
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "b"}}
+	err = createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := getTestChartData(t, userKey, name, ""); data.Value != 2 {
+		t.Errorf("value = %v after an insert, want 2", data.Value)
+	}
+}
+
+func TestDashboards(t *testing.T) {
+	role := uniqueName("Role")
+	open := createTestDoctype(t, nil, Field{Name: "status", Type: "string", Label: "Status"})
+	private := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	for _, status := range []string{"Open", "Open", "Closed"} {
+		doc := Document{DoctypeName: open.Name, Data: map[string]interface{}{"status": status}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	byStatus := createTestChart(t, open.Name, map[string]interface{}{"chart_type": ChartBar, "group_by": "status"})
+	hidden := createTestChart(t, private.Name, nil)
+	dashboard := Document{DoctypeName: DashboardDoctype, Data: map[string]interface{}{
+		"name":   uniqueName("dashboard"),
+		"charts": byStatus + "\n" + hidden + "\nmissing",
+		"roles":  role,
+	}}
+	err := createDocument(&dashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(key string) *DashboardView {
+		t.Helper()
+		w := apiRequest(t, "GET", "/api/dashboards", key, "")
+		expectStatus(t, w, http.StatusOK)
+		var views []DashboardView
+		json.Unmarshal(w.Body.Bytes(), &views)
+		for i := range views {
+			if views[i].ID == dashboard.ID {
+				return &views[i]
+			}
+		}
+		return nil
+	}
+	if view := list(createTestAPIKey(t, createTestUser(t, "User", false))); view != nil {
+		t.Errorf("dashboard shown without its role: %+v", view)
+	}
+	view := list(createTestAPIKey(t, createTestUser(t, role, false)))
+	if view == nil {
+		t.Fatal("dashboard not shown to its role")
+	}
+	if len(view.Cards) != 0 || len(view.Charts) != 1 || len(view.Errors) != 0 {
+		t.Fatalf("view = %+v, want only the bar chart and no errors", view)
+	}
+	if points := view.Charts[0].Points; fmt.Sprintf("%s %v %s %v", points[0].Label, points[0].Value, points[1].Label, points[1].Value) != "Open 2 Closed 1" {
+		t.Errorf("points = %+v", points)
+	}
+	if view := list(createTestAPIKey(t, createTestUser(t, "User", true))); view == nil || len(view.Cards) != 1 || len(view.Errors) != 1 {
+		t.Errorf("admin view = %+v, want the card and the missing chart's error", view)
+	}
+	expectStatus(t, apiRequest(t, "GET", "/api/dashboards", "", ""), http.StatusUnauthorized)
+}
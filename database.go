@@ -2,12 +2,23 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
+// timestampLayout is used for stored timestamps that need to sort in the
+// order events happened, so it has a fixed width and sub-second precision.
+const timestampLayout = "2006-01-02T15:04:05.000000Z"
+
 func initDB() error {
 	var err error
-	db, err = sql.Open("sqlite3", "./frappe.db")
+	// Background jobs write while requests are served, so wait for locks
+	// rather than failing straight away. In WAL mode readers, such as
+	// long query reports and exports, do not block writers at all.
+	// Transactions take the write lock when they begin, so one that reads
+	// before it writes cannot act on a value another writer changes
+	db, err = sql.Open(sqliteDriver, dbFile+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
 	if err != nil {
 		return err
 	}
@@ -22,6 +33,121 @@ func initDB() error {
 		return err
 	}
 
+	err = createSearchTables()
+	if err != nil {
+		return err
+	}
+
+	err = createImportTables()
+	if err != nil {
+		return err
+	}
+
+	err = createFileTables()
+	if err != nil {
+		return err
+	}
+
+	err = createVersionTables()
+	if err != nil {
+		return err
+	}
+
+	err = createCommentTables()
+	if err != nil {
+		return err
+	}
+
+	err = createNotificationTables()
+	if err != nil {
+		return err
+	}
+
+	err = createJobTables()
+	if err != nil {
+		return err
+	}
+
+	err = createEmailTables()
+	if err != nil {
+		return err
+	}
+
+	err = createAssignmentTables()
+	if err != nil {
+		return err
+	}
+
+	err = createTagTables()
+	if err != nil {
+		return err
+	}
+
+	err = createNotificationRuleDoctype()
+	if err != nil {
+		return err
+	}
+
+	err = createWebhookTables()
+	if err != nil {
+		return err
+	}
+
+	err = createWebhookDoctype()
+	if err != nil {
+		return err
+	}
+
+	err = createScheduledJobDoctype()
+	if err != nil {
+		return err
+	}
+
+	err = createReportTables()
+	if err != nil {
+		return err
+	}
+
+	err = createQueryReportDoctype()
+	if err != nil {
+		return err
+	}
+
+	err = createDashboardDoctypes()
+	if err != nil {
+		return err
+	}
+
+	err = createKanbanBoardDoctype()
+	if err != nil {
+		return err
+	}
+
+	err = createCalendarViewDoctype()
+	if err != nil {
+		return err
+	}
+
+	err = createListViewTables()
+	if err != nil {
+		return err
+	}
+
+	err = createBulkTables()
+	if err != nil {
+		return err
+	}
+
+	err = createAPIKeyTables()
+	if err != nil {
+		return err
+	}
+
+	err = openReadOnlyDB()
+	if err != nil {
+		return err
+	}
+
 	// Create Role doctype
 	err = createRoleDoctype()
 	if err != nil {
@@ -93,7 +219,10 @@ func createTables() error {
 	createDoctypeTable := `
 	CREATE TABLE IF NOT EXISTS doctypes (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL UNIQUE
+		name TEXT NOT NULL UNIQUE,
+		title_field TEXT NOT NULL DEFAULT '',
+		sort_field TEXT NOT NULL DEFAULT '',
+		sort_order TEXT NOT NULL DEFAULT ''
 	);`
 
 	_, err := db.Exec(createDoctypeTable)
@@ -109,6 +238,9 @@ func createTables() error {
 		type TEXT NOT NULL,
 		label TEXT NOT NULL,
 		required BOOLEAN NOT NULL,
+		searchable BOOLEAN NOT NULL DEFAULT 0,
+		in_list_view BOOLEAN NOT NULL DEFAULT 0,
+		options TEXT NOT NULL DEFAULT '',
 		FOREIGN KEY (doctype_id) REFERENCES doctypes(id)
 	);`
 
@@ -117,6 +249,28 @@ func createTables() error {
 		return err
 	}
 
+	// Databases created before fields could be searchable lack the column
+	err = addColumnIfMissing("fields", "searchable", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	// Likewise for the list view settings
+	err = addColumnIfMissing("fields", "in_list_view", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = addColumnIfMissing("fields", "options", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"title_field", "sort_field", "sort_order"} {
+		err = addColumnIfMissing("doctypes", column, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+
 	createPermissionTable := `
 	CREATE TABLE IF NOT EXISTS permissions (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -169,5 +323,83 @@ func createTables() error {
 		return err
 	}
 
-	return nil
+	return migrateLegacyPermissions()
+}
+
+// legacyPermissionsVersion is the schema version from which doctype
+// permissions live in doctype_permissions.
+const legacyPermissionsVersion = 1
+
+// migrateLegacyPermissions copies doctype permissions out of the legacy
+// permissions table, which permission checks never read, so admin-only
+// doctypes are admin-only. It runs once: the schema version records the
+// copy, so permissions removed later are not copied back. The legacy
+// table is left as it was.
+func migrateLegacyPermissions() error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	if version >= legacyPermissionsVersion {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+	INSERT INTO doctype_permissions (doctype_id, permission)
+	SELECT DISTINCT doctype_id, permission FROM permissions p
+	WHERE NOT EXISTS (
+		SELECT 1 FROM doctype_permissions dp
+		WHERE dp.doctype_id = p.doctype_id AND dp.permission = p.permission
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", legacyPermissionsVersion))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is
+// already there.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(`%s`)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue interface{}
+			pk        int
+		)
+		err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition))
+	return err
+}
+
+// nowTimestamp returns the current UTC time formatted with timestampLayout.
+func nowTimestamp() string {
+	return time.Now().UTC().Format(timestampLayout)
 }
@@ -2,6 +2,27 @@ package main
 
 import (
 	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 var db *sql.DB
+
+// dbFile is the path of the SQLite database.
+var dbFile = "./frappe.db"
+
+// readOnlyDB is a second connection to the same database that cannot
+// write, used to run SQL written by admins.
+var readOnlyDB *sql.DB
+
+// sqliteDriver is the SQLite driver with the functions the application
+// adds to SQL, such as bm25 for ranking FTS4 search results.
+const sqliteDriver = "sqlite3_frappe"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("bm25", matchinfoBM25, true)
+		},
+	})
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Email queue statuses
+const (
+	EmailNotSent = "Not Sent"
+	EmailSent    = "Sent"
+	EmailError   = "Error"
+)
+
+// maxEmailAttempts is how many times sending is tried before an email is
+// marked as failed.
+const maxEmailAttempts = 5
+
+// EmailMessage is an email waiting in, or sent from, the outgoing queue.
+type EmailMessage struct {
+	ID            int64  `json:"id"`
+	To            string `json:"to"`
+	Subject       string `json:"subject"`
+	Body          string `json:"body"`
+	HTML          bool   `json:"html"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt string `json:"next_attempt_at"`
+	LastError     string `json:"last_error"`
+	CreatedAt     string `json:"created_at"`
+	SentAt        string `json:"sent_at"`
+}
+
+// EmailSender delivers email.
+type EmailSender interface {
+	Send(from string, msg EmailMessage) error
+}
+
+// emailSender delivers queued email, emailFrom is the sender address.
+var (
+	emailSender EmailSender = &FileSender{Dir: "outbox"}
+	emailFrom               = "noreply@localhost"
+)
+
+// initEmailSender picks the email backend from the environment.
+// EMAIL_SENDER=smtp sends through SMTP_HOST, EMAIL_SENDER=memory keeps sent
+// messages in memory, anything else writes them as .eml files to
+// EMAIL_OUTBOX_DIR (default ./outbox).
+func initEmailSender() error {
+	if from := os.Getenv("EMAIL_FROM"); from != "" {
+		emailFrom = from
+	}
+
+	switch os.Getenv("EMAIL_SENDER") {
+	case "smtp":
+		s := &SMTPSender{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+		if s.Host == "" {
+			return fmt.Errorf("SMTP_HOST must be set for the smtp email sender")
+		}
+		if s.Port == "" {
+			s.Port = "587"
+		}
+		emailSender = s
+	case "memory":
+		emailSender = &MemorySender{}
+	default:
+		dir := os.Getenv("EMAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "outbox"
+		}
+		emailSender = &FileSender{Dir: dir}
+	}
+	return nil
+}
+
+// formatEmail builds the RFC 5322 message for an email.
+func formatEmail(from string, msg EmailMessage) []byte {
+	contentType := "text/plain"
+	if msg.HTML {
+		contentType = "text/html"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s; charset=UTF-8\r\n", contentType)
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// SMTPSender sends email through an SMTP server, authenticating when a
+// username is set.
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(from string, msg EmailMessage) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, from, []string{msg.To}, formatEmail(from, msg))
+}
+
+// FileSender writes each email as an .eml file, for development.
+type FileSender struct {
+	Dir string
+}
+
+func (s *FileSender) Send(from string, msg EmailMessage) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102T150405.000000"), msg.ID)
+	return os.WriteFile(filepath.Join(s.Dir, name), formatEmail(from, msg), 0o644)
+}
+
+// MemorySender keeps sent email in memory, for tests.
+type MemorySender struct {
+	mu   sync.Mutex
+	Sent []EmailMessage
+}
+
+func (s *MemorySender) Send(from string, msg EmailMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Sent = append(s.Sent, msg)
+	return nil
+}
+
+func createEmailTables() error {
+	createEmailQueueTable := `
+	CREATE TABLE IF NOT EXISTS email_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		recipient TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createEmailQueueTable)
+	if err != nil {
+		return err
+	}
+
+	columns := []struct{ name, definition string }{
+		{"html", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"attempts", "INTEGER NOT NULL DEFAULT 0"},
+		{"next_attempt_at", "TEXT NOT NULL DEFAULT ''"},
+		{"last_error", "TEXT NOT NULL DEFAULT ''"},
+		{"sent_at", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		err = addColumnIfMissing("email_queue", c.name, c.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_email_queue_status ON email_queue (status, next_attempt_at)")
+	return err
+}
+
+// EmailJob is the payload of the background job that sends a queued email.
+type EmailJob struct {
+	EmailID int64 `json:"email_id"`
+}
+
+var sendEmailJob JobType[EmailJob]
+
+func init() {
+	sendEmailJob = defineJob("send_email", JobOptions{MaxAttempts: maxEmailAttempts, RetryDelay: emailRetryDelay}, sendEmail)
+}
+
+// queueEmail adds an email to the outgoing queue and starts a job to send
+// it.
+func queueEmail(msg *EmailMessage) error {
+	msg.Status = EmailNotSent
+	msg.CreatedAt = nowTimestamp()
+	msg.NextAttemptAt = msg.CreatedAt
+	result, err := db.Exec("INSERT INTO email_queue (recipient, subject, body, html, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		msg.To, msg.Subject, msg.Body, msg.HTML, msg.Status, msg.NextAttemptAt, msg.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	msg.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = sendEmailJob.Enqueue(EmailJob{EmailID: msg.ID})
+	return err
+}
+
+const emailColumns = "id, recipient, subject, body, html, status, attempts, next_attempt_at, last_error, created_at, sent_at"
+
+func scanEmail(scanner interface{ Scan(...interface{}) error }) (EmailMessage, error) {
+	var m EmailMessage
+	err := scanner.Scan(&m.ID, &m.To, &m.Subject, &m.Body, &m.HTML, &m.Status, &m.Attempts, &m.NextAttemptAt, &m.LastError, &m.CreatedAt, &m.SentAt)
+	return m, err
+}
+
+func getEmail(id int64) (EmailMessage, error) {
+	return scanEmail(db.QueryRow("SELECT "+emailColumns+" FROM email_queue WHERE id = ?", id))
+}
+
+// getEmails lists queued email, newest first, optionally only with the
+// given status.
+func getEmails(status string, limit int) ([]EmailMessage, error) {
+	query := "SELECT " + emailColumns + " FROM email_queue"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []EmailMessage{}
+	for rows.Next() {
+		m, err := scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, m)
+	}
+	return emails, rows.Err()
+}
+
+// emailRetryDelay is the wait before the next attempt after the given
+// number of failed attempts: one minute, doubling each time.
+func emailRetryDelay(attempts int) time.Duration {
+	return time.Minute << (attempts - 1)
+}
+
+// sendEmail makes one attempt at sending a queued email. A failure is
+// returned so the job is retried.
+func sendEmail(ctx context.Context, p EmailJob) error {
+	m, err := getEmail(p.EmailID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if m.Status != EmailNotSent {
+		return nil
+	}
+
+	m.Attempts++
+	sendErr := emailSender.Send(emailFrom, m)
+	if sendErr == nil {
+		_, err = db.Exec("UPDATE email_queue SET status = ?, attempts = ?, last_error = '', sent_at = ? WHERE id = ?",
+			EmailSent, m.Attempts, nowTimestamp(), m.ID)
+		return err
+	}
+
+	status := EmailNotSent
+	if m.Attempts >= maxEmailAttempts {
+		status = EmailError
+	}
+	next := time.Now().UTC().Add(emailRetryDelay(m.Attempts)).Format(timestampLayout)
+	_, err = db.Exec("UPDATE email_queue SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?",
+		status, m.Attempts, sendErr.Error(), next, m.ID)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("sending email %d to %s: %w", m.ID, m.To, sendErr)
+}
+
+// retryEmail puts a failed email back in the queue to be sent right away.
+func retryEmail(id int64) error {
+	result, err := db.Exec("UPDATE email_queue SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ? AND status = ?",
+		EmailNotSent, nowTimestamp(), id, EmailError)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = sendEmailJob.Enqueue(EmailJob{EmailID: id})
+	return err
+}
+
+func apiListEmails(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	emails, err := getEmails(r.URL.Query().Get("status"), limit)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, emails)
+}
+
+func apiRetryEmail(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	err = retryEmail(id)
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "Email not found or not failed")
+		return
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	m, err := getEmail(id)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, m)
+}
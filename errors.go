@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Error codes sent in API error responses. Clients should branch on the
+// code rather than on the message.
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeValidation       = "validation_failed"
+	ErrCodeNotFound         = "not_found"
+	ErrCodePermissionDenied = "permission_denied"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodeDuplicate        = "duplicate"
+	ErrCodeUnsupportedMedia = "unsupported_media_type"
+	ErrCodeInternal         = "internal_error"
+)
+
+// NotFoundError reports that a record does not exist.
+type NotFoundError struct {
+	What string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.What + " not found"
+}
+
+// PermissionError reports that the user may not do what was asked.
+type PermissionError struct {
+	Message string
+}
+
+func (e *PermissionError) Error() string {
+	if e.Message == "" {
+		return "permission denied"
+	}
+	return e.Message
+}
+
+// ConflictError reports a write that does not fit the current state of the
+// record, such as a failed precondition.
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// DuplicateError reports a write that would store a second record with
+// values that must be unique.
+type DuplicateError struct {
+	Message string
+}
+
+func (e *DuplicateError) Error() string {
+	if e.Message == "" {
+		return "a record with the same values already exists"
+	}
+	return e.Message
+}
+
+// APIError is the body of every error response from the API.
+type APIError struct {
+	Error     string            `json:"error"`
+	Code      string            `json:"code"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// errorStatus returns the HTTP status and error code for an error from the
+// model layer, or 0 if the error is of no known kind.
+func errorStatus(err error) (int, string) {
+	var validationErr *ValidationError
+	var notFoundErr *NotFoundError
+	var permissionErr *PermissionError
+	var conflictErr *ConflictError
+	var duplicateErr *DuplicateError
+	var sqliteErr sqlite3.Error
+
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest, ErrCodeValidation
+	case errors.As(err, &notFoundErr), errors.Is(err, sql.ErrNoRows):
+		return http.StatusNotFound, ErrCodeNotFound
+	case errors.As(err, &permissionErr):
+		return http.StatusForbidden, ErrCodePermissionDenied
+	case errors.As(err, &conflictErr):
+		return http.StatusConflict, ErrCodeConflict
+	case errors.As(err, &duplicateErr):
+		return http.StatusConflict, ErrCodeDuplicate
+	case errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey):
+		return http.StatusConflict, ErrCodeDuplicate
+	}
+	return 0, ""
+}
+
+// statusForError returns the HTTP status for an error, or status if the
+// error is of no known kind.
+func statusForError(err error, status int) int {
+	if s, _ := errorStatus(err); s != 0 {
+		return s
+	}
+	return status
+}
+
+// errorCodeForStatus returns the error code sent with a status when the
+// handler gives only a status.
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodePermissionDenied
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	case http.StatusConflict:
+		return ErrCodeConflict
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupportedMedia
+	}
+	if status >= http.StatusInternalServerError {
+		return ErrCodeInternal
+	}
+	return ErrCodeBadRequest
+}
+
+// newAPIError builds the error body for a response, tagged with the ID of
+// the request being answered.
+func newAPIError(w http.ResponseWriter, status int, message string) APIError {
+	return APIError{
+		Error:     message,
+		Code:      errorCodeForStatus(status),
+		RequestID: w.Header().Get(requestIDHeader),
+	}
+}
+
+// apiErrorFor builds the error response for an error. Errors of a known
+// kind get their own status and code, and others the given status. The
+// details of internal errors are logged rather than sent, since they can
+// contain SQL.
+func apiErrorFor(w http.ResponseWriter, status int, err error) (int, APIError) {
+	body := newAPIError(w, status, err.Error())
+	if s, code := errorStatus(err); s != 0 {
+		status = s
+		body.Code = code
+	}
+
+	var validationErr *ValidationError
+	var duplicateErr *DuplicateError
+	switch {
+	case errors.As(err, &validationErr):
+		body.Fields = validationErr.Fields
+	case body.Code == ErrCodeDuplicate && !errors.As(err, &duplicateErr):
+		// A constraint failure from SQLite names the table and columns
+		body.Error = (&DuplicateError{}).Error()
+	case body.Code == ErrCodeInternal:
+		log.Printf("API error (request %s): %v", body.RequestID, err)
+		body.Error = "Internal server error"
+	}
+	return status, body
+}
+
+// RespondAPIError sends the error response for an error, using status for
+// errors of no known kind.
+func RespondAPIError(w http.ResponseWriter, status int, err error) {
+	status, body := apiErrorFor(w, status, err)
+	RespondJSON(w, status, body)
+}
+
+// apiNotFoundHandler answers requests for API paths that do not exist.
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	RespondError(w, http.StatusNotFound, "No such API endpoint")
+}
+
+// apiMethodNotAllowedHandler answers API requests with an unsupported
+// method.
+func apiMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	RespondError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
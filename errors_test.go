@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIErrorResponses(t *testing.T) {
+	userKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title", Required: true})
+	hidden := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/documents/%s/%d", dt.Name, doc.ID)
+	report := fmt.Sprintf(`{"name": %q, "doctype": %q}`, uniqueName("Report"), dt.Name)
+	expectStatus(t, apiRequest(t, "POST", "/api/reports", userKey, report), http.StatusCreated)
+
+	tests := []struct {
+		name         string
+		method, path string
+		key, body    string
+		status       int
+		code         string
+	}{
+		{"no login", "GET", path, "", "", http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"unknown key", "GET", path, "fgk_unknown", "", http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"no permission", "GET", "/api/documents/" + hidden.Name, userKey, "", http.StatusForbidden, ErrCodePermissionDenied},
+		{"no permission to write", "POST", "/api/documents", userKey, fmt.Sprintf(`{"doctype_name": %q, "data": {}}`, hidden.Name), http.StatusForbidden, ErrCodePermissionDenied},
+		{"missing document", "GET", fmt.Sprintf("/api/documents/%s/0", dt.Name), userKey, "", http.StatusNotFound, ErrCodeNotFound},
+		{"missing doctype", "GET", "/api/documents/NoSuchDoctype/1", userKey, "", http.StatusNotFound, ErrCodeNotFound},
+		{"missing required field", "POST", "/api/documents", userKey, fmt.Sprintf(`{"doctype_name": %q, "data": {}}`, dt.Name), http.StatusBadRequest, ErrCodeValidation},
+		{"failed patch test", "PATCH", path, userKey, `[{"op": "test", "path": "/data/title", "value": "b"}]`, http.StatusConflict, ErrCodeConflict},
+		{"duplicate report", "POST", "/api/reports", userKey, report, http.StatusConflict, ErrCodeDuplicate},
+		{"bad JSON", "POST", "/api/documents", userKey, "{", http.StatusBadRequest, ErrCodeBadRequest},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newAPIRequest(tt.method, tt.path, tt.key, tt.body)
+			req.Header.Set(requestIDHeader, fmt.Sprintf("test-%d", i))
+			if tt.method == "PATCH" {
+				req.Header.Set("Content-Type", jsonPatchContentType)
+			}
+			w := serveAPIRequest(req)
+			expectStatus(t, w, tt.status)
+
+			var body APIError
+			err := json.Unmarshal(w.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatalf("body %q is not an error envelope: %v", w.Body.String(), err)
+			}
+			if body.Code != tt.code {
+				t.Errorf("code = %q, want %q", body.Code, tt.code)
+			}
+			if body.Error == "" {
+				t.Error("no error message")
+			}
+			if id := w.Header().Get(requestIDHeader); id != req.Header.Get(requestIDHeader) || body.RequestID != id {
+				t.Errorf("request_id = %q, header %q, want %q", body.RequestID, id, req.Header.Get(requestIDHeader))
+			}
+			if tt.code == ErrCodeValidation && body.Fields["title"] == "" {
+				t.Errorf("fields = %v, want an error for title", body.Fields)
+			}
+		})
+	}
+}
+
+// expectAPIError checks the status and error code of an API response.
+func expectAPIError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	expectStatus(t, w, status)
+	var body APIError
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil || body.Code != code {
+		t.Errorf("body = %s, want code %q", w.Body.String(), code)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// exportFormats maps each export format to its content type.
+var exportFormats = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"xlsx":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+}
+
+// exportRowWriter writes exported documents in one of the export formats.
+type exportRowWriter interface {
+	WriteHeader(fields []Field) error
+	WriteDocument(doc Document) error
+	Close() error
+}
+
+func newExportRowWriter(format string, w io.Writer, sheetName string) (exportRowWriter, error) {
+	switch format {
+	case "csv":
+		return &csvExportWriter{cw: csv.NewWriter(w)}, nil
+	case "xlsx":
+		xw, err := newXLSXWriter(w, sheetName)
+		if err != nil {
+			return nil, err
+		}
+		return &xlsxExportWriter{xw: xw}, nil
+	case "json":
+		return &jsonExportWriter{w: w, array: true}, nil
+	case "ndjson":
+		return &jsonExportWriter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+// exportValue converts a scanned column value to a printable value.
+func exportValue(value interface{}) interface{} {
+	if raw, ok := value.([]byte); ok {
+		return string(raw)
+	}
+	return value
+}
+
+type csvExportWriter struct {
+	cw     *csv.Writer
+	fields []Field
+}
+
+func (c *csvExportWriter) WriteHeader(fields []Field) error {
+	c.fields = fields
+	header := []string{"id"}
+	for _, field := range fields {
+		header = append(header, field.Name)
+	}
+	return c.cw.Write(header)
+}
+
+func (c *csvExportWriter) WriteDocument(doc Document) error {
+	record := []string{fmt.Sprint(doc.ID)}
+	for _, field := range c.fields {
+		value := exportValue(doc.Data[field.Name])
+		if value == nil {
+			record = append(record, "")
+		} else {
+			record = append(record, fmt.Sprint(value))
+		}
+	}
+	return c.cw.Write(record)
+}
+
+func (c *csvExportWriter) Close() error {
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+type xlsxExportWriter struct {
+	xw     *xlsxWriter
+	fields []Field
+}
+
+func (x *xlsxExportWriter) WriteHeader(fields []Field) error {
+	x.fields = fields
+	header := []interface{}{"id"}
+	for _, field := range fields {
+		header = append(header, field.Name)
+	}
+	return x.xw.WriteRow(header)
+}
+
+func (x *xlsxExportWriter) WriteDocument(doc Document) error {
+	row := []interface{}{doc.ID}
+	for _, field := range x.fields {
+		row = append(row, exportValue(doc.Data[field.Name]))
+	}
+	return x.xw.WriteRow(row)
+}
+
+func (x *xlsxExportWriter) Close() error {
+	return x.xw.Close()
+}
+
+// jsonExportWriter writes flat objects, either as one JSON array or as
+// newline delimited JSON.
+type jsonExportWriter struct {
+	w      io.Writer
+	array  bool
+	fields []Field
+	count  int
+}
+
+func (j *jsonExportWriter) WriteHeader(fields []Field) error {
+	j.fields = fields
+	if j.array {
+		_, err := io.WriteString(j.w, "[")
+		return err
+	}
+	return nil
+}
+
+func (j *jsonExportWriter) WriteDocument(doc Document) error {
+	row := map[string]interface{}{"id": doc.ID}
+	for _, field := range j.fields {
+		row[field.Name] = exportValue(doc.Data[field.Name])
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	if j.array && j.count > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.count++
+
+	if _, err := j.w.Write(data); err != nil {
+		return err
+	}
+	if !j.array {
+		_, err = io.WriteString(j.w, "\n")
+	}
+	return err
+}
+
+func (j *jsonExportWriter) Close() error {
+	if j.array {
+		_, err := io.WriteString(j.w, "]")
+		return err
+	}
+	return nil
+}
+
+// exportDocuments streams the matching documents of a doctype to w.
+func exportDocuments(w io.Writer, format string, doctype Doctype, fields []Field, filters []Filter) error {
+	rw, err := newExportRowWriter(format, w, doctype.Name)
+	if err != nil {
+		return err
+	}
+
+	err = rw.WriteHeader(fields)
+	if err != nil {
+		return err
+	}
+
+	err = streamDocuments(doctype, fields, filters, rw.WriteDocument)
+	if err != nil {
+		return err
+	}
+
+	return rw.Close()
+}
+
+// exportTable writes rows with the given column names in one of the export
+// formats. It is used for report results, which are not documents.
+func exportTable(w io.Writer, format, sheetName string, columns []string, rows [][]interface{}) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(columns); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			record := make([]string, len(row))
+			for i, value := range row {
+				if value = exportValue(value); value != nil {
+					record[i] = fmt.Sprint(value)
+				}
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case "xlsx":
+		xw, err := newXLSXWriter(w, sheetName)
+		if err != nil {
+			return err
+		}
+		header := make([]interface{}, len(columns))
+		for i, c := range columns {
+			header[i] = c
+		}
+		if err := xw.WriteRow(header); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			values := make([]interface{}, len(row))
+			for i, value := range row {
+				values[i] = exportValue(value)
+			}
+			if err := xw.WriteRow(values); err != nil {
+				return err
+			}
+		}
+		return xw.Close()
+	case "json", "ndjson":
+		objects := make([]map[string]interface{}, len(rows))
+		for n, row := range rows {
+			objects[n] = make(map[string]interface{}, len(columns))
+			for i, c := range columns {
+				objects[n][c] = exportValue(row[i])
+			}
+		}
+		enc := json.NewEncoder(w)
+		if format == "json" {
+			return enc.Encode(objects)
+		}
+		for _, obj := range objects {
+			if err := enc.Encode(obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+func apiExportDocuments(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["doctype"]
+	query := r.URL.Query()
+
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		RespondAPIError(w, http.StatusForbidden, &PermissionError{})
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		RespondError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported format %q", format))
+		return
+	}
+
+	var names []string
+	if f := query.Get("fields"); f != "" {
+		names = strings.Split(f, ",")
+	}
+	fields, err := resolveFields(doctype, names)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	filters, err := parseFilters(query.Get("filters"))
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	// Check the filters before any of the response has been written
+	if _, _, err := buildWhereClause(doctype, filters); err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", doctype.Name, format))
+
+	bw := bufio.NewWriter(w)
+	err = exportDocuments(bw, format, doctype, fields, filters)
+	if err != nil {
+		// Headers are already sent, so all we can do is log and stop
+		log.Printf("Error exporting %s: %v", doctype.Name, err)
+		return
+	}
+	bw.Flush()
+}
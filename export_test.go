@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStreamDocumentsInPages(t *testing.T) {
+	defer func(size int) { streamPageSize = size }(streamPageSize)
+	streamPageSize = 3
+
+	dt := createTestDoctype(t, nil, Field{Name: "n", Type: "integer", Label: "N"})
+	var ids []int
+	for i := 0; i < 8; i++ {
+		doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"n": i}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+
+	// Writes while streaming must not wait for the stream to finish
+	var got []int
+	err := streamDocuments(dt, dt.Fields, []Filter{{Field: "n", Operator: "!=", Value: 4}}, func(doc Document) error {
+		got = append(got, doc.ID)
+		return updateDocument(&Document{ID: doc.ID, DoctypeName: dt.Name, Data: map[string]interface{}{"n": 100}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]int{}, ids[:4]...), ids[5:]...)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("streamed %v, want %v", got, want)
+	}
+}
+
+func TestXLSXSheetName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Task", "Task"},
+		{"Sales Invoice Item Tax Template Detail", "Sales Invoice Item Tax Template"},
+		{"Q1/Q2 [draft]: *?", "Q1_Q2 _draft__ __"},
+		{"'quoted'", "quoted"},
+		{"", "Sheet1"},
+	}
+	for _, tt := range tests {
+		got := xlsxSheetName(tt.name)
+		if got != tt.want {
+			t.Errorf("xlsxSheetName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if n := len([]rune(got)); n > 31 {
+			t.Errorf("xlsxSheetName(%q) has %d characters", tt.name, n)
+		}
+	}
+
+	var buf bytes.Buffer
+	xw, err := newXLSXWriter(&buf, strings.Repeat("x", 40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.WriteRow([]interface{}{"a", 1})
+	err = xw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "xl/workbook.xml" {
+			continue
+		}
+		rc, _ := f.Open()
+		workbook, _ := io.ReadAll(rc)
+		rc.Close()
+		if !strings.Contains(string(workbook), `name="`+strings.Repeat("x", 31)+`"`) {
+			t.Errorf("workbook.xml = %s, want a 31 character sheet name", workbook)
+		}
+	}
+	rows, err := readXLSX(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(rows) != 1 || rows[0][0] != "a" {
+		t.Errorf("readXLSX = %v, %v; want one row", rows, err)
+	}
+}
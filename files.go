@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxUploadSize is the largest file accepted for upload.
+const maxUploadSize = 10 << 20
+
+// File is an uploaded file, optionally attached to a document.
+type File struct {
+	ID                int64  `json:"id"`
+	Filename          string `json:"filename"`
+	Size              int64  `json:"size"`
+	ContentType       string `json:"content_type"`
+	Hash              string `json:"hash"`
+	Owner             string `json:"owner"`
+	AttachedToDoctype string `json:"attached_to_doctype"`
+	AttachedToID      int    `json:"attached_to_id"`
+	AttachedToField   string `json:"attached_to_field"`
+	Storage           string `json:"storage"`
+	StorageKey        string `json:"-"`
+	CreatedAt         string `json:"created_at"`
+}
+
+// URL is where the file can be downloaded.
+func (f File) URL() string {
+	return fmt.Sprintf("/files/%d/%s", f.ID, f.Filename)
+}
+
+// IsImage reports whether the file has an image content type.
+func (f File) IsImage() bool {
+	return strings.HasPrefix(f.ContentType, "image/")
+}
+
+func init() {
+	registerDocumentHook(fileCleanupHook)
+}
+
+func createFileTables() error {
+	createFilesTable := `
+	CREATE TABLE IF NOT EXISTS files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		owner TEXT NOT NULL DEFAULT '',
+		attached_to_doctype TEXT NOT NULL DEFAULT '',
+		attached_to_id INTEGER NOT NULL DEFAULT 0,
+		attached_to_field TEXT NOT NULL DEFAULT '',
+		storage TEXT NOT NULL,
+		storage_key TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createFilesTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_files_attached_to ON files (attached_to_doctype, attached_to_id)")
+	return err
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeFilename keeps uploaded names safe to use in storage keys and
+// download headers.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	name = strings.Trim(name, "._")
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
+
+func newStorageKey(filename string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().Format("2006/01") + "/" + hex.EncodeToString(b) + "-" + filename, nil
+}
+
+// saveUploadedFile stores the upload with the configured storage backend and
+// records it in the files table.
+func saveUploadedFile(upload multipart.File, header *multipart.FileHeader, owner string, imageOnly bool) (*File, error) {
+	if header.Size > maxUploadSize {
+		return nil, fmt.Errorf("file is larger than %d MB", maxUploadSize>>20)
+	}
+
+	// Detect the content type from the data rather than trusting the client
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(upload, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	contentType := http.DetectContentType(sniff[:n])
+	if _, err := upload.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if imageOnly && !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("%s is not an image", header.Filename)
+	}
+
+	f := &File{
+		Filename:    sanitizeFilename(header.Filename),
+		Size:        header.Size,
+		ContentType: contentType,
+		Owner:       owner,
+		Storage:     fileStorage.Name(),
+		CreatedAt:   time.Now().Format(time.RFC3339),
+	}
+	f.StorageKey, err = newStorageKey(f.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	err = fileStorage.Put(f.StorageKey, io.TeeReader(upload, hash), header.Size, contentType)
+	if err != nil {
+		return nil, err
+	}
+	f.Hash = hex.EncodeToString(hash.Sum(nil))
+
+	result, err := db.Exec(`INSERT INTO files (filename, size, content_type, hash, owner, storage, storage_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		f.Filename, f.Size, f.ContentType, f.Hash, f.Owner, f.Storage, f.StorageKey, f.CreatedAt)
+	if err != nil {
+		fileStorage.Delete(f.StorageKey)
+		return nil, err
+	}
+
+	f.ID, err = result.LastInsertId()
+	return f, err
+}
+
+// attachFile links a stored file to a document and optionally one of its
+// attach fields.
+func attachFile(fileID int64, doctypeName string, docID int, field string) error {
+	_, err := db.Exec("UPDATE files SET attached_to_doctype = ?, attached_to_id = ?, attached_to_field = ? WHERE id = ?",
+		doctypeName, docID, field, fileID)
+	return err
+}
+
+const fileColumns = `id, filename, size, content_type, hash, owner, attached_to_doctype, attached_to_id,
+	attached_to_field, storage, storage_key, created_at`
+
+func scanFile(scanner interface{ Scan(...interface{}) error }) (File, error) {
+	var f File
+	err := scanner.Scan(&f.ID, &f.Filename, &f.Size, &f.ContentType, &f.Hash, &f.Owner, &f.AttachedToDoctype,
+		&f.AttachedToID, &f.AttachedToField, &f.Storage, &f.StorageKey, &f.CreatedAt)
+	return f, err
+}
+
+func getFileByID(id int64) (File, error) {
+	f, err := scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return f, &NotFoundError{What: "file"}
+	}
+	return f, err
+}
+
+// getAttachments returns the files attached to a document.
+func getAttachments(doctypeName string, docID int) ([]File, error) {
+	rows, err := db.Query("SELECT "+fileColumns+" FROM files WHERE attached_to_doctype = ? AND attached_to_id = ? ORDER BY id",
+		doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+func storageFor(f File) (FileStorage, error) {
+	if fileStorage.Name() != f.Storage {
+		return nil, fmt.Errorf("file is kept in %s storage, which is not configured", f.Storage)
+	}
+	return fileStorage, nil
+}
+
+func deleteFile(f File) error {
+	storage, err := storageFor(f)
+	if err != nil {
+		return err
+	}
+	err = storage.Delete(f.StorageKey)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM files WHERE id = ?", f.ID)
+	return err
+}
+
+// fileCleanupHook removes the attachments of deleted documents.
+func fileCleanupHook(event string, doc *Document) error {
+	if event != DocEventDelete {
+		return nil
+	}
+
+	files, err := getAttachments(doc.DoctypeName, doc.ID)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := deleteFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canAccessFile reports whether the user may download or delete the file:
+// its owner, or anyone who can read the document it is attached to.
+func canAccessFile(user *Document, f File) bool {
+	if user == nil {
+		return false
+	}
+	if isAdminUser(user) || f.Owner == username(user) {
+		return true
+	}
+	if f.AttachedToDoctype == "" {
+		return false
+	}
+	doctype, err := getDoctypeByName(f.AttachedToDoctype)
+	if err != nil {
+		return false
+	}
+	return canReadDoctype(user, doctype)
+}
+
+func isAttachFieldType(fieldType string) bool {
+	return fieldType == "attach" || fieldType == "attach_image"
+}
+
+// saveAttachFields stores files uploaded for the attach fields of a document
+// form and sets the field values to their URLs. It returns the new files,
+// which still need attachFile once the document has an ID.
+func saveAttachFields(r *http.Request, doctype Doctype, doc *Document) ([]*File, error) {
+	var saved []*File
+	for _, field := range doctype.Fields {
+		if !isAttachFieldType(field.Type) {
+			continue
+		}
+		upload, header, err := r.FormFile(field.Name)
+		if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+			continue
+		}
+		if err != nil {
+			return saved, err
+		}
+
+		f, err := saveUploadedFile(upload, header, username(currentUser(r)), field.Type == "attach_image")
+		upload.Close()
+		if err != nil {
+			return saved, fmt.Errorf("%s: %v", field.Label, err)
+		}
+		f.AttachedToField = field.Name
+		doc.Data[field.Name] = f.URL()
+		saved = append(saved, f)
+	}
+	return saved, nil
+}
+
+// linkAttachFields attaches files saved by saveAttachFields to the document
+// once it has been written.
+func linkAttachFields(files []*File, doc *Document) error {
+	for _, f := range files {
+		err := attachFile(f.ID, doc.DoctypeName, doc.ID, f.AttachedToField)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardUploads removes files saved for a document write that failed.
+func discardUploads(files []*File) {
+	for _, f := range files {
+		if err := deleteFile(*f); err != nil {
+			log.Printf("Error discarding upload %d: %v", f.ID, err)
+		}
+	}
+}
+
+// parseDocumentForm parses a document form, which is multipart when the
+// doctype has attach fields.
+func parseDocumentForm(r *http.Request) error {
+	err := r.ParseMultipartForm(maxUploadSize)
+	if err == http.ErrNotMultipart {
+		return r.ParseForm()
+	}
+	return err
+}
+
+// loadFileForRequest returns the file named in the request URL, with the
+// HTTP status to respond with if it cannot be loaded.
+func loadFileForRequest(r *http.Request) (File, int, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return File{}, http.StatusBadRequest, fmt.Errorf("Invalid ID")
+	}
+	f, err := getFileByID(id)
+	if err != nil {
+		return f, http.StatusNotFound, err
+	}
+	if !canAccessFile(currentUser(r), f) {
+		return f, http.StatusForbidden, &PermissionError{Message: "Permission denied"}
+	}
+	return f, http.StatusOK, nil
+}
+
+func fileDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	f, status, err := loadFileForRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	storage, err := storageFor(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rc, err := storage.Get(f.StorageKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	disposition := "attachment"
+	if f.IsImage() || f.ContentType == "application/pdf" {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(f.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, f.Filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, rc)
+}
+
+// documentAttachmentsHandler handles the attachments panel on the document
+// form.
+func documentAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user := currentUser(r)
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	err = parseDocumentForm(r)
+	if err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if deleteID := r.FormValue("delete"); deleteID != "" {
+		fileID, _ := strconv.ParseInt(deleteID, 10, 64)
+		f, err := getFileByID(fileID)
+		if err != nil || f.AttachedToDoctype != name || f.AttachedToID != id {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		err = deleteFile(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		upload, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "No file uploaded", http.StatusBadRequest)
+			return
+		}
+		defer upload.Close()
+
+		f, err := saveUploadedFile(upload, header, username(user), false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = attachFile(f.ID, name, id, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/document/%d", name, id), http.StatusSeeOther)
+}
+
+func apiUploadFile(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	err := r.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Failed to parse upload: "+err.Error())
+		return
+	}
+
+	doctypeName := r.FormValue("doctype")
+	docID, _ := strconv.Atoi(r.FormValue("doc_id"))
+	fieldName := r.FormValue("field")
+	imageOnly := false
+
+	if doctypeName != "" {
+		doctype, err := getDoctypeByName(doctypeName)
+		if err != nil {
+			RespondError(w, http.StatusNotFound, "Doctype not found")
+			return
+		}
+		if !canReadDoctype(user, doctype) {
+			RespondError(w, http.StatusForbidden, "Permission denied")
+			return
+		}
+		if _, err := getDocumentByID(doctypeName, strconv.Itoa(docID)); err != nil {
+			RespondError(w, http.StatusNotFound, "Document not found")
+			return
+		}
+		if fieldName != "" {
+			field := getFieldByName(doctype.Fields, fieldName)
+			if field == nil || !isAttachFieldType(field.Type) {
+				RespondError(w, http.StatusBadRequest, fmt.Sprintf("%s is not an attach field", fieldName))
+				return
+			}
+			if !canEditField(user, doctype, *field) {
+				RespondAPIError(w, http.StatusForbidden, &PermissionError{Message: fmt.Sprintf("permission denied for field %q", fieldName)})
+				return
+			}
+			imageOnly = field.Type == "attach_image"
+		}
+	}
+
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "No file uploaded")
+		return
+	}
+	defer upload.Close()
+
+	f, err := saveUploadedFile(upload, header, username(user), imageOnly)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if doctypeName != "" {
+		f.AttachedToDoctype, f.AttachedToID, f.AttachedToField = doctypeName, docID, fieldName
+		err = attachFile(f.ID, doctypeName, docID, fieldName)
+		if err == nil && fieldName != "" {
+			err = updateDocument(&Document{
+				ID:          docID,
+				DoctypeName: doctypeName,
+				Data:        map[string]interface{}{fieldName: f.URL()},
+				ModifiedBy:  username(user),
+			})
+		}
+		if err != nil {
+			RespondAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	RespondJSON(w, http.StatusCreated, struct {
+		File
+		URL string `json:"url"`
+	}{*f, f.URL()})
+}
+
+func apiListFiles(w http.ResponseWriter, r *http.Request) {
+	doctypeName := r.URL.Query().Get("doctype")
+	docID, _ := strconv.Atoi(r.URL.Query().Get("doc_id"))
+
+	doctype, err := getDoctypeByName(doctypeName)
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(currentUser(r), doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	files, err := getAttachments(doctypeName, docID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, files)
+}
+
+func apiGetFile(w http.ResponseWriter, r *http.Request) {
+	f, status, err := loadFileForRequest(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, f)
+}
+
+func apiDeleteFile(w http.ResponseWriter, r *http.Request) {
+	f, status, err := loadFileForRequest(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	err = deleteFile(f)
+	if err != nil {
+		log.Printf("Error deleting file %d: %v", f.ID, err)
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,11 +2,12 @@ module frappe-go
 
 go 1.22.7
 
-require github.com/gorilla/mux v1.8.1
-
 require (
-	github.com/gorilla/securecookie v1.1.2 // indirect
-	github.com/gorilla/sessions v1.2.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.24 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/sessions v1.2.1
+	github.com/graphql-go/graphql v0.8.1
+	github.com/mattn/go-sqlite3 v1.14.24
+	golang.org/x/crypto v0.28.0
 )
+
+require github.com/gorilla/securecookie v1.1.2 // indirect
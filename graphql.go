@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// The GraphQL schema is built for each request from the doctypes the user
+// can read. Every doctype gets an object type with its fields, where link
+// fields resolve to the linked document and table fields to the child
+// rows, plus the document's comments, attachments, tags and assignments;
+// queries to get one document or list them with filters; and create,
+// update and delete mutations. All reads and writes go through the same
+// functions and permission checks as the REST API, and errors are returned
+// in the response's errors list.
+
+var graphQLNamePattern = regexp.MustCompile(`^[_A-Za-z][_A-Za-z0-9]*$`)
+
+// maxGraphQLDepth bounds how deeply the fields of a query may nest. Links
+// can point back at their own doctype, so without a bound a single query
+// could resolve any number of documents.
+const maxGraphQLDepth = 10
+
+type graphQLUserKey struct{}
+
+func graphQLUser(p graphql.ResolveParams) *Document {
+	user, _ := p.Context.Value(graphQLUserKey{}).(*Document)
+	return user
+}
+
+// graphQLScalar returns the GraphQL type of a field's values.
+func graphQLScalar(field Field) graphql.Output {
+	switch field.Type {
+	case "integer", "link":
+		return graphql.Int
+	case "float":
+		return graphql.Float
+	case "boolean":
+		return graphql.Boolean
+	}
+	return graphql.String
+}
+
+// graphQLFieldResolver returns a field's value from a document, converted
+// to the field type. Blank values resolve to null.
+func graphQLFieldResolver(field Field) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		doc, _ := p.Source.(Document)
+		value := exportValue(doc.Data[field.Name])
+		if isEmptyValue(value) {
+			return nil, nil
+		}
+		if isTextFieldType(field.Type) {
+			return fmt.Sprint(value), nil
+		}
+		return coerceFieldValue(field, value)
+	}
+}
+
+func graphQLDocumentID(p graphql.ResolveParams) (interface{}, error) {
+	doc, _ := p.Source.(Document)
+	return doc.ID, nil
+}
+
+var graphQLCommentType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "DocumentComment",
+	Fields: graphql.Fields{
+		"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"content":     &graphql.Field{Type: graphql.String},
+		"owner":       &graphql.Field{Type: graphql.String},
+		"created_at":  &graphql.Field{Type: graphql.String},
+		"modified_at": &graphql.Field{Type: graphql.String},
+	},
+})
+
+var graphQLAttachmentType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "DocumentAttachment",
+	Fields: graphql.Fields{
+		"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"filename":     &graphql.Field{Type: graphql.String},
+		"size":         &graphql.Field{Type: graphql.Int},
+		"content_type": &graphql.Field{Type: graphql.String},
+		"field": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(File).AttachedToField, nil
+			},
+		},
+		"url": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(File).URL(), nil
+			},
+		},
+	},
+})
+
+var graphQLAssignmentType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "DocumentAssignment",
+	Fields: graphql.Fields{
+		"user":        &graphql.Field{Type: graphql.String},
+		"assigned_by": &graphql.Field{Type: graphql.String},
+		"created_at":  &graphql.Field{Type: graphql.String},
+	},
+})
+
+var graphQLFilterType = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "DocumentFilter",
+	Description: "Compares a field to a value. Operators: " + strings.Join(reportFilterOperators, ", "),
+	Fields: graphql.InputObjectConfigFieldMap{
+		"field":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"operator": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		"value":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+	},
+})
+
+// graphQLRelatedFields returns the fields every document type has for the
+// records attached to a document.
+func graphQLRelatedFields() graphql.Fields {
+	return graphql.Fields{
+		"_comments": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLCommentType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				doc := p.Source.(Document)
+				return getComments(doc.DoctypeName, doc.ID)
+			},
+		},
+		"_attachments": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLAttachmentType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				doc := p.Source.(Document)
+				return getAttachments(doc.DoctypeName, doc.ID)
+			},
+		},
+		"_tags": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				doc := p.Source.(Document)
+				tags, err := getDocumentTags(doc.DoctypeName, doc.ID)
+				if err != nil {
+					return nil, err
+				}
+				names := make([]string, len(tags))
+				for i, t := range tags {
+					names[i] = t.Tag
+				}
+				return names, nil
+			},
+		},
+		"_assignments": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLAssignmentType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				doc := p.Source.(Document)
+				return getAssignments(doc.DoctypeName, doc.ID)
+			},
+		},
+	}
+}
+
+// buildGraphQLSchema builds the schema for the given doctypes. Doctypes and
+// fields whose names cannot be used in GraphQL are left out.
+func buildGraphQLSchema(doctypes []Doctype) (graphql.Schema, error) {
+	queries := graphql.Fields{
+		"doctypes": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+			Description: "Names of the doctypes in this schema",
+		},
+	}
+	mutations := graphql.Fields{}
+
+	// Make every object type before filling in any fields, since link and
+	// table fields refer to the types of other doctypes
+	names := []string{}
+	types := map[string]*graphql.Object{}
+	used := map[string]bool{
+		"DocumentComment": true, "DocumentAttachment": true,
+		"DocumentAssignment": true, "DocumentFilter": true,
+	}
+	for _, doctype := range doctypes {
+		name := openAPIName(doctype.Name)
+		if !graphQLNamePattern.MatchString(name) || used[name] || used[name+"Input"] {
+			continue
+		}
+		used[name] = true
+		used[name+"Input"] = true
+		names = append(names, doctype.Name)
+		types[doctype.Name] = graphql.NewObject(graphql.ObjectConfig{
+			Name:   name,
+			Fields: graphQLObjectFields(doctype, types),
+		})
+	}
+	for _, doctype := range doctypes {
+		if objectType := types[doctype.Name]; objectType != nil {
+			addGraphQLDoctype(doctype, objectType, queries, mutations)
+		}
+	}
+	queries["doctypes"].Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+		return names, nil
+	}
+
+	config := graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: queries}),
+	}
+	if len(mutations) > 0 {
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutations})
+	}
+	return graphql.NewSchema(config)
+}
+
+// graphQLObjectFields returns the fields of a doctype's object type. They
+// are made when the schema is checked, once types holds every doctype in
+// the schema. Link fields resolve to the linked document and table fields
+// to the list of child rows when the other doctype is in the schema, and
+// otherwise a link is just the ID and a table is left out.
+func graphQLObjectFields(doctype Doctype, types map[string]*graphql.Object) graphql.FieldsThunk {
+	return func() graphql.Fields {
+		fields := graphQLRelatedFields()
+		fields["id"] = &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: graphQLDocumentID}
+		for _, field := range doctype.Fields {
+			if !graphQLNamePattern.MatchString(field.Name) || fields[field.Name] != nil || isSecretField(doctype.Name, field.Name) {
+				continue
+			}
+			f := &graphql.Field{
+				Type:        graphQLScalar(field),
+				Description: field.Label,
+				Resolve:     graphQLFieldResolver(field),
+			}
+			target := types[field.Options]
+			switch {
+			case field.Type == "link" && target != nil:
+				f.Type = target
+				f.Resolve = graphQLLinkResolver(field)
+			case field.Type == "table" && target != nil:
+				f.Type = graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(target)))
+				f.Resolve = graphQLTableResolver(field)
+			case field.Type == "table":
+				continue
+			}
+			fields[field.Name] = f
+		}
+		return fields
+	}
+}
+
+// graphQLLinkResolver resolves a link field to the linked document, or
+// null if the link is blank or the document is gone.
+func graphQLLinkResolver(field Field) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		linked, err := getLinkedDocument(field, p.Source.(Document))
+		if err != nil || linked == nil {
+			return nil, err
+		}
+		return *linked, nil
+	}
+}
+
+// graphQLTableResolver resolves a table field to its child rows.
+func graphQLTableResolver(field Field) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return getChildDocuments(field, p.Source.(Document))
+	}
+}
+
+// addGraphQLDoctype adds the input type of a doctype and its queries and
+// mutations.
+func addGraphQLDoctype(doctype Doctype, objectType *graphql.Object, queries, mutations graphql.Fields) {
+	name := objectType.Name()
+	reserved := graphQLRelatedFields()
+	inputFields := graphql.InputObjectConfigFieldMap{}
+	for _, field := range doctype.Fields {
+		if !graphQLNamePattern.MatchString(field.Name) || reserved[field.Name] != nil || field.Name == "id" || field.Type == "table" {
+			continue
+		}
+		inputFields[field.Name] = &graphql.InputObjectFieldConfig{
+			Type:        graphQLScalar(field),
+			Description: field.Label,
+		}
+	}
+
+	queryName := strings.ToLower(name[:1]) + name[1:]
+
+	queries[queryName] = &graphql.Field{
+		Type:        objectType,
+		Description: "Get a " + doctype.Name + " document",
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			doc, err := readDocument(db, doctype, strconv.Itoa(p.Args["id"].(int)))
+			if err != nil {
+				return nil, err
+			}
+			return doc, nil
+		},
+	}
+	queries[queryName+"List"] = &graphql.Field{
+		Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(objectType))),
+		Description: "List " + doctype.Name + " documents",
+		Args: graphql.FieldConfigArgument{
+			"filters":  &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphQLFilterType))},
+			"order_by": &graphql.ArgumentConfig{Type: graphql.String},
+			"order":    &graphql.ArgumentConfig{Type: graphql.String},
+			"limit":    &graphql.ArgumentConfig{Type: graphql.Int},
+			"offset":   &graphql.ArgumentConfig{Type: graphql.Int},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			var filters []Filter
+			list, _ := p.Args["filters"].([]interface{})
+			for _, item := range list {
+				f := item.(map[string]interface{})
+				filter := Filter{Field: f["field"].(string), Operator: f["operator"].(string)}
+				if value, ok := f["value"]; ok {
+					filter.Value = value
+				}
+				filters = append(filters, filter)
+			}
+			orderBy, _ := p.Args["order_by"].(string)
+			order, _ := p.Args["order"].(string)
+			limit, _ := p.Args["limit"].(int)
+			offset, _ := p.Args["offset"].(int)
+			if limit < 0 || offset < 0 {
+				return nil, fmt.Errorf("limit and offset must be zero or more")
+			}
+
+			docs, _, err := listDocuments(doctype, visibleFields(doctype, doctype.Fields), filters, orderBy, order, pageSize(limit), offset)
+			return docs, err
+		},
+	}
+
+	if len(inputFields) == 0 {
+		return
+	}
+	inputType := graphql.NewInputObject(graphql.InputObjectConfig{Name: name + "Input", Fields: inputFields})
+
+	mutations["create"+name] = &graphql.Field{
+		Type:        objectType,
+		Description: "Create a " + doctype.Name + " document",
+		Args: graphql.FieldConfigArgument{
+			"data": &graphql.ArgumentConfig{Type: graphql.NewNonNull(inputType)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			user := graphQLUser(p)
+			data, err := graphQLMutationData(user, doctype, p.Args["data"])
+			if err != nil {
+				return nil, err
+			}
+			doc := Document{DoctypeName: doctype.Name, Data: data, ModifiedBy: username(user)}
+			err = createDocument(&doc)
+			if err != nil {
+				return nil, err
+			}
+			created, err := readDocument(db, doctype, strconv.Itoa(doc.ID))
+			if err != nil {
+				return nil, err
+			}
+			return created, nil
+		},
+	}
+	mutations["update"+name] = &graphql.Field{
+		Type:        objectType,
+		Description: "Change the given fields of a " + doctype.Name + " document",
+		Args: graphql.FieldConfigArgument{
+			"id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+			"data": &graphql.ArgumentConfig{Type: graphql.NewNonNull(inputType)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			user := graphQLUser(p)
+			id := strconv.Itoa(p.Args["id"].(int))
+			doc, err := readDocument(db, doctype, id)
+			if err != nil {
+				return nil, err
+			}
+			data, err := graphQLMutationData(user, doctype, p.Args["data"])
+			if err != nil {
+				return nil, err
+			}
+			err = updateDocument(&Document{ID: doc.ID, DoctypeName: doctype.Name, Data: data, ModifiedBy: username(user)})
+			if err != nil {
+				return nil, err
+			}
+			updated, err := readDocument(db, doctype, id)
+			if err != nil {
+				return nil, err
+			}
+			return updated, nil
+		},
+	}
+	mutations["delete"+name] = &graphql.Field{
+		Type:        graphql.Boolean,
+		Description: "Delete a " + doctype.Name + " document",
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			id := strconv.Itoa(p.Args["id"].(int))
+			_, err := readDocument(db, doctype, id)
+			if err != nil {
+				return nil, err
+			}
+			err = deleteDocument(doctype.Name, id)
+			if err != nil {
+				return nil, err
+			}
+			return true, nil
+		},
+	}
+}
+
+// graphQLMutationData returns the document data of a mutation's input,
+// checking the user may change every field it sets.
+func graphQLMutationData(user *Document, doctype Doctype, input interface{}) (map[string]interface{}, error) {
+	values, _ := input.(map[string]interface{})
+	data := map[string]interface{}{}
+	for name, value := range values {
+		field := getFieldByName(doctype.Fields, name)
+		if field == nil {
+			continue
+		}
+		if !canEditField(user, doctype, *field) {
+			return nil, &PermissionError{Message: fmt.Sprintf("permission denied for field %q", name)}
+		}
+		data[name] = value
+	}
+	return data, nil
+}
+
+// graphQLQueryDepth returns how deeply the fields of a query nest,
+// counting the fields selected through fragments. Each fragment's depth is
+// worked out once, and fragment cycles, which validation rejects, end the
+// count.
+func graphQLQueryDepth(doc *ast.Document) int {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	fragmentDepths := map[string]int{}
+	visiting := map[string]bool{}
+	var depth func(set *ast.SelectionSet) int
+	depth = func(set *ast.SelectionSet) int {
+		if set == nil {
+			return 0
+		}
+		deepest := 0
+		for _, selection := range set.Selections {
+			switch s := selection.(type) {
+			case *ast.Field:
+				deepest = max(deepest, 1+depth(s.SelectionSet))
+			case *ast.InlineFragment:
+				deepest = max(deepest, depth(s.SelectionSet))
+			case *ast.FragmentSpread:
+				name := s.Name.Value
+				d, ok := fragmentDepths[name]
+				if !ok && fragments[name] != nil && !visiting[name] {
+					visiting[name] = true
+					d = depth(fragments[name].SelectionSet)
+					delete(visiting, name)
+					fragmentDepths[name] = d
+				}
+				deepest = max(deepest, d)
+			}
+		}
+		return deepest
+	}
+
+	deepest := 0
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok {
+			deepest = max(deepest, depth(op.SelectionSet))
+		}
+	}
+	return deepest
+}
+
+// apiGraphQL runs a GraphQL query or mutation sent as
+// {"query": ..., "variables": {...}, "operationName": ...}.
+func apiGraphQL(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Login required")
+		return
+	}
+
+	var body struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(body.Query) == "" {
+		RespondError(w, http.StatusBadRequest, "query is required")
+		return
+	}
+	// Syntax errors are left for graphql.Do to report
+	if doc, err := parser.Parse(parser.ParseParams{Source: body.Query}); err == nil && graphQLQueryDepth(doc) > maxGraphQLDepth {
+		RespondError(w, http.StatusBadRequest, fmt.Sprintf("query is nested more than %d levels deep", maxGraphQLDepth))
+		return
+	}
+
+	doctypes, err := readableDoctypes(user)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	schema, err := buildGraphQLSchema(doctypes)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         schema,
+		RequestString:  body.Query,
+		VariableValues: body.Variables,
+		OperationName:  body.OperationName,
+		Context:        context.WithValue(r.Context(), graphQLUserKey{}, user),
+	})
+	RespondJSON(w, http.StatusOK, result)
+}
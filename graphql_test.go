@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// graphQLRequest runs a GraphQL query as the API key's user and returns
+// the decoded response.
+func graphQLRequest(t *testing.T, key, query string) (data map[string]interface{}, errs []map[string]interface{}) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"query": query})
+	w := apiRequest(t, "POST", "/api/graphql", key, string(body))
+	expectStatus(t, w, http.StatusOK)
+	var result struct {
+		Data   map[string]interface{}   `json:"data"`
+		Errors []map[string]interface{} `json:"errors"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.Data, result.Errors
+}
+
+func TestGraphQLRelations(t *testing.T) {
+	customer := createTestDoctype(t, nil, Field{Name: "name", Type: "string", Label: "Name"})
+	secret := createTestDoctype(t, []string{"HR"}, Field{Name: "name", Type: "string", Label: "Name"})
+	order := createTestDoctype(t, nil,
+		Field{Name: "customer", Type: "link", Label: "Customer", Options: customer.Name},
+		Field{Name: "account", Type: "link", Label: "Account", Options: secret.Name},
+	)
+	line := createTestDoctype(t, nil,
+		Field{Name: "parent_order", Type: "link", Label: "Order", Options: order.Name},
+		Field{Name: "item", Type: "string", Label: "Item"},
+	)
+	order.Fields = append(order.Fields, Field{Name: "lines", Type: "table", Label: "Lines", Options: line.Name})
+	err := updateDoctype(&order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Document{DoctypeName: customer.Name, Data: map[string]interface{}{"name": "Acme"}}
+	a := Document{DoctypeName: secret.Name, Data: map[string]interface{}{"name": "Hidden"}}
+	for _, doc := range []*Document{&c, &a} {
+		if err := createDocument(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := Document{DoctypeName: order.Name, Data: map[string]interface{}{"customer": c.ID, "account": a.ID}}
+	if err := createDocument(&o); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"bolts", "nuts"} {
+		l := Document{DoctypeName: line.Name, Data: map[string]interface{}{"parent_order": o.ID, "item": item}}
+		if err := createDocument(&l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+	queryName := strings.ToLower(order.Name[:1]) + order.Name[1:]
+	data, errs := graphQLRequest(t, key, fmt.Sprintf(
+		`{ %s(id: %d) { id customer { id name } account lines { item parent_order { id } } } }`, queryName, o.ID))
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+	got, _ := json.Marshal(data[queryName])
+	want := fmt.Sprintf(`{"account":%d,"customer":{"id":%d,"name":"Acme"},"id":%d,"lines":[{"item":"bolts","parent_order":{"id":%d}},{"item":"nuts","parent_order":{"id":%d}}]}`,
+		a.ID, c.ID, o.ID, o.ID, o.ID)
+	if string(got) != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestGraphQLReturnsErrors(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+	queryName := strings.ToLower(dt.Name[:1]) + dt.Name[1:]
+
+	data, errs := graphQLRequest(t, key, fmt.Sprintf(`{ %s(id: 999999) { id title } }`, queryName))
+	if len(errs) != 1 || !strings.Contains(fmt.Sprint(errs[0]["message"]), "not found") {
+		t.Errorf("errors = %v, want one not found error", errs)
+	}
+	if data[queryName] != nil {
+		t.Errorf("data = %v, want null", data[queryName])
+	}
+
+	_, errs = graphQLRequest(t, key, fmt.Sprintf(
+		`{ %sList(filters: [{field: "nope", operator: "=", value: "x"}]) { id } }`, queryName))
+	if len(errs) != 1 || !strings.Contains(fmt.Sprint(errs[0]["message"]), "unknown field") {
+		t.Errorf("errors = %v, want an unknown field error", errs)
+	}
+}
+
+func TestCheckFieldOptions(t *testing.T) {
+	parent := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	orphan := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+
+	tests := []struct {
+		name  string
+		field Field
+		ok    bool
+	}{
+		{"link", Field{Name: "f", Type: "link", Options: parent.Name}, true},
+		{"link to itself", Field{Name: "f", Type: "link", Options: "Self"}, true},
+		{"link without options", Field{Name: "f", Type: "link"}, false},
+		{"link to unknown doctype", Field{Name: "f", Type: "link", Options: "NoSuchDoctype"}, false},
+		{"table without a link back", Field{Name: "f", Type: "table", Options: orphan.Name}, false},
+		{"table of itself", Field{Name: "f", Type: "table", Options: "Self"}, false},
+	}
+	for _, tt := range tests {
+		err := checkFieldOptions(Doctype{Name: "Self", Fields: []Field{tt.field}})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestGraphQLQueryDepth(t *testing.T) {
+	tests := []struct {
+		query string
+		depth int
+	}{
+		{`{ a }`, 1},
+		{`{ a { b { c } } d }`, 3},
+		{`{ a { ... on T { b { c } } } }`, 3},
+		{`query { a { ...F } } fragment F on T { b { c } }`, 3},
+		{`{ a { ...F ...F } } fragment F on T { b { ...G } } fragment G on T { c }`, 3},
+		{`{ a { ...F } } fragment F on T { b { ...F } }`, 2},
+	}
+	for _, tt := range tests {
+		doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := graphQLQueryDepth(doc); got != tt.depth {
+			t.Errorf("%s: depth = %d, want %d", tt.query, got, tt.depth)
+		}
+	}
+}
+
+func TestGraphQLRejectsDeepQueries(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	dt.Fields = append(dt.Fields, Field{Name: "parent", Type: "link", Label: "Parent", Options: dt.Name})
+	err := updateDoctype(&dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+	queryName := strings.ToLower(dt.Name[:1]) + dt.Name[1:]
+
+	nested := func(depth int) string {
+		return "{ " + queryName + "List { " + strings.Repeat("parent { ", depth-2) + "id" + strings.Repeat(" }", depth-1) + " }"
+	}
+	if _, errs := graphQLRequest(t, key, nested(maxGraphQLDepth)); len(errs) > 0 {
+		t.Errorf("errors at the depth limit: %v", errs)
+	}
+	body, _ := json.Marshal(map[string]string{"query": nested(maxGraphQLDepth + 1)})
+	expectStatus(t, apiRequest(t, "POST", "/api/graphql", key, string(body)), http.StatusBadRequest)
+}
+
+func TestGraphQLListHidesSecrets(t *testing.T) {
+	user := createTestUser(t, "User", true)
+	data, errs := graphQLRequest(t, createTestAPIKey(t, user), `{ userList(limit: 1000) { id username } }`)
+	if len(errs) > 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+	got, _ := json.Marshal(data["userList"])
+	if !strings.Contains(string(got), fmt.Sprintf(`"username":%q`, username(user))) {
+		t.Errorf("userList = %s, want the user listed", got)
+	}
+}
@@ -48,9 +48,13 @@ type PageData struct {
 }
 
 type DocumentFormData struct {
-	Doctype  Doctype
-	Document *Document // Note the pointer here
-	IsNew    bool
+	Doctype     Doctype
+	Document    *Document // Note the pointer here
+	IsNew       bool
+	Attachments []File
+	Assignments []Assignment
+	Tags        []DocumentTag
+	Timeline    []TimelineEntry
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -81,6 +85,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		// Set user as authenticated
 		session.Values["authenticated"] = true
 		session.Values["user_id"] = user.ID
+		// Start the new session with a new CSRF token
+		delete(session.Values, csrfSessionKey)
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -96,15 +102,28 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Revoke users authentication
 	session.Values["authenticated"] = false
 	session.Values["user_id"] = nil
+	delete(session.Values, csrfSessionKey)
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
+	dashboards, err := getDashboardViews(currentUser(r), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	data := PageData{
-		Title:   "Home",
-		Content: "Welcome to the Frappe Framework",
+		Title: "Home",
+		Content: struct {
+			Message    string
+			Dashboards []DashboardView
+		}{
+			Message:    "Welcome to the Frappe Framework",
+			Dashboards: dashboards,
+		},
 	}
 	renderTemplate(w, r, "home.html", data)
 }
@@ -144,20 +163,28 @@ func doctypeNewHandler(w http.ResponseWriter, r *http.Request) {
 		fieldTypes := r.Form["field_type"]
 		fieldLabels := r.Form["field_label"]
 		fieldRequired := r.Form["field_required"]
+		fieldSearchable := r.Form["field_searchable"]
+		fieldInListView := r.Form["field_in_list_view"]
+		fieldOptions := r.Form["field_options"]
 
 		for i := range fieldNames {
 			field := Field{
-				Name:     fieldNames[i],
-				Type:     fieldTypes[i],
-				Label:    fieldLabels[i],
-				Required: len(fieldRequired) > i && fieldRequired[i] == "on",
+				Name:       fieldNames[i],
+				Type:       fieldTypes[i],
+				Label:      fieldLabels[i],
+				Required:   len(fieldRequired) > i && fieldRequired[i] == "on",
+				Searchable: len(fieldSearchable) > i && fieldSearchable[i] == "on",
+				InListView: len(fieldInListView) > i && fieldInListView[i] == "on",
+			}
+			if i < len(fieldOptions) {
+				field.Options = strings.TrimSpace(fieldOptions[i])
 			}
 			newDoctype.Fields = append(newDoctype.Fields, field)
 		}
 
 		err = createDoctype(&newDoctype)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
 			return
 		}
 
@@ -222,13 +249,19 @@ func doctypeEditHandler(w http.ResponseWriter, r *http.Request) {
 		doctype.Name = r.FormValue("name")
 		doctype.Fields = []Field{}
 		doctype.Permissions = r.Form["permissions"]
+		doctype.TitleField = r.FormValue("title_field")
+		doctype.SortField = r.FormValue("sort_field")
+		doctype.SortOrder = r.FormValue("sort_order")
 
 		fieldIDs := r.Form["field_id"]
 		fieldNames := r.Form["field_name"]
 		fieldTypes := r.Form["field_type"]
 		fieldLabels := r.Form["field_label"]
 		fieldRequired := r.Form["field_required"]
+		fieldSearchable := r.Form["field_searchable"]
+		fieldInListView := r.Form["field_in_list_view"]
 		fieldPermissions := r.Form["field_permissions"]
+		fieldOptions := r.Form["field_options"]
 
 		// Find the minimum length of all field-related slices
 		minLen := len(fieldNames)
@@ -258,11 +291,16 @@ func doctypeEditHandler(w http.ResponseWriter, r *http.Request) {
 				Type:        fieldTypes[i],
 				Label:       fieldLabels[i],
 				Required:    required,
+				Searchable:  contains(fieldSearchable, fieldNames[i]),
+				InListView:  contains(fieldInListView, fieldNames[i]),
 				Permissions: []string{},
 			}
 			if i < len(fieldPermissions) {
 				field.Permissions = strings.Fields(fieldPermissions[i])
 			}
+			if i < len(fieldOptions) {
+				field.Options = strings.TrimSpace(fieldOptions[i])
+			}
 			doctype.Fields = append(doctype.Fields, field)
 		}
 
@@ -272,12 +310,17 @@ func doctypeEditHandler(w http.ResponseWriter, r *http.Request) {
 		err = updateDoctype(&doctype)
 		if err != nil {
 			log.Printf("Error updating doctype: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
 			return
 		}
 
 		log.Println("Doctype updated successfully")
 
+		err = rebuildSearchIndex(doctype.Name)
+		if err != nil {
+			log.Printf("Error rebuilding search index: %v", err)
+		}
+
 		http.Redirect(w, r, "/doctypes", http.StatusSeeOther)
 		return
 	}
@@ -302,6 +345,23 @@ func getRoles() ([]string, error) {
 	return []string{"Admin", "User", "Guest"}, nil
 }
 
+// changedFields returns the posted fields whose values differ from the
+// stored ones. Forms post every field back, so only these are checked
+// against field permissions.
+func changedFields(posted, stored map[string]interface{}) map[string]interface{} {
+	changed := map[string]interface{}{}
+	for name, value := range posted {
+		old, ok := stored[name]
+		if !ok || old == nil {
+			old = ""
+		}
+		if fmt.Sprint(value) != fmt.Sprint(old) {
+			changed[name] = value
+		}
+	}
+	return changed
+}
+
 // Helper function to check if a slice contains a string
 func contains(slice []string, str string) bool {
 	for _, v := range slice {
@@ -312,30 +372,6 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
-func documentListHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
-
-	documents, err := getDocuments(name)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	data := PageData{
-		Title: name + " Documents",
-		Content: struct {
-			DoctypeName string
-			Documents   []Document
-		}{
-			DoctypeName: name,
-			Documents:   documents,
-		},
-	}
-
-	renderTemplate(w, r, "document_list.html", data)
-}
-
 func documentNewHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
@@ -345,6 +381,11 @@ func documentNewHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	user := currentUser(r)
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
 
 	doc := Document{
 		DoctypeName: name,
@@ -355,7 +396,7 @@ func documentNewHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
-		err := r.ParseForm()
+		err := parseDocumentForm(r)
 		if err != nil {
 			http.Error(w, "Failed to parse form", http.StatusBadRequest)
 			return
@@ -364,10 +405,21 @@ func documentNewHandler(w http.ResponseWriter, r *http.Request) {
 		for _, field := range doctype.Fields {
 			doc.Data[field.Name] = r.FormValue(field.Name)
 		}
+		doc.ModifiedBy = username(user)
 
-		err = createDocument(&doc)
+		uploads, err := saveAttachFields(r, doctype, &doc)
+		if err == nil {
+			err = checkDocumentWrite(user, doctype, changedFields(doc.Data, nil))
+		}
+		if err == nil {
+			err = createDocument(&doc)
+		}
+		if err == nil {
+			err = linkAttachFields(uploads, &doc)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			discardUploads(uploads)
+			http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
 			return
 		}
 
@@ -384,17 +436,7 @@ func documentNewHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	tmpl, err := template.ParseFiles("templates/base.html", "templates/document_form.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = tmpl.ExecuteTemplate(w, "base", data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	renderTemplate(w, r, "document_form.html", data)
 }
 
 func documentEditHandler(w http.ResponseWriter, r *http.Request) {
@@ -408,13 +450,19 @@ func documentEditHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user := currentUser(r)
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
 	isNew := id == "new"
 	var doc Document
 
 	if !isNew {
 		doc, err = getDocumentByID(name, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
 			return
 		}
 	} else {
@@ -428,23 +476,42 @@ func documentEditHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodPost {
-		err := r.ParseForm()
+		err := parseDocumentForm(r)
 		if err != nil {
 			http.Error(w, "Failed to parse form", http.StatusBadRequest)
 			return
 		}
 
+		// Only fields present in the form are changed, so a form that
+		// leaves a field out does not blank it
+		stored := doc.Data
+		if !isNew {
+			doc.Data = map[string]interface{}{}
+		}
 		for _, field := range doctype.Fields {
-			doc.Data[field.Name] = r.FormValue(field.Name)
+			if _, ok := r.PostForm[field.Name]; ok || isNew {
+				doc.Data[field.Name] = r.FormValue(field.Name)
+			}
 		}
+		doc.ModifiedBy = username(user)
 
-		if isNew {
-			err = createDocument(&doc)
-		} else {
-			err = updateDocument(&doc)
+		uploads, err := saveAttachFields(r, doctype, &doc)
+		if err == nil {
+			err = checkDocumentWrite(user, doctype, changedFields(doc.Data, stored))
+		}
+		if err == nil {
+			if isNew {
+				err = createDocument(&doc)
+			} else {
+				err = updateDocument(&doc)
+			}
+		}
+		if err == nil {
+			err = linkAttachFields(uploads, &doc)
 		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			discardUploads(uploads)
+			http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
 			return
 		}
 
@@ -457,23 +524,35 @@ func documentEditHandler(w http.ResponseWriter, r *http.Request) {
 		Document: &doc,
 		IsNew:    isNew,
 	}
+	if !isNew {
+		formData.Attachments, err = getAttachments(name, doc.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		formData.Assignments, err = getAssignments(name, doc.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		formData.Tags, err = getDocumentTags(name, doc.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		formData.Timeline, err = getTimeline(name, doc.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
 	data := PageData{
 		Title:   fmt.Sprintf("%s %s Document", map[bool]string{true: "New", false: "Edit"}[isNew], name),
 		Content: formData,
 	}
 
-	tmpl, err := template.ParseFiles("templates/base.html", "templates/document_form.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = tmpl.ExecuteTemplate(w, "base", data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	renderTemplate(w, r, "document_form.html", data)
 
 }
 
@@ -506,6 +585,11 @@ func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data in
 	}
 
 	dataMap["User"] = user
+	token := csrfToken(w, r, session)
+	dataMap["CSRFToken"] = token
+	if user != nil {
+		dataMap["UnreadNotifications"], _ = countUnreadNotifications(username(user))
+	}
 
 	buf := &bytes.Buffer{}
 	err := t.ExecuteTemplate(buf, "base", dataMap)
@@ -515,5 +599,5 @@ func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, data in
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	buf.WriteTo(w)
+	w.Write(injectCSRFToken(buf.Bytes(), token))
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+// Document events passed to document hooks.
+const (
+	DocEventInsert = "insert"
+	DocEventUpdate = "update"
+	DocEventDelete = "delete"
+	DocEventSubmit = "submit"
+	DocEventCancel = "cancel"
+)
+
+// Document status values. Doctypes with a docstatus field are submittable:
+// setting docstatus to 1 submits a draft and 2 cancels a submitted
+// document, which run the submit and cancel hooks after the update hooks.
+const (
+	DocStatusDraft     = 0
+	DocStatusSubmitted = 1
+	DocStatusCancelled = 2
+)
+
+// DocumentHook is called after a document has been written.
+type DocumentHook func(event string, doc *Document) error
+
+var documentHooks []DocumentHook
+
+// registerDocumentHook adds a hook that runs after every document write.
+func registerDocumentHook(hook DocumentHook) {
+	documentHooks = append(documentHooks, hook)
+}
+
+// runDocumentHooks calls the registered hooks. Hook failures are logged but
+// do not fail the write that triggered them.
+func runDocumentHooks(event string, doc *Document) {
+	for _, hook := range documentHooks {
+		if err := hook(event, doc); err != nil {
+			log.Printf("Document hook error (%s %s %d): %v", event, doc.DoctypeName, doc.ID, err)
+		}
+	}
+}
+
+// hookDocumentData returns the full stored data of the document a hook was
+// called for. Updates only carry the changed fields, and deleted documents
+// can no longer be read, so their data is used as is.
+func hookDocumentData(event string, doc *Document) (map[string]interface{}, error) {
+	if event == DocEventDelete {
+		return doc.Data, nil
+	}
+	stored, err := getDocumentByID(doc.DoctypeName, strconv.Itoa(doc.ID))
+	if err != nil {
+		return nil, err
+	}
+	return stored.Data, nil
+}
+
+// docStatusEvent returns the event for a change of docstatus, or "" if the
+// change is not a submit or cancel.
+func docStatusEvent(old, new interface{}) string {
+	from, to := docStatusValue(old), docStatusValue(new)
+	switch {
+	case from == DocStatusDraft && to == DocStatusSubmitted:
+		return DocEventSubmit
+	case from == DocStatusSubmitted && to == DocStatusCancelled:
+		return DocEventCancel
+	}
+	return ""
+}
+
+func docStatusValue(value interface{}) int {
+	switch v := value.(type) {
+	case int64:
+		return int(v)
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return DocStatusDraft
+}
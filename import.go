@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Data import modes
+const (
+	ImportModeInsert = "insert"
+	ImportModeUpdate = "update"
+)
+
+// Data import statuses
+const (
+	ImportStatusPending   = "Pending"
+	ImportStatusQueued    = "Queued"
+	ImportStatusRunning   = "Running"
+	ImportStatusCompleted = "Completed"
+	ImportStatusPartial   = "Completed with errors"
+	ImportStatusFailed    = "Failed"
+)
+
+const maxImportFileSize = 32 << 20
+
+// DataImport is an uploaded file being loaded into a doctype.
+type DataImport struct {
+	ID           int64             `json:"id"`
+	Doctype      string            `json:"doctype"`
+	Filename     string            `json:"filename"`
+	Mode         string            `json:"mode"`
+	KeyField     string            `json:"key_field"`
+	Status       string            `json:"status"`
+	Headers      []string          `json:"headers"`
+	Mapping      map[string]string `json:"mapping"`
+	TotalRows    int               `json:"total_rows"`
+	SuccessCount int               `json:"success_count"`
+	ErrorCount   int               `json:"error_count"`
+	CreatedBy    string            `json:"created_by"`
+	CreatedAt    string            `json:"created_at"`
+	FinishedAt   string            `json:"finished_at,omitempty"`
+}
+
+// DataImportJob is the payload of the background job that runs an import.
+type DataImportJob struct {
+	ImportID int64 `json:"import_id"`
+}
+
+// Imports are not safe to repeat, so they run once.
+var dataImportJob JobType[DataImportJob]
+
+func init() {
+	dataImportJob = defineJob("data_import", JobOptions{Queue: JobQueueLong, MaxAttempts: 1, Timeout: time.Hour}, runDataImport)
+}
+
+// DataImportLog records the outcome of a single imported row.
+type DataImportLog struct {
+	RowNumber int    `json:"row_number"`
+	DocID     int    `json:"doc_id,omitempty"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+}
+
+func createImportTables() error {
+	createImportTable := `
+	CREATE TABLE IF NOT EXISTS data_imports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		key_field TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		headers TEXT NOT NULL,
+		mapping TEXT NOT NULL DEFAULT '{}',
+		rows TEXT NOT NULL,
+		total_rows INTEGER NOT NULL DEFAULT 0,
+		success_count INTEGER NOT NULL DEFAULT 0,
+		error_count INTEGER NOT NULL DEFAULT 0,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		finished_at TEXT NOT NULL DEFAULT ''
+	);`
+
+	_, err := db.Exec(createImportTable)
+	if err != nil {
+		return err
+	}
+
+	createImportLogTable := `
+	CREATE TABLE IF NOT EXISTS data_import_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		import_id INTEGER NOT NULL,
+		row_number INTEGER NOT NULL,
+		doc_id INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (import_id) REFERENCES data_imports(id)
+	);`
+
+	_, err = db.Exec(createImportLogTable)
+	return err
+}
+
+// parseImportFile reads a CSV or XLSX upload into a header row and records.
+func parseImportFile(file multipart.File, header *multipart.FileHeader) ([]string, [][]string, error) {
+	var rows [][]string
+	var err error
+
+	switch strings.ToLower(filepath.Ext(header.Filename)) {
+	case ".csv":
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		rows, err = reader.ReadAll()
+	case ".xlsx":
+		var data []byte
+		data, err = io.ReadAll(file)
+		if err == nil {
+			rows, err = readXLSX(bytes.NewReader(data), int64(len(data)))
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported file type %q, upload a .csv or .xlsx file", filepath.Ext(header.Filename))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Drop blank lines, which spreadsheets often leave at the end
+	var records [][]string
+	for _, row := range rows {
+		if strings.TrimSpace(strings.Join(row, "")) != "" {
+			records = append(records, row)
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("the file is empty")
+	}
+
+	headers := records[0]
+	if len(headers) > 0 {
+		headers[0] = strings.TrimPrefix(headers[0], "\ufeff")
+	}
+	for i := range headers {
+		headers[i] = strings.TrimSpace(headers[i])
+	}
+
+	return headers, records[1:], nil
+}
+
+// guessImportMapping maps each column to the field whose name or label
+// matches the header.
+func guessImportMapping(doctype Doctype, headers []string) map[string]string {
+	mapping := make(map[string]string)
+	for _, h := range headers {
+		if strings.EqualFold(h, "id") {
+			mapping[h] = "id"
+			continue
+		}
+		for _, field := range doctype.Fields {
+			if strings.EqualFold(h, field.Name) || strings.EqualFold(h, field.Label) {
+				mapping[h] = field.Name
+				break
+			}
+		}
+	}
+	return mapping
+}
+
+func createDataImport(imp *DataImport, records [][]string) error {
+	headers, _ := json.Marshal(imp.Headers)
+	mapping, _ := json.Marshal(imp.Mapping)
+	rows, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	imp.TotalRows = len(records)
+	imp.CreatedAt = time.Now().Format(time.RFC3339)
+
+	result, err := db.Exec(`INSERT INTO data_imports
+		(doctype, filename, mode, key_field, status, headers, mapping, rows, total_rows, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		imp.Doctype, imp.Filename, imp.Mode, imp.KeyField, imp.Status, string(headers), string(mapping),
+		string(rows), imp.TotalRows, imp.CreatedBy, imp.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	imp.ID, err = result.LastInsertId()
+	return err
+}
+
+func getDataImport(id int64) (DataImport, error) {
+	var imp DataImport
+	var headers, mapping string
+	err := db.QueryRow(`SELECT id, doctype, filename, mode, key_field, status, headers, mapping,
+		total_rows, success_count, error_count, created_by, created_at, finished_at
+		FROM data_imports WHERE id = ?`, id).Scan(&imp.ID, &imp.Doctype, &imp.Filename, &imp.Mode,
+		&imp.KeyField, &imp.Status, &headers, &mapping, &imp.TotalRows, &imp.SuccessCount,
+		&imp.ErrorCount, &imp.CreatedBy, &imp.CreatedAt, &imp.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return imp, &NotFoundError{What: "import"}
+		}
+		return imp, err
+	}
+
+	json.Unmarshal([]byte(headers), &imp.Headers)
+	json.Unmarshal([]byte(mapping), &imp.Mapping)
+	return imp, nil
+}
+
+func getDataImportRows(id int64) ([][]string, error) {
+	var data string
+	err := db.QueryRow("SELECT rows FROM data_imports WHERE id = ?", id).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	err = json.Unmarshal([]byte(data), &rows)
+	return rows, err
+}
+
+func getDataImportLogs(id int64, failedOnly bool) ([]DataImportLog, error) {
+	query := "SELECT row_number, doc_id, status, message FROM data_import_logs WHERE import_id = ?"
+	if failedOnly {
+		query += " AND status = 'Error'"
+	}
+	query += " ORDER BY row_number"
+
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []DataImportLog
+	for rows.Next() {
+		var l DataImportLog
+		err := rows.Scan(&l.RowNumber, &l.DocID, &l.Status, &l.Message)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
+
+// checkDataImport checks that the mode, key field and column mapping of an
+// import name fields of the doctype, and that the user may edit every
+// mapped field.
+func checkDataImport(imp DataImport, doctype Doctype, user *Document) error {
+	if imp.Mode != ImportModeInsert && imp.Mode != ImportModeUpdate {
+		return &ValidationError{Fields: map[string]string{"mode": fmt.Sprintf("invalid mode %q", imp.Mode)}}
+	}
+	if imp.KeyField != "" && imp.KeyField != "id" && getFieldByName(doctype.Fields, imp.KeyField) == nil {
+		return &ValidationError{Fields: map[string]string{"key_field": fmt.Sprintf("unknown field %q", imp.KeyField)}}
+	}
+	if !canReadDoctype(user, doctype) {
+		return &PermissionError{}
+	}
+	for header, name := range imp.Mapping {
+		if name == "" || name == "id" {
+			continue
+		}
+		field := getFieldByName(doctype.Fields, name)
+		if field == nil {
+			return &ValidationError{Fields: map[string]string{"mapping": fmt.Sprintf("column %q maps to unknown field %q", header, name)}}
+		}
+		if !canEditField(user, doctype, *field) {
+			return &PermissionError{Message: fmt.Sprintf("permission denied for field %q", name)}
+		}
+	}
+	return nil
+}
+
+// startDataImport checks the import for the user, saves the column mapping
+// and runs the import in the background.
+func startDataImport(imp *DataImport, doctype Doctype, user *Document) error {
+	err := checkDataImport(*imp, doctype, user)
+	if err != nil {
+		return err
+	}
+
+	mapping, _ := json.Marshal(imp.Mapping)
+	imp.Status = ImportStatusQueued
+	_, err = db.Exec("UPDATE data_imports SET mapping = ?, mode = ?, key_field = ?, status = ? WHERE id = ?",
+		string(mapping), imp.Mode, imp.KeyField, imp.Status, imp.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = dataImportJob.Enqueue(DataImportJob{ImportID: imp.ID})
+	return err
+}
+
+func setDataImportProgress(id int64, status string, success, failed int, finished bool) {
+	finishedAt := ""
+	if finished {
+		finishedAt = time.Now().Format(time.RFC3339)
+	}
+	_, err := db.Exec("UPDATE data_imports SET status = ?, success_count = ?, error_count = ?, finished_at = ? WHERE id = ?",
+		status, success, failed, finishedAt, id)
+	if err != nil {
+		log.Printf("Error updating import %d: %v", id, err)
+	}
+}
+
+// runDataImport imports the rows of a queued import, stopping early if the
+// job times out.
+func runDataImport(ctx context.Context, p DataImportJob) error {
+	id := p.ImportID
+	imp, err := getDataImport(id)
+	if err != nil {
+		return err
+	}
+	records, err := getDataImportRows(id)
+	if err != nil {
+		setDataImportProgress(id, ImportStatusFailed, 0, 0, true)
+		return err
+	}
+
+	// Check the import again as its creator, whose permissions may have
+	// changed since it was queued
+	doctype, err := getDoctypeByName(imp.Doctype)
+	if err == nil {
+		var user Document
+		user, err = getUserByUsername(imp.CreatedBy)
+		if err == nil {
+			err = checkDataImport(imp, doctype, &user)
+		}
+	}
+	if err != nil {
+		setDataImportProgress(id, ImportStatusFailed, 0, 0, true)
+		return err
+	}
+
+	setDataImportProgress(id, ImportStatusRunning, 0, 0, false)
+
+	success, failed := 0, 0
+	for i, record := range records {
+		if ctx.Err() != nil {
+			setDataImportProgress(id, ImportStatusFailed, success, failed, true)
+			return ctx.Err()
+		}
+
+		// Row numbers match the spreadsheet, where row 1 is the header
+		rowNumber := i + 2
+
+		docID, err := importRow(imp, doctype, record)
+		entry := DataImportLog{RowNumber: rowNumber, DocID: docID, Status: "Success"}
+		if err != nil {
+			entry.Status = "Error"
+			entry.Message = err.Error()
+			failed++
+		} else {
+			success++
+		}
+
+		_, err = db.Exec("INSERT INTO data_import_logs (import_id, row_number, doc_id, status, message) VALUES (?, ?, ?, ?, ?)",
+			id, entry.RowNumber, entry.DocID, entry.Status, entry.Message)
+		if err != nil {
+			log.Printf("Error writing import log %d: %v", id, err)
+		}
+
+		if (i+1)%100 == 0 {
+			setDataImportProgress(id, ImportStatusRunning, success, failed, false)
+		}
+	}
+
+	status := ImportStatusCompleted
+	if failed > 0 && success == 0 {
+		status = ImportStatusFailed
+	} else if failed > 0 {
+		status = ImportStatusPartial
+	}
+	setDataImportProgress(id, status, success, failed, true)
+	return nil
+}
+
+// importRow writes one record and returns the ID of the document it created
+// or updated.
+func importRow(imp DataImport, doctype Doctype, record []string) (int, error) {
+	data := make(map[string]interface{})
+	keyValue := ""
+	for i, header := range imp.Headers {
+		field := imp.Mapping[header]
+		if field == "" || i >= len(record) {
+			continue
+		}
+		if field == "id" || field == imp.KeyField {
+			keyValue = strings.TrimSpace(record[i])
+		}
+		if field != "id" {
+			data[field] = record[i]
+		}
+	}
+
+	doc := Document{DoctypeName: imp.Doctype, Data: data, ModifiedBy: imp.CreatedBy}
+
+	if imp.Mode == ImportModeInsert {
+		err := createDocument(&doc)
+		return doc.ID, err
+	}
+
+	if keyValue == "" {
+		return 0, fmt.Errorf("missing value for key column %s", imp.KeyField)
+	}
+	id, err := findDocumentID(doctype, imp.KeyField, keyValue)
+	if err != nil {
+		return 0, err
+	}
+
+	doc.ID = id
+	err = updateDocument(&doc)
+	return doc.ID, err
+}
+
+// findDocumentID looks up the document whose key field holds the value.
+func findDocumentID(doctype Doctype, keyField, value string) (int, error) {
+	doctypeName := doctype.Name
+	if keyField == "" || keyField == "id" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid id %q", value)
+		}
+		_, err = getDocumentByID(doctypeName, value)
+		if err != nil {
+			return 0, fmt.Errorf("no %s with id %s", doctypeName, value)
+		}
+		return id, nil
+	}
+
+	// The key field is used as a column name, so it must be a field
+	if getFieldByName(doctype.Fields, keyField) == nil {
+		return 0, fmt.Errorf("unknown key field %q", keyField)
+	}
+
+	var ids []int
+	rows, err := db.Query(fmt.Sprintf("SELECT id FROM `%s` WHERE `%s` = ? LIMIT 2", doctypeName, keyField), value)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, fmt.Errorf("no %s with %s = %s", doctypeName, keyField, value)
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, fmt.Errorf("more than one %s with %s = %s", doctypeName, keyField, value)
+	}
+}
+
+// writeImportErrorReport writes the failed rows as CSV with their original
+// values and the error, so they can be fixed and uploaded again.
+func writeImportErrorReport(w io.Writer, imp DataImport) error {
+	records, err := getDataImportRows(imp.ID)
+	if err != nil {
+		return err
+	}
+	logs, err := getDataImportLogs(imp.ID, true)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	header := append([]string{"Row"}, imp.Headers...)
+	header = append(header, "Error")
+	cw.Write(header)
+
+	for _, l := range logs {
+		idx := l.RowNumber - 2
+		if idx < 0 || idx >= len(records) {
+			continue
+		}
+		line := []string{strconv.Itoa(l.RowNumber)}
+		line = append(line, records[idx]...)
+		for len(line) < len(imp.Headers)+1 {
+			line = append(line, "")
+		}
+		line = append(line, l.Message)
+		cw.Write(line)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// newDataImportFromRequest reads the uploaded file and import options from a
+// multipart form.
+func newDataImportFromRequest(r *http.Request, doctype Doctype) (*DataImport, [][]string, error) {
+	err := r.ParseMultipartForm(maxImportFileSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse upload: %v", err)
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil, fmt.Errorf("no file uploaded")
+	}
+	defer file.Close()
+
+	headers, records, err := parseImportFile(file, header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = ImportModeInsert
+	}
+	if mode != ImportModeInsert && mode != ImportModeUpdate {
+		return nil, nil, fmt.Errorf("invalid mode %q", mode)
+	}
+
+	keyField := r.FormValue("key_field")
+	if mode == ImportModeUpdate && keyField == "" {
+		keyField = "id"
+	}
+	if keyField != "" && keyField != "id" && getFieldByName(doctype.Fields, keyField) == nil {
+		return nil, nil, fmt.Errorf("unknown key field %q", keyField)
+	}
+
+	imp := &DataImport{
+		Doctype:  doctype.Name,
+		Filename: header.Filename,
+		Mode:     mode,
+		KeyField: keyField,
+		Status:   ImportStatusPending,
+		Headers:  headers,
+		Mapping:  guessImportMapping(doctype, headers),
+	}
+	imp.CreatedBy = username(currentUser(r))
+
+	return imp, records, nil
+}
+
+func loadImportForRequest(w http.ResponseWriter, r *http.Request) (DataImport, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return DataImport{}, false
+	}
+
+	imp, err := getDataImport(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return imp, false
+	}
+
+	doctype, err := getDoctypeByName(imp.Doctype)
+	if err != nil || !canReadDoctype(currentUser(r), doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return imp, false
+	}
+	return imp, true
+}
+
+func importNewHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canReadDoctype(currentUser(r), doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	var formError string
+	if r.Method == http.MethodPost {
+		imp, records, err := newDataImportFromRequest(r, doctype)
+		if err == nil {
+			err = createDataImport(imp, records)
+		}
+		if err == nil {
+			http.Redirect(w, r, fmt.Sprintf("/import/%d", imp.ID), http.StatusSeeOther)
+			return
+		}
+		formError = err.Error()
+	}
+
+	data := PageData{
+		Title: "Import " + name,
+		Content: struct {
+			Doctype Doctype
+			Error   string
+		}{
+			Doctype: doctype,
+			Error:   formError,
+		},
+	}
+	renderTemplate(w, r, "import_new.html", data)
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	imp, ok := loadImportForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	doctype, err := getDoctypeByName(imp.Doctype)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if imp.Status != ImportStatusPending {
+			http.Error(w, "Import has already been started", http.StatusConflict)
+			return
+		}
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		imp.Mapping = make(map[string]string)
+		for i, header := range imp.Headers {
+			field := r.FormValue(fmt.Sprintf("map_%d", i))
+			if field != "" {
+				imp.Mapping[header] = field
+			}
+		}
+		if mode := r.FormValue("mode"); mode == ImportModeInsert || mode == ImportModeUpdate {
+			imp.Mode = mode
+		}
+		imp.KeyField = r.FormValue("key_field")
+		if imp.Mode == ImportModeUpdate && imp.KeyField == "" {
+			imp.KeyField = "id"
+		}
+
+		err = startDataImport(&imp, doctype, currentUser(r))
+		if err != nil {
+			http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/import/%d", imp.ID), http.StatusSeeOther)
+		return
+	}
+
+	logs, err := getDataImportLogs(imp.ID, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Import " + imp.Filename,
+		Content: struct {
+			Import  DataImport
+			Doctype Doctype
+			Errors  []DataImportLog
+			Running bool
+		}{
+			Import:  imp,
+			Doctype: doctype,
+			Errors:  logs,
+			Running: imp.Status == ImportStatusQueued || imp.Status == ImportStatusRunning,
+		},
+	}
+	renderTemplate(w, r, "import.html", data)
+}
+
+func importReportHandler(w http.ResponseWriter, r *http.Request) {
+	imp, ok := loadImportForRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"import-%d-errors.csv\"", imp.ID))
+	err := writeImportErrorReport(w, imp)
+	if err != nil {
+		log.Printf("Error writing import report %d: %v", imp.ID, err)
+	}
+}
+
+func apiCreateImport(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["doctype"]
+
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(currentUser(r), doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	imp, records, err := newDataImportFromRequest(r, doctype)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// An explicit column mapping may be sent as JSON; otherwise headers are
+	// matched to fields by name or label
+	if m := r.FormValue("mapping"); m != "" {
+		imp.Mapping = make(map[string]string)
+		if err := json.Unmarshal([]byte(m), &imp.Mapping); err != nil {
+			RespondError(w, http.StatusBadRequest, "Invalid mapping: "+err.Error())
+			return
+		}
+	}
+
+	err = checkDataImport(*imp, doctype, currentUser(r))
+	if err == nil {
+		err = createDataImport(imp, records)
+	}
+	if err == nil {
+		err = startDataImport(imp, doctype, currentUser(r))
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusAccepted, imp)
+}
+
+func apiGetImport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	imp, err := getDataImport(id)
+	if err != nil {
+		RespondAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	doctype, err := getDoctypeByName(imp.Doctype)
+	if err != nil || !canReadDoctype(currentUser(r), doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	logs, err := getDataImportLogs(id, true)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusOK, struct {
+		DataImport
+		Errors []DataImportLog `json:"errors"`
+	}{imp, logs})
+}
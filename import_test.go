@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDataImport(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "code", Type: "string", Label: "Code"},
+		Field{Name: "salary", Type: "string", Label: "Salary", Permissions: []string{"HR"}},
+	)
+	user := createTestUser(t, "User", false)
+	hr := createTestUser(t, "HR", false)
+
+	tests := []struct {
+		name string
+		imp  DataImport
+		user *Document
+		want interface{}
+	}{
+		{"insert", DataImport{Mode: ImportModeInsert, Mapping: map[string]string{"Code": "code"}}, user, nil},
+		{"update by id", DataImport{Mode: ImportModeUpdate, KeyField: "id", Mapping: map[string]string{"ID": "id", "Code": "code"}}, user, nil},
+		{"update by field", DataImport{Mode: ImportModeUpdate, KeyField: "code", Mapping: map[string]string{"Code": "code"}}, user, nil},
+		{"bad mode", DataImport{Mode: "upsert"}, user, &ValidationError{}},
+		{"key field injection", DataImport{Mode: ImportModeUpdate, KeyField: "code` = '' OR 1=1 --"}, user, &ValidationError{}},
+		{"unknown mapped field", DataImport{Mode: ImportModeInsert, Mapping: map[string]string{"X": "code`, `id"}}, user, &ValidationError{}},
+		{"restricted field", DataImport{Mode: ImportModeInsert, Mapping: map[string]string{"Salary": "salary"}}, user, &PermissionError{}},
+		{"restricted field with role", DataImport{Mode: ImportModeInsert, Mapping: map[string]string{"Salary": "salary"}}, hr, nil},
+		{"not logged in", DataImport{Mode: ImportModeInsert}, nil, &PermissionError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDataImport(tt.imp, dt, tt.user)
+			switch want := tt.want.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("err = %v, want nil", err)
+				}
+			case *ValidationError:
+				if !errors.As(err, &want) {
+					t.Errorf("err = %v, want a validation error", err)
+				}
+			case *PermissionError:
+				if !errors.As(err, &want) {
+					t.Errorf("err = %v, want a permission error", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFindDocumentIDRejectsUnknownKeyField(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "code", Type: "string", Label: "Code"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"code": "A1"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := findDocumentID(dt, "code", "A1")
+	if err != nil || id != doc.ID {
+		t.Errorf("findDocumentID(code, A1) = %d, %v; want %d", id, err, doc.ID)
+	}
+	_, err = findDocumentID(dt, "code` = `code", "A1")
+	if err == nil {
+		t.Error("findDocumentID accepted a key field that is not a field")
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job statuses. Jobs that used up their attempts stay Failed, as a dead
+// letter queue, until an admin retries or deletes them.
+const (
+	JobQueued    = "Queued"
+	JobRunning   = "Running"
+	JobCompleted = "Completed"
+	JobFailed    = "Failed"
+)
+
+// Job queues
+const (
+	JobQueueDefault = "default"
+	JobQueueLong    = "long"
+)
+
+// JobOptions control how jobs of a type are queued and retried.
+type JobOptions struct {
+	Queue       string
+	Priority    int // Higher priority jobs run first
+	MaxAttempts int
+	Timeout     time.Duration
+	RetryDelay  func(attempt int) time.Duration
+	RunAt       time.Time
+}
+
+// defaultJobRetryDelay waits 10 seconds after the first failure, doubling
+// each time.
+func defaultJobRetryDelay(attempt int) time.Duration {
+	return 10 * time.Second << (attempt - 1)
+}
+
+func (o JobOptions) withDefaults() JobOptions {
+	if o.Queue == "" {
+		o.Queue = JobQueueDefault
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 3
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Minute
+	}
+	if o.RetryDelay == nil {
+		o.RetryDelay = defaultJobRetryDelay
+	}
+	return o
+}
+
+// Job is a unit of background work stored in the jobs table.
+type Job struct {
+	ID             int64  `json:"id"`
+	Queue          string `json:"queue"`
+	Type           string `json:"type"`
+	Payload        string `json:"payload"`
+	Priority       int    `json:"priority"`
+	Status         string `json:"status"`
+	Attempts       int    `json:"attempts"`
+	MaxAttempts    int    `json:"max_attempts"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	RunAt          string `json:"run_at"`
+	StartedAt      string `json:"started_at"`
+	FinishedAt     string `json:"finished_at"`
+	LastError      string `json:"last_error"`
+	CreatedAt      string `json:"created_at"`
+}
+
+type jobDefinition struct {
+	name    string
+	options JobOptions
+	run     func(ctx context.Context, payload []byte) error
+}
+
+var jobTypes = map[string]*jobDefinition{}
+
+// JobType enqueues jobs whose payload is a T.
+type JobType[T any] struct {
+	def *jobDefinition
+}
+
+// defineJob registers the function that runs jobs of the named type. The
+// payload is stored as JSON. Call it from init so the type is known before
+// the workers start.
+func defineJob[T any](name string, options JobOptions, fn func(ctx context.Context, payload T) error) JobType[T] {
+	def := &jobDefinition{
+		name:    name,
+		options: options.withDefaults(),
+		run: func(ctx context.Context, payload []byte) error {
+			var p T
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return fmt.Errorf("invalid payload: %w", err)
+			}
+			return fn(ctx, p)
+		},
+	}
+	jobTypes[name] = def
+	return JobType[T]{def: def}
+}
+
+// Enqueue adds a job with the type's default options.
+func (jt JobType[T]) Enqueue(payload T) (int64, error) {
+	return jt.EnqueueWith(payload, JobOptions{})
+}
+
+// EnqueueWith adds a job, overriding the type's defaults with any options
+// that are set.
+func (jt JobType[T]) EnqueueWith(payload T, options JobOptions) (int64, error) {
+	o := jt.def.options
+	if options.Queue != "" {
+		o.Queue = options.Queue
+	}
+	if options.Priority != 0 {
+		o.Priority = options.Priority
+	}
+	if options.MaxAttempts > 0 {
+		o.MaxAttempts = options.MaxAttempts
+	}
+	if options.Timeout > 0 {
+		o.Timeout = options.Timeout
+	}
+	o.RunAt = options.RunAt
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	return enqueueJob(jt.def.name, data, o)
+}
+
+func enqueueJob(jobType string, payload []byte, o JobOptions) (int64, error) {
+	now := nowTimestamp()
+	runAt := now
+	if !o.RunAt.IsZero() {
+		runAt = o.RunAt.UTC().Format(timestampLayout)
+	}
+
+	result, err := db.Exec(`INSERT INTO jobs (queue, job_type, payload, priority, status, max_attempts, timeout_seconds, run_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		o.Queue, jobType, string(payload), o.Priority, JobQueued, o.MaxAttempts, int(o.Timeout/time.Second), runAt, now)
+	if err != nil {
+		return 0, err
+	}
+	wakeJobWorkers(o.Queue)
+	return result.LastInsertId()
+}
+
+func createJobTables() error {
+	createJobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue TEXT NOT NULL,
+		job_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		timeout_seconds INTEGER NOT NULL,
+		run_at TEXT NOT NULL,
+		started_at TEXT NOT NULL DEFAULT '',
+		finished_at TEXT NOT NULL DEFAULT '',
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createJobTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_jobs_queue ON jobs (queue, status, priority, run_at)")
+	return err
+}
+
+var (
+	jobWakeupMu sync.Mutex
+	jobWakeup   = map[string]chan struct{}{}
+)
+
+func jobWakeupChannel(queue string) chan struct{} {
+	jobWakeupMu.Lock()
+	defer jobWakeupMu.Unlock()
+	ch, ok := jobWakeup[queue]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		jobWakeup[queue] = ch
+	}
+	return ch
+}
+
+// wakeJobWorkers tells an idle worker of the queue that there is work.
+func wakeJobWorkers(queue string) {
+	select {
+	case jobWakeupChannel(queue) <- struct{}{}:
+	default:
+	}
+}
+
+// startJobWorkers starts the given number of workers for each queue. Jobs
+// left running by a previous process are queued again first.
+func startJobWorkers(workers map[string]int) error {
+	_, err := db.Exec("UPDATE jobs SET status = ?, last_error = 'interrupted by restart' WHERE status = ?", JobQueued, JobRunning)
+	if err != nil {
+		return err
+	}
+
+	for queue, n := range workers {
+		for i := 0; i < n; i++ {
+			go jobWorker(queue)
+		}
+	}
+	return nil
+}
+
+func jobWorker(queue string) {
+	wakeup := jobWakeupChannel(queue)
+	for {
+		job, err := claimJob(queue)
+		if err != nil {
+			log.Printf("Error claiming job from %s queue: %v", queue, err)
+		}
+		if job != nil {
+			runJob(job)
+			continue
+		}
+
+		select {
+		case <-wakeup:
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// claimJob marks the next due job of the queue as running and returns it,
+// or nil if there is none.
+func claimJob(queue string) (*Job, error) {
+	now := nowTimestamp()
+	job := &Job{}
+	err := db.QueryRow(`UPDATE jobs SET status = ?, attempts = attempts + 1, started_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE queue = ? AND status = ? AND run_at <= ? ORDER BY priority DESC, run_at, id LIMIT 1)
+		RETURNING id, queue, job_type, payload, attempts, max_attempts, timeout_seconds`,
+		JobRunning, now, queue, JobQueued, now).Scan(&job.ID, &job.Queue, &job.Type, &job.Payload, &job.Attempts, &job.MaxAttempts, &job.TimeoutSeconds)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// runJob runs a claimed job and records the outcome. A job that fails is
+// retried after its type's retry delay until it runs out of attempts.
+func runJob(job *Job) {
+	def, ok := jobTypes[job.Type]
+	var err error
+	if !ok {
+		err = fmt.Errorf("unknown job type %q", job.Type)
+		job.Attempts = job.MaxAttempts
+	} else {
+		err = callJob(def, job)
+	}
+
+	now := nowTimestamp()
+	switch {
+	case err == nil:
+		_, err = db.Exec("UPDATE jobs SET status = ?, finished_at = ?, last_error = '' WHERE id = ?", JobCompleted, now, job.ID)
+	case job.Attempts < job.MaxAttempts:
+		log.Printf("Job %d (%s) failed, will retry: %v", job.ID, job.Type, err)
+		runAt := time.Now().UTC().Add(def.options.RetryDelay(job.Attempts)).Format(timestampLayout)
+		_, err = db.Exec("UPDATE jobs SET status = ?, run_at = ?, last_error = ? WHERE id = ?", JobQueued, runAt, err.Error(), job.ID)
+	default:
+		log.Printf("Job %d (%s) failed: %v", job.ID, job.Type, err)
+		_, err = db.Exec("UPDATE jobs SET status = ?, finished_at = ?, last_error = ? WHERE id = ?", JobFailed, now, err.Error(), job.ID)
+	}
+	if err != nil {
+		log.Printf("Error updating job %d: %v", job.ID, err)
+	}
+}
+
+// callJob runs the job function with the job's timeout. A job that times
+// out fails once its function has returned, so a retry never runs beside
+// it; the function should stop as soon as the context is done.
+func callJob(def *jobDefinition, job *Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(job.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- def.run(ctx, []byte(job.Payload))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		<-done
+		return fmt.Errorf("timed out after %ds", job.TimeoutSeconds)
+	}
+}
+
+const jobColumns = "id, queue, job_type, payload, priority, status, attempts, max_attempts, timeout_seconds, run_at, started_at, finished_at, last_error, created_at"
+
+func getJobs(status, queue string, limit int) ([]Job, error) {
+	query := "SELECT " + jobColumns + " FROM jobs WHERE 1 = 1"
+	var args []interface{}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if queue != "" {
+		query += " AND queue = ?"
+		args = append(args, queue)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		err := rows.Scan(&j.ID, &j.Queue, &j.Type, &j.Payload, &j.Priority, &j.Status, &j.Attempts, &j.MaxAttempts,
+			&j.TimeoutSeconds, &j.RunAt, &j.StartedAt, &j.FinishedAt, &j.LastError, &j.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// JobCount is the number of jobs of a queue in one status.
+type JobCount struct {
+	Queue  string
+	Status string
+	Count  int
+}
+
+func countJobs() ([]JobCount, error) {
+	rows, err := db.Query("SELECT queue, status, COUNT(*) FROM jobs GROUP BY queue, status ORDER BY queue, status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []JobCount
+	for rows.Next() {
+		var c JobCount
+		if err := rows.Scan(&c.Queue, &c.Status, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// retryJob queues a failed job again with a fresh set of attempts.
+func retryJob(id int64) error {
+	var queue string
+	err := db.QueryRow("UPDATE jobs SET status = ?, attempts = 0, run_at = ?, finished_at = '' WHERE id = ? AND status = ? RETURNING queue",
+		JobQueued, nowTimestamp(), id, JobFailed).Scan(&queue)
+	if err != nil {
+		return err
+	}
+	wakeJobWorkers(queue)
+	return nil
+}
+
+// deleteJob removes a job that is not running.
+func deleteJob(id int64) error {
+	result, err := db.Exec("DELETE FROM jobs WHERE id = ? AND status != ?", id, JobRunning)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	queue := r.URL.Query().Get("queue")
+	jobs, err := getJobs(status, queue, 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	counts, err := countJobs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Background Jobs",
+		Content: struct {
+			Jobs     []Job
+			Counts   []JobCount
+			Status   string
+			Queue    string
+			Statuses []string
+		}{
+			Jobs:     jobs,
+			Counts:   counts,
+			Status:   status,
+			Queue:    queue,
+			Statuses: []string{JobQueued, JobRunning, JobCompleted, JobFailed},
+		},
+	}
+	renderTemplate(w, r, "jobs.html", data)
+}
+
+func jobActionHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "retry":
+		err = retryJob(id)
+	case "delete":
+		err = deleteJob(id)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Job not found or in the wrong state", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/jobs?status="+url.QueryEscape(r.FormValue("status")), http.StatusSeeOther)
+}
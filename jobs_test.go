@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJobQueue keeps the jobs of these tests away from the jobs queued by
+// document hooks in other tests.
+const testJobQueue = "test"
+
+// runTestJobs runs the due jobs of the test queue and returns how many ran.
+func runTestJobs(t *testing.T) int {
+	t.Helper()
+	n := 0
+	for {
+		job, err := claimJob(testJobQueue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil {
+			return n
+		}
+		runJob(job)
+		n++
+	}
+}
+
+func getTestJob(t *testing.T, id int64) Job {
+	t.Helper()
+	jobs, err := getJobs("", testJobQueue, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	t.Fatalf("job %d not found", id)
+	return Job{}
+}
+
+type testJobPayload struct {
+	Name string `json:"name"`
+}
+
+func TestJobRetries(t *testing.T) {
+	var calls atomic.Int32
+	var got []string
+	jt := defineJob(uniqueName("flaky"), JobOptions{Queue: testJobQueue, RetryDelay: func(int) time.Duration { return 0 }},
+		func(ctx context.Context, p testJobPayload) error {
+			got = append(got, p.Name)
+			if calls.Add(1) < 3 {
+				return errors.New("not yet")
+			}
+			return nil
+		})
+
+	id, err := jt.Enqueue(testJobPayload{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := runTestJobs(t); n != 3 {
+		t.Errorf("ran %d times, want 3", n)
+	}
+	job := getTestJob(t, id)
+	if job.Status != JobCompleted || job.Attempts != 3 || job.LastError != "" || job.FinishedAt == "" {
+		t.Errorf("job = %+v, want completed on the third attempt", job)
+	}
+	if strings.Join(got, ",") != "a,a,a" {
+		t.Errorf("payloads = %v", got)
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	jt := defineJob(uniqueName("failing"), JobOptions{Queue: testJobQueue}, func(ctx context.Context, p testJobPayload) error {
+		return errors.New("down")
+	})
+
+	id, err := jt.Enqueue(testJobPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := runTestJobs(t); n != 1 {
+		t.Fatalf("ran %d times, want 1 before the retry is due", n)
+	}
+	job := getTestJob(t, id)
+	runAt, err := time.Parse(timestampLayout, job.RunAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait := time.Until(runAt); wait < 5*time.Second || wait > 10*time.Second {
+		t.Errorf("retry in %s, want 10s", wait)
+	}
+	if job.Status != JobQueued || job.LastError != "down" {
+		t.Errorf("job = %+v", job)
+	}
+
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second} {
+		if got := defaultJobRetryDelay(attempt); got != want {
+			t.Errorf("defaultJobRetryDelay(%d) = %s, want %s", attempt, got, want)
+		}
+	}
+	// Leave nothing queued for the other tests
+	_, err = db.Exec("DELETE FROM jobs WHERE id = ?", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobDeadLetter(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	jt := defineJob(uniqueName("dead"), JobOptions{Queue: testJobQueue, MaxAttempts: 2, RetryDelay: func(int) time.Duration { return 0 }},
+		func(ctx context.Context, p testJobPayload) error {
+			if fail.Load() {
+				panic("boom")
+			}
+			return nil
+		})
+
+	id, err := jt.Enqueue(testJobPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := runTestJobs(t); n != 2 {
+		t.Errorf("ran %d times, want 2", n)
+	}
+	job := getTestJob(t, id)
+	if job.Status != JobFailed || job.Attempts != 2 || job.LastError != "panic: boom" {
+		t.Errorf("job = %+v, want failed after 2 attempts", job)
+	}
+
+	// Failed jobs wait for an admin
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	for admin, want := range map[bool]int{false: http.StatusForbidden, true: http.StatusOK} {
+		s := newTestSession(t, server, createTestUser(t, "User", admin))
+		resp, err := s.client.Get(server.URL + "/jobs?status=" + JobFailed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("admin %v: status = %d, want %d", admin, resp.StatusCode, want)
+		}
+	}
+
+	fail.Store(false)
+	err = retryJob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestJobs(t)
+	if job := getTestJob(t, id); job.Status != JobCompleted || job.Attempts != 1 {
+		t.Errorf("job = %+v, want completed after the retry", job)
+	}
+	err = deleteJob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobTimeoutWaitsForFunction(t *testing.T) {
+	var running, stopped atomic.Int32
+	jt := defineJob(uniqueName("slow"), JobOptions{Queue: testJobQueue, MaxAttempts: 2, Timeout: time.Second, RetryDelay: func(int) time.Duration { return 0 }},
+		func(ctx context.Context, p testJobPayload) error {
+			if running.Add(1) > 1 {
+				t.Error("job ran twice at once")
+			}
+			defer running.Add(-1)
+			<-ctx.Done()
+			// Slow to notice, like a request that is still being sent
+			time.Sleep(300 * time.Millisecond)
+			stopped.Add(1)
+			return ctx.Err()
+		})
+
+	id, err := jt.Enqueue(testJobPayload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := claimJob(testJobQueue)
+	if err != nil || job == nil {
+		t.Fatalf("claimJob = %v, %v", job, err)
+	}
+	runJob(job)
+	if stopped.Load() != 1 {
+		t.Error("runJob returned before the job function stopped")
+	}
+	if job := getTestJob(t, id); job.Status != JobQueued || !strings.Contains(job.LastError, "timed out") {
+		t.Errorf("job = %+v, want queued to retry after the timeout", job)
+	}
+
+	runTestJobs(t)
+	if job := getTestJob(t, id); job.Status != JobFailed || stopped.Load() != 2 {
+		t.Errorf("job = %+v, want failed after 2 timeouts", job)
+	}
+}
+
+func TestJobPriority(t *testing.T) {
+	var order []string
+	jt := defineJob(uniqueName("ordered"), JobOptions{Queue: testJobQueue}, func(ctx context.Context, p testJobPayload) error {
+		order = append(order, p.Name)
+		return nil
+	})
+	jt.Enqueue(testJobPayload{Name: "low"})
+	jt.EnqueueWith(testJobPayload{Name: "high"}, JobOptions{Priority: 10})
+	jt.EnqueueWith(testJobPayload{Name: "later"}, JobOptions{Priority: 20, RunAt: time.Now().Add(time.Hour)})
+	runTestJobs(t)
+	if strings.Join(order, ",") != "high,low" {
+		t.Errorf("ran %v, want high then low", order)
+	}
+	_, err := db.Exec("DELETE FROM jobs WHERE queue = ? AND status = ?", testJobQueue, JobQueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// KanbanBoardDoctype holds Kanban board configurations. A board shows the
+// documents of a doctype as cards in columns, one per value of a select
+// field, in the order the values are listed. Cards show the title field
+// and the card fields; moving a card sets the select field to the value of
+// its new column.
+const KanbanBoardDoctype = "Kanban Board"
+
+// KanbanBoard is a parsed Kanban Board document.
+type KanbanBoard struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Doctype    string   `json:"doctype"`
+	Field      string   `json:"field"`
+	Columns    []string `json:"columns"`
+	TitleField string   `json:"title_field"`
+	CardFields []string `json:"card_fields"`
+}
+
+// KanbanCardField is a labelled value shown on a card.
+type KanbanCardField struct {
+	Label string
+	Value interface{}
+}
+
+// KanbanCard is a document on a board.
+type KanbanCard struct {
+	ID     int
+	Title  string
+	Fields []KanbanCardField
+}
+
+// KanbanColumn is a column of cards. Documents whose value is not one of
+// the board's columns are shown in an extra column with Other set, so they
+// can be moved into a real one.
+type KanbanColumn struct {
+	Value string
+	Other bool
+	Cards []KanbanCard
+}
+
+// createKanbanBoardDoctype creates the Kanban Board doctype unless it
+// already exists.
+func createKanbanBoardDoctype() error {
+	if _, err := getDoctypeByName(KanbanBoardDoctype); err == nil {
+		return nil
+	}
+
+	boardDoctype := Doctype{
+		Name: KanbanBoardDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "document_type", Type: "string", Label: "Document Type", Required: true},
+			{Name: "field", Type: "string", Label: "Column Field (a select field)", Required: true},
+			{Name: "columns", Type: "text", Label: "Columns (one value per line)", Required: true},
+			{Name: "title_field", Type: "string", Label: "Card Title Field", Required: false},
+			{Name: "card_fields", Type: "string", Label: "Card Fields (comma separated)", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+
+	return createDoctype(&boardDoctype)
+}
+
+// parseKanbanBoard reads a Kanban Board document and checks it against the
+// doctype it shows.
+func parseKanbanBoard(doc Document) (KanbanBoard, Doctype, error) {
+	board := KanbanBoard{
+		ID:         doc.ID,
+		Name:       ruleString(doc, "name"),
+		Doctype:    ruleString(doc, "document_type"),
+		Field:      ruleString(doc, "field"),
+		Columns:    []string{},
+		TitleField: ruleString(doc, "title_field"),
+		CardFields: splitList(ruleString(doc, "card_fields")),
+	}
+	for _, line := range strings.Split(ruleString(doc, "columns"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			board.Columns = append(board.Columns, line)
+		}
+	}
+
+	doctype, err := getDoctypeByName(board.Doctype)
+	if err != nil {
+		return board, doctype, fmt.Errorf("doctype %q not found", board.Doctype)
+	}
+	field := getFieldByName(doctype.Fields, board.Field)
+	if field == nil || field.Type != "select" {
+		return board, doctype, fmt.Errorf("column field %q must be a select field of %s", board.Field, board.Doctype)
+	}
+	if len(board.Columns) == 0 {
+		return board, doctype, fmt.Errorf("board has no columns")
+	}
+	if board.TitleField != "" && getFieldByName(doctype.Fields, board.TitleField) == nil {
+		return board, doctype, fmt.Errorf("unknown title field %q", board.TitleField)
+	}
+	for _, name := range board.CardFields {
+		if getFieldByName(doctype.Fields, name) == nil {
+			return board, doctype, fmt.Errorf("unknown card field %q", name)
+		}
+	}
+	return board, doctype, nil
+}
+
+// getKanbanBoards returns the boards of a doctype and the problems found
+// with any that could not be parsed.
+func getKanbanBoards(doctypeName string) ([]KanbanBoard, []string, error) {
+	docs, err := getDocuments(KanbanBoardDoctype)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var boards []KanbanBoard
+	var problems []string
+	for _, doc := range docs {
+		if ruleString(doc, "document_type") != doctypeName {
+			continue
+		}
+		board, _, err := parseKanbanBoard(doc)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Board %s: %v", board.Name, err))
+			continue
+		}
+		boards = append(boards, board)
+	}
+	return boards, problems, nil
+}
+
+// getKanbanBoard finds a board by name.
+func getKanbanBoard(name string) (KanbanBoard, Doctype, error) {
+	docs, err := getDocuments(KanbanBoardDoctype)
+	if err != nil {
+		return KanbanBoard{}, Doctype{}, err
+	}
+	for _, doc := range docs {
+		if ruleString(doc, "name") == name {
+			return parseKanbanBoard(doc)
+		}
+	}
+	return KanbanBoard{}, Doctype{}, sql.ErrNoRows
+}
+
+// buildKanbanColumns sorts the documents of a board's doctype into its
+// columns.
+func buildKanbanColumns(board KanbanBoard, doctype Doctype) ([]KanbanColumn, error) {
+	docs, err := getDocuments(board.Doctype)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]KanbanColumn, len(board.Columns))
+	index := map[string]int{}
+	for i, value := range board.Columns {
+		columns[i] = KanbanColumn{Value: value}
+		index[value] = i
+	}
+	other := KanbanColumn{Other: true}
+
+	for _, doc := range docs {
+		card := KanbanCard{ID: doc.ID, Title: fmt.Sprintf("#%d", doc.ID)}
+		if title := exportValue(doc.Data[board.TitleField]); board.TitleField != "" && !isEmptyValue(title) {
+			card.Title = fmt.Sprint(title)
+		}
+		for _, name := range board.CardFields {
+			field := getFieldByName(doctype.Fields, name)
+			if value := exportValue(doc.Data[name]); !isEmptyValue(value) {
+				card.Fields = append(card.Fields, KanbanCardField{Label: field.Label, Value: value})
+			}
+		}
+
+		value, _ := exportValue(doc.Data[board.Field]).(string)
+		if i, ok := index[value]; ok {
+			columns[i].Cards = append(columns[i].Cards, card)
+		} else {
+			other.Cards = append(other.Cards, card)
+		}
+	}
+
+	if len(other.Cards) > 0 {
+		columns = append([]KanbanColumn{other}, columns...)
+	}
+	return columns, nil
+}
+
+// moveKanbanCard sets the column field of a document to the value of the
+// column it was moved to. The change goes through updateDocument, so it is
+// validated and runs the document hooks like any other edit.
+func moveKanbanCard(user *Document, board KanbanBoard, docID int, value string) error {
+	known := false
+	for _, c := range board.Columns {
+		if c == value {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return &ValidationError{Fields: map[string]string{board.Field: fmt.Sprintf("%q is not a column of the board", value)}}
+	}
+
+	return updateDocument(&Document{
+		ID:          docID,
+		DoctypeName: board.Doctype,
+		Data:        map[string]interface{}{board.Field: value},
+		ModifiedBy:  username(user),
+	})
+}
+
+func kanbanHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	doctype, err := getDoctypeByName(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return
+	}
+	if user == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	boards, problems, err := getKanbanBoards(doctype.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isAdminUser(user) {
+		problems = nil
+	}
+
+	// Show the board asked for, or the first one
+	var board *KanbanBoard
+	name := r.URL.Query().Get("board")
+	for i := range boards {
+		if name == "" || boards[i].Name == name {
+			board = &boards[i]
+			break
+		}
+	}
+
+	var columns []KanbanColumn
+	canMove := false
+	if board != nil {
+		columns, err = buildKanbanColumns(*board, doctype)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		canMove = canEditField(user, doctype, *getFieldByName(doctype.Fields, board.Field))
+	}
+
+	data := PageData{
+		Title: doctype.Name + " Board",
+		Content: struct {
+			Doctype  Doctype
+			Boards   []KanbanBoard
+			Board    *KanbanBoard
+			Columns  []KanbanColumn
+			CanMove  bool
+			IsAdmin  bool
+			Problems []string
+		}{
+			Doctype:  doctype,
+			Boards:   boards,
+			Board:    board,
+			Columns:  columns,
+			CanMove:  canMove,
+			IsAdmin:  isAdminUser(user),
+			Problems: problems,
+		},
+	}
+	renderTemplate(w, r, "kanban.html", data)
+}
+
+// apiKanbanMove moves a card to another column of a board. The body names
+// the document and the column: {"id": 3, "value": "Done"}.
+func apiKanbanMove(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	board, doctype, err := getKanbanBoard(mux.Vars(r)["board"])
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "Board not found")
+		return
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !canEditField(user, doctype, *getFieldByName(doctype.Fields, board.Field)) {
+		RespondAPIError(w, http.StatusForbidden, &PermissionError{})
+		return
+	}
+
+	var body struct {
+		ID    int    `json:"id"`
+		Value string `json:"value"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := getDocumentByID(board.Doctype, fmt.Sprint(body.ID)); err != nil {
+		RespondError(w, http.StatusNotFound, "Document not found")
+		return
+	}
+
+	err = moveKanbanCard(user, board, body.ID, body.Value)
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		RespondAPIError(w, http.StatusBadRequest, err)
+	case err != nil:
+		RespondAPIError(w, http.StatusInternalServerError, err)
+	default:
+		RespondJSON(w, http.StatusOK, map[string]interface{}{"id": body.ID, board.Field: body.Value})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// createTestBoard creates a Kanban Board over the status field of the
+// doctype and returns its name.
+func createTestBoard(t *testing.T, doctype string) string {
+	t.Helper()
+	name := uniqueName("board")
+	board := Document{DoctypeName: KanbanBoardDoctype, Data: map[string]interface{}{
+		"name":          name,
+		"document_type": doctype,
+		"field":         "status",
+		"columns":       "To Do\nDoing\nDone",
+		"title_field":   "title",
+	}}
+	err := createDocument(&board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestKanbanColumns(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "status", Type: "select", Label: "Status"},
+	)
+	var untitled Document
+	for _, data := range []map[string]interface{}{
+		{"title": "a", "status": "Doing"},
+		{"title": "b", "status": "Blocked"},
+		{"status": "Done"},
+	} {
+		untitled = Document{DoctypeName: dt.Name, Data: data}
+		err := createDocument(&untitled)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	board, doctype, err := getKanbanBoard(createTestBoard(t, dt.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, err := buildKanbanColumns(board, doctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range columns {
+		var titles []string
+		for _, card := range c.Cards {
+			titles = append(titles, card.Title)
+		}
+		got = append(got, fmt.Sprintf("%s%v", c.Value, titles))
+	}
+	// Documents outside the columns come first, untitled ones show their ID
+	want := fmt.Sprintf("[[b] To Do[] Doing[a] Done[#%d]]", untitled.ID)
+	if fmt.Sprint(got) != want || !columns[0].Other {
+		t.Errorf("columns = %v, want %s", got, want)
+	}
+}
+
+func TestKanbanMove(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "status", Type: "select", Label: "Status", Permissions: []string{"Manager"}},
+	)
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a", "status": "To Do"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/kanban/" + createTestBoard(t, dt.Name) + "/move"
+	managerKey := createTestAPIKey(t, createTestUser(t, "Manager", false))
+	move := func(id int, value string) string {
+		return fmt.Sprintf(`{"id": %d, "value": %q}`, id, value)
+	}
+
+	expectAPIError(t, apiRequest(t, "POST", path, createTestAPIKey(t, createTestUser(t, "User", false)), move(doc.ID, "Done")), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "POST", path, "", move(doc.ID, "Done")), http.StatusUnauthorized, ErrCodeUnauthorized)
+	expectStatus(t, apiRequest(t, "POST", path, managerKey, move(doc.ID, "Nowhere")), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "POST", path, managerKey, move(999999, "Done")), http.StatusNotFound)
+	expectStatus(t, apiRequest(t, "POST", "/api/kanban/"+uniqueName("missing")+"/move", managerKey, move(doc.ID, "Done")), http.StatusNotFound)
+	expectStatus(t, apiRequest(t, "POST", path, managerKey, move(doc.ID, "Done")), http.StatusOK)
+
+	stored, err := getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Data["status"] != "Done" || stored.Data["title"] != "a" {
+		t.Errorf("stored data = %v, want status Done and the title kept", stored.Data)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A link field stores the ID of a document of the doctype named in its
+// Options. A table field stores nothing itself: its rows are the documents
+// of the child doctype named in its Options whose link field points back
+// at the parent document.
+
+// checkFieldOptions returns a *ValidationError unless every link and table
+// field of the doctype names a doctype that exists. A link may point at
+// the doctype itself.
+func checkFieldOptions(dt Doctype) error {
+	errs := map[string]string{}
+	for _, field := range dt.Fields {
+		if field.Type != "link" && field.Type != "table" {
+			continue
+		}
+		if field.Options == "" {
+			errs[field.Name] = "options must name a doctype"
+			continue
+		}
+		if field.Options == dt.Name {
+			if field.Type == "table" {
+				errs[field.Name] = "a doctype cannot be its own child table"
+			}
+			continue
+		}
+		target, err := getDoctypeByName(field.Options)
+		if err != nil {
+			errs[field.Name] = fmt.Sprintf("unknown doctype %q", field.Options)
+			continue
+		}
+		if field.Type == "table" && childLinkField(target, dt.Name) == nil {
+			errs[field.Name] = fmt.Sprintf("%s has no link field to %s", target.Name, dt.Name)
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+// childLinkField returns the link field of a child doctype that points at
+// the parent doctype, or nil if it has none.
+func childLinkField(child Doctype, parent string) *Field {
+	for i, field := range child.Fields {
+		if field.Type == "link" && field.Options == parent {
+			return &child.Fields[i]
+		}
+	}
+	return nil
+}
+
+// getLinkedDocument returns the document a link field of doc points at,
+// or nil if the field is blank or the document no longer exists.
+func getLinkedDocument(field Field, doc Document) (*Document, error) {
+	value := exportValue(doc.Data[field.Name])
+	if isEmptyValue(value) {
+		return nil, nil
+	}
+	target, err := getDoctypeByName(field.Options)
+	if err != nil {
+		return nil, err
+	}
+	linked, err := readDocument(db, target, fmt.Sprint(value))
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &linked, nil
+}
+
+// getChildDocuments returns the rows of a table field of doc, in ID order.
+func getChildDocuments(field Field, doc Document) ([]Document, error) {
+	child, err := getDoctypeByName(field.Options)
+	if err != nil {
+		return nil, err
+	}
+	link := childLinkField(child, doc.DoctypeName)
+	if link == nil {
+		return nil, fmt.Errorf("%s has no link field to %s", child.Name, doc.DoctypeName)
+	}
+	filters := []Filter{{Field: link.Name, Operator: "=", Value: doc.ID}}
+	rows, _, err := listDocuments(child, visibleFields(child, child.Fields), filters, "id", "asc", 0, 0)
+	return rows, err
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 500
+	// defaultListColumns is how many fields a list shows when none are
+	// marked In List View.
+	defaultListColumns = 5
+)
+
+// ListViewConfig describes how a document list is shown. Empty settings
+// fall back to the doctype's list view settings.
+type ListViewConfig struct {
+	Columns   []string `json:"columns,omitempty"`
+	Filters   []Filter `json:"filters,omitempty"`
+	SortField string   `json:"sort_field,omitempty"`
+	SortOrder string   `json:"sort_order,omitempty"`
+	PageSize  int      `json:"page_size,omitempty"`
+}
+
+// ListView is a list configuration a user saved for a doctype. Saved views
+// belong to the user who saved them.
+type ListView struct {
+	ID         int64          `json:"id"`
+	Doctype    string         `json:"doctype"`
+	Owner      string         `json:"owner"`
+	Name       string         `json:"name"`
+	Config     ListViewConfig `json:"config"`
+	CreatedAt  string         `json:"created_at"`
+	ModifiedAt string         `json:"modified_at"`
+}
+
+// ListRow is a document as shown in a list: its title and the values of
+// the list's columns.
+type ListRow struct {
+	ID     int
+	Title  string
+	Values []interface{}
+}
+
+func createListViewTables() error {
+	createListViewsTable := `
+	CREATE TABLE IF NOT EXISTS list_views (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		name TEXT NOT NULL,
+		config TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		modified_at TEXT NOT NULL,
+		UNIQUE (doctype, owner, name)
+	);`
+
+	_, err := db.Exec(createListViewsTable)
+	return err
+}
+
+// listColumns returns the fields a list shows: the ones asked for, else
+// the doctype's In List View fields, else its first few fields.
+func listColumns(doctype Doctype, names []string) ([]Field, error) {
+	if len(names) > 0 {
+		return resolveFields(doctype, names)
+	}
+	visible := visibleFields(doctype, doctype.Fields)
+	var fields []Field
+	for _, field := range visible {
+		if field.InListView {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 && len(visible) > 0 {
+		fields = visible[:min(len(visible), defaultListColumns)]
+	}
+	return fields, nil
+}
+
+// listOrder returns the ORDER BY clause for a list, falling back to the
+// doctype's default sort and then to the ID.
+func listOrder(doctype Doctype, field, order string) (string, error) {
+	if field == "" {
+		field, order = doctype.SortField, doctype.SortOrder
+		if !isDocumentColumn(doctype, field) {
+			field = "id"
+		}
+	}
+	if !isDocumentColumn(doctype, field) {
+		return "", fmt.Errorf("unknown sort field %q", field)
+	}
+	switch strings.ToLower(order) {
+	case "", "asc":
+		order = "ASC"
+	case "desc":
+		order = "DESC"
+	default:
+		return "", fmt.Errorf("sort order must be asc or desc")
+	}
+	if field == "id" {
+		return " ORDER BY id " + order, nil
+	}
+	return fmt.Sprintf(" ORDER BY `%s` %s, id %s", field, order, order), nil
+}
+
+// listDocuments returns a page of the documents matching the filters, with
+// the given fields, and the number of matching documents. A limit of zero
+// returns every match.
+func listDocuments(doctype Doctype, fields []Field, filters []Filter, sortField, sortOrder string, limit, offset int) ([]Document, int, error) {
+	where, args, err := buildWhereClause(doctype, filters)
+	if err != nil {
+		return nil, 0, err
+	}
+	order, err := listOrder(doctype, sortField, sortOrder)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s`%s", doctype.Name, where), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	columns := []string{"id"}
+	for _, field := range fields {
+		columns = append(columns, fmt.Sprintf("`%s`", field.Name))
+	}
+	query := fmt.Sprintf("SELECT %s FROM `%s`%s%s", strings.Join(columns, ", "), doctype.Name, where, order)
+	if limit > 0 || offset > 0 {
+		if limit <= 0 {
+			limit = -1 // no limit, as SQLite needs one for an offset
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	docs := []Document{}
+	for rows.Next() {
+		doc := Document{DoctypeName: doctype.Name, Data: make(map[string]interface{})}
+
+		values := make([]interface{}, len(fields)+1)
+		values[0] = &doc.ID
+		for i := range fields {
+			values[i+1] = new(interface{})
+		}
+
+		err := rows.Scan(values...)
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, field := range fields {
+			doc.Data[field.Name] = exportValue(*(values[i+1].(*interface{})))
+		}
+		docs = append(docs, doc)
+	}
+	return docs, total, rows.Err()
+}
+
+// listViewConfigFromForm reads list settings from the list page's form.
+func listViewConfigFromForm(form url.Values) ListViewConfig {
+	cfg := ListViewConfig{
+		Columns:   form["column"],
+		SortField: form.Get("sort_field"),
+		SortOrder: form.Get("sort_order"),
+	}
+
+	operators, values := form["filter_operator"], form["filter_value"]
+	for i, field := range form["filter_field"] {
+		if field == "" {
+			continue
+		}
+		f := Filter{Field: field, Operator: "="}
+		if i < len(operators) {
+			f.Operator = operators[i]
+		}
+		if i < len(values) {
+			f.Value = values[i]
+		}
+		cfg.Filters = append(cfg.Filters, f)
+	}
+
+	cfg.PageSize, _ = strconv.Atoi(form.Get("page_size"))
+	return cfg
+}
+
+// listViewFormValues is the inverse of listViewConfigFromForm, used to
+// build the pagination links of the list being shown.
+func listViewFormValues(cfg ListViewConfig) url.Values {
+	v := url.Values{}
+	v.Set("apply", "1")
+	for _, c := range cfg.Columns {
+		v.Add("column", c)
+	}
+	for _, f := range cfg.Filters {
+		v.Add("filter_field", f.Field)
+		v.Add("filter_operator", f.Operator)
+		v.Add("filter_value", fmt.Sprint(f.Value))
+	}
+	if cfg.SortField != "" {
+		v.Set("sort_field", cfg.SortField)
+		v.Set("sort_order", cfg.SortOrder)
+	}
+	if cfg.PageSize > 0 {
+		v.Set("page_size", strconv.Itoa(cfg.PageSize))
+	}
+	return v
+}
+
+// pageSize returns the page size to use, within the allowed bounds.
+func pageSize(size int) int {
+	if size <= 0 {
+		return defaultPageSize
+	}
+	return min(size, maxPageSize)
+}
+
+func scanListView(scanner interface{ Scan(...interface{}) error }) (ListView, error) {
+	var view ListView
+	var config string
+	err := scanner.Scan(&view.ID, &view.Doctype, &view.Owner, &view.Name, &config, &view.CreatedAt, &view.ModifiedAt)
+	if err != nil {
+		return view, err
+	}
+	err = json.Unmarshal([]byte(config), &view.Config)
+	return view, err
+}
+
+const listViewColumns = "id, doctype, owner, name, config, created_at, modified_at"
+
+// getListView returns one of the user's saved views.
+func getListView(id int64, owner string) (ListView, error) {
+	return scanListView(db.QueryRow("SELECT "+listViewColumns+" FROM list_views WHERE id = ? AND owner = ?", id, owner))
+}
+
+// getListViews lists the user's saved views of a doctype, by name.
+func getListViews(doctype, owner string) ([]ListView, error) {
+	rows, err := db.Query("SELECT "+listViewColumns+" FROM list_views WHERE doctype = ? AND owner = ? ORDER BY name", doctype, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []ListView{}
+	for rows.Next() {
+		view, err := scanListView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, rows.Err()
+}
+
+// saveListView checks a view and stores it. Saving a view under a name the
+// owner already uses for the doctype replaces that view.
+func saveListView(view *ListView) error {
+	view.Name = strings.TrimSpace(view.Name)
+	if view.Name == "" {
+		return fmt.Errorf("view name is required")
+	}
+	doctype, err := getDoctypeByName(view.Doctype)
+	if err != nil {
+		return fmt.Errorf("doctype %s not found", view.Doctype)
+	}
+	if _, err := listColumns(doctype, view.Config.Columns); err != nil {
+		return err
+	}
+	if _, _, err := buildWhereClause(doctype, view.Config.Filters); err != nil {
+		return err
+	}
+	if _, err := listOrder(doctype, view.Config.SortField, view.Config.SortOrder); err != nil {
+		return err
+	}
+
+	config, err := json.Marshal(view.Config)
+	if err != nil {
+		return err
+	}
+
+	view.ModifiedAt = nowTimestamp()
+	view.CreatedAt = view.ModifiedAt
+	_, err = db.Exec(`INSERT INTO list_views (doctype, owner, name, config, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (doctype, owner, name) DO UPDATE SET config = excluded.config, modified_at = excluded.modified_at`,
+		view.Doctype, view.Owner, view.Name, string(config), view.CreatedAt, view.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	saved, err := scanListView(db.QueryRow("SELECT "+listViewColumns+" FROM list_views WHERE doctype = ? AND owner = ? AND name = ?",
+		view.Doctype, view.Owner, view.Name))
+	if err != nil {
+		return err
+	}
+	*view = saved
+	return nil
+}
+
+func deleteListView(id int64, owner string) error {
+	result, err := db.Exec("DELETE FROM list_views WHERE id = ? AND owner = ?", id, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListPageData drives document_list.html.
+type ListPageData struct {
+	DoctypeName string
+	Doctype     Doctype
+	Config      ListViewConfig
+	Columns     []Field
+	TitleLabel  string
+	Rows        []ListRow
+	Filters     []Filter
+	Operators   []string
+	Views       []ListView
+	View        *ListView
+	Total       int
+	Page        int
+	PageSize    int
+	First       int
+	Last        int
+	PrevURL     string
+	NextURL     string
+	Error       string
+}
+
+func documentListHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	doctype, err := getDoctypeByName(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	views, err := getListViews(doctype.Name, username(user))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The settings come from the form when it was submitted, else from the
+	// saved view asked for
+	query := r.URL.Query()
+	data := ListPageData{
+		DoctypeName: doctype.Name,
+		Doctype:     doctype,
+		Operators:   reportFilterOperators,
+		Views:       views,
+		TitleLabel:  "ID",
+	}
+	if id, err := strconv.ParseInt(query.Get("view"), 10, 64); err == nil {
+		view, err := getListView(id, username(user))
+		if err == sql.ErrNoRows {
+			http.Error(w, "View not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.View = &view
+		data.Config = view.Config
+	}
+	if query.Get("apply") != "" {
+		data.Config = listViewConfigFromForm(query)
+	}
+	data.Filters = append(append([]Filter{}, data.Config.Filters...), Filter{})
+
+	data.Page, _ = strconv.Atoi(query.Get("page"))
+	if data.Page < 1 {
+		data.Page = 1
+	}
+	data.PageSize = pageSize(data.Config.PageSize)
+
+	data.Columns, err = listColumns(doctype, data.Config.Columns)
+	if err == nil {
+		// The title field is read along with the columns but only shown as
+		// the row's link
+		fields := data.Columns
+		if title := getFieldByName(doctype.Fields, doctype.TitleField); title != nil {
+			fields = append(append([]Field{}, fields...), *title)
+			data.TitleLabel = title.Label
+		}
+		var docs []Document
+		docs, data.Total, err = listDocuments(doctype, fields, data.Config.Filters, data.Config.SortField, data.Config.SortOrder,
+			data.PageSize, (data.Page-1)*data.PageSize)
+		for _, doc := range docs {
+			row := ListRow{ID: doc.ID, Title: strconv.Itoa(doc.ID)}
+			if title := doc.Data[doctype.TitleField]; doctype.TitleField != "" && !isEmptyValue(title) {
+				row.Title = fmt.Sprint(title)
+			}
+			for _, field := range data.Columns {
+				row.Values = append(row.Values, doc.Data[field.Name])
+			}
+			data.Rows = append(data.Rows, row)
+		}
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	if data.Total > 0 {
+		data.First = (data.Page-1)*data.PageSize + 1
+		data.Last = data.First + len(data.Rows) - 1
+	}
+	values := listViewFormValues(data.Config)
+	if data.View != nil {
+		values.Set("view", strconv.FormatInt(data.View.ID, 10))
+	}
+	if data.Page > 1 {
+		values.Set("page", strconv.Itoa(data.Page-1))
+		data.PrevURL = "?" + values.Encode()
+	}
+	if data.Page*data.PageSize < data.Total {
+		values.Set("page", strconv.Itoa(data.Page+1))
+		data.NextURL = "?" + values.Encode()
+	}
+
+	renderTemplate(w, r, "document_list.html", PageData{Title: doctype.Name + " Documents", Content: data})
+}
+
+// listViewSaveHandler saves the list settings in the form as a view of the
+// current user.
+func listViewSaveHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	view := ListView{
+		Doctype: mux.Vars(r)["name"],
+		Owner:   username(user),
+		Name:    r.FormValue("view_name"),
+		Config:  listViewConfigFromForm(r.Form),
+	}
+	err = saveListView(&view)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/documents?view=%d", url.PathEscape(view.Doctype), view.ID), http.StatusSeeOther)
+}
+
+// listViewActionHandler handles the buttons on a saved view. Deleting is
+// the only action.
+func listViewActionHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if r.FormValue("action") != "delete" {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	err = deleteListView(id, username(user))
+	if err == sql.ErrNoRows {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/documents", url.PathEscape(vars["name"])), http.StatusSeeOther)
+}
+
+// apiListViews lists the current user's saved views of a doctype.
+func apiListViews(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	views, err := getListViews(mux.Vars(r)["doctype"], username(user))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, views)
+}
+
+// apiSaveListView saves a view of a doctype for the current user, replacing
+// the user's view of the same name.
+func apiSaveListView(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	var view ListView
+	err := json.NewDecoder(r.Body).Decode(&view)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	view.Doctype = mux.Vars(r)["doctype"]
+	view.Owner = username(user)
+
+	err = saveListView(&view)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, view)
+}
+
+func apiDeleteListView(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "View not found")
+		return
+	}
+
+	err = deleteListView(id, username(user))
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "View not found")
+		return
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
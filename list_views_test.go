@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestListColumns(t *testing.T) {
+	users, err := getDoctypeByName("User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "status", Type: "string", Label: "Status", InListView: true},
+		Field{Name: "notes", Type: "text", Label: "Notes"},
+	)
+
+	tests := []struct {
+		name    string
+		doctype Doctype
+		columns []string
+		want    string
+	}{
+		{"first fields without secrets", users, nil, "[username is_admin role]"},
+		{"in list view", dt, nil, "[status]"},
+		{"asked for", dt, []string{"notes", "title"}, "[notes title]"},
+	}
+	for _, tt := range tests {
+		fields, err := listColumns(tt.doctype, tt.columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range fields {
+			names = append(names, f.Name)
+		}
+		if fmt.Sprint(names) != tt.want {
+			t.Errorf("%s: columns = %v, want %s", tt.name, names, tt.want)
+		}
+	}
+	if _, err := listColumns(users, []string{"password"}); err == nil {
+		t.Error("listColumns accepted the password column")
+	}
+}
+
+func TestSavedListViews(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "status", Type: "string", Label: "Status"},
+	)
+	path := "/api/list-views/" + dt.Name
+	ownerKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	otherKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	save := func(key, body string) ListView {
+		t.Helper()
+		w := apiRequest(t, "POST", path, key, body)
+		expectStatus(t, w, http.StatusOK)
+		var view ListView
+		json.Unmarshal(w.Body.Bytes(), &view)
+		return view
+	}
+	list := func(key string) []ListView {
+		t.Helper()
+		w := apiRequest(t, "GET", path, key, "")
+		expectStatus(t, w, http.StatusOK)
+		var views []ListView
+		json.Unmarshal(w.Body.Bytes(), &views)
+		return views
+	}
+
+	first := save(ownerKey, `{"name": "Open", "config": {"filters": [{"field": "status", "operator": "=", "value": "Open"}]}}`)
+	// Saving under the same name replaces the view
+	second := save(ownerKey, `{"name": "Open", "config": {"columns": ["title"], "sort_field": "title", "sort_order": "desc"}}`)
+	if second.ID != first.ID || len(second.Config.Filters) != 0 || second.Config.SortOrder != "desc" {
+		t.Errorf("saved view = %+v, want the first view replaced", second)
+	}
+	if views := list(ownerKey); len(views) != 1 || views[0].ID != first.ID {
+		t.Errorf("owner's views = %+v", views)
+	}
+	if views := list(otherKey); len(views) != 0 {
+		t.Errorf("other user's views = %+v, want none", views)
+	}
+
+	for _, body := range []string{
+		`{"name": " "}`,
+		`{"name": "Bad", "config": {"columns": ["missing"]}}`,
+		`{"name": "Bad", "config": {"sort_field": "title", "sort_order": "sideways"}}`,
+	} {
+		w := apiRequest(t, "POST", path, ownerKey, body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	viewPath := fmt.Sprintf("%s/%d", path, first.ID)
+	expectStatus(t, apiRequest(t, "DELETE", viewPath, otherKey, ""), http.StatusNotFound)
+	expectStatus(t, apiRequest(t, "DELETE", viewPath, ownerKey, ""), http.StatusNoContent)
+
+	expectStatus(t, apiRequest(t, "GET", path, "", ""), http.StatusUnauthorized)
+	expectStatus(t, apiRequest(t, "POST", path, "", `{"name": "Open"}`), http.StatusUnauthorized)
+	expectStatus(t, apiRequest(t, "DELETE", viewPath, "", ""), http.StatusUnauthorized)
+}
+
+func TestListViewForms(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	user := createTestUser(t, "User", false)
+	s := newTestSession(t, server, user)
+
+	resp := s.post(fmt.Sprintf("/doctype/%s/views", dt.Name), url.Values{"view_name": {"Titles"}, "column": {"title"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("save: status = %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+	views, err := getListViews(dt.Name, username(user))
+	if err != nil || len(views) != 1 || fmt.Sprint(views[0].Config.Columns) != "[title]" {
+		t.Fatalf("views = %+v, %v", views, err)
+	}
+
+	// A session whose user is gone cannot save or delete views
+	_, err = db.Exec("DELETE FROM User WHERE id = ?", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = s.post(fmt.Sprintf("/doctype/%s/views", dt.Name), url.Values{"view_name": {"Mine"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("save without a user: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	resp = s.post(fmt.Sprintf("/doctype/%s/views/%d", dt.Name, views[0].ID), url.Values{"action": {"delete"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("delete without a user: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -16,14 +16,27 @@ func main() {
 	}
 	defer db.Close()
 
-	// Create a new router
-	r := mux.NewRouter()
+	err = initFileStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Serve static files
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	err = initEmailSender()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Register routes
-	registerRoutes(r)
+	err = startJobWorkers(map[string]int{JobQueueDefault: 4, JobQueueLong: 1})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = startScheduler()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := newRouter()
 
 	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		pathTemplate, _ := route.GetPathTemplate()
@@ -36,3 +49,15 @@ func main() {
 	fmt.Println("Server is running on http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", r))
 }
+
+// newRouter returns the router serving the whole application.
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	// Serve static files
+	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+
+	// Register routes
+	registerRoutes(r)
+	return r
+}
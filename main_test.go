@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestMain runs the tests against a fresh database in a temporary
+// directory, with uploads and email kept there too.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "frappe-go-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dbFile = filepath.Join(dir, "test.db")
+	os.Setenv("FILES_DIR", filepath.Join(dir, "files"))
+	os.Setenv("EMAIL_SENDER", "memory")
+
+	err = initDB()
+	if err == nil {
+		err = initFileStorage()
+	}
+	if err == nil {
+		err = initEmailSender()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	db.Close()
+	readOnlyDB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testCounter makes the names of records created by tests unique.
+var testCounter int
+
+func uniqueName(prefix string) string {
+	testCounter++
+	return fmt.Sprintf("%s%d", prefix, testCounter)
+}
+
+// testPassword is the password of every user made by createTestUser.
+const testPassword = "secret"
+
+// createTestUser creates a user with the role and returns it.
+func createTestUser(t *testing.T, role string, admin bool) *Document {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := Document{Data: map[string]interface{}{
+		"username": uniqueName("user"),
+		"password": string(hash),
+		"is_admin": admin,
+		"role":     role,
+	}}
+	err = createUser(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+// createTestAPIKey returns a new API key for the user.
+func createTestAPIKey(t *testing.T, user *Document) string {
+	t.Helper()
+	key := APIKey{UserID: user.ID, Name: "test"}
+	err := createAPIKey(&key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Key
+}
+
+// createTestDoctype creates a doctype with a unique name.
+func createTestDoctype(t *testing.T, permissions []string, fields ...Field) Doctype {
+	t.Helper()
+	dt := Doctype{Name: uniqueName("Test"), Fields: fields, Permissions: permissions}
+	err := createDoctype(&dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err = getDoctypeByName(dt.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dt
+}
+
+// apiRequest sends a request to the application, authenticated with the
+// API key unless it is empty, and returns the response.
+func apiRequest(t *testing.T, method, path, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveAPIRequest(newAPIRequest(method, path, key, body))
+}
+
+// newAPIRequest builds the request sent by apiRequest, so tests can add
+// headers to it.
+func newAPIRequest(method, path, key, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	return req
+}
+
+func serveAPIRequest(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
+
+// runQueuedJobs runs the due jobs of the default queue until there are
+// none left, as a worker would.
+func runQueuedJobs(t *testing.T) {
+	t.Helper()
+	for {
+		job, err := claimJob(JobQueueDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job == nil {
+			return
+		}
+		runJob(job)
+	}
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, status, w.Body.String())
+	}
+}
+
+// testSession is a logged-in browser session: it keeps the session cookie
+// and sends the session's CSRF token with each form post.
+type testSession struct {
+	t      *testing.T
+	server *httptest.Server
+	client *http.Client
+	token  string
+}
+
+var csrfFieldPattern = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// newTestSession starts a session on the server and logs in as the user.
+func newTestSession(t *testing.T, server *httptest.Server, user *Document) *testSession {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	s := &testSession{t: t, server: server, client: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+
+	s.loadToken()
+	resp := s.post("/login", url.Values{"username": {username(user)}, "password": {testPassword}})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Fatalf("login as %s: status %d", username(user), resp.StatusCode)
+	}
+	// Logging in starts the session with a new token
+	s.loadToken()
+	return s
+}
+
+// loadToken reads the CSRF token from the login page, which any session
+// can load.
+func (s *testSession) loadToken() {
+	s.t.Helper()
+	resp, err := s.client.Get(s.server.URL + "/login")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	m := csrfFieldPattern.FindSubmatch(page)
+	if m == nil {
+		s.t.Fatal("no CSRF token on the login page")
+	}
+	s.token = string(m[1])
+}
+
+// post submits a form with the session's CSRF token.
+func (s *testSession) post(path string, form url.Values) *http.Response {
+	s.t.Helper()
+	form.Set(csrfFormField, s.token)
+	resp, err := s.client.PostForm(s.server.URL+path, form)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+    "crypto/rand"
+    "encoding/hex"
     "net/http"
+    "regexp"
 )
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -28,3 +31,24 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
         next.ServeHTTP(w, r)
     }
 }
+
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs sent by clients are kept if they look like an ID.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags each request with an ID, taken from the
+// X-Request-ID header or generated, and returns it in the same header so
+// errors can be matched to log lines.
+func requestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get(requestIDHeader)
+        if !validRequestID.MatchString(id) {
+            b := make([]byte, 8)
+            rand.Read(b)
+            id = hex.EncodeToString(b)
+        }
+        w.Header().Set(requestIDHeader, id)
+        next.ServeHTTP(w, r)
+    })
+}
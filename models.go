@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"strconv"
 	"strings"
 )
 
@@ -16,6 +17,11 @@ type Doctype struct {
 	Name        string   `json:"name"`
 	Fields      []Field  `json:"fields"`
 	Permissions []string `json:"permissions"`
+	// List view settings: the field shown as each row's link, and the
+	// default order of the list
+	TitleField string `json:"title_field,omitempty"`
+	SortField  string `json:"sort_field,omitempty"`
+	SortOrder  string `json:"sort_order,omitempty"`
 }
 
 type Field struct {
@@ -25,6 +31,9 @@ type Field struct {
 	Type        string   `json:"type"`
 	Label       string   `json:"label"`
 	Required    bool     `json:"required"`
+	Searchable  bool     `json:"searchable"`
+	InListView  bool     `json:"in_list_view"`
+	Options     string   `json:"options,omitempty"` // Doctype a link or table field refers to
 	Permissions []string `json:"permissions"`
 }
 
@@ -32,6 +41,7 @@ type Document struct {
 	ID          int                    `json:"id"`
 	DoctypeName string                 `json:"doctype_name"`
 	Data        map[string]interface{} `json:"data"`
+	ModifiedBy  string                 `json:"-"` // User making the current change, for hooks
 }
 
 type User struct {
@@ -42,7 +52,7 @@ type User struct {
 }
 
 func getDoctypes() ([]Doctype, error) {
-	rows, err := db.Query("SELECT id, name FROM doctypes")
+	rows, err := db.Query("SELECT id, name, title_field, sort_field, sort_order FROM doctypes")
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +61,7 @@ func getDoctypes() ([]Doctype, error) {
 	var doctypes []Doctype
 	for rows.Next() {
 		var dt Doctype
-		err := rows.Scan(&dt.ID, &dt.Name)
+		err := rows.Scan(&dt.ID, &dt.Name, &dt.TitleField, &dt.SortField, &dt.SortOrder)
 		if err != nil {
 			return nil, err
 		}
@@ -73,7 +83,7 @@ func getDoctypes() ([]Doctype, error) {
 }
 
 func getFields(doctypeID int64) ([]Field, error) {
-	rows, err := db.Query("SELECT id, name, type, label, required FROM fields WHERE doctype_id = ?", doctypeID)
+	rows, err := db.Query("SELECT id, name, type, label, required, searchable, in_list_view, options FROM fields WHERE doctype_id = ?", doctypeID)
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +92,7 @@ func getFields(doctypeID int64) ([]Field, error) {
 	var fields []Field
 	for rows.Next() {
 		var f Field
-		err := rows.Scan(&f.ID, &f.Name, &f.Type, &f.Label, &f.Required)
+		err := rows.Scan(&f.ID, &f.Name, &f.Type, &f.Label, &f.Required, &f.Searchable, &f.InListView, &f.Options)
 		if err != nil {
 			return nil, err
 		}
@@ -110,7 +120,7 @@ func getFields(doctypeID int64) ([]Field, error) {
 }
 
 func getPermissions(doctypeID int64) ([]string, error) {
-	rows, err := db.Query("SELECT permission FROM permissions WHERE doctype_id = ?", doctypeID)
+	rows, err := db.Query("SELECT permission FROM doctype_permissions WHERE doctype_id = ?", doctypeID)
 	if err != nil {
 		return nil, err
 	}
@@ -130,6 +140,11 @@ func getPermissions(doctypeID int64) ([]string, error) {
 }
 
 func createDoctype(dt *Doctype) error {
+	err := checkFieldOptions(*dt)
+	if err != nil {
+		return err
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -137,7 +152,8 @@ func createDoctype(dt *Doctype) error {
 	defer tx.Rollback()
 
 	// Insert into doctypes table
-	result, err := tx.Exec("INSERT INTO doctypes (name) VALUES (?)", dt.Name)
+	result, err := tx.Exec("INSERT INTO doctypes (name, title_field, sort_field, sort_order) VALUES (?, ?, ?, ?)",
+		dt.Name, dt.TitleField, dt.SortField, dt.SortOrder)
 	if err != nil {
 		return err
 	}
@@ -149,16 +165,26 @@ func createDoctype(dt *Doctype) error {
 
 	// Insert fields
 	for _, field := range dt.Fields {
-		_, err = tx.Exec("INSERT INTO fields (doctype_id, name, type, label, required) VALUES (?, ?, ?, ?, ?)",
-			doctypeID, field.Name, field.Type, field.Label, field.Required)
+		result, err := tx.Exec("INSERT INTO fields (doctype_id, name, type, label, required, searchable, in_list_view, options) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			doctypeID, field.Name, field.Type, field.Label, field.Required, field.Searchable, field.InListView, field.Options)
+		if err != nil {
+			return err
+		}
+		fieldID, err := result.LastInsertId()
 		if err != nil {
 			return err
 		}
+		for _, permission := range field.Permissions {
+			_, err = tx.Exec("INSERT INTO field_permissions (field_id, permission) VALUES (?, ?)", fieldID, permission)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	// Insert permissions
 	for _, permission := range dt.Permissions {
-		_, err = tx.Exec("INSERT INTO permissions (doctype_id, permission) VALUES (?, ?)",
+		_, err = tx.Exec("INSERT INTO doctype_permissions (doctype_id, permission) VALUES (?, ?)",
 			doctypeID, permission)
 		if err != nil {
 			return err
@@ -199,6 +225,10 @@ func getSQLType(fieldType string) string {
 		return "TEXT"
 	case "select":
 		return "TEXT"
+	case "attach", "attach_image":
+		return "TEXT"
+	case "link":
+		return "INTEGER"
 	default:
 		return "TEXT"
 	}
@@ -249,12 +279,38 @@ func getDocuments(doctypeName string) ([]Document, error) {
 	return documents, nil
 }
 
+// dbExecutor is implemented by both *sql.DB and *sql.Tx, so the document
+// writes below can run on their own or as part of a larger transaction.
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func createDocument(doc *Document) error {
 	doctype, err := getDoctypeByName(doc.DoctypeName)
 	if err != nil {
 		return err
 	}
 
+	err = insertDocument(db, doctype, doc)
+	if err != nil {
+		return err
+	}
+
+	runDocumentHooks(DocEventInsert, doc)
+	return nil
+
+}
+
+// insertDocument validates and stores a new document without running
+// hooks.
+func insertDocument(q dbExecutor, doctype Doctype, doc *Document) error {
+	err := validateDocument(doctype, doc.Data, false)
+	if err != nil {
+		return err
+	}
+
 	columns := []string{}
 	values := []interface{}{}
 	placeholders := []string{}
@@ -272,7 +328,7 @@ func createDocument(doc *Document) error {
 		strings.Join(columns, ", "),
 		strings.Join(placeholders, ", "))
 
-	result, err := db.Exec(query, values...)
+	result, err := q.Exec(query, values...)
 	if err != nil {
 		return err
 	}
@@ -284,7 +340,6 @@ func createDocument(doc *Document) error {
 
 	doc.ID = int(id)
 	return nil
-
 }
 
 func updateDocument(doc *Document) error {
@@ -293,6 +348,38 @@ func updateDocument(doc *Document) error {
 		return err
 	}
 
+	events, err := writeDocumentUpdate(db, doctype, doc)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		runDocumentHooks(event, doc)
+	}
+	return nil
+}
+
+// writeDocumentUpdate validates and stores the changed fields of a document
+// without running hooks. It returns the hook events the update calls for.
+func writeDocumentUpdate(q dbExecutor, doctype Doctype, doc *Document) ([]string, error) {
+	err := validateDocument(doctype, doc.Data, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note the current docstatus to tell whether this update submits or
+	// cancels the document
+	var oldStatus interface{}
+	_, statusChanged := doc.Data["docstatus"]
+	statusChanged = statusChanged && getFieldByName(doctype.Fields, "docstatus") != nil
+	if statusChanged {
+		query := fmt.Sprintf("SELECT docstatus FROM `%s` WHERE id = ?", doc.DoctypeName)
+		err = q.QueryRow(query, doc.ID).Scan(&oldStatus)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
 	updates := []string{}
 	values := []interface{}{}
 
@@ -303,25 +390,44 @@ func updateDocument(doc *Document) error {
 		}
 	}
 
+	if len(updates) == 0 {
+		return nil, nil
+	}
 	values = append(values, doc.ID)
 
 	query := fmt.Sprintf("UPDATE `%s` SET %s WHERE id = ?",
 		doc.DoctypeName,
 		strings.Join(updates, ", "))
 
-	_, err = db.Exec(query, values...)
-	return err
+	result, err := q.Exec(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, &NotFoundError{What: "document"}
+	}
+
+	events := []string{DocEventUpdate}
+	if statusChanged {
+		if event := docStatusEvent(oldStatus, doc.Data["docstatus"]); event != "" {
+			events = append(events, event)
+		}
+	}
+	return events, nil
 }
 
 func getDoctypeByName(name string) (Doctype, error) {
 	var dt Doctype
-	err := db.QueryRow("SELECT id, name FROM doctypes WHERE name = ?", name).Scan(&dt.ID, &dt.Name)
+	err := db.QueryRow("SELECT id, name, title_field, sort_field, sort_order FROM doctypes WHERE name = ?", name).Scan(&dt.ID, &dt.Name, &dt.TitleField, &dt.SortField, &dt.SortOrder)
+	if err == sql.ErrNoRows {
+		return dt, &NotFoundError{What: "doctype"}
+	}
 	if err != nil {
 		return dt, err
 	}
 
 	// Get fields
-	rows, err := db.Query("SELECT id, name, type, label, required FROM fields WHERE doctype_id = ?", dt.ID)
+	rows, err := db.Query("SELECT id, name, type, label, required, searchable, in_list_view, options FROM fields WHERE doctype_id = ?", dt.ID)
 	if err != nil {
 		return dt, err
 	}
@@ -329,7 +435,7 @@ func getDoctypeByName(name string) (Doctype, error) {
 
 	for rows.Next() {
 		var f Field
-		err := rows.Scan(&f.ID, &f.Name, &f.Type, &f.Label, &f.Required)
+		err := rows.Scan(&f.ID, &f.Name, &f.Type, &f.Label, &f.Required, &f.Searchable, &f.InListView, &f.Options)
 		if err != nil {
 			return dt, err
 		}
@@ -376,18 +482,24 @@ func getDocumentByID(doctypeName, id string) (Document, error) {
 	// First, get the doctype to know the fields
 	doctype, err := getDoctypeByName(doctypeName)
 	if err != nil {
-		return Document{}, fmt.Errorf("error getting doctype: %v", err)
+		return Document{}, fmt.Errorf("error getting doctype: %w", err)
 	}
 
+	return readDocument(db, doctype, id)
+}
+
+// readDocument loads a document of a doctype that has already been looked
+// up.
+func readDocument(q dbExecutor, doctype Doctype, id string) (Document, error) {
 	// Construct the query
 	fieldNames := getFieldNames(doctype.Fields)
 	query := fmt.Sprintf("SELECT id, %s FROM `%s` WHERE id = ?",
 		strings.Join(fieldNames, ", "),
-		doctypeName)
+		doctype.Name)
 
 	// Execute the query
 	var doc Document
-	doc.DoctypeName = doctypeName
+	doc.DoctypeName = doctype.Name
 	doc.Data = make(map[string]interface{})
 
 	var scanValues []interface{}
@@ -396,12 +508,12 @@ func getDocumentByID(doctypeName, id string) (Document, error) {
 		scanValues = append(scanValues, new(interface{}))
 	}
 
-	err = db.QueryRow(query, id).Scan(scanValues...)
+	err := q.QueryRow(query, id).Scan(scanValues...)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return Document{}, fmt.Errorf("document not found")
+			return Document{}, &NotFoundError{What: "document"}
 		}
-		return Document{}, fmt.Errorf("error querying document: %v", err)
+		return Document{}, fmt.Errorf("error querying document: %w", err)
 	}
 
 	// Populate the doc.Data map
@@ -415,6 +527,11 @@ func getDocumentByID(doctypeName, id string) (Document, error) {
 func updateDoctype(dt *Doctype) error {
 	log.Printf("Updating doctype: %d", dt.ID)
 
+	err := checkFieldOptions(*dt)
+	if err != nil {
+		return err
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		log.Printf("Error beginning transaction: %v", err)
@@ -446,6 +563,14 @@ func updateDoctype(dt *Doctype) error {
 		}
 	}
 
+	// Update list view settings
+	_, err = tx.Exec("UPDATE doctypes SET title_field = ?, sort_field = ?, sort_order = ? WHERE id = ?",
+		dt.TitleField, dt.SortField, dt.SortOrder, dt.ID)
+	if err != nil {
+		log.Printf("Error updating list view settings: %v", err)
+		return err
+	}
+
 	// Alter table structure
 	for _, newField := range dt.Fields {
 		oldField := getFieldByName(originalDoctype.Fields, newField.Name)
@@ -496,8 +621,8 @@ func updateDoctype(dt *Doctype) error {
 	}
 
 	for _, field := range dt.Fields {
-		result, err := tx.Exec("INSERT INTO fields (doctype_id, name, type, label, required) VALUES (?, ?, ?, ?, ?)",
-			dt.ID, field.Name, field.Type, field.Label, field.Required)
+		result, err := tx.Exec("INSERT INTO fields (doctype_id, name, type, label, required, searchable, in_list_view, options) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			dt.ID, field.Name, field.Type, field.Label, field.Required, field.Searchable, field.InListView, field.Options)
 		if err != nil {
 			log.Printf("Error inserting field: %v", err)
 			return err
@@ -555,7 +680,7 @@ func getFieldByName(fields []Field, name string) *Field {
 
 func getDoctypeByID(id int64) (Doctype, error) {
 	var dt Doctype
-	err := db.QueryRow("SELECT id, name FROM doctypes WHERE id = ?", id).Scan(&dt.ID, &dt.Name)
+	err := db.QueryRow("SELECT id, name, title_field, sort_field, sort_order FROM doctypes WHERE id = ?", id).Scan(&dt.ID, &dt.Name, &dt.TitleField, &dt.SortField, &dt.SortOrder)
 	if err != nil {
 		return dt, err
 	}
@@ -582,9 +707,24 @@ func getFieldNames(fields []Field) []string {
 }
 
 func deleteDocument(doctypeName, id string) error {
+	// Keep a copy of the document so hooks can see what was removed
+	doc, err := getDocumentByID(doctypeName, id)
+	if err != nil {
+		doc = Document{DoctypeName: doctypeName}
+		doc.ID, _ = strconv.Atoi(id)
+	}
+
 	query := fmt.Sprintf("DELETE FROM `%s` WHERE id = ?", doctypeName)
-	_, err := db.Exec(query, id)
-	return err
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &NotFoundError{What: "document"}
+	}
+
+	runDocumentHooks(DocEventDelete, &doc)
+	return nil
 }
 
 func createUserDoctype() error {
@@ -635,7 +775,7 @@ func getUserByID(id int) (*Document, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("user not found")
+	return nil, &NotFoundError{What: "user"}
 }
 
 func getUserByUsername(username string) (Document, error) {
@@ -650,7 +790,7 @@ func getUserByUsername(username string) (Document, error) {
 		}
 	}
 
-	return Document{}, fmt.Errorf("user not found")
+	return Document{}, &NotFoundError{What: "user"}
 }
 
 func createUser(user *Document) error {
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+)
+
+// NotificationRuleDoctype is the doctype holding the email alert rules.
+// Each rule names a doctype and event, an optional condition and who to
+// email, with subject and message templates. Conditions and templates use
+// html/template syntax and see the document as .Doc, e.g.
+//
+//	{{if eq .Doc.status "Open"}}yes{{end}}
+//
+// A rule applies when its condition renders to anything other than blank,
+// "0" or "false".
+const NotificationRuleDoctype = "Notification Rule"
+
+// NotificationRuleContext is the data that rule conditions and templates
+// are rendered with.
+type NotificationRuleContext struct {
+	Doc     map[string]interface{}
+	Doctype string
+	ID      int
+	Event   string
+	User    string
+	Link    string
+}
+
+func init() {
+	registerDocumentHook(notificationRuleHook)
+}
+
+// createNotificationRuleDoctype creates the Notification Rule doctype unless
+// it already exists.
+func createNotificationRuleDoctype() error {
+	if _, err := getDoctypeByName(NotificationRuleDoctype); err == nil {
+		return nil
+	}
+
+	ruleDoctype := Doctype{
+		Name: NotificationRuleDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "document_type", Type: "string", Label: "Document Type", Required: true},
+			{Name: "event", Type: "string", Label: "Event (insert, update, delete, submit or cancel)", Required: true},
+			{Name: "condition", Type: "text", Label: "Condition", Required: false},
+			{Name: "recipient_fields", Type: "string", Label: "Recipients from Fields (comma separated)", Required: false},
+			{Name: "recipient_roles", Type: "string", Label: "Recipients by Role (comma separated)", Required: false},
+			{Name: "subject", Type: "string", Label: "Subject", Required: true},
+			{Name: "message", Type: "text", Label: "Message", Required: true},
+			{Name: "enabled", Type: "boolean", Label: "Enabled", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+
+	return createDoctype(&ruleDoctype)
+}
+
+// notificationRuleHook queues the emails of every enabled rule matching the
+// document event.
+func notificationRuleHook(event string, doc *Document) error {
+	if doc.DoctypeName == NotificationRuleDoctype {
+		return nil
+	}
+
+	rules, err := findEventRules(NotificationRuleDoctype, doc.DoctypeName, event)
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	data, err := hookDocumentData(event, doc)
+	if err != nil {
+		return err
+	}
+
+	ctx := NotificationRuleContext{
+		Doc:     data,
+		Doctype: doc.DoctypeName,
+		ID:      doc.ID,
+		Event:   event,
+		User:    doc.ModifiedBy,
+		Link:    fmt.Sprintf("/doctype/%s/document/%d", doc.DoctypeName, doc.ID),
+	}
+
+	var errs []string
+	for _, rule := range rules {
+		if err := applyNotificationRule(rule, ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("rule %q: %v", ruleString(rule, "name"), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// findEventRules returns the enabled documents of a rule doctype, such as
+// Notification Rule or Webhook, whose document_type and event match.
+func findEventRules(ruleDoctype, doctypeName, event string) ([]Document, error) {
+	rules, err := getDocuments(ruleDoctype)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Document
+	for _, rule := range rules {
+		if ruleString(rule, "document_type") == doctypeName && strings.EqualFold(ruleString(rule, "event"), event) && ruleEnabled(rule) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching, nil
+}
+
+func applyNotificationRule(rule Document, ctx NotificationRuleContext) error {
+	if condition := strings.TrimSpace(ruleString(rule, "condition")); condition != "" {
+		result, err := renderRuleTemplate("condition", condition, ctx)
+		if err != nil {
+			return err
+		}
+		switch strings.TrimSpace(result) {
+		case "", "0", "false":
+			return nil
+		}
+	}
+
+	subject, err := renderRuleTemplate("subject", ruleString(rule, "subject"), ctx)
+	if err != nil {
+		return err
+	}
+	// The subject is a plain text header, so undo the HTML escaping
+	subject = strings.TrimSpace(html.UnescapeString(subject))
+
+	body, err := renderRuleTemplate("message", ruleString(rule, "message"), ctx)
+	if err != nil {
+		return err
+	}
+
+	recipients, err := ruleRecipients(rule, ctx.Doc)
+	if err != nil {
+		return err
+	}
+	for _, to := range recipients {
+		msg := EmailMessage{To: to, Subject: subject, Body: body, HTML: true}
+		if err := queueEmail(&msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renderRuleTemplate(name, text string, ctx NotificationRuleContext) (string, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, ctx); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ruleRecipients returns the email addresses a rule sends to. Recipient
+// fields may hold an email address or a username, and roles match the
+// users with that role. Users are emailed at the address in their
+// notification settings.
+func ruleRecipients(rule Document, data map[string]interface{}) ([]string, error) {
+	seen := make(map[string]bool)
+	var recipients []string
+	add := func(address string) {
+		address = strings.TrimSpace(address)
+		if address != "" && !seen[address] && !strings.ContainsAny(address, "\r\n") {
+			seen[address] = true
+			recipients = append(recipients, address)
+		}
+	}
+
+	for _, field := range splitList(ruleString(rule, "recipient_fields")) {
+		value, _ := data[field].(string)
+		for _, v := range splitList(value) {
+			if strings.Contains(v, "@") {
+				add(v)
+				continue
+			}
+			address, err := userEmail(v)
+			if err != nil {
+				return nil, err
+			}
+			add(address)
+		}
+	}
+
+	if roles := splitList(ruleString(rule, "recipient_roles")); len(roles) > 0 {
+		users, err := getAllUsers()
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			for _, role := range roles {
+				if strings.EqualFold(userRole(&user), role) {
+					address, err := userEmail(username(&user))
+					if err != nil {
+						return nil, err
+					}
+					add(address)
+					break
+				}
+			}
+		}
+	}
+
+	return recipients, nil
+}
+
+// userEmail returns the address a user receives email at, or "" if they
+// have not set one.
+func userEmail(name string) (string, error) {
+	settings, err := getNotificationSettings(name)
+	if err != nil {
+		return "", err
+	}
+	return settings.Email, nil
+}
+
+func ruleString(rule Document, field string) string {
+	s, _ := rule.Data[field].(string)
+	return strings.TrimSpace(s)
+}
+
+func ruleEnabled(rule Document) bool {
+	switch v := rule.Data["enabled"].(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// sentEmails runs the queued jobs and returns the email they sent since
+// the last call.
+func sentEmails(t *testing.T) []EmailMessage {
+	t.Helper()
+	runQueuedJobs(t)
+	sender := emailSender.(*MemorySender)
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sent := sender.Sent
+	sender.Sent = nil
+	return sent
+}
+
+// createTestRule creates an enabled notification rule for the doctype with
+// the given fields set.
+func createTestRule(t *testing.T, doctype string, data map[string]interface{}) {
+	t.Helper()
+	rule := Document{DoctypeName: NotificationRuleDoctype, Data: map[string]interface{}{
+		"name":          uniqueName("rule"),
+		"document_type": doctype,
+		"event":         DocEventInsert,
+		"subject":       "{{.Doc.title}}",
+		"message":       "<p>{{.Doc.title}}</p>",
+		"enabled":       true,
+	}}
+	for k, v := range data {
+		rule.Data[k] = v
+	}
+	err := createDocument(&rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotificationRuleMatching(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "status", Type: "string", Label: "Status"},
+		Field{Name: "email", Type: "string", Label: "Email"},
+	)
+	sentEmails(t)
+	createTestRule(t, dt.Name, map[string]interface{}{"recipient_fields": "email", "subject": "new {{.Doc.title}}"})
+	createTestRule(t, dt.Name, map[string]interface{}{"recipient_fields": "email", "event": DocEventUpdate, "subject": "changed {{.Doc.title}}"})
+	createTestRule(t, dt.Name, map[string]interface{}{"recipient_fields": "email", "subject": "open {{.Doc.title}}",
+		"condition": `{{if eq .Doc.status "Open"}}yes{{end}}`})
+	createTestRule(t, dt.Name, map[string]interface{}{"recipient_fields": "email", "subject": "disabled", "enabled": false})
+
+	tests := []struct {
+		name   string
+		status string
+		want   []string
+	}{
+		{"condition fails", "Closed", []string{"new a & b"}},
+		{"condition passes", "Open", []string{"new a & b", "open a & b"}},
+	}
+	for _, tt := range tests {
+		doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{
+			"title": "a & b", "status": tt.status, "email": "owner@example.com",
+		}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var subjects []string
+		for _, msg := range sentEmails(t) {
+			if msg.To != "owner@example.com" || !msg.HTML {
+				t.Errorf("%s: sent %+v", tt.name, msg)
+			}
+			subjects = append(subjects, msg.Subject)
+		}
+		sort.Strings(subjects)
+		if fmt.Sprint(subjects) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: subjects = %q, want %q", tt.name, subjects, tt.want)
+		}
+	}
+
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "c", "email": "owner@example.com"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentEmails(t)
+	err = updateDocument(&Document{ID: doc.ID, DoctypeName: dt.Name, Data: map[string]interface{}{"title": "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := sentEmails(t)
+	if len(sent) != 1 || sent[0].Subject != "changed d" || sent[0].Body != "<p>d</p>" {
+		t.Errorf("update sent %+v, want one email for the update rule", sent)
+	}
+}
+
+func TestNotificationRuleRecipients(t *testing.T) {
+	role := uniqueName("Role")
+	member := createTestUser(t, role, false)
+	other := createTestUser(t, role, false)
+	owner := createTestUser(t, "User", false)
+	settings := map[*Document]string{
+		member: "member@example.com",
+		other:  "other@example.com\r\nBcc: victim@example.com",
+		owner:  "owner@example.com",
+	}
+	for user, email := range settings {
+		err := saveNotificationSettings(username(user), NotificationSettings{Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "contacts", Type: "string", Label: "Contacts"},
+		Field{Name: "assigned_to", Type: "string", Label: "Assigned To"},
+	)
+	createTestRule(t, dt.Name, map[string]interface{}{"recipient_fields": "contacts, assigned_to", "recipient_roles": role})
+
+	tests := []struct {
+		name     string
+		contacts string
+		want     []string
+	}{
+		{"fields, users and roles", "a@example.com, b@example.com, member@example.com",
+			[]string{"a@example.com", "b@example.com", "member@example.com", "owner@example.com"}},
+		{"CR/LF in a field", "a@example.com\r\nBcc: victim@example.com",
+			[]string{"member@example.com", "owner@example.com"}},
+		{"LF in a field", "a@example.com\nCc: victim@example.com, b@example.com",
+			[]string{"b@example.com", "member@example.com", "owner@example.com"}},
+	}
+	for _, tt := range tests {
+		doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{
+			"title": "t", "contacts": tt.contacts, "assigned_to": username(owner),
+		}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var to []string
+		for _, msg := range sentEmails(t) {
+			to = append(to, msg.To)
+		}
+		sort.Strings(to)
+		if fmt.Sprint(to) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: sent to %q, want %q", tt.name, to, tt.want)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Notification types
+const (
+	NotificationMention    = "mention"
+	NotificationAssignment = "assignment"
+	NotificationShare      = "share"
+	NotificationWorkflow   = "workflow"
+	NotificationChange     = "change"
+)
+
+// notificationTypes lists the events users can set preferences for, with
+// their labels.
+var notificationTypes = []struct {
+	Type  string
+	Label string
+}{
+	{NotificationAssignment, "A document is assigned to me"},
+	{NotificationMention, "Someone mentions me"},
+	{NotificationShare, "A document is shared with me"},
+	{NotificationWorkflow, "A document I own moves to another workflow state"},
+	{NotificationChange, "Someone changes a document I own"},
+}
+
+// Notification is an entry in a user's notification log.
+type Notification struct {
+	ID        int64  `json:"id"`
+	ForUser   string `json:"for_user"`
+	Type      string `json:"type"`
+	Subject   string `json:"subject"`
+	Doctype   string `json:"doctype"`
+	DocID     int    `json:"doc_id"`
+	FromUser  string `json:"from_user"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Link returns the page the notification refers to.
+func (n Notification) Link() string {
+	if n.Doctype == "" {
+		return "/notifications"
+	}
+	return fmt.Sprintf("/doctype/%s/document/%d", n.Doctype, n.DocID)
+}
+
+// NotificationPreference controls how a user hears about one type of event.
+type NotificationPreference struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+	InApp bool   `json:"in_app"`
+	Email bool   `json:"email"`
+}
+
+// NotificationSettings are a user's notification preferences.
+type NotificationSettings struct {
+	Email       string                   `json:"email"`
+	Preferences []NotificationPreference `json:"preferences"`
+}
+
+func init() {
+	registerDocumentHook(ownerNotificationHook)
+}
+
+func createNotificationTables() error {
+	createNotificationLogTable := `
+	CREATE TABLE IF NOT EXISTS notification_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		for_user TEXT NOT NULL,
+		type TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		doctype TEXT NOT NULL DEFAULT '',
+		doc_id INTEGER NOT NULL DEFAULT 0,
+		from_user TEXT NOT NULL DEFAULT '',
+		read BOOLEAN NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createNotificationLogTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_notification_log_user ON notification_log (for_user, read)")
+	if err != nil {
+		return err
+	}
+
+	createSettingsTable := `
+	CREATE TABLE IF NOT EXISTS notification_settings (
+		user TEXT PRIMARY KEY,
+		email TEXT NOT NULL DEFAULT ''
+	);`
+
+	_, err = db.Exec(createSettingsTable)
+	if err != nil {
+		return err
+	}
+
+	createPreferencesTable := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		user TEXT NOT NULL,
+		type TEXT NOT NULL,
+		in_app BOOLEAN NOT NULL,
+		email BOOLEAN NOT NULL,
+		PRIMARY KEY (user, type)
+	);`
+
+	_, err = db.Exec(createPreferencesTable)
+	return err
+}
+
+// getNotificationSettings returns the user's preferences. Events without a
+// saved preference are shown in the app and not emailed.
+func getNotificationSettings(user string) (NotificationSettings, error) {
+	var settings NotificationSettings
+	err := db.QueryRow("SELECT email FROM notification_settings WHERE user = ?", user).Scan(&settings.Email)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, err
+	}
+
+	saved := make(map[string]NotificationPreference)
+	rows, err := db.Query("SELECT type, in_app, email FROM notification_preferences WHERE user = ?", user)
+	if err != nil {
+		return settings, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p NotificationPreference
+		if err := rows.Scan(&p.Type, &p.InApp, &p.Email); err != nil {
+			return settings, err
+		}
+		saved[p.Type] = p
+	}
+	if err := rows.Err(); err != nil {
+		return settings, err
+	}
+
+	for _, t := range notificationTypes {
+		p, ok := saved[t.Type]
+		if !ok {
+			p = NotificationPreference{Type: t.Type, InApp: true}
+		}
+		p.Label = t.Label
+		settings.Preferences = append(settings.Preferences, p)
+	}
+	return settings, nil
+}
+
+func saveNotificationSettings(user string, settings NotificationSettings) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO notification_settings (user, email) VALUES (?, ?) ON CONFLICT (user) DO UPDATE SET email = excluded.email",
+		user, settings.Email)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range settings.Preferences {
+		_, err = tx.Exec(`INSERT INTO notification_preferences (user, type, in_app, email) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user, type) DO UPDATE SET in_app = excluded.in_app, email = excluded.email`,
+			user, p.Type, p.InApp, p.Email)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// createNotification adds an entry to the recipient's notification log.
+func createNotification(n *Notification) error {
+	n.CreatedAt = nowTimestamp()
+	result, err := db.Exec(`INSERT INTO notification_log (for_user, type, subject, doctype, doc_id, from_user, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		n.ForUser, n.Type, n.Subject, n.Doctype, n.DocID, n.FromUser, n.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	n.ID, err = result.LastInsertId()
+	return err
+}
+
+// notifyUser delivers a notification through the channels the recipient
+// has chosen for its type.
+func notifyUser(n *Notification) error {
+	settings, err := getNotificationSettings(n.ForUser)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range settings.Preferences {
+		if p.Type != n.Type {
+			continue
+		}
+		if p.InApp {
+			if err := createNotification(n); err != nil {
+				return err
+			}
+		}
+		if p.Email && settings.Email != "" {
+			msg := EmailMessage{To: settings.Email, Subject: n.Subject, Body: n.Subject + "\n\n" + n.Link()}
+			if err := queueEmail(&msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// documentOwner returns the user who created the document, from its first
+// recorded version.
+func documentOwner(doctypeName string, docID int) (string, error) {
+	var owner string
+	err := db.QueryRow("SELECT user FROM document_versions WHERE doctype = ? AND doc_id = ? ORDER BY id LIMIT 1",
+		doctypeName, docID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return owner, err
+}
+
+// ownerNotificationHook tells owners when someone else changes their
+// documents.
+func ownerNotificationHook(event string, doc *Document) error {
+	if event != DocEventUpdate || doc.ModifiedBy == "" {
+		return nil
+	}
+
+	owner, err := documentOwner(doc.DoctypeName, doc.ID)
+	if err != nil || owner == "" || owner == doc.ModifiedBy {
+		return err
+	}
+
+	return notifyUser(&Notification{
+		ForUser:  owner,
+		Type:     NotificationChange,
+		Subject:  fmt.Sprintf("%s changed %s %d", doc.ModifiedBy, doc.DoctypeName, doc.ID),
+		Doctype:  doc.DoctypeName,
+		DocID:    doc.ID,
+		FromUser: doc.ModifiedBy,
+	})
+}
+
+func getNotifications(user string, unreadOnly bool, limit int) ([]Notification, error) {
+	query := "SELECT id, for_user, type, subject, doctype, doc_id, from_user, read, created_at FROM notification_log WHERE for_user = ?"
+	if unreadOnly {
+		query += " AND read = 0"
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+
+	rows, err := db.Query(query, user, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		err := rows.Scan(&n.ID, &n.ForUser, &n.Type, &n.Subject, &n.Doctype, &n.DocID, &n.FromUser, &n.Read, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func countUnreadNotifications(user string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notification_log WHERE for_user = ? AND read = 0", user).Scan(&count)
+	return count, err
+}
+
+// markNotificationsRead marks the user's notification as read, or all of
+// them when id is 0.
+func markNotificationsRead(user string, id int64) error {
+	if id == 0 {
+		_, err := db.Exec("UPDATE notification_log SET read = 1 WHERE for_user = ?", user)
+		return err
+	}
+
+	result, err := db.Exec("UPDATE notification_log SET read = 1 WHERE for_user = ? AND id = ?", user, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &NotFoundError{What: "notification"}
+	}
+	return nil
+}
+
+func notificationsHandler(w http.ResponseWriter, r *http.Request) {
+	user := username(currentUser(r))
+
+	if r.Method == http.MethodPost {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		err = markNotificationsRead(user, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if next := r.FormValue("next"); next != "" && next[0] == '/' && (len(next) == 1 || next[1] != '/') {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+		return
+	}
+
+	notifications, err := getNotifications(user, false, 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Notifications",
+		Content: struct {
+			Notifications []Notification
+		}{
+			Notifications: notifications,
+		},
+	}
+	renderTemplate(w, r, "notifications.html", data)
+}
+
+func notificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := username(currentUser(r))
+
+	settings, err := getNotificationSettings(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+
+		settings.Email = r.FormValue("email")
+		for i, p := range settings.Preferences {
+			settings.Preferences[i].InApp = contains(r.Form["in_app"], p.Type)
+			settings.Preferences[i].Email = contains(r.Form["email_notify"], p.Type)
+		}
+
+		err = saveNotificationSettings(user, settings)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/notifications/settings", http.StatusSeeOther)
+		return
+	}
+
+	data := PageData{
+		Title:   "Notification Settings",
+		Content: settings,
+	}
+	renderTemplate(w, r, "notification_settings.html", data)
+}
+
+func apiListNotifications(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	notifications, err := getNotifications(username(user), r.URL.Query().Get("unread") == "1", limit)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	unread, err := countUnreadNotifications(username(user))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	RespondJSON(w, http.StatusOK, map[string]interface{}{
+		"unread":        unread,
+		"notifications": notifications,
+	})
+}
+
+func apiMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	var id int64
+	if idStr, ok := mux.Vars(r)["id"]; ok {
+		var err error
+		id, err = strconv.ParseInt(idStr, 10, 64)
+		if err != nil || id <= 0 {
+			RespondError(w, http.StatusBadRequest, "Invalid ID")
+			return
+		}
+	}
+
+	err := markNotificationsRead(username(user), id)
+	if err != nil {
+		RespondAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiGetNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	settings, err := getNotificationSettings(username(user))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, settings)
+}
+
+func apiUpdateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	var settings NotificationSettings
+	err := json.NewDecoder(r.Body).Decode(&settings)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	for _, p := range settings.Preferences {
+		known := false
+		for _, t := range notificationTypes {
+			known = known || t.Type == p.Type
+		}
+		if !known {
+			RespondError(w, http.StatusBadRequest, fmt.Sprintf("Unknown notification type %q", p.Type))
+			return
+		}
+	}
+
+	err = saveNotificationSettings(username(user), settings)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	settings, err = getNotificationSettings(username(user))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, settings)
+}
+
+// logNotifyError is used where a failed notification must not fail the
+// action that caused it.
+func logNotifyError(err error) {
+	if err != nil {
+		log.Printf("Error sending notification: %v", err)
+	}
+}
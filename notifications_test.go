@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// notificationList is the body of GET /api/notifications.
+type notificationList struct {
+	Unread        int            `json:"unread"`
+	Notifications []Notification `json:"notifications"`
+}
+
+func listNotifications(t *testing.T, key, query string) notificationList {
+	t.Helper()
+	w := apiRequest(t, "GET", "/api/notifications"+query, key, "")
+	expectStatus(t, w, http.StatusOK)
+	var list notificationList
+	err := json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestOwnerNotifications(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	owner := createTestUser(t, "User", false)
+	ownerKey := createTestAPIKey(t, owner)
+	editor := createTestUser(t, "User", false)
+
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}, ModifiedBy: username(owner)}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Owners are not told about their own changes
+	for _, by := range []*Document{owner, editor} {
+		err = updateDocument(&Document{ID: doc.ID, DoctypeName: dt.Name, Data: map[string]interface{}{"title": username(by)}, ModifiedBy: username(by)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := listNotifications(t, ownerKey, "")
+	if list.Unread != 1 || len(list.Notifications) != 1 {
+		t.Fatalf("notifications = %+v, want one", list)
+	}
+	n := list.Notifications[0]
+	if n.Type != NotificationChange || n.FromUser != username(editor) || n.Link() != fmt.Sprintf("/doctype/%s/document/%d", dt.Name, doc.ID) {
+		t.Errorf("notification = %+v", n)
+	}
+
+	expectStatus(t, apiRequest(t, "POST", fmt.Sprintf("/api/notifications/%d/read", n.ID), createTestAPIKey(t, editor), ""), http.StatusNotFound)
+	expectStatus(t, apiRequest(t, "POST", fmt.Sprintf("/api/notifications/%d/read", n.ID), ownerKey, ""), http.StatusNoContent)
+	if list := listNotifications(t, ownerKey, "?unread=1"); list.Unread != 0 || len(list.Notifications) != 0 {
+		t.Errorf("unread notifications = %+v, want none", list)
+	}
+	if list := listNotifications(t, ownerKey, ""); len(list.Notifications) != 1 || !list.Notifications[0].Read {
+		t.Errorf("notifications = %+v, want one read", list)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	user := createTestUser(t, "User", false)
+	key := createTestAPIKey(t, user)
+
+	body := fmt.Sprintf(`{"email": "me@example.com", "preferences": [{"type": %q, "in_app": false, "email": true}]}`, NotificationAssignment)
+	w := apiRequest(t, "PUT", "/api/notifications/settings", key, body)
+	expectStatus(t, w, http.StatusOK)
+	var settings NotificationSettings
+	json.Unmarshal(w.Body.Bytes(), &settings)
+	if len(settings.Preferences) != len(notificationTypes) {
+		t.Errorf("settings = %+v, want every type", settings)
+	}
+	w = apiRequest(t, "PUT", "/api/notifications/settings", key, `{"preferences": [{"type": "nope", "in_app": true}]}`)
+	expectStatus(t, w, http.StatusBadRequest)
+
+	sentEmails(t)
+	for _, typ := range []string{NotificationAssignment, NotificationMention} {
+		err := notifyUser(&Notification{ForUser: username(user), Type: typ, Subject: "about " + typ})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Assignments only by email, mentions only in the app, as by default
+	list := listNotifications(t, key, "")
+	if len(list.Notifications) != 1 || list.Notifications[0].Type != NotificationMention {
+		t.Errorf("notifications = %+v, want the mention", list.Notifications)
+	}
+	sent := sentEmails(t)
+	if len(sent) != 1 || sent[0].To != "me@example.com" || sent[0].Subject != "about "+NotificationAssignment {
+		t.Errorf("sent %+v, want the assignment email", sent)
+	}
+
+	expectStatus(t, apiRequest(t, "POST", "/api/notifications/read-all", key, ""), http.StatusNoContent)
+	if list := listNotifications(t, key, ""); list.Unread != 0 {
+		t.Errorf("%d unread after reading all", list.Unread)
+	}
+	expectStatus(t, apiRequest(t, "GET", "/api/notifications", "", ""), http.StatusUnauthorized)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// openAPIVersion is the version of the API described by the generated
+// specification.
+const openAPIVersion = "1.0.0"
+
+var openAPINameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// openAPIName turns a doctype name into one usable as a schema name or
+// operation ID, which may not contain spaces.
+func openAPIName(doctypeName string) string {
+	return openAPINameInvalidChars.ReplaceAllString(doctypeName, "")
+}
+
+// openAPIFieldSchema returns the JSON schema of a field's values.
+func openAPIFieldSchema(field Field) map[string]interface{} {
+	schema := map[string]interface{}{"title": field.Label}
+	switch field.Type {
+	case "integer":
+		schema["type"] = "integer"
+		schema["format"] = "int64"
+	case "float":
+		schema["type"] = "number"
+		schema["format"] = "double"
+	case "boolean":
+		schema["type"] = "boolean"
+	case "date":
+		schema["type"] = "string"
+		schema["format"] = "date"
+	case "datetime":
+		schema["type"] = "string"
+		schema["format"] = "date-time"
+	case "attach", "attach_image":
+		schema["type"] = "string"
+		schema["description"] = "URL of the attached file"
+	case "link":
+		schema["type"] = "integer"
+		schema["format"] = "int64"
+		schema["description"] = "ID of a " + field.Options + " document"
+	default:
+		schema["type"] = "string"
+	}
+	if !field.Required {
+		schema["nullable"] = true
+	}
+	return schema
+}
+
+// openAPIDoctypeSchemas returns the schemas of a doctype's document data,
+// of its documents, and of the body that creates one.
+func openAPIDoctypeSchemas(doctype Doctype) map[string]interface{} {
+	name := openAPIName(doctype.Name)
+
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, field := range doctype.Fields {
+		if field.Type == "table" {
+			// Child rows are documents of their own doctype
+			continue
+		}
+		properties[field.Name] = openAPIFieldSchema(field)
+		if field.Required {
+			required = append(required, field.Name)
+		}
+	}
+	data := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		data["required"] = required
+	}
+
+	doctypeName := map[string]interface{}{"type": "string", "enum": []string{doctype.Name}}
+	return map[string]interface{}{
+		name + "Data": data,
+		name: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"id":           map[string]interface{}{"type": "integer"},
+				"doctype_name": doctypeName,
+				"data":         openAPIRef(name + "Data"),
+			},
+		},
+		name + "Create": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"doctype_name", "data"},
+			"properties": map[string]interface{}{
+				"doctype_name": doctypeName,
+				"data":         openAPIRef(name + "Data"),
+			},
+		},
+	}
+}
+
+func openAPIRef(schema string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + schema}
+}
+
+func openAPIJSONContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func openAPIResponse(description string, schema interface{}) map[string]interface{} {
+	response := map[string]interface{}{"description": description}
+	if schema != nil {
+		response["content"] = openAPIJSONContent(schema)
+	}
+	return response
+}
+
+func openAPIErrorResponse(description string) map[string]interface{} {
+	return openAPIResponse(description, openAPIRef("Error"))
+}
+
+func openAPIQueryParameter(name, description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      schema,
+	}
+}
+
+// openAPIDoctypePaths returns the list, get, update, patch and delete
+// operations of a doctype.
+func openAPIDoctypePaths(doctype Doctype) map[string]interface{} {
+	name := openAPIName(doctype.Name)
+	base := "/api/documents/" + url.PathEscape(doctype.Name)
+	tags := []string{doctype.Name}
+
+	sortFields := []string{"id"}
+	for _, field := range visibleFields(doctype, doctype.Fields) {
+		sortFields = append(sortFields, field.Name)
+	}
+
+	list := map[string]interface{}{
+		"tags":        tags,
+		"summary":     "List " + doctype.Name + " documents",
+		"operationId": "list" + name,
+		"parameters": []interface{}{
+			openAPIQueryParameter("fields", "Comma-separated fields to return",
+				map[string]interface{}{"type": "string"}),
+			openAPIQueryParameter("filters", fmt.Sprintf(
+				"JSON list of [field, operator, value] filters, or an object of field: value equality filters. Operators: %v",
+				reportFilterOperators),
+				map[string]interface{}{"type": "string"}),
+			openAPIQueryParameter("order_by", "Field to sort by",
+				map[string]interface{}{"type": "string", "enum": sortFields}),
+			openAPIQueryParameter("order", "Sort direction",
+				map[string]interface{}{"type": "string", "enum": []string{"asc", "desc"}}),
+			openAPIQueryParameter("limit", "Maximum number of documents to return",
+				map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxPageSize}),
+			openAPIQueryParameter("offset", "Number of documents to skip",
+				map[string]interface{}{"type": "integer", "minimum": 0}),
+		},
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "The matching documents",
+				"headers": map[string]interface{}{
+					"X-Total-Count": map[string]interface{}{
+						"description": "Number of documents matching the filters",
+						"schema":      map[string]interface{}{"type": "integer"},
+					},
+				},
+				"content": openAPIJSONContent(map[string]interface{}{
+					"type":  "array",
+					"items": openAPIRef(name),
+				}),
+			},
+			"400": openAPIErrorResponse("Invalid parameters"),
+			"403": openAPIErrorResponse("Permission denied"),
+		},
+	}
+
+	idParameter := map[string]interface{}{
+		"name":     "id",
+		"in":       "path",
+		"required": true,
+		"schema":   map[string]interface{}{"type": "integer"},
+	}
+	document := map[string]interface{}{
+		"parameters": []interface{}{idParameter},
+		"get": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Get a " + doctype.Name + " document",
+			"operationId": "get" + name,
+			"responses": map[string]interface{}{
+				"200": openAPIResponse("The document", openAPIRef(name)),
+				"404": openAPIResponse("Document not found", nil),
+			},
+		},
+		"put": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Update a " + doctype.Name + " document",
+			"description": "Only the fields present in data are changed.",
+			"operationId": "update" + name,
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": openAPIJSONContent(map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"data": map[string]interface{}{
+							"type":        "object",
+							"description": "The fields to change, with values as in " + name + "Data",
+						},
+					},
+				}),
+			},
+			"responses": map[string]interface{}{
+				"200": openAPIResponse("The changes that were saved", openAPIRef(name)),
+			},
+		},
+		"patch": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Patch a " + doctype.Name + " document",
+			"description": "Applies a JSON Merge Patch or a JSON Patch to the document as returned by GET. Fields set to null or removed are cleared.",
+			"operationId": "patch" + name,
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					mergePatchContentType: map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"data": map[string]interface{}{"type": "object"},
+							},
+						},
+					},
+					jsonPatchContentType: map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type":  "array",
+							"items": openAPIRef("JSONPatchOperation"),
+						},
+					},
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": openAPIResponse("The patched document", openAPIRef(name)),
+				"400": openAPIErrorResponse("Invalid patch or validation failed"),
+				"404": openAPIErrorResponse("Document not found"),
+				"409": openAPIErrorResponse("A test operation failed"),
+			},
+		},
+		"delete": map[string]interface{}{
+			"tags":        tags,
+			"summary":     "Delete a " + doctype.Name + " document",
+			"operationId": "delete" + name,
+			"responses": map[string]interface{}{
+				"204": openAPIResponse("Deleted", nil),
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		base:           map[string]interface{}{"get": list},
+		base + "/{id}": document,
+	}
+}
+
+// buildOpenAPISpec generates an OpenAPI 3 document describing the document
+// API of the given doctypes.
+func buildOpenAPISpec(doctypes []Doctype, serverURL string) map[string]interface{} {
+	schemas := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{"type": "string"},
+			},
+		},
+		"JSONPatchOperation": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"op", "path"},
+			"properties": map[string]interface{}{
+				"op": map[string]interface{}{
+					"type": "string",
+					"enum": []string{"add", "remove", "replace", "move", "copy", "test"},
+				},
+				"path":  map[string]interface{}{"type": "string"},
+				"from":  map[string]interface{}{"type": "string"},
+				"value": map[string]interface{}{},
+			},
+		},
+	}
+	paths := map[string]interface{}{}
+	tags := []interface{}{}
+	createSchemas := []interface{}{}
+	mapping := map[string]interface{}{}
+
+	sort.Slice(doctypes, func(i, j int) bool { return doctypes[i].Name < doctypes[j].Name })
+	for _, doctype := range doctypes {
+		for name, schema := range openAPIDoctypeSchemas(doctype) {
+			schemas[name] = schema
+		}
+		for path, item := range openAPIDoctypePaths(doctype) {
+			paths[path] = item
+		}
+		tags = append(tags, map[string]interface{}{"name": doctype.Name})
+		ref := "#/components/schemas/" + openAPIName(doctype.Name) + "Create"
+		createSchemas = append(createSchemas, map[string]interface{}{"$ref": ref})
+		mapping[doctype.Name] = ref
+	}
+
+	if len(doctypes) > 0 {
+		paths["/api/documents"] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary":     "Create a document",
+				"description": "The doctype_name member picks the doctype of the new document.",
+				"operationId": "createDocument",
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": openAPIJSONContent(map[string]interface{}{
+						"oneOf": createSchemas,
+						"discriminator": map[string]interface{}{
+							"propertyName": "doctype_name",
+							"mapping":      mapping,
+						},
+					}),
+				},
+				"responses": map[string]interface{}{
+					"201": openAPIResponse("The created document", map[string]interface{}{"oneOf": createSchemas}),
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Frappe Go API",
+			"version": openAPIVersion,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": serverURL}},
+		"tags":    tags,
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": "session-name",
+				},
+				"apiKey": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"session": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		},
+	}
+}
+
+// readableDoctypes returns the doctypes the user may see documents of.
+func readableDoctypes(user *Document) ([]Doctype, error) {
+	doctypes, err := getDoctypes()
+	if err != nil {
+		return nil, err
+	}
+	readable := []Doctype{}
+	for _, doctype := range doctypes {
+		if canReadDoctype(user, doctype) {
+			readable = append(readable, doctype)
+		}
+	}
+	return readable, nil
+}
+
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// apiOpenAPISpec serves the OpenAPI specification of the document API,
+// generated from the doctypes the user can read.
+func apiOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Login required")
+		return
+	}
+	doctypes, err := readableDoctypes(user)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, buildOpenAPISpec(doctypes, requestBaseURL(r)))
+}
+
+// APIDocsData is the content of the API docs page.
+type APIDocsData struct {
+	Doctypes  []Doctype
+	Operators []string
+}
+
+func apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	doctypes, err := readableDoctypes(currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(doctypes, func(i, j int) bool { return doctypes[i].Name < doctypes[j].Name })
+
+	renderTemplate(w, r, "api_docs.html", PageData{
+		Title:   "API Docs",
+		Content: APIDocsData{Doctypes: doctypes, Operators: reportFilterOperators},
+	})
+}
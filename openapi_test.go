@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func getTestOpenAPISpec(t *testing.T, key string) map[string]interface{} {
+	t.Helper()
+	w := apiRequest(t, "GET", "/api/openapi.json", key, "")
+	expectStatus(t, w, http.StatusOK)
+	var spec map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// openAPIRefs returns every $ref in a part of the specification.
+func openAPIRefs(v interface{}) []string {
+	var refs []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if ref, ok := item.(string); ok && k == "$ref" {
+				refs = append(refs, ref)
+			}
+			refs = append(refs, openAPIRefs(item)...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			refs = append(refs, openAPIRefs(item)...)
+		}
+	}
+	return refs
+}
+
+// lookup follows a path of keys through nested JSON objects.
+func lookup(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	dt := Doctype{Name: uniqueName("Sales Order "), Fields: []Field{
+		{Name: "title", Type: "string", Label: "Title", Required: true},
+		{Name: "amount", Type: "float", Label: "Amount"},
+		{Name: "due", Type: "date", Label: "Due"},
+		{Name: "customer", Type: "link", Label: "Customer", Options: "User"},
+	}}
+	err := createDoctype(&dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	spec := getTestOpenAPISpec(t, createTestAPIKey(t, createTestUser(t, "User", false)))
+
+	if spec["openapi"] != "3.0.3" || fmt.Sprint(lookup(spec, "servers")) != "[map[url:http://example.com]]" {
+		t.Errorf("openapi = %v, servers = %v", spec["openapi"], spec["servers"])
+	}
+	name := openAPIName(dt.Name)
+	if strings.Contains(name, " ") {
+		t.Errorf("schema name %q has a space", name)
+	}
+	schemas := lookup(spec, "components", "schemas").(map[string]interface{})
+	data := schemas[name+"Data"]
+	if fmt.Sprint(lookup(data, "required")) != "[title]" {
+		t.Errorf("required = %v", lookup(data, "required"))
+	}
+	for field, want := range map[string]string{"title": "string", "amount": "number", "due": "string", "customer": "integer"} {
+		if got := lookup(data, "properties", field, "type"); got != want {
+			t.Errorf("%s type = %v, want %s", field, got, want)
+		}
+	}
+	if lookup(data, "properties", "due", "format") != "date" || lookup(data, "properties", "customer", "description") != "ID of a User document" {
+		t.Errorf("properties = %v", lookup(data, "properties"))
+	}
+
+	base := "/api/documents/" + url.PathEscape(dt.Name)
+	paths := spec["paths"].(map[string]interface{})
+	for _, path := range []string{base, base + "/{id}", "/api/documents"} {
+		if paths[path] == nil {
+			t.Errorf("no path %s", path)
+		}
+	}
+	if lookup(paths, base+"/{id}", "patch", "operationId") != "patch"+name {
+		t.Errorf("patch = %v", lookup(paths, base+"/{id}", "patch"))
+	}
+	if lookup(paths, "/api/documents", "post", "requestBody", "content", "application/json", "schema", "discriminator", "mapping", dt.Name) != "#/components/schemas/"+name+"Create" {
+		t.Error("create mapping does not name the doctype's schema")
+	}
+	for _, ref := range openAPIRefs(spec) {
+		if schemas[strings.TrimPrefix(ref, "#/components/schemas/")] == nil {
+			t.Errorf("dangling $ref %s", ref)
+		}
+	}
+
+	// Only readable doctypes are described
+	if paths["/api/documents/"+private.Name] != nil {
+		t.Errorf("spec describes %s, which the user cannot read", private.Name)
+	}
+	spec = getTestOpenAPISpec(t, createTestAPIKey(t, createTestUser(t, "HR", false)))
+	if lookup(spec, "paths", "/api/documents/"+private.Name) == nil {
+		t.Errorf("spec leaves out %s, which the user can read", private.Name)
+	}
+	expectStatus(t, apiRequest(t, "GET", "/api/openapi.json", "", ""), http.StatusUnauthorized)
+}
+
+func TestOpenAPISortFieldsHideSecretFields(t *testing.T) {
+	spec := getTestOpenAPISpec(t, createTestAPIKey(t, createTestUser(t, "User", true)))
+	params, _ := lookup(spec, "paths", "/api/documents/User", "get", "parameters").([]interface{})
+	for _, p := range params {
+		if lookup(p, "name") != "order_by" {
+			continue
+		}
+		if enum := fmt.Sprint(lookup(p, "schema", "enum")); enum != "[id username is_admin role]" {
+			t.Errorf("order_by enum = %s", enum)
+		}
+		return
+	}
+	t.Error("no order_by parameter")
+}
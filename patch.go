@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Patch formats accepted by PATCH /api/documents/{doctype}/{id}, chosen by
+// the request Content-Type. Both apply to the document as returned by GET,
+// so fields are addressed under "data". Plain application/json is treated
+// as a merge patch.
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// JSONPatchOperation is one step of a JSON Patch (RFC 6902).
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to a decoded JSON
+// value. Null members of the patch remove the member from the target.
+func applyMergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+		} else {
+			t[key] = applyMergePatch(t[key], value)
+		}
+	}
+	return t
+}
+
+// applyJSONPatch applies the operations of a JSON Patch in order to a
+// decoded JSON value.
+func applyJSONPatch(doc interface{}, ops []JSONPatchOperation) (interface{}, error) {
+	for i, op := range ops {
+		var err error
+		doc, err = applyJSONPatchOperation(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyJSONPatchOperation(doc interface{}, op JSONPatchOperation) (interface{}, error) {
+	path, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return jsonPointerAdd(doc, path, cloneJSON(op.Value))
+	case "remove":
+		return jsonPointerRemove(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return cloneJSON(op.Value), nil
+		}
+		doc, err = jsonPointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return jsonPointerAdd(doc, path, cloneJSON(op.Value))
+	case "move", "copy":
+		from, err := parseJSONPointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := jsonPointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+				return nil, fmt.Errorf("cannot move a value into itself")
+			}
+			doc, err = jsonPointerRemove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value = cloneJSON(value)
+		}
+		return jsonPointerAdd(doc, path, value)
+	case "test":
+		value, err := jsonPointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, cloneJSON(op.Value)) {
+			return nil, &ConflictError{Message: fmt.Sprintf("test failed at %s", op.Path)}
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parseJSONPointer splits a JSON Pointer (RFC 6901) into its unescaped
+// reference tokens. The empty pointer refers to the whole document.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func jsonPointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found")
+			}
+			doc = value
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("path not found")
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerAdd sets a member of an object, or inserts an array element
+// ("-" appends), and returns the updated document.
+func jsonPointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			if token == "-" {
+				return append(node, value), nil
+			}
+			i, err := jsonArrayIndex(token, len(node))
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("path not found")
+	})
+}
+
+// jsonPointerRemove removes a member of an object or an array element and
+// returns the updated document.
+func jsonPointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return jsonPointerUpdateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, fmt.Errorf("path not found")
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("path not found")
+	})
+}
+
+// jsonPointerUpdateParent calls change on the container holding the last
+// token of path, and stores the container it returns back in its own
+// parent, since appending to an array can move it.
+func jsonPointerUpdateParent(doc interface{}, path []string, change func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+	child, err := jsonPointerGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = jsonPointerUpdateParent(child, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := jsonArrayIndex(path[0], len(node)-1)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+func jsonArrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// cloneJSON deep copies a value and normalizes it to the types produced by
+// decoding JSON, so values from the document and the patch compare equal.
+func cloneJSON(value interface{}) interface{} {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var out interface{}
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// patchDocument applies a merge patch or JSON Patch to the stored document
+// and returns the fields it changes. Fields the patch removes or sets to
+// null are returned as nil, which clears them.
+func patchDocument(doctype Doctype, doc Document, contentType string, body []byte) (map[string]interface{}, error) {
+	before := cloneJSON(doc).(map[string]interface{})
+
+	var after interface{}
+	switch contentType {
+	case jsonPatchContentType:
+		var ops []JSONPatchOperation
+		err := json.Unmarshal(body, &ops)
+		if err != nil {
+			return nil, err
+		}
+		after, err = applyJSONPatch(cloneJSON(doc), ops)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var patch interface{}
+		err := json.Unmarshal(body, &patch)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("merge patch must be an object")
+		}
+		after = applyMergePatch(cloneJSON(doc), patch)
+	}
+
+	patched, ok := after.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("patched document must be an object")
+	}
+	for key, value := range patched {
+		switch key {
+		case "id", "doctype_name":
+			if !reflect.DeepEqual(value, before[key]) {
+				return nil, fmt.Errorf("%s cannot be changed", key)
+			}
+		case "data":
+		default:
+			return nil, fmt.Errorf("unknown member %q", key)
+		}
+	}
+
+	data, _ := patched["data"].(map[string]interface{})
+	if data == nil && patched["data"] != nil {
+		return nil, fmt.Errorf("data must be an object")
+	}
+	for name := range data {
+		if getFieldByName(doctype.Fields, name) == nil {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+	}
+
+	oldData, _ := before["data"].(map[string]interface{})
+	changes := map[string]interface{}{}
+	for _, field := range doctype.Fields {
+		value := data[field.Name]
+		if !reflect.DeepEqual(value, oldData[field.Name]) {
+			changes[field.Name] = value
+		}
+	}
+	return changes, nil
+}
+
+// apiPatchDocument updates only the fields a patch changes. The body is a
+// JSON Merge Patch or, with Content-Type application/json-patch+json, a
+// JSON Patch.
+func apiPatchDocument(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	doctype, err := getDoctypeByName(vars["doctype"])
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		RespondAPIError(w, http.StatusForbidden, &PermissionError{})
+		return
+	}
+
+	contentType := mergePatchContentType
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		contentType, _, err = mime.ParseMediaType(ct)
+		if err != nil {
+			RespondError(w, http.StatusUnsupportedMediaType, err.Error())
+			return
+		}
+	}
+	switch contentType {
+	case mergePatchContentType, jsonPatchContentType, "application/json":
+	default:
+		RespondError(w, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("Content-Type must be %s or %s", mergePatchContentType, jsonPatchContentType))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Read, patch and write in one transaction, so a test op cannot pass
+	// against a value another request changes before the write
+	tx, err := db.Begin()
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	doc, err := readDocument(tx, doctype, vars["id"])
+	if err != nil {
+		RespondAPIError(w, http.StatusNotFound, err)
+		return
+	}
+
+	// Patches must not be able to test or copy secret values
+	changes, err := patchDocument(doctype, hideSecretFields(doc), contentType, body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	for name := range changes {
+		if !canEditField(user, doctype, *getFieldByName(doctype.Fields, name)) {
+			RespondAPIError(w, http.StatusForbidden, &PermissionError{Message: fmt.Sprintf("Permission denied for field %q", name)})
+			return
+		}
+	}
+
+	update := &Document{ID: doc.ID, DoctypeName: doctype.Name, Data: changes, ModifiedBy: username(user)}
+	events, err := writeDocumentUpdate(tx, doctype, update)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	doc, err = readDocument(tx, doctype, vars["id"])
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	for _, event := range events {
+		runDocumentHooks(event, update)
+	}
+	RespondJSON(w, http.StatusOK, hideSecretFields(doc))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONPatchTestIsAtomic(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "n", Type: "integer", Label: "N"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"n": 0}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	// A session, unlike an API key, is checked without writing anything
+	session := newTestSession(t, server, createTestUser(t, "User", false))
+	url := fmt.Sprintf("%s/api/documents/%s/%d", server.URL, dt.Name, doc.ID)
+
+	// Another writer changes the value while the patch is in flight
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(fmt.Sprintf("UPDATE `%s` SET n = 5 WHERE id = ?", dt.Name), doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() {
+		body := `[{"op": "test", "path": "/data/n", "value": 0}, {"op": "replace", "path": "/data/n", "value": 1}]`
+		req, _ := http.NewRequest("PATCH", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", jsonPatchContentType)
+		resp, err := session.client.Do(req)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	time.Sleep(200 * time.Millisecond)
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := <-done; status != http.StatusConflict {
+		t.Errorf("status = %d, want %d", status, http.StatusConflict)
+	}
+	got, err := readDocument(db, dt, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got.Data["n"]) != "5" {
+		t.Errorf("n = %v, want 5", got.Data["n"])
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// currentUser returns the logged-in user for the request, or nil if the
+// session is not authenticated. A request carrying an API key is made as
+// the key's user, whatever its session.
+func currentUser(r *http.Request) *Document {
+	if key := requestAPIKey(r); key != "" {
+		if user, ok := r.Context().Value(apiKeyUserKey{}).(*Document); ok {
+			return user
+		}
+		user, err := userForAPIKey(key)
+		if err != nil {
+			return nil
+		}
+		return user
+	}
+
+	session, _ := store.Get(r, "session-name")
+	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+		return nil
+	}
+	userID, ok := session.Values["user_id"].(int)
+	if !ok || userID == 0 {
+		return nil
+	}
+	user, err := getUserByID(userID)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// isAdminUser reports whether the user has the admin flag or the Admin role.
+func isAdminUser(user *Document) bool {
+	if user == nil {
+		return false
+	}
+	switch v := user.Data["is_admin"].(type) {
+	case bool:
+		if v {
+			return true
+		}
+	case int64:
+		if v != 0 {
+			return true
+		}
+	}
+	return strings.EqualFold(userRole(user), "Admin")
+}
+
+// username returns the login name of the user.
+func username(user *Document) string {
+	if user == nil {
+		return ""
+	}
+	name, _ := user.Data["username"].(string)
+	return name
+}
+
+// userRole returns the role name stored on the user document.
+func userRole(user *Document) string {
+	if user == nil {
+		return ""
+	}
+	role, _ := user.Data["role"].(string)
+	return role
+}
+
+// canReadDoctype reports whether the user may see documents of the doctype.
+// Doctypes without permissions are open to every logged-in user.
+func canReadDoctype(user *Document, dt Doctype) bool {
+	if user == nil {
+		return false
+	}
+	if isAdminUser(user) || len(dt.Permissions) == 0 {
+		return true
+	}
+	role := userRole(user)
+	for _, p := range dt.Permissions {
+		if strings.EqualFold(p, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// canEditField reports whether the user may change a field. Fields without
+// permissions can be changed by anyone who can read the doctype.
+func canEditField(user *Document, dt Doctype, field Field) bool {
+	if !canReadDoctype(user, dt) {
+		return false
+	}
+	if isAdminUser(user) || len(field.Permissions) == 0 {
+		return true
+	}
+	role := userRole(user)
+	for _, p := range field.Permissions {
+		if strings.EqualFold(p, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDocumentWrite returns a *PermissionError unless the user may write
+// documents of the doctype, including each of the given fields.
+func checkDocumentWrite(user *Document, dt Doctype, data map[string]interface{}) error {
+	if !canReadDoctype(user, dt) {
+		return &PermissionError{}
+	}
+	for name := range data {
+		field := getFieldByName(dt.Fields, name)
+		if field != nil && !canEditField(user, dt, *field) {
+			return &PermissionError{Message: fmt.Sprintf("permission denied for field %q", name)}
+		}
+	}
+	return nil
+}
+
+// secretFields are stored with their documents but never sent to clients,
+// nor can clients filter, sort or group on them.
+var secretFields = map[string][]string{
+	"User": {"password"},
+}
+
+// isSecretField reports whether a field of the doctype is secret.
+func isSecretField(doctype, name string) bool {
+	for _, secret := range secretFields[doctype] {
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hideSecretFields returns a copy of the document without its secret
+// fields, ready to be sent to a client.
+func hideSecretFields(doc Document) Document {
+	for _, name := range secretFields[doc.DoctypeName] {
+		if _, ok := doc.Data[name]; ok {
+			doc.Data = copyWithout(doc.Data, name)
+		}
+	}
+	return doc
+}
+
+// visibleFields returns the fields without the doctype's secret ones.
+func visibleFields(doctype Doctype, fields []Field) []Field {
+	if len(secretFields[doctype.Name]) == 0 {
+		return fields
+	}
+	var visible []Field
+	for _, field := range fields {
+		if !isSecretField(doctype.Name, field.Name) {
+			visible = append(visible, field)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAPIDocumentWritesNeedPermission(t *testing.T) {
+	user := createTestUser(t, "User", false)
+	userKey := createTestAPIKey(t, user)
+	adminKey := createTestAPIKey(t, createTestUser(t, "Admin", true))
+
+	report := `{"doctype_name": "Query Report", "data": {"name": "Users", "query": "SELECT id FROM User"}}`
+	expectStatus(t, apiRequest(t, "POST", "/api/documents", "", report), http.StatusUnauthorized)
+	expectStatus(t, apiRequest(t, "POST", "/api/documents", userKey, report), http.StatusForbidden)
+
+	w := apiRequest(t, "POST", "/api/documents", adminKey, report)
+	expectStatus(t, w, http.StatusCreated)
+	var created Document
+	json.Unmarshal(w.Body.Bytes(), &created)
+	path := fmt.Sprintf("/api/documents/Query%%20Report/%d", created.ID)
+	expectStatus(t, apiRequest(t, "PUT", path, userKey, `{"data": {"query": "SELECT 1"}}`), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "DELETE", path, userKey, ""), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "DELETE", path, "", ""), http.StatusUnauthorized)
+
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "salary", Type: "string", Label: "Salary", Permissions: []string{"HR"}},
+	)
+	expectStatus(t, apiRequest(t, "POST", "/api/documents", userKey,
+		fmt.Sprintf(`{"doctype_name": %q, "data": {"title": "a", "salary": "10"}}`, dt.Name)), http.StatusForbidden)
+	w = apiRequest(t, "POST", "/api/documents", userKey, fmt.Sprintf(`{"doctype_name": %q, "data": {"title": "a"}}`, dt.Name))
+	expectStatus(t, w, http.StatusCreated)
+	json.Unmarshal(w.Body.Bytes(), &created)
+	path = fmt.Sprintf("/api/documents/%s/%d", dt.Name, created.ID)
+	expectStatus(t, apiRequest(t, "PUT", path, userKey, `{"data": {"salary": "20"}}`), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "PUT", path, userKey, `{"data": {"title": "b"}}`), http.StatusOK)
+}
+
+func TestFormDocumentWritesNeedPermission(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	user := createTestUser(t, "User", false)
+	s := newTestSession(t, server, user)
+
+	resp := s.post("/doctype/Query%20Report/document/new", url.Values{"name": {"Users"}, "query": {"SELECT id FROM User"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("new Query Report: status %d, want 403", resp.StatusCode)
+	}
+
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "salary", Type: "string", Label: "Salary", Permissions: []string{"HR"}},
+	)
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a", "salary": "10"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/doctype/%s/document/%d", dt.Name, doc.ID)
+
+	// The form posts every field back, so an unchanged restricted field
+	// does not stop the save
+	resp = s.post(path, url.Values{"title": {"b"}, "salary": {"10"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("edit with salary unchanged: status %d, want 303", resp.StatusCode)
+	}
+	resp = s.post(path, url.Values{"title": {"b"}, "salary": {"99"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("edit of salary: status %d, want 403", resp.StatusCode)
+	}
+
+	stored, err := getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Data["title"] != "b" || stored.Data["salary"] != "10" {
+		t.Errorf("stored data = %v, want title b and salary 10", stored.Data)
+	}
+}
+
+func TestSystemDoctypesAreAdminOnly(t *testing.T) {
+	userKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	adminKey := createTestAPIKey(t, createTestUser(t, "User", true))
+	for _, name := range []string{WebhookDoctype, ScheduledJobDoctype, QueryReportDoctype, DashboardDoctype,
+		DashboardChartDoctype, KanbanBoardDoctype, CalendarViewDoctype, NotificationRuleDoctype} {
+		path := "/api/documents/" + url.PathEscape(name)
+		expectStatus(t, apiRequest(t, "GET", path, userKey, ""), http.StatusForbidden)
+		expectStatus(t, apiRequest(t, "GET", path, adminKey, ""), http.StatusOK)
+	}
+}
+
+func TestMigrateLegacyPermissions(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	_, err := db.Exec("INSERT INTO permissions (doctype_id, permission) VALUES (?, 'HR')", dt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM permissions WHERE doctype_id = ?", dt.ID)
+	migrate := func() {
+		t.Helper()
+		err := migrateLegacyPermissions()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.Exec("PRAGMA user_version = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate()
+	migrate()
+	dt, err = getDoctypeByName(dt.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(dt.Permissions) != "[HR]" {
+		t.Fatalf("permissions = %v, want the legacy HR permission once", dt.Permissions)
+	}
+
+	// Later boots leave the permissions alone
+	dt.Permissions = nil
+	err = updateDoctype(&dt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate()
+	dt, err = getDoctypeByName(dt.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dt.Permissions) != 0 {
+		t.Errorf("permissions = %v, want none after they were removed", dt.Permissions)
+	}
+	var legacy int
+	db.QueryRow("SELECT COUNT(*) FROM permissions WHERE doctype_id = ?", dt.ID).Scan(&legacy)
+	if legacy != 1 {
+		t.Errorf("%d legacy permissions, want the table left as it was", legacy)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Filter restricts a document query to rows where Field compares to Value
+// with Operator.
+type Filter struct {
+	Field    string      `json:"field"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value"`
+}
+
+var filterOperators = map[string]string{
+	"=":        "=",
+	"!=":       "!=",
+	">":        ">",
+	"<":        "<",
+	">=":       ">=",
+	"<=":       "<=",
+	"like":     "LIKE",
+	"not like": "NOT LIKE",
+	"in":       "IN",
+	"not in":   "NOT IN",
+	"is":       "IS",
+}
+
+// parseFilters reads filters from their JSON form. Both a list of
+// [field, operator, value] triples and an object of field: value equality
+// filters are accepted.
+func parseFilters(raw string) ([]Filter, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(raw, "{") {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+			return nil, fmt.Errorf("invalid filters: %v", err)
+		}
+		var filters []Filter
+		for field, value := range obj {
+			filters = append(filters, Filter{Field: field, Operator: "=", Value: value})
+		}
+		return filters, nil
+	}
+
+	var list [][]interface{}
+	if err := json.Unmarshal([]byte(raw), &list); err != nil {
+		return nil, fmt.Errorf("invalid filters: %v", err)
+	}
+
+	var filters []Filter
+	for _, item := range list {
+		if len(item) != 3 {
+			return nil, fmt.Errorf("invalid filter %v: expected [field, operator, value]", item)
+		}
+		field, ok1 := item[0].(string)
+		op, ok2 := item[1].(string)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("invalid filter %v: field and operator must be strings", item)
+		}
+		filters = append(filters, Filter{Field: field, Operator: op, Value: item[2]})
+	}
+	return filters, nil
+}
+
+// isDocumentColumn reports whether name is a column of the doctype's table
+// that clients may query. Secret fields are left out.
+func isDocumentColumn(doctype Doctype, name string) bool {
+	if isSecretField(doctype.Name, name) {
+		return false
+	}
+	return name == "id" || getFieldByName(doctype.Fields, name) != nil
+}
+
+// buildWhereClause turns filters into a SQL WHERE clause. Field names are
+// checked against the doctype and values are always bound as parameters.
+func buildWhereClause(doctype Doctype, filters []Filter) (string, []interface{}, error) {
+	if len(filters) == 0 {
+		return "", nil, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+
+	for _, f := range filters {
+		if !isDocumentColumn(doctype, f.Field) {
+			return "", nil, fmt.Errorf("unknown field %q", f.Field)
+		}
+		op, ok := filterOperators[strings.ToLower(f.Operator)]
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported operator %q", f.Operator)
+		}
+		column := fmt.Sprintf("`%s`", f.Field)
+
+		switch op {
+		case "IN", "NOT IN":
+			values, ok := f.Value.([]interface{})
+			if !ok {
+				if s, isString := f.Value.(string); isString {
+					for _, v := range strings.Split(s, ",") {
+						values = append(values, strings.TrimSpace(v))
+					}
+				} else {
+					values = []interface{}{f.Value}
+				}
+			}
+			if len(values) == 0 {
+				if op == "IN" {
+					conditions = append(conditions, "0")
+				}
+				continue
+			}
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+			conditions = append(conditions, fmt.Sprintf("%s %s (%s)", column, op, placeholders))
+			args = append(args, values...)
+		case "IS":
+			switch fmt.Sprint(f.Value) {
+			case "set":
+				conditions = append(conditions, fmt.Sprintf("(%s IS NOT NULL AND %s != '')", column, column))
+			case "not set":
+				conditions = append(conditions, fmt.Sprintf("(%s IS NULL OR %s = '')", column, column))
+			default:
+				return "", nil, fmt.Errorf("operator \"is\" expects \"set\" or \"not set\"")
+			}
+		default:
+			conditions = append(conditions, fmt.Sprintf("%s %s ?", column, op))
+			args = append(args, f.Value)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// resolveFields returns the doctype fields named in the list, or all fields
+// when the list is empty.
+func resolveFields(doctype Doctype, names []string) ([]Field, error) {
+	if len(names) == 0 {
+		return visibleFields(doctype, doctype.Fields), nil
+	}
+
+	var fields []Field
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "id" {
+			continue
+		}
+		field := getFieldByName(doctype.Fields, name)
+		if field == nil || isSecretField(doctype.Name, name) {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		fields = append(fields, *field)
+	}
+	return fields, nil
+}
+
+// streamPageSize is the number of documents streamDocuments reads at a time.
+var streamPageSize = 500
+
+// streamDocuments runs a filtered query and calls fn for each document in
+// turn, so callers can process large tables without holding every row in
+// memory. Documents are read a page at a time, after the last ID seen, so
+// no query is left open while fn runs: fn may write to a slow client
+// without keeping writers out of the database.
+func streamDocuments(doctype Doctype, fields []Field, filters []Filter, fn func(doc Document) error) error {
+	lastID := 0
+	for {
+		page := append(filters[:len(filters):len(filters)], Filter{Field: "id", Operator: ">", Value: lastID})
+		docs, err := readDocumentPage(doctype, fields, page)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			err = fn(doc)
+			if err != nil {
+				return err
+			}
+		}
+		if len(docs) < streamPageSize {
+			return nil
+		}
+		lastID = docs[len(docs)-1].ID
+	}
+}
+
+// readDocumentPage reads the first streamPageSize matching documents in ID
+// order.
+func readDocumentPage(doctype Doctype, fields []Field, filters []Filter) ([]Document, error) {
+	where, args, err := buildWhereClause(doctype, filters)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{"id"}
+	for _, field := range fields {
+		columns = append(columns, fmt.Sprintf("`%s`", field.Name))
+	}
+	query := fmt.Sprintf("SELECT %s FROM `%s`%s ORDER BY id LIMIT %d",
+		strings.Join(columns, ", "), doctype.Name, where, streamPageSize)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []Document
+	for rows.Next() {
+		doc := Document{DoctypeName: doctype.Name, Data: make(map[string]interface{})}
+
+		values := make([]interface{}, len(fields)+1)
+		values[0] = &doc.ID
+		for i := range fields {
+			values[i+1] = new(interface{})
+		}
+
+		err := rows.Scan(values...)
+		if err != nil {
+			return nil, err
+		}
+		for i, field := range fields {
+			doc.Data[field.Name] = *(values[i+1].(*interface{}))
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, rows.Err()
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// QueryReportDoctype is the doctype holding reports defined by SQL. Only
+// admins can edit them. The query must be a single SELECT (or WITH)
+// statement and can use parameters as named placeholders:
+//
+//	SELECT region, SUM(amount) AS total FROM `Sale`
+//	WHERE (:region IS NULL OR region = :region) GROUP BY region
+//
+// Parameters are declared one per line as name:type:Label:default and
+// columns as name:type:Label; everything after the name is optional. A
+// parameter left blank with no default is bound as NULL. Without column
+// definitions every column of the result is shown. Users with one of the
+// space-separated roles, and admins, can run the report.
+const QueryReportDoctype = "Query Report"
+
+// queryReportTimeout is how long a query report may run before it is
+// interrupted. It can be longer than the busy timeout because the database
+// is in WAL mode, where a running read does not hold off writers.
+const queryReportTimeout = 30 * time.Second
+
+// queryReportParamTypes are the types a query report parameter can have.
+// Values are checked like document fields of the same type.
+var queryReportParamTypes = map[string]bool{
+	"string":   true,
+	"integer":  true,
+	"float":    true,
+	"boolean":  true,
+	"date":     true,
+	"datetime": true,
+}
+
+var queryReportNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// QueryReportParam is a filter parameter of a query report.
+type QueryReportParam struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Label   string `json:"label"`
+	Default string `json:"default,omitempty"`
+}
+
+// QueryReport is a parsed Query Report document.
+type QueryReport struct {
+	ID      int                `json:"id"`
+	Name    string             `json:"name"`
+	Query   string             `json:"-"`
+	Params  []QueryReportParam `json:"params"`
+	Columns []ReportColumn     `json:"columns,omitempty"`
+	Roles   []string           `json:"roles"`
+}
+
+// createQueryReportDoctype creates the Query Report doctype unless it
+// already exists.
+func createQueryReportDoctype() error {
+	if _, err := getDoctypeByName(QueryReportDoctype); err == nil {
+		return nil
+	}
+
+	queryReportDoctype := Doctype{
+		Name: QueryReportDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "query", Type: "text", Label: "SQL Query (a single SELECT)", Required: true},
+			{Name: "parameters", Type: "text", Label: "Parameters (one name:type:Label:default per line)", Required: false},
+			{Name: "columns", Type: "text", Label: "Columns (one name:type:Label per line)", Required: false},
+			{Name: "roles", Type: "string", Label: "Roles (space separated)", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+
+	return createDoctype(&queryReportDoctype)
+}
+
+// openReadOnlyDB opens the connection query reports run on. SQLite refuses
+// any write made through it.
+func openReadOnlyDB() error {
+	var err error
+	readOnlyDB, err = sql.Open("sqlite3", "file:"+dbFile+"?mode=ro&_query_only=1&_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+	return readOnlyDB.Ping()
+}
+
+// definitionLines splits a parameters or columns definition into its
+// lines, each split on ":" into at most n parts. Blank lines are skipped.
+func definitionLines(text string, n int) [][]string {
+	var lines [][]string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", n)
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		for len(parts) < n {
+			parts = append(parts, "")
+		}
+		lines = append(lines, parts)
+	}
+	return lines
+}
+
+// parseQueryReport reads a Query Report document and checks its
+// definition.
+func parseQueryReport(doc Document) (QueryReport, error) {
+	qr := QueryReport{
+		ID:    doc.ID,
+		Name:  ruleString(doc, "name"),
+		Roles: strings.Fields(ruleString(doc, "roles")),
+	}
+
+	query, err := checkReadOnlyQuery(ruleString(doc, "query"))
+	if err != nil {
+		return qr, err
+	}
+	qr.Query = query
+
+	for _, parts := range definitionLines(ruleString(doc, "parameters"), 4) {
+		p := QueryReportParam{Name: parts[0], Type: parts[1], Label: parts[2], Default: parts[3]}
+		if !queryReportNamePattern.MatchString(p.Name) {
+			return qr, fmt.Errorf("invalid parameter name %q", p.Name)
+		}
+		if p.Type == "" {
+			p.Type = "string"
+		}
+		if !queryReportParamTypes[p.Type] {
+			return qr, fmt.Errorf("parameter %s has unknown type %q", p.Name, p.Type)
+		}
+		if p.Label == "" {
+			p.Label = p.Name
+		}
+		if p.Default != "" {
+			if _, err := coerceFieldValue(Field{Type: p.Type}, p.Default); err != nil {
+				return qr, fmt.Errorf("default of parameter %s %v", p.Name, err)
+			}
+		}
+		qr.Params = append(qr.Params, p)
+	}
+
+	for _, parts := range definitionLines(ruleString(doc, "columns"), 3) {
+		c := ReportColumn{Name: parts[0], Type: parts[1], Label: parts[2]}
+		if c.Name == "" {
+			return qr, fmt.Errorf("column definition without a name")
+		}
+		if c.Label == "" {
+			c.Label = c.Name
+		}
+		qr.Columns = append(qr.Columns, c)
+	}
+	return qr, nil
+}
+
+// checkReadOnlyQuery makes sure the query is a single SELECT or WITH
+// statement and returns it without a trailing semicolon. The read-only
+// connection is what actually prevents writes; this rejects statements
+// such as ATTACH or PRAGMA, and stacked statements, which it would allow.
+func checkReadOnlyQuery(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return "", fmt.Errorf("the query is empty")
+	}
+
+	// Find the end of the first statement, skipping quoted text and
+	// comments
+	end := len(query)
+scan:
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			j := strings.IndexByte(query[i+1:], closing)
+			if j < 0 {
+				return "", fmt.Errorf("unterminated quote in query")
+			}
+			i += j + 1
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				break scan
+			}
+			i += j
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return "", fmt.Errorf("unterminated comment in query")
+			}
+			i += j + 3
+		case c == ';':
+			end = i
+			break scan
+		}
+	}
+	if rest := strings.TrimSpace(query[end:]); rest != "" && rest != ";" {
+		return "", fmt.Errorf("the query must be a single statement")
+	}
+	query = strings.TrimSpace(query[:end])
+
+	words := strings.Fields(stripLeadingComments(query))
+	if len(words) == 0 || (!strings.EqualFold(words[0], "SELECT") && !strings.EqualFold(words[0], "WITH")) {
+		return "", fmt.Errorf("the query must start with SELECT or WITH")
+	}
+	return query, nil
+}
+
+// stripLeadingComments removes comments from the start of a query.
+func stripLeadingComments(query string) string {
+	for {
+		query = strings.TrimSpace(query)
+		switch {
+		case strings.HasPrefix(query, "--"):
+			i := strings.IndexByte(query, '\n')
+			if i < 0 {
+				return ""
+			}
+			query = query[i+1:]
+		case strings.HasPrefix(query, "/*"):
+			i := strings.Index(query, "*/")
+			if i < 0 {
+				return ""
+			}
+			query = query[i+2:]
+		default:
+			return query
+		}
+	}
+}
+
+// canRunQueryReport reports whether the user may run a query report.
+func canRunQueryReport(user *Document, qr QueryReport) bool {
+	if user == nil {
+		return false
+	}
+	if isAdminUser(user) {
+		return true
+	}
+	role := userRole(user)
+	for _, r := range qr.Roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// getQueryReport finds a query report by name.
+func getQueryReport(name string) (QueryReport, error) {
+	docs, err := getDocuments(QueryReportDoctype)
+	if err != nil {
+		return QueryReport{}, err
+	}
+	for _, doc := range docs {
+		if ruleString(doc, "name") == name {
+			return parseQueryReport(doc)
+		}
+	}
+	return QueryReport{}, sql.ErrNoRows
+}
+
+// getQueryReports lists the query reports the user can run. Reports with
+// an invalid definition are listed for admins only, so they can fix them.
+func getQueryReports(user *Document) ([]QueryReport, error) {
+	docs, err := getDocuments(QueryReportDoctype)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []QueryReport{}
+	for _, doc := range docs {
+		qr, err := parseQueryReport(doc)
+		if err != nil && !isAdminUser(user) {
+			continue
+		}
+		if canRunQueryReport(user, qr) {
+			reports = append(reports, qr)
+		}
+	}
+	return reports, nil
+}
+
+// queryReportArgs converts the submitted parameter values to typed
+// placeholder values.
+func queryReportArgs(qr QueryReport, values url.Values) ([]interface{}, error) {
+	var args []interface{}
+	for _, p := range qr.Params {
+		raw := strings.TrimSpace(values.Get(p.Name))
+		if raw == "" {
+			raw = p.Default
+		}
+		var value interface{}
+		if raw != "" {
+			var err error
+			value, err = coerceFieldValue(Field{Type: p.Type}, raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s %v", p.Label, err)
+			}
+		}
+		args = append(args, sql.Named(p.Name, value))
+	}
+	return args, nil
+}
+
+// runQueryReport runs a query report on the read-only connection with the
+// given parameter values, returning at most limit rows.
+func runQueryReport(ctx context.Context, qr QueryReport, values url.Values, limit int) (ReportResult, error) {
+	args, err := queryReportArgs(qr, values)
+	if err != nil {
+		return ReportResult{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, queryReportTimeout)
+	defer cancel()
+
+	rows, err := readOnlyDB.QueryContext(ctx, qr.Query, args...)
+	if err != nil {
+		return ReportResult{}, queryReportError(ctx, err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return ReportResult{}, err
+	}
+
+	// Pick out the defined columns, in their order, or show them all
+	result := ReportResult{Rows: [][]interface{}{}}
+	var indexes []int
+	if len(qr.Columns) == 0 {
+		for i, name := range names {
+			result.Columns = append(result.Columns, ReportColumn{Name: name, Label: name})
+			indexes = append(indexes, i)
+		}
+	} else {
+		positions := make(map[string]int, len(names))
+		for i, name := range names {
+			positions[name] = i
+		}
+		for _, c := range qr.Columns {
+			i, ok := positions[c.Name]
+			if !ok {
+				return ReportResult{}, fmt.Errorf("column %q is not in the query result", c.Name)
+			}
+			result.Columns = append(result.Columns, c)
+			indexes = append(indexes, i)
+		}
+	}
+
+	for rows.Next() {
+		if len(result.Rows) == limit {
+			result.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(names))
+		pointers := make([]interface{}, len(names))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return ReportResult{}, queryReportError(ctx, err)
+		}
+		row := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			row[i] = exportValue(values[index])
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return ReportResult{}, queryReportError(ctx, err)
+	}
+	return result, nil
+}
+
+// queryReportError explains an error from a query that was interrupted
+// because it ran too long.
+func queryReportError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("the query took longer than %s", queryReportTimeout)
+	}
+	return err
+}
+
+// loadQueryReportForUser fetches the query report named in the URL and
+// checks the user may run it. On failure it returns the HTTP status to
+// respond with.
+func loadQueryReportForUser(r *http.Request) (QueryReport, int, error) {
+	qr, err := getQueryReport(mux.Vars(r)["name"])
+	if err == sql.ErrNoRows {
+		return qr, http.StatusNotFound, fmt.Errorf("Query report not found")
+	}
+	user := currentUser(r)
+	if user == nil {
+		return qr, http.StatusUnauthorized, fmt.Errorf("Not logged in")
+	}
+	if !canRunQueryReport(user, qr) {
+		return qr, http.StatusForbidden, &PermissionError{}
+	}
+	if err != nil {
+		return qr, http.StatusInternalServerError, err
+	}
+	return qr, http.StatusOK, nil
+}
+
+func queryReportHandler(w http.ResponseWriter, r *http.Request) {
+	qr, status, err := loadQueryReportForUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	query := r.URL.Query()
+	values := map[string]string{}
+	for _, p := range qr.Params {
+		values[p.Name] = query.Get(p.Name)
+		if values[p.Name] == "" {
+			values[p.Name] = p.Default
+		}
+	}
+
+	data := struct {
+		Report    QueryReport
+		Values    map[string]string
+		Result    *ReportResult
+		Error     string
+		ExportURL string
+		IsAdmin   bool
+	}{
+		Report:    qr,
+		Values:    values,
+		ExportURL: fmt.Sprintf("/query-reports/%s/export?%s", url.PathEscape(qr.Name), query.Encode()),
+		IsAdmin:   isAdminUser(currentUser(r)),
+	}
+
+	// Reports with parameters wait for the form to be submitted
+	if len(qr.Params) == 0 || query.Get("run") != "" {
+		result, err := runQueryReport(r.Context(), qr, query, defaultReportLimit)
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Result = &result
+		}
+	}
+
+	renderTemplate(w, r, "query_report.html", PageData{Title: qr.Name, Content: data})
+}
+
+func queryReportExportHandler(w http.ResponseWriter, r *http.Request) {
+	qr, status, err := loadQueryReportForUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	result, err := runQueryReport(r.Context(), qr, r.URL.Query(), maxReportLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", exportFormats["csv"])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", sanitizeFilename(qr.Name)))
+	bw := bufio.NewWriter(w)
+	err = exportTable(bw, "csv", qr.Name, result.ColumnNames(), result.Rows)
+	if err != nil {
+		log.Printf("Error exporting query report %s: %v", qr.Name, err)
+		return
+	}
+	bw.Flush()
+}
+
+func apiListQueryReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := getQueryReports(currentUser(r))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, reports)
+}
+
+// apiRunQueryReport runs a query report with the parameters given in the
+// query string.
+func apiRunQueryReport(w http.ResponseWriter, r *http.Request) {
+	qr, status, err := loadQueryReportForUser(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	result, err := runQueryReport(r.Context(), qr, r.URL.Query(), defaultReportLimit)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueryReportReadsDoNotBlockWrites(t *testing.T) {
+	var mode string
+	err := db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if err != nil || mode != "wal" {
+		t.Fatalf("journal_mode = %q, %v; want wal", mode, err)
+	}
+
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	for i := 0; i < 3; i++ {
+		err := createDocument(&Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Keep a report query open, as a slow report would
+	rows, err := readOnlyDB.Query("SELECT id FROM `" + dt.Name + "`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatal("no rows")
+	}
+
+	start := time.Now()
+	err = createDocument(&Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("write took %s while a report was reading", d)
+	}
+}
+
+func TestQueryReportPermissions(t *testing.T) {
+	name := uniqueName("query")
+	report := Document{DoctypeName: QueryReportDoctype, Data: map[string]interface{}{
+		"name":  name,
+		"query": "SELECT 1 AS one",
+		"roles": "Manager",
+	}}
+	err := createDocument(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/query-reports/" + name + "/run"
+
+	expectAPIError(t, apiRequest(t, "GET", path, createTestAPIKey(t, createTestUser(t, "User", false)), ""), http.StatusForbidden, ErrCodePermissionDenied)
+	expectAPIError(t, apiRequest(t, "GET", path, "", ""), http.StatusUnauthorized, ErrCodeUnauthorized)
+	expectStatus(t, apiRequest(t, "GET", path, createTestAPIKey(t, createTestUser(t, "Manager", false)), ""), http.StatusOK)
+}
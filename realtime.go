@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RealtimeEvent tells subscribers that a document changed. It carries no
+// document data; clients fetch the document if they need it.
+type RealtimeEvent struct {
+	Event     string `json:"event"`
+	Doctype   string `json:"doctype"`
+	ID        int    `json:"id"`
+	User      string `json:"user"`
+	Timestamp string `json:"timestamp"`
+}
+
+// realtimeSubscriber is one open event stream. It receives events for the
+// doctypes and documents it subscribed to that its user may read.
+type realtimeSubscriber struct {
+	user      *Document
+	doctypes  map[string]bool
+	documents map[string]bool
+	events    chan RealtimeEvent
+}
+
+func (s *realtimeSubscriber) wants(e RealtimeEvent) bool {
+	return s.doctypes[e.Doctype] || s.documents[fmt.Sprintf("%s/%d", e.Doctype, e.ID)]
+}
+
+// realtimeHub fans document events out to the open event streams.
+type realtimeHub struct {
+	mu          sync.Mutex
+	subscribers map[*realtimeSubscriber]bool
+}
+
+var realtime = &realtimeHub{subscribers: map[*realtimeSubscriber]bool{}}
+
+func (h *realtimeHub) subscribe(s *realtimeSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[s] = true
+}
+
+func (h *realtimeHub) unsubscribe(s *realtimeSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, s)
+}
+
+// publish sends the event to interested subscribers. Subscribers that are
+// too far behind miss the event rather than slowing down the write.
+func (h *realtimeHub) publish(e RealtimeEvent) error {
+	h.mu.Lock()
+	var targets []*realtimeSubscriber
+	for s := range h.subscribers {
+		if s.wants(e) {
+			targets = append(targets, s)
+		}
+	}
+	h.mu.Unlock()
+	if len(targets) == 0 {
+		return nil
+	}
+
+	doctype, err := getDoctypeByName(e.Doctype)
+	if err != nil {
+		return err
+	}
+	for _, s := range targets {
+		if !canReadDoctype(s.user, doctype) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerDocumentHook(realtimeHook)
+}
+
+func realtimeHook(event string, doc *Document) error {
+	return realtime.publish(RealtimeEvent{
+		Event:     event,
+		Doctype:   doc.DoctypeName,
+		ID:        doc.ID,
+		User:      doc.ModifiedBy,
+		Timestamp: nowTimestamp(),
+	})
+}
+
+// apiRealtime streams document events as Server-Sent Events. Clients
+// subscribe with doctype=Name for every document of a doctype and
+// document=Name/ID for a single document; both may be repeated.
+func apiRealtime(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		RespondError(w, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	sub := &realtimeSubscriber{
+		user:      user,
+		doctypes:  map[string]bool{},
+		documents: map[string]bool{},
+		events:    make(chan RealtimeEvent, 32),
+	}
+	// Every doctype subscribed to, directly or through one of its documents,
+	// must be readable by the user.
+	names := map[string]bool{}
+	query := r.URL.Query()
+	for _, name := range query["doctype"] {
+		sub.doctypes[name] = true
+		names[name] = true
+	}
+	for _, key := range query["document"] {
+		name, id, ok := strings.Cut(key, "/")
+		if _, err := strconv.Atoi(id); !ok || err != nil {
+			RespondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid document %q, expected Doctype/ID", key))
+			return
+		}
+		sub.documents[key] = true
+		names[name] = true
+	}
+	if len(names) == 0 {
+		RespondError(w, http.StatusBadRequest, "Subscribe to at least one doctype or document")
+		return
+	}
+	for name := range names {
+		doctype, err := getDoctypeByName(name)
+		if err != nil {
+			RespondError(w, http.StatusNotFound, fmt.Sprintf("Doctype %s not found", name))
+			return
+		}
+		if !canReadDoctype(user, doctype) {
+			RespondError(w, http.StatusForbidden, fmt.Sprintf("Permission denied for %s", name))
+			return
+		}
+	}
+
+	realtime.subscribe(sub)
+	defer realtime.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(25 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-sub.events:
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRealtimePublish(t *testing.T) {
+	dt := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	other := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	subscribe := func(user *Document, doctypes, documents []string) *realtimeSubscriber {
+		sub := &realtimeSubscriber{user: user, doctypes: map[string]bool{}, documents: map[string]bool{}, events: make(chan RealtimeEvent, 8)}
+		for _, name := range doctypes {
+			sub.doctypes[name] = true
+		}
+		for _, key := range documents {
+			sub.documents[key] = true
+		}
+		realtime.subscribe(sub)
+		t.Cleanup(func() { realtime.unsubscribe(sub) })
+		return sub
+	}
+	hr := createTestUser(t, "HR", false)
+	reader := subscribe(hr, []string{dt.Name}, nil)
+	outsider := subscribe(createTestUser(t, "User", false), []string{dt.Name}, nil)
+	watcher := subscribe(hr, nil, []string{dt.Name + "/2"})
+	bystander := subscribe(hr, []string{other.Name}, nil)
+
+	for _, id := range []int{1, 2} {
+		err := realtime.publish(RealtimeEvent{Event: DocEventUpdate, Doctype: dt.Name, ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, tt := range map[string]struct {
+		sub  *realtimeSubscriber
+		want int
+	}{
+		"doctype":       {reader, 2},
+		"no permission": {outsider, 0},
+		"document":      {watcher, 1},
+		"other doctype": {bystander, 0},
+	} {
+		if got := len(tt.sub.events); got != tt.want {
+			t.Errorf("%s: %d events, want %d", name, got, tt.want)
+		}
+	}
+}
+
+func TestRealtimeStream(t *testing.T) {
+	dt := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	key := createTestAPIKey(t, createTestUser(t, "HR", false))
+	outsiderKey := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	expectStatus(t, apiRequest(t, "GET", "/api/realtime?doctype="+dt.Name, "", ""), http.StatusUnauthorized)
+	expectStatus(t, apiRequest(t, "GET", "/api/realtime", key, ""), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "GET", "/api/realtime?document="+dt.Name, key, ""), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "GET", "/api/realtime?doctype="+dt.Name, outsiderKey, ""), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "GET", "/api/realtime?document="+dt.Name+"/1", outsiderKey, ""), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "GET", "/api/realtime?doctype="+uniqueName("Missing"), key, ""), http.StatusNotFound)
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	req, err := http.NewRequest("GET", server.URL+"/api/realtime?doctype="+dt.Name, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status = %d, content type = %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// The stream is open once the retry line arrives
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() && lines.Text() != "" {
+	}
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}, ModifiedBy: "someone"}
+	err = createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan []string)
+	go func() {
+		var event []string
+		for lines.Scan() && lines.Text() != "" {
+			event = append(event, lines.Text())
+		}
+		done <- event
+	}()
+	select {
+	case event := <-done:
+		if len(event) != 2 || event[0] != "event: "+DocEventInsert || !strings.HasPrefix(event[1], "data: ") {
+			t.Fatalf("event = %q", event)
+		}
+		var e RealtimeEvent
+		json.Unmarshal([]byte(strings.TrimPrefix(event[1], "data: ")), &e)
+		if e.Doctype != dt.Name || e.ID != doc.ID || e.User != "someone" {
+			t.Errorf("event = %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+}
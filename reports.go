@@ -0,0 +1,947 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Row limits for reports. A report shows defaultReportLimit rows unless it
+// sets its own limit; exports default to maxReportLimit.
+const (
+	defaultReportLimit = 500
+	maxReportLimit     = 5000
+)
+
+var reportAggregateFunctions = []string{"count", "sum", "avg", "min", "max"}
+
+// reportFilterOperators lists the filter operators in the order the report
+// builder offers them.
+var reportFilterOperators = []string{"=", "!=", ">", "<", ">=", "<=", "like", "not like", "in", "not in", "is"}
+
+// ReportAggregate is an aggregate column of a grouped report. Count may be
+// used without a field to count rows.
+type ReportAggregate struct {
+	Function string `json:"function"`
+	Field    string `json:"field,omitempty"`
+}
+
+// Alias is the result column name of the aggregate.
+func (a ReportAggregate) Alias() string {
+	if a.Field == "" {
+		return a.Function
+	}
+	return a.Function + "_" + a.Field
+}
+
+// ReportSort orders a report by a column.
+type ReportSort struct {
+	Field      string `json:"field"`
+	Descending bool   `json:"descending,omitempty"`
+}
+
+// ReportConfig describes what a report shows. When it has group-by fields
+// or aggregates the report has one row per group, otherwise one row per
+// document with the chosen columns.
+type ReportConfig struct {
+	Columns    []string          `json:"columns,omitempty"`
+	Filters    []Filter          `json:"filters,omitempty"`
+	Sort       []ReportSort      `json:"sort,omitempty"`
+	GroupBy    []string          `json:"group_by,omitempty"`
+	Aggregates []ReportAggregate `json:"aggregates,omitempty"`
+	Limit      int               `json:"limit,omitempty"`
+}
+
+// Grouped reports whether the report has a row per group.
+func (c ReportConfig) Grouped() bool {
+	return len(c.GroupBy) > 0 || len(c.Aggregates) > 0
+}
+
+// Report is a saved report configuration. It is visible to its owner,
+// admins and users with one of its roles.
+type Report struct {
+	ID         int64        `json:"id"`
+	Name       string       `json:"name"`
+	Doctype    string       `json:"doctype"`
+	Owner      string       `json:"owner"`
+	Roles      []string     `json:"roles"`
+	Config     ReportConfig `json:"config"`
+	CreatedAt  string       `json:"created_at"`
+	ModifiedAt string       `json:"modified_at"`
+}
+
+// ReportColumn is a column of a report result. Type is a field type such
+// as integer or date, when known.
+type ReportColumn struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type,omitempty"`
+}
+
+// ReportResult holds the rows of a report run. Truncated is set when there
+// were more rows than the limit.
+type ReportResult struct {
+	Columns   []ReportColumn  `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated"`
+}
+
+// ColumnNames returns the names of the result columns.
+func (r ReportResult) ColumnNames() []string {
+	names := make([]string, len(r.Columns))
+	for i, c := range r.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func createReportTables() error {
+	createReportsTable := `
+	CREATE TABLE IF NOT EXISTS reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		doctype TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		roles TEXT NOT NULL,
+		config TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		modified_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createReportsTable)
+	return err
+}
+
+// reportFieldLabel returns the label of a document column.
+func reportFieldLabel(doctype Doctype, name string) (string, error) {
+	if name == "id" {
+		return "ID", nil
+	}
+	field := getFieldByName(doctype.Fields, name)
+	if field == nil || isSecretField(doctype.Name, name) {
+		return "", fmt.Errorf("unknown field %q", name)
+	}
+	if field.Label == "" {
+		return field.Name, nil
+	}
+	return field.Label, nil
+}
+
+// aggregateExpression returns the SQL expression and column label of an
+// aggregate. Sum and average are only allowed on number fields.
+func aggregateExpression(doctype Doctype, a ReportAggregate) (string, string, error) {
+	var title string
+	switch a.Function {
+	case "count", "sum", "min", "max":
+		title = strings.ToUpper(a.Function[:1]) + a.Function[1:]
+	case "avg":
+		title = "Average"
+	default:
+		return "", "", fmt.Errorf("unsupported aggregate %q", a.Function)
+	}
+	if a.Field == "" {
+		if a.Function != "count" {
+			return "", "", fmt.Errorf("%s needs a field", a.Function)
+		}
+		return "COUNT(*)", title, nil
+	}
+
+	label, err := reportFieldLabel(doctype, a.Field)
+	if err != nil {
+		return "", "", err
+	}
+	if a.Function == "sum" || a.Function == "avg" {
+		field := getFieldByName(doctype.Fields, a.Field)
+		if a.Field != "id" && (field == nil || (field.Type != "integer" && field.Type != "float")) {
+			return "", "", fmt.Errorf("%s needs a number field, %q is not one", a.Function, a.Field)
+		}
+	}
+	return fmt.Sprintf("%s(`%s`)", strings.ToUpper(a.Function), a.Field), title + " of " + label, nil
+}
+
+// buildReportQuery turns a report configuration into a SQL query. Every
+// field is checked against the doctype and filter values are bound as
+// parameters, so no user input reaches the SQL text.
+func buildReportQuery(doctype Doctype, cfg ReportConfig, limit int) (string, []interface{}, []ReportColumn, error) {
+	where, args, err := buildWhereClause(doctype, cfg.Filters)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var selects, groups, order []string
+	var columns []ReportColumn
+	// sortable maps each result column to the expression to order by
+	sortable := map[string]string{}
+	addColumn := func(name, label, expr string) error {
+		if _, ok := sortable[name]; ok {
+			return fmt.Errorf("column %q is used twice", name)
+		}
+		sortable[name] = fmt.Sprintf("`%s`", name)
+		selects = append(selects, fmt.Sprintf("%s AS `%s`", expr, name))
+		columns = append(columns, ReportColumn{Name: name, Label: label})
+		return nil
+	}
+
+	if cfg.Grouped() {
+		for _, name := range cfg.GroupBy {
+			label, err := reportFieldLabel(doctype, name)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			err = addColumn(name, label, fmt.Sprintf("`%s`", name))
+			if err != nil {
+				return "", nil, nil, err
+			}
+			groups = append(groups, fmt.Sprintf("`%s`", name))
+		}
+		for _, a := range cfg.Aggregates {
+			expr, label, err := aggregateExpression(doctype, a)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			err = addColumn(a.Alias(), label, expr)
+			if err != nil {
+				return "", nil, nil, err
+			}
+		}
+		order = groups
+	} else {
+		names := cfg.Columns
+		if len(names) == 0 {
+			for _, field := range visibleFields(doctype, doctype.Fields) {
+				names = append(names, field.Name)
+			}
+		}
+		if err := addColumn("id", "ID", "`id`"); err != nil {
+			return "", nil, nil, err
+		}
+		for _, name := range names {
+			if name == "id" {
+				continue
+			}
+			label, err := reportFieldLabel(doctype, name)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			err = addColumn(name, label, fmt.Sprintf("`%s`", name))
+			if err != nil {
+				return "", nil, nil, err
+			}
+		}
+		order = []string{"`id`"}
+	}
+
+	if len(cfg.Sort) > 0 {
+		order = nil
+		for _, s := range cfg.Sort {
+			expr, ok := sortable[s.Field]
+			if !ok {
+				return "", nil, nil, fmt.Errorf("cannot sort by %q, it is not a column of the report", s.Field)
+			}
+			if s.Descending {
+				expr += " DESC"
+			}
+			order = append(order, expr)
+		}
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM `%s`%s", strings.Join(selects, ", "), doctype.Name, where)
+	if len(groups) > 0 {
+		query += " GROUP BY " + strings.Join(groups, ", ")
+	}
+	if len(order) > 0 {
+		query += " ORDER BY " + strings.Join(order, ", ")
+	}
+	// Fetch one extra row to tell whether the result was cut off
+	query += " LIMIT ?"
+	args = append(args, limit+1)
+	return query, args, columns, nil
+}
+
+// reportLimit returns the row limit for a report run.
+func reportLimit(cfg ReportConfig, defaultLimit int) int {
+	if cfg.Limit <= 0 {
+		return defaultLimit
+	}
+	if cfg.Limit > maxReportLimit {
+		return maxReportLimit
+	}
+	return cfg.Limit
+}
+
+// runReport runs a report against the doctype.
+func runReport(doctype Doctype, cfg ReportConfig, defaultLimit int) (ReportResult, error) {
+	limit := reportLimit(cfg, defaultLimit)
+	query, args, columns, err := buildReportQuery(doctype, cfg, limit)
+	if err != nil {
+		return ReportResult{}, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return ReportResult{}, err
+	}
+	defer rows.Close()
+
+	result := ReportResult{Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return ReportResult{}, err
+		}
+		if len(result.Rows) == limit {
+			result.Truncated = true
+			break
+		}
+		for i, v := range values {
+			values[i] = exportValue(v)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, rows.Err()
+}
+
+// canViewReport reports whether the user may see a saved report. Running it
+// also needs read access to its doctype.
+func canViewReport(user *Document, rep Report) bool {
+	if user == nil {
+		return false
+	}
+	if canEditReport(user, rep) {
+		return true
+	}
+	role := userRole(user)
+	for _, r := range rep.Roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// canEditReport reports whether the user may change or delete a saved
+// report, which only its owner and admins can.
+func canEditReport(user *Document, rep Report) bool {
+	if user == nil {
+		return false
+	}
+	return isAdminUser(user) || rep.Owner == username(user)
+}
+
+func scanReport(scanner interface{ Scan(...interface{}) error }) (Report, error) {
+	var rep Report
+	var roles, config string
+	err := scanner.Scan(&rep.ID, &rep.Name, &rep.Doctype, &rep.Owner, &roles, &config, &rep.CreatedAt, &rep.ModifiedAt)
+	if err != nil {
+		return rep, err
+	}
+	if err := json.Unmarshal([]byte(roles), &rep.Roles); err != nil {
+		return rep, err
+	}
+	err = json.Unmarshal([]byte(config), &rep.Config)
+	return rep, err
+}
+
+const reportColumns = "id, name, doctype, owner, roles, config, created_at, modified_at"
+
+func getReport(id int64) (Report, error) {
+	return scanReport(db.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = ?", id))
+}
+
+// getReports lists the saved reports the user can see, by name.
+func getReports(user *Document) ([]Report, error) {
+	rows, err := db.Query("SELECT " + reportColumns + " FROM reports ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []Report{}
+	for rows.Next() {
+		rep, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		if canViewReport(user, rep) {
+			reports = append(reports, rep)
+		}
+	}
+	return reports, rows.Err()
+}
+
+// saveReport checks a report and stores it, inserting it when it has no ID
+// yet.
+func saveReport(rep *Report) error {
+	rep.Name = strings.TrimSpace(rep.Name)
+	if rep.Name == "" {
+		return fmt.Errorf("report name is required")
+	}
+	doctype, err := getDoctypeByName(rep.Doctype)
+	if err != nil {
+		return fmt.Errorf("doctype %s not found", rep.Doctype)
+	}
+	if _, _, _, err := buildReportQuery(doctype, rep.Config, defaultReportLimit); err != nil {
+		return err
+	}
+	if rep.Roles == nil {
+		rep.Roles = []string{}
+	}
+
+	roles, err := json.Marshal(rep.Roles)
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(rep.Config)
+	if err != nil {
+		return err
+	}
+
+	rep.ModifiedAt = nowTimestamp()
+	if rep.ID != 0 {
+		_, err = db.Exec("UPDATE reports SET name = ?, doctype = ?, roles = ?, config = ?, modified_at = ? WHERE id = ?",
+			rep.Name, rep.Doctype, string(roles), string(config), rep.ModifiedAt, rep.ID)
+		return err
+	}
+
+	rep.CreatedAt = rep.ModifiedAt
+	result, err := db.Exec("INSERT INTO reports (name, doctype, owner, roles, config, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		rep.Name, rep.Doctype, rep.Owner, string(roles), string(config), rep.CreatedAt, rep.ModifiedAt)
+	if err != nil {
+		return err
+	}
+	rep.ID, err = result.LastInsertId()
+	return err
+}
+
+func deleteReport(id int64) error {
+	_, err := db.Exec("DELETE FROM reports WHERE id = ?", id)
+	return err
+}
+
+// loadReportForUser fetches a saved report and its doctype, checking that
+// the user may see both. On failure it returns the HTTP status to respond
+// with.
+func loadReportForUser(user *Document, idParam string) (Report, Doctype, int, error) {
+	id, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		return Report{}, Doctype{}, http.StatusBadRequest, fmt.Errorf("Invalid ID")
+	}
+	rep, err := getReport(id)
+	if err == sql.ErrNoRows {
+		return Report{}, Doctype{}, http.StatusNotFound, fmt.Errorf("Report not found")
+	}
+	if err != nil {
+		return Report{}, Doctype{}, http.StatusInternalServerError, err
+	}
+	if !canViewReport(user, rep) {
+		return Report{}, Doctype{}, http.StatusForbidden, fmt.Errorf("Permission denied")
+	}
+	doctype, err := getDoctypeByName(rep.Doctype)
+	if err != nil {
+		return Report{}, Doctype{}, http.StatusNotFound, fmt.Errorf("Doctype not found")
+	}
+	if !canReadDoctype(user, doctype) {
+		return Report{}, Doctype{}, http.StatusForbidden, fmt.Errorf("Permission denied")
+	}
+	return rep, doctype, http.StatusOK, nil
+}
+
+// reportConfigFromForm reads a report configuration from the report
+// builder form. Aggregates, sorts and filters are sent as parallel lists,
+// rows with an empty first value are ignored.
+func reportConfigFromForm(form url.Values) ReportConfig {
+	cfg := ReportConfig{
+		Columns: form["column"],
+		GroupBy: form["group_by"],
+	}
+
+	fields := form["agg_field"]
+	for i, fn := range form["agg_function"] {
+		if fn == "" {
+			continue
+		}
+		a := ReportAggregate{Function: fn}
+		if i < len(fields) {
+			a.Field = fields[i]
+		}
+		cfg.Aggregates = append(cfg.Aggregates, a)
+	}
+
+	orders := form["sort_order"]
+	for i, field := range form["sort_field"] {
+		if field == "" {
+			continue
+		}
+		cfg.Sort = append(cfg.Sort, ReportSort{Field: field, Descending: i < len(orders) && orders[i] == "desc"})
+	}
+
+	operators, values := form["filter_operator"], form["filter_value"]
+	for i, field := range form["filter_field"] {
+		if field == "" {
+			continue
+		}
+		f := Filter{Field: field, Operator: "="}
+		if i < len(operators) {
+			f.Operator = operators[i]
+		}
+		if i < len(values) {
+			f.Value = values[i]
+		}
+		cfg.Filters = append(cfg.Filters, f)
+	}
+
+	cfg.Limit, _ = strconv.Atoi(form.Get("limit"))
+	return cfg
+}
+
+// reportFormValues is the inverse of reportConfigFromForm, used to build
+// export links for the report being shown.
+func reportFormValues(cfg ReportConfig) url.Values {
+	v := url.Values{}
+	v.Set("run", "1")
+	for _, c := range cfg.Columns {
+		v.Add("column", c)
+	}
+	for _, g := range cfg.GroupBy {
+		v.Add("group_by", g)
+	}
+	for _, a := range cfg.Aggregates {
+		v.Add("agg_function", a.Function)
+		v.Add("agg_field", a.Field)
+	}
+	for _, s := range cfg.Sort {
+		v.Add("sort_field", s.Field)
+		if s.Descending {
+			v.Add("sort_order", "desc")
+		} else {
+			v.Add("sort_order", "asc")
+		}
+	}
+	for _, f := range cfg.Filters {
+		v.Add("filter_field", f.Field)
+		v.Add("filter_operator", f.Operator)
+		v.Add("filter_value", fmt.Sprint(f.Value))
+	}
+	if cfg.Limit > 0 {
+		v.Set("limit", strconv.Itoa(cfg.Limit))
+	}
+	return v
+}
+
+// ReportBuilderData is shown by the report builder template. The
+// aggregate, sort and filter lists end with a blank row for adding one.
+type ReportBuilderData struct {
+	Doctype    Doctype
+	Report     *Report
+	CanEdit    bool
+	Config     ReportConfig
+	Aggregates []ReportAggregate
+	Sorts      []ReportSort
+	Filters    []Filter
+	Roles      string
+	Functions  []string
+	Operators  []string
+	Result     *ReportResult
+	Error      string
+	FormAction string
+	ExportURL  string
+}
+
+func renderReportBuilder(w http.ResponseWriter, r *http.Request, doctype Doctype, rep *Report, cfg ReportConfig) {
+	data := ReportBuilderData{
+		Doctype:    doctype,
+		Report:     rep,
+		Config:     cfg,
+		Aggregates: append(append([]ReportAggregate{}, cfg.Aggregates...), ReportAggregate{}),
+		Sorts:      append(append([]ReportSort{}, cfg.Sort...), ReportSort{}),
+		Filters:    append(append([]Filter{}, cfg.Filters...), Filter{}),
+		Functions:  reportAggregateFunctions,
+		Operators:  reportFilterOperators,
+		FormAction: fmt.Sprintf("/doctype/%s/report", url.PathEscape(doctype.Name)),
+	}
+	title := doctype.Name + " Report"
+	if rep != nil {
+		title = rep.Name
+		data.CanEdit = canEditReport(currentUser(r), *rep)
+		data.Roles = strings.Join(rep.Roles, " ")
+		data.FormAction = fmt.Sprintf("/reports/%d", rep.ID)
+	}
+	data.ExportURL = data.FormAction + "/export?" + reportFormValues(cfg).Encode()
+
+	result, err := runReport(doctype, cfg, defaultReportLimit)
+	if err != nil {
+		data.Error = err.Error()
+	} else {
+		data.Result = &result
+	}
+
+	renderTemplate(w, r, "report.html", PageData{Title: title, Content: data})
+}
+
+// writeReportExport sends a report result as a download in the format
+// named by the format query parameter.
+func writeReportExport(w http.ResponseWriter, r *http.Request, name string, doctype Doctype, cfg ReportConfig) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	result, err := runReport(doctype, cfg, maxReportLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", sanitizeFilename(name), format))
+	bw := bufio.NewWriter(w)
+	err = exportTable(bw, format, doctype.Name, result.ColumnNames(), result.Rows)
+	if err != nil {
+		log.Printf("Error exporting report %s: %v", name, err)
+		return
+	}
+	bw.Flush()
+}
+
+// loadReportDoctype fetches the doctype named in the URL for the ad-hoc
+// report builder.
+func loadReportDoctype(w http.ResponseWriter, r *http.Request) (Doctype, bool) {
+	doctype, err := getDoctypeByName(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return doctype, false
+	}
+	if !canReadDoctype(currentUser(r), doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return doctype, false
+	}
+	return doctype, true
+}
+
+func reportBuilderHandler(w http.ResponseWriter, r *http.Request) {
+	doctype, ok := loadReportDoctype(w, r)
+	if !ok {
+		return
+	}
+	renderReportBuilder(w, r, doctype, nil, reportConfigFromForm(r.URL.Query()))
+}
+
+// newReportHandler opens the report builder for the doctype picked on the
+// report list.
+func newReportHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("doctype")
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/report", url.PathEscape(name)), http.StatusSeeOther)
+}
+
+func reportBuilderExportHandler(w http.ResponseWriter, r *http.Request) {
+	doctype, ok := loadReportDoctype(w, r)
+	if !ok {
+		return
+	}
+	writeReportExport(w, r, doctype.Name, doctype, reportConfigFromForm(r.URL.Query()))
+}
+
+func reportListHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	reports, err := getReports(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	queryReports, err := getQueryReports(user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	doctypes, err := getDoctypes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Reports",
+		Content: struct {
+			Reports      []Report
+			QueryReports []QueryReport
+			Doctypes     []Doctype
+			IsAdmin      bool
+		}{
+			Reports:      reports,
+			QueryReports: queryReports,
+			Doctypes:     doctypes,
+			IsAdmin:      isAdminUser(user),
+		},
+	}
+	renderTemplate(w, r, "reports.html", data)
+}
+
+// reportSaveHandler saves the configuration in the report builder form,
+// as a new report or over the report given by the id field.
+func reportSaveHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	rep := Report{Owner: username(user), Doctype: r.FormValue("doctype")}
+	if id := r.FormValue("id"); id != "" {
+		var status int
+		rep, _, status, err = loadReportForUser(user, id)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if !canEditReport(user, rep) {
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+	}
+	doctype, err := getDoctypeByName(rep.Doctype)
+	if err != nil || !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	rep.Name = r.FormValue("name")
+	rep.Roles = strings.Fields(r.FormValue("roles"))
+	rep.Config = reportConfigFromForm(r.PostForm)
+	err = saveReport(&rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/reports/%d", rep.ID), http.StatusSeeOther)
+}
+
+// reportHandler shows a saved report. Running it from the builder form
+// shows the changed configuration without saving it.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	rep, doctype, status, err := loadReportForUser(currentUser(r), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	cfg := rep.Config
+	if r.URL.Query().Get("run") != "" {
+		cfg = reportConfigFromForm(r.URL.Query())
+	}
+	renderReportBuilder(w, r, doctype, &rep, cfg)
+}
+
+func reportActionHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	rep, _, status, err := loadReportForUser(user, mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !canEditReport(user, rep) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "delete":
+		err = deleteReport(rep.ID)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/reports", http.StatusSeeOther)
+}
+
+func reportExportHandler(w http.ResponseWriter, r *http.Request) {
+	rep, doctype, status, err := loadReportForUser(currentUser(r), mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	cfg := rep.Config
+	if r.URL.Query().Get("run") != "" {
+		cfg = reportConfigFromForm(r.URL.Query())
+	}
+	writeReportExport(w, r, rep.Name, doctype, cfg)
+}
+
+func apiListReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := getReports(currentUser(r))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, reports)
+}
+
+func apiGetReport(w http.ResponseWriter, r *http.Request) {
+	rep, _, status, err := loadReportForUser(currentUser(r), mux.Vars(r)["id"])
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, rep)
+}
+
+func apiCreateReport(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	var rep Report
+	err := json.NewDecoder(r.Body).Decode(&rep)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	doctype, err := getDoctypeByName(rep.Doctype)
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(user, doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	rep.ID = 0
+	rep.Owner = username(user)
+	err = saveReport(&rep)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusCreated, rep)
+}
+
+func apiUpdateReport(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	rep, _, status, err := loadReportForUser(user, mux.Vars(r)["id"])
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+	if !canEditReport(user, rep) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	var update struct {
+		Name   *string       `json:"name"`
+		Roles  []string      `json:"roles"`
+		Config *ReportConfig `json:"config"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if update.Name != nil {
+		rep.Name = *update.Name
+	}
+	if update.Roles != nil {
+		rep.Roles = update.Roles
+	}
+	if update.Config != nil {
+		rep.Config = *update.Config
+	}
+
+	err = saveReport(&rep)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, rep)
+}
+
+func apiDeleteReport(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	rep, _, status, err := loadReportForUser(user, mux.Vars(r)["id"])
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+	if !canEditReport(user, rep) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	err = deleteReport(rep.ID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiRunReport runs a saved report and returns its rows.
+func apiRunReport(w http.ResponseWriter, r *http.Request) {
+	rep, doctype, status, err := loadReportForUser(currentUser(r), mux.Vars(r)["id"])
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	result, err := runReport(doctype, rep.Config, defaultReportLimit)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, result)
+}
+
+// apiRunAdHocReport runs a report configuration without saving it.
+func apiRunAdHocReport(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Doctype string       `json:"doctype"`
+		Config  ReportConfig `json:"config"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	doctype, err := getDoctypeByName(req.Doctype)
+	if err != nil {
+		RespondError(w, http.StatusNotFound, "Doctype not found")
+		return
+	}
+	if !canReadDoctype(currentUser(r), doctype) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	result, err := runReport(doctype, req.Config, defaultReportLimit)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func runTestReport(t *testing.T, key, body string) ReportResult {
+	t.Helper()
+	w := apiRequest(t, "POST", "/api/reports/run", key, body)
+	expectStatus(t, w, http.StatusOK)
+	var result ReportResult
+	err := json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestReportGroupBy(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "status", Type: "string", Label: "Status"},
+		Field{Name: "amount", Type: "integer", Label: "Amount"},
+	)
+	for _, row := range []struct {
+		status string
+		amount int
+	}{{"Open", 5}, {"Open", 7}, {"Closed", 1}} {
+		doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"status": row.status, "amount": row.amount}}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	body := fmt.Sprintf(`{"doctype": %q, "config": {"group_by": ["status"], "aggregates": [{"function": "count"}, {"function": "sum", "field": "amount"}], "sort": [{"field": "status", "descending": true}]}}`, dt.Name)
+	result := runTestReport(t, key, body)
+	if fmt.Sprint(result.ColumnNames()) != "[status count sum_amount]" || result.Columns[2].Label != "Sum of Amount" {
+		t.Errorf("columns = %+v", result.Columns)
+	}
+	if fmt.Sprint(result.Rows) != "[[Open 2 12] [Closed 1 1]]" {
+		t.Errorf("rows = %v", result.Rows)
+	}
+
+	body = fmt.Sprintf(`{"doctype": %q, "config": {"columns": ["amount"], "filters": [{"field": "amount", "operator": ">", "value": 2}], "limit": 1}}`, dt.Name)
+	result = runTestReport(t, key, body)
+	if fmt.Sprint(result.ColumnNames()) != "[id amount]" || len(result.Rows) != 1 || !result.Truncated {
+		t.Errorf("result = %+v, want one of two rows", result)
+	}
+
+	for _, config := range []string{
+		`{"aggregates": [{"function": "sum", "field": "status"}]}`,
+		`{"aggregates": [{"function": "median", "field": "amount"}]}`,
+		`{"columns": ["missing"]}`,
+		`{"columns": ["amount"], "sort": [{"field": "status"}]}`,
+	} {
+		w := apiRequest(t, "POST", "/api/reports/run", key, fmt.Sprintf(`{"doctype": %q, "config": %s}`, dt.Name, config))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", config, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestReportDefaultColumnsHideSecretFields(t *testing.T) {
+	key := createTestAPIKey(t, createTestUser(t, "User", true))
+	result := runTestReport(t, key, `{"doctype": "User", "config": {"limit": 1}}`)
+	names := result.ColumnNames()
+	if len(names) < 2 {
+		t.Fatalf("columns = %v", names)
+	}
+	for _, name := range names {
+		if name == "password" {
+			t.Errorf("columns = %v, want no password", names)
+		}
+	}
+	w := apiRequest(t, "POST", "/api/reports/run", key, `{"doctype": "User", "config": {"columns": ["password"]}}`)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestSavedReports(t *testing.T) {
+	role := uniqueName("Role")
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	ownerKey := createTestAPIKey(t, createTestUser(t, "User", false))
+	memberKey := createTestAPIKey(t, createTestUser(t, role, false))
+	otherKey := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	body := fmt.Sprintf(`{"name": "Titles", "doctype": %q, "roles": [%q], "config": {"columns": ["title"]}}`, dt.Name, role)
+	w := apiRequest(t, "POST", "/api/reports", ownerKey, body)
+	expectStatus(t, w, http.StatusCreated)
+	var rep Report
+	json.Unmarshal(w.Body.Bytes(), &rep)
+	path := fmt.Sprintf("/api/reports/%d", rep.ID)
+
+	expectStatus(t, apiRequest(t, "GET", path+"/run", memberKey, ""), http.StatusOK)
+	expectStatus(t, apiRequest(t, "GET", path+"/run", otherKey, ""), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "PUT", path, memberKey, `{"name": "Mine"}`), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "PUT", path, ownerKey, `{"config": {"columns": ["missing"]}}`), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "DELETE", path, ownerKey, ""), http.StatusNoContent)
+	expectStatus(t, apiRequest(t, "GET", path, ownerKey, ""), http.StatusNotFound)
+}
@@ -47,5 +47,5 @@ func RespondJSON(w http.ResponseWriter, code int, payload interface{}) {
 
 // RespondError sends a JSON error response
 func RespondError(w http.ResponseWriter, code int, message string) {
-	RespondJSON(w, code, map[string]string{"error": message})
+	RespondJSON(w, code, newAPIError(w, code, message))
 }
@@ -1,28 +1,124 @@
 package main
 
 import (
+	"net/http"
+
 	"github.com/gorilla/mux"
 )
 
 func registerRoutes(r *mux.Router) {
+	r.Use(csrfMiddleware)
 
 	r.HandleFunc("/login", loginHandler).Methods("GET", "POST")
 	r.HandleFunc("/logout", logoutHandler).Methods("GET")
 
 	r.HandleFunc("/", authMiddleware(homeHandler)).Methods("GET")
+	r.HandleFunc("/search", authMiddleware(searchHandler)).Methods("GET")
 	r.HandleFunc("/doctypes", authMiddleware(doctypeListHandler)).Methods("GET")
 	r.HandleFunc("/doctype/new", authMiddleware(doctypeNewHandler)).Methods("GET", "POST")
 	r.HandleFunc("/doctype/{name}", authMiddleware(doctypeHandler)).Methods("GET")
 	r.HandleFunc("/doctype/{name}/edit", authMiddleware(doctypeEditHandler)).Methods("GET", "POST")
 	r.HandleFunc("/doctype/{name}/documents", authMiddleware(documentListHandler)).Methods("GET")
+	r.HandleFunc("/doctype/{name}/views", authMiddleware(listViewSaveHandler)).Methods("POST")
+	r.HandleFunc("/doctype/{name}/views/{id}", authMiddleware(listViewActionHandler)).Methods("POST")
 	r.HandleFunc("/doctype/{name}/document/new", authMiddleware(documentNewHandler)).Methods("GET", "POST")
+	r.HandleFunc("/doctype/{name}/import", authMiddleware(importNewHandler)).Methods("GET", "POST")
+	r.HandleFunc("/doctype/{name}/report", authMiddleware(reportBuilderHandler)).Methods("GET")
+	r.HandleFunc("/doctype/{name}/report/export", authMiddleware(reportBuilderExportHandler)).Methods("GET")
+	r.HandleFunc("/doctype/{name}/kanban", authMiddleware(kanbanHandler)).Methods("GET")
+	r.HandleFunc("/doctype/{name}/calendar", authMiddleware(calendarHandler)).Methods("GET")
 	r.HandleFunc("/doctype/{name}/document/{id}", authMiddleware(documentEditHandler)).Methods("GET", "POST")
+	r.HandleFunc("/doctype/{name}/document/{id}/attachments", authMiddleware(documentAttachmentsHandler)).Methods("POST")
+	r.HandleFunc("/doctype/{name}/document/{id}/comments", authMiddleware(documentCommentHandler)).Methods("POST")
+	r.HandleFunc("/doctype/{name}/document/{id}/assignments", authMiddleware(documentAssignmentHandler)).Methods("POST")
+	r.HandleFunc("/doctype/{name}/document/{id}/tags", authMiddleware(documentTagHandler)).Methods("POST")
+	r.HandleFunc("/doctype/{name}/bulk", authMiddleware(bulkHandler)).Methods("POST")
+	r.HandleFunc("/bulk/{id}", authMiddleware(bulkOperationHandler)).Methods("GET")
+	r.HandleFunc("/notifications", authMiddleware(notificationsHandler)).Methods("GET", "POST")
+	r.HandleFunc("/notifications/settings", authMiddleware(notificationSettingsHandler)).Methods("GET", "POST")
+	r.HandleFunc("/jobs", authMiddleware(jobsHandler)).Methods("GET")
+	r.HandleFunc("/jobs/{id}", authMiddleware(jobActionHandler)).Methods("POST")
+	r.HandleFunc("/scheduler", authMiddleware(scheduledJobsHandler)).Methods("GET")
+	r.HandleFunc("/scheduler/{name}", authMiddleware(scheduledJobActionHandler)).Methods("POST")
+	r.HandleFunc("/webhooks/deliveries", authMiddleware(webhookDeliveriesHandler)).Methods("GET")
+	r.HandleFunc("/webhooks/deliveries/{id}", authMiddleware(webhookDeliveryHandler)).Methods("GET", "POST")
+	r.HandleFunc("/reports", authMiddleware(reportListHandler)).Methods("GET")
+	r.HandleFunc("/reports", authMiddleware(reportSaveHandler)).Methods("POST")
+	r.HandleFunc("/reports/new", authMiddleware(newReportHandler)).Methods("GET")
+	r.HandleFunc("/reports/{id}", authMiddleware(reportHandler)).Methods("GET")
+	r.HandleFunc("/reports/{id}", authMiddleware(reportActionHandler)).Methods("POST")
+	r.HandleFunc("/reports/{id}/export", authMiddleware(reportExportHandler)).Methods("GET")
+	r.HandleFunc("/query-reports/{name}", authMiddleware(queryReportHandler)).Methods("GET")
+	r.HandleFunc("/query-reports/{name}/export", authMiddleware(queryReportExportHandler)).Methods("GET")
+	r.HandleFunc("/files/{id}/{filename}", authMiddleware(fileDownloadHandler)).Methods("GET")
+	r.HandleFunc("/import/{id}", authMiddleware(importHandler)).Methods("GET", "POST")
+	r.HandleFunc("/import/{id}/report", authMiddleware(importReportHandler)).Methods("GET")
 
 	// API routes
 	api := r.PathPrefix("/api").Subrouter()
+	api.Use(requestIDMiddleware, apiKeyMiddleware)
+	api.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(apiNotFoundHandler))
+	api.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(apiMethodNotAllowedHandler))
 	api.HandleFunc("/documents", apiCreateDocument).Methods("POST")
+	api.HandleFunc("/batch", apiBatch).Methods("POST")
+	api.HandleFunc("/openapi.json", apiOpenAPISpec).Methods("GET")
+	api.HandleFunc("/graphql", apiGraphQL).Methods("POST")
+	api.HandleFunc("/docs", authMiddleware(apiDocsHandler)).Methods("GET")
+	api.HandleFunc("/documents/{doctype}/export", apiExportDocuments).Methods("GET")
 	api.HandleFunc("/documents/{doctype}/{id}", apiGetDocument).Methods("GET")
 	api.HandleFunc("/documents/{doctype}/{id}", apiUpdateDocument).Methods("PUT")
+	api.HandleFunc("/documents/{doctype}/{id}", apiPatchDocument).Methods("PATCH")
 	api.HandleFunc("/documents/{doctype}/{id}", apiDeleteDocument).Methods("DELETE")
+	api.HandleFunc("/documents/{doctype}/{id}/comments", apiListComments).Methods("GET")
+	api.HandleFunc("/documents/{doctype}/{id}/comments", apiAddComment).Methods("POST")
+	api.HandleFunc("/documents/{doctype}/{id}/timeline", apiTimeline).Methods("GET")
+	api.HandleFunc("/documents/{doctype}/{id}/assignments", apiListAssignments).Methods("GET")
+	api.HandleFunc("/documents/{doctype}/{id}/assignments", apiAssignDocument).Methods("POST")
+	api.HandleFunc("/documents/{doctype}/{id}/assignments/{user}", apiUnassignDocument).Methods("DELETE")
+	api.HandleFunc("/documents/{doctype}/{id}/tags", apiListTags).Methods("GET")
+	api.HandleFunc("/documents/{doctype}/{id}/tags", apiAddTag).Methods("POST")
+	api.HandleFunc("/documents/{doctype}/{id}/tags/{tag}", apiRemoveTag).Methods("DELETE")
+	api.HandleFunc("/documents/{doctype}/bulk", apiCreateBulkOperation).Methods("POST")
+	api.HandleFunc("/bulk/{id}", apiGetBulkOperation).Methods("GET")
 	api.HandleFunc("/documents/{doctype}", apiListDocuments).Methods("GET")
+	api.HandleFunc("/documents/{doctype}/import", apiCreateImport).Methods("POST")
+	api.HandleFunc("/imports/{id}", apiGetImport).Methods("GET")
+	api.HandleFunc("/comments/{id}", apiUpdateComment).Methods("PUT")
+	api.HandleFunc("/comments/{id}", apiDeleteComment).Methods("DELETE")
+	api.HandleFunc("/files", apiUploadFile).Methods("POST")
+	api.HandleFunc("/files", apiListFiles).Methods("GET")
+	api.HandleFunc("/files/{id}", apiGetFile).Methods("GET")
+	api.HandleFunc("/files/{id}", apiDeleteFile).Methods("DELETE")
+	api.HandleFunc("/search", apiSearch).Methods("GET")
+	api.HandleFunc("/realtime", apiRealtime).Methods("GET")
+	api.HandleFunc("/reports", apiListReports).Methods("GET")
+	api.HandleFunc("/reports", apiCreateReport).Methods("POST")
+	api.HandleFunc("/reports/run", apiRunAdHocReport).Methods("POST")
+	api.HandleFunc("/reports/{id}", apiGetReport).Methods("GET")
+	api.HandleFunc("/reports/{id}", apiUpdateReport).Methods("PUT")
+	api.HandleFunc("/reports/{id}", apiDeleteReport).Methods("DELETE")
+	api.HandleFunc("/reports/{id}/run", apiRunReport).Methods("GET")
+	api.HandleFunc("/query-reports", apiListQueryReports).Methods("GET")
+	api.HandleFunc("/dashboards", apiListDashboards).Methods("GET")
+	api.HandleFunc("/dashboard-charts/{name}/data", apiChartData).Methods("GET")
+	api.HandleFunc("/query-reports/{name}/run", apiRunQueryReport).Methods("GET")
+	api.HandleFunc("/kanban/{board}/move", apiKanbanMove).Methods("POST")
+	api.HandleFunc("/calendar/{view}/events", apiCalendarEvents).Methods("GET")
+	api.HandleFunc("/calendar/{view}/move", apiCalendarMove).Methods("POST")
+	api.HandleFunc("/list-views/{doctype}", apiListViews).Methods("GET")
+	api.HandleFunc("/list-views/{doctype}", apiSaveListView).Methods("POST")
+	api.HandleFunc("/list-views/{doctype}/{id}", apiDeleteListView).Methods("DELETE")
+	api.HandleFunc("/notifications", apiListNotifications).Methods("GET")
+	api.HandleFunc("/notifications/read-all", apiMarkNotificationRead).Methods("POST")
+	api.HandleFunc("/notifications/settings", apiGetNotificationSettings).Methods("GET")
+	api.HandleFunc("/notifications/settings", apiUpdateNotificationSettings).Methods("PUT")
+	api.HandleFunc("/notifications/{id}/read", apiMarkNotificationRead).Methods("POST")
+	api.HandleFunc("/emails", apiListEmails).Methods("GET")
+	api.HandleFunc("/emails/{id}/retry", apiRetryEmail).Methods("POST")
+	api.HandleFunc("/webhooks/deliveries", apiListWebhookDeliveries).Methods("GET")
+	api.HandleFunc("/webhooks/deliveries/{id}", apiGetWebhookDelivery).Methods("GET")
+	api.HandleFunc("/webhooks/deliveries/{id}/retry", apiRetryWebhookDelivery).Methods("POST")
+	api.HandleFunc("/api-keys", apiListAPIKeys).Methods("GET")
+	api.HandleFunc("/api-keys", apiCreateAPIKey).Methods("POST")
+	api.HandleFunc("/api-keys/{id}", apiDeleteAPIKey).Methods("DELETE")
 }
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ScheduledJobDoctype records each scheduled task with its last and next
+// run. Admins can pause tasks or change their catch-up policy.
+const ScheduledJobDoctype = "Scheduled Job"
+
+// Catch-up policies decide what happens to runs missed while the server
+// was down. Runs that are due at most schedulerGrace ago are never missed.
+const (
+	SchedulePolicySkip    = "skip"     // Missed runs are dropped
+	SchedulePolicyCatchUp = "catch_up" // Every missed run is made, oldest first
+)
+
+// Scheduled job statuses
+const (
+	ScheduleIdle    = "Idle"
+	ScheduleQueued  = "Queued"
+	ScheduleRunning = "Running"
+	ScheduleFailed  = "Failed"
+)
+
+const (
+	schedulerInterval = 30 * time.Second
+	schedulerGrace    = 2 * time.Minute
+	maxCatchUpRuns    = 100
+)
+
+// ScheduledTask is a Go function run on a schedule. It is passed the time
+// the run was scheduled for, which matters when catching up.
+type ScheduledTask struct {
+	Name     string
+	Schedule string
+	Policy   string
+	Queue    string
+	Timeout  time.Duration
+	Run      func(ctx context.Context, scheduledFor time.Time) error
+
+	schedule Schedule
+}
+
+var scheduledTasks = map[string]*ScheduledTask{}
+
+// registerScheduledTask adds a task to the scheduler. Call it from init.
+func registerScheduledTask(task ScheduledTask) {
+	s, err := parseSchedule(task.Schedule)
+	if err != nil {
+		panic(fmt.Sprintf("scheduled task %s: %v", task.Name, err))
+	}
+	task.schedule = s
+	if task.Policy == "" {
+		task.Policy = SchedulePolicySkip
+	}
+	scheduledTasks[task.Name] = &task
+}
+
+// ScheduledJob is the stored state of a scheduled task.
+type ScheduledJob struct {
+	ID        int
+	Name      string
+	Schedule  string
+	Policy    string
+	Paused    bool
+	Status    string
+	LastRun   string
+	NextRun   string
+	LastError string
+	JobID     int64
+}
+
+// ScheduledTaskJob is the payload of the background job that makes one or
+// more runs of a scheduled task.
+type ScheduledTaskJob struct {
+	Name  string      `json:"name"`
+	Times []time.Time `json:"times"`
+}
+
+var scheduledTaskJob JobType[ScheduledTaskJob]
+
+func init() {
+	scheduledTaskJob = defineJob("scheduled_task", JobOptions{MaxAttempts: 1, Timeout: time.Hour}, runScheduledTask)
+
+	registerScheduledTask(ScheduledTask{
+		Name:     "prune_jobs",
+		Schedule: "30 3 * * *",
+		Run: func(ctx context.Context, scheduledFor time.Time) error {
+			return pruneJobs(scheduledFor.AddDate(0, 0, -7))
+		},
+	})
+	registerScheduledTask(ScheduledTask{
+		Name:     "prune_notifications",
+		Schedule: "@weekly",
+		Run: func(ctx context.Context, scheduledFor time.Time) error {
+			return pruneNotifications(scheduledFor.AddDate(0, 0, -90))
+		},
+	})
+}
+
+// createScheduledJobDoctype creates the Scheduled Job doctype unless it
+// already exists.
+func createScheduledJobDoctype() error {
+	if _, err := getDoctypeByName(ScheduledJobDoctype); err == nil {
+		return nil
+	}
+
+	scheduledJobDoctype := Doctype{
+		Name: ScheduledJobDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "schedule", Type: "string", Label: "Schedule", Required: true},
+			{Name: "catch_up_policy", Type: "string", Label: "Catch-up Policy (skip or catch_up)", Required: true},
+			{Name: "paused", Type: "boolean", Label: "Paused", Required: false},
+			{Name: "status", Type: "string", Label: "Status", Required: false},
+			{Name: "last_run", Type: "string", Label: "Last Run", Required: false},
+			{Name: "next_run", Type: "string", Label: "Next Run", Required: false},
+			{Name: "last_error", Type: "text", Label: "Last Error", Required: false},
+			{Name: "job_id", Type: "integer", Label: "Current Job", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+
+	return createDoctype(&scheduledJobDoctype)
+}
+
+// The scheduler keeps its own bookkeeping columns up to date with plain
+// SQL, so runs do not show up as document changes or fire hooks.
+const scheduledJobColumns = "id, name, schedule, catch_up_policy, paused, status, last_run, next_run, last_error, job_id"
+
+func scanScheduledJob(scanner interface{ Scan(...interface{}) error }) (ScheduledJob, error) {
+	var j ScheduledJob
+	var paused sql.NullBool
+	var status, lastRun, nextRun, lastError sql.NullString
+	var jobID sql.NullInt64
+	err := scanner.Scan(&j.ID, &j.Name, &j.Schedule, &j.Policy, &paused, &status, &lastRun, &nextRun, &lastError, &jobID)
+	j.Paused = paused.Bool
+	j.Status = status.String
+	j.LastRun = lastRun.String
+	j.NextRun = nextRun.String
+	j.LastError = lastError.String
+	j.JobID = jobID.Int64
+	return j, err
+}
+
+func getScheduledJob(name string) (ScheduledJob, error) {
+	return scanScheduledJob(db.QueryRow("SELECT "+scheduledJobColumns+" FROM `"+ScheduledJobDoctype+"` WHERE name = ?", name))
+}
+
+func getScheduledJobs() ([]ScheduledJob, error) {
+	rows, err := db.Query("SELECT " + scheduledJobColumns + " FROM `" + ScheduledJobDoctype + "` ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []ScheduledJob
+	for rows.Next() {
+		j, err := scanScheduledJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// syncScheduledJobs makes sure every registered task has a Scheduled Job
+// with its current schedule.
+func syncScheduledJobs() error {
+	now := time.Now()
+	for _, task := range scheduledTasks {
+		job, err := getScheduledJob(task.Name)
+		if err == sql.ErrNoRows {
+			doc := Document{
+				DoctypeName: ScheduledJobDoctype,
+				Data: map[string]interface{}{
+					"name":            task.Name,
+					"schedule":        task.Schedule,
+					"catch_up_policy": task.Policy,
+					"paused":          false,
+					"status":          ScheduleIdle,
+					"next_run":        formatScheduleTime(task.schedule.Next(now)),
+				},
+			}
+			err = createDocument(&doc)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if job.Schedule != task.Schedule || job.NextRun == "" {
+			_, err = db.Exec("UPDATE `"+ScheduledJobDoctype+"` SET schedule = ?, next_run = ? WHERE id = ?",
+				task.Schedule, formatScheduleTime(task.schedule.Next(now)), job.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatScheduleTime(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+func parseScheduleTime(s string) (time.Time, error) {
+	if t, err := time.Parse(timestampLayout, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// startScheduler syncs the scheduled jobs and checks for due runs in the
+// background.
+func startScheduler() error {
+	err := syncScheduledJobs()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			if err := runDueScheduledTasks(time.Now()); err != nil {
+				log.Printf("Error running scheduler: %v", err)
+			}
+			time.Sleep(schedulerInterval)
+		}
+	}()
+	return nil
+}
+
+// scheduledJobBusy reports whether the job's previous run is still queued
+// or running, so a new one must not start.
+func scheduledJobBusy(job ScheduledJob) (bool, error) {
+	if job.Status != ScheduleQueued && job.Status != ScheduleRunning {
+		return false, nil
+	}
+	var status string
+	err := db.QueryRow("SELECT status FROM jobs WHERE id = ?", job.JobID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return status == JobQueued || status == JobRunning, nil
+}
+
+// runDueScheduledTasks queues a run of every task that is due.
+func runDueScheduledTasks(now time.Time) error {
+	jobs, err := getScheduledJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		task, ok := scheduledTasks[job.Name]
+		if !ok || job.Paused {
+			continue
+		}
+
+		next, err := parseScheduleTime(job.NextRun)
+		if err != nil {
+			next = now
+		}
+		if next.After(now) {
+			continue
+		}
+
+		busy, err := scheduledJobBusy(job)
+		if err != nil {
+			return err
+		}
+		if busy {
+			continue
+		}
+
+		// Work out which of the runs due by now to make
+		var times []time.Time
+		for t := next; !t.IsZero() && !t.After(now); t = task.schedule.Next(t) {
+			late := now.Sub(t) > schedulerGrace
+			if !late || job.Policy == SchedulePolicyCatchUp {
+				times = append(times, t)
+			}
+			if len(times) == maxCatchUpRuns {
+				break
+			}
+		}
+		newNext := formatScheduleTime(task.schedule.Next(now))
+
+		if len(times) == 0 {
+			_, err = db.Exec("UPDATE `"+ScheduledJobDoctype+"` SET next_run = ? WHERE id = ?", newNext, job.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = queueScheduledTask(job, task, times, newNext)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queueScheduledTask(job ScheduledJob, task *ScheduledTask, times []time.Time, next string) error {
+	options := JobOptions{Queue: task.Queue, Timeout: task.Timeout}
+	jobID, err := scheduledTaskJob.EnqueueWith(ScheduledTaskJob{Name: task.Name, Times: times}, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE `"+ScheduledJobDoctype+"` SET status = ?, job_id = ?, next_run = ? WHERE id = ?",
+		ScheduleQueued, jobID, next, job.ID)
+	return err
+}
+
+// runScheduledTask makes the runs of a task queued by the scheduler,
+// stopping at the first failure.
+func runScheduledTask(ctx context.Context, p ScheduledTaskJob) error {
+	task, ok := scheduledTasks[p.Name]
+	if !ok {
+		return fmt.Errorf("unknown scheduled task %q", p.Name)
+	}
+
+	_, err := db.Exec("UPDATE `"+ScheduledJobDoctype+"` SET status = ? WHERE name = ?", ScheduleRunning, p.Name)
+	if err != nil {
+		return err
+	}
+
+	var runErr error
+	for _, t := range p.Times {
+		if runErr = task.Run(ctx, t); runErr != nil {
+			break
+		}
+	}
+
+	status, lastError := ScheduleIdle, ""
+	if runErr != nil {
+		status, lastError = ScheduleFailed, runErr.Error()
+	}
+	_, err = db.Exec("UPDATE `"+ScheduledJobDoctype+"` SET status = ?, last_run = ?, last_error = ? WHERE name = ?",
+		status, nowTimestamp(), lastError, p.Name)
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+// setScheduledJobPaused pauses or resumes a task. Resumed tasks carry on
+// from the next scheduled time, without catching up on the pause.
+func setScheduledJobPaused(job ScheduledJob, paused bool, user string) error {
+	data := map[string]interface{}{"paused": paused}
+	if !paused {
+		if task, ok := scheduledTasks[job.Name]; ok {
+			data["next_run"] = formatScheduleTime(task.schedule.Next(time.Now()))
+		}
+	}
+	doc := Document{ID: job.ID, DoctypeName: ScheduledJobDoctype, Data: data, ModifiedBy: user}
+	return updateDocument(&doc)
+}
+
+// runScheduledJobNow queues a run of the task straight away, keeping its
+// schedule.
+func runScheduledJobNow(job ScheduledJob) error {
+	task, ok := scheduledTasks[job.Name]
+	if !ok {
+		return fmt.Errorf("unknown scheduled task %q", job.Name)
+	}
+	busy, err := scheduledJobBusy(job)
+	if err != nil {
+		return err
+	}
+	if busy {
+		return fmt.Errorf("%s is already queued or running", job.Name)
+	}
+	return queueScheduledTask(job, task, []time.Time{time.Now()}, job.NextRun)
+}
+
+func pruneJobs(before time.Time) error {
+	_, err := db.Exec("DELETE FROM jobs WHERE status = ? AND finished_at < ?", JobCompleted, formatScheduleTime(before))
+	return err
+}
+
+func pruneNotifications(before time.Time) error {
+	_, err := db.Exec("DELETE FROM notification_log WHERE read = 1 AND created_at < ?", formatScheduleTime(before))
+	return err
+}
+
+func scheduledJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	jobs, err := getScheduledJobs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Scheduled Jobs",
+		Content: struct {
+			Jobs []ScheduledJob
+		}{
+			Jobs: jobs,
+		},
+	}
+	renderTemplate(w, r, "scheduled_jobs.html", data)
+}
+
+func scheduledJobActionHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if !isAdminUser(user) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	job, err := getScheduledJob(mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, "Scheduled job not found", http.StatusNotFound)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "pause":
+		err = setScheduledJobPaused(job, true, username(user))
+	case "resume":
+		err = setScheduledJobPaused(job, false, username(user))
+	case "run":
+		err = runScheduledJobNow(job)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/scheduler", http.StatusSeeOther)
+}
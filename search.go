@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// searchUsesFTS5 is set when the search index is an FTS5 table, which
+// needs a SQLite driver built with FTS5 (go build -tags sqlite_fts5).
+// Otherwise the index is an FTS4 table.
+//
+// FTS5 is what search is meant to use, but go-sqlite3 only compiles it in
+// with that build tag, and a plain go build has to keep working. So the
+// FTS4 fallback ranks with the same BM25 formula as FTS5, registered as
+// the bm25 function on the sqliteDriver connections, and both give the
+// same results in the same order.
+var searchUsesFTS5 bool
+
+// SearchResult is a single hit returned by the global search.
+type SearchResult struct {
+	Doctype string `json:"doctype"`
+	ID      int    `json:"id"`
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+}
+
+func init() {
+	registerDocumentHook(searchIndexHook)
+}
+
+func createSearchTables() error {
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(
+		doctype UNINDEXED,
+		doc_id UNINDEXED,
+		title,
+		content
+	)`)
+	if err != nil {
+		log.Printf("FTS5 not available (%v), using FTS4 for search", err)
+		_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts4(
+			doctype,
+			doc_id,
+			title,
+			content,
+			notindexed=doctype,
+			notindexed=doc_id
+		)`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// An index made by an earlier build stays as it was, so look at the
+	// table rather than at which statement worked
+	var definition string
+	err = db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'search_index'").Scan(&definition)
+	if err != nil {
+		return err
+	}
+	searchUsesFTS5 = strings.Contains(strings.ToLower(definition), "using fts5")
+	return nil
+}
+
+// BM25 parameters for ranking FTS4 results, the same as FTS5 uses.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// matchinfoBM25 scores an FTS4 match from its matchinfo(search_index,
+// 'pcnalx') blob with Okapi BM25. Higher scores are better matches. FTS5
+// has this built in as its rank.
+func matchinfoBM25(info []byte) float64 {
+	values := make([]uint32, len(info)/4)
+	for i := range values {
+		values[i] = binary.NativeEndian.Uint32(info[i*4:])
+	}
+	if len(values) < 3 {
+		return 0
+	}
+	phrases, columns, rows := int(values[0]), int(values[1]), float64(values[2])
+	if len(values) < 3+2*columns+3*phrases*columns {
+		return 0
+	}
+	avgLength := values[3 : 3+columns]
+	length := values[3+columns : 3+2*columns]
+	hits := values[3+2*columns:]
+
+	score := 0.0
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < columns; c++ {
+			x := hits[3*(p*columns+c):]
+			tf, docs := float64(x[0]), float64(x[2])
+			if tf == 0 || avgLength[c] == 0 {
+				continue
+			}
+			idf := math.Log((rows - docs + 0.5) / (docs + 0.5))
+			if idf < 1e-6 {
+				// Terms in most rows still count for a little
+				idf = 1e-6
+			}
+			norm := 1 - bm25B + bm25B*float64(length[c])/float64(avgLength[c])
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	return score
+}
+
+// searchIndexHook keeps the search index in step with document writes.
+func searchIndexHook(event string, doc *Document) error {
+	if event == DocEventDelete {
+		return removeFromSearchIndex(doc.DoctypeName, doc.ID)
+	}
+	if event != DocEventInsert && event != DocEventUpdate {
+		return nil
+	}
+
+	doctype, err := getDoctypeByName(doc.DoctypeName)
+	if err != nil {
+		return err
+	}
+	if len(searchableFields(doctype)) == 0 {
+		return nil
+	}
+
+	// Updates may carry only some fields, so index the stored document
+	stored, err := getDocumentByID(doc.DoctypeName, strconv.Itoa(doc.ID))
+	if err != nil {
+		return err
+	}
+	return indexDocument(doctype, &stored)
+}
+
+func searchableFields(doctype Doctype) []Field {
+	var fields []Field
+	for _, field := range doctype.Fields {
+		if field.Searchable {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func indexDocument(doctype Doctype, doc *Document) error {
+	err := removeFromSearchIndex(doctype.Name, doc.ID)
+	if err != nil {
+		return err
+	}
+
+	fields := searchableFields(doctype)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var parts []string
+	for _, field := range fields {
+		if value := doc.Data[field.Name]; value != nil {
+			parts = append(parts, fmt.Sprint(value))
+		}
+	}
+	title := documentTitle(doctype, doc)
+
+	_, err = db.Exec("INSERT INTO search_index (doctype, doc_id, title, content) VALUES (?, ?, ?, ?)",
+		doctype.Name, doc.ID, title, strings.Join(parts, " "))
+	return err
+}
+
+func removeFromSearchIndex(doctypeName string, id int) error {
+	_, err := db.Exec("DELETE FROM search_index WHERE doctype = ? AND doc_id = ?", doctypeName, id)
+	return err
+}
+
+// rebuildSearchIndex re-indexes every document of a doctype, e.g. after its
+// searchable fields have changed.
+func rebuildSearchIndex(doctypeName string) error {
+	doctype, err := getDoctypeByName(doctypeName)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM search_index WHERE doctype = ?", doctypeName)
+	if err != nil {
+		return err
+	}
+	if len(searchableFields(doctype)) == 0 {
+		return nil
+	}
+
+	documents, err := getDocuments(doctypeName)
+	if err != nil {
+		return err
+	}
+	for i := range documents {
+		err = indexDocument(doctype, &documents[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// documentTitle picks a human readable title: the first searchable field
+// with a value, falling back to the document ID.
+func documentTitle(doctype Doctype, doc *Document) string {
+	for _, field := range searchableFields(doctype) {
+		if value := doc.Data[field.Name]; value != nil && fmt.Sprint(value) != "" {
+			return fmt.Sprint(value)
+		}
+	}
+	return fmt.Sprintf("%s #%d", doctype.Name, doc.ID)
+}
+
+// buildMatchQuery turns free text into an FTS query. Every term is quoted so
+// user input can't inject FTS syntax, and matched as a prefix.
+func buildMatchQuery(text string) string {
+	var terms []string
+	for _, term := range strings.Fields(text) {
+		term = strings.ReplaceAll(term, `"`, `""`)
+		if searchUsesFTS5 {
+			terms = append(terms, `"`+term+`"*`)
+		} else {
+			terms = append(terms, `"`+term+`*"`)
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// searchDocuments runs a ranked full-text search restricted to the doctypes
+// the user may read.
+func searchDocuments(user *Document, text, doctypeName string, limit int) ([]SearchResult, error) {
+	match := buildMatchQuery(text)
+	if match == "" {
+		return []SearchResult{}, nil
+	}
+
+	doctypes, err := getDoctypes()
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []interface{}
+	for _, dt := range doctypes {
+		if doctypeName != "" && dt.Name != doctypeName {
+			continue
+		}
+		if canReadDoctype(user, dt) {
+			allowed = append(allowed, dt.Name)
+		}
+	}
+	if len(allowed) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	var query string
+	if searchUsesFTS5 {
+		query = "SELECT doctype, doc_id, title, snippet(search_index, 3, '', '', '...', 12) FROM search_index " +
+			"WHERE search_index MATCH ? AND doctype IN (%s) ORDER BY rank LIMIT ?"
+	} else {
+		query = "SELECT doctype, doc_id, title, snippet(search_index, '', '', '...', 3, 12) FROM search_index " +
+			"WHERE search_index MATCH ? AND doctype IN (%s) " +
+			"ORDER BY bm25(matchinfo(search_index, 'pcnalx')) DESC, doc_id DESC LIMIT ?"
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(allowed)), ", ")
+	query = fmt.Sprintf(query, placeholders)
+
+	args := []interface{}{match}
+	args = append(args, allowed...)
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		err := rows.Scan(&res.Doctype, &res.ID, &res.Title, &res.Snippet)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+
+	return results, rows.Err()
+}
+
+func searchLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		return 20
+	}
+	return limit
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+
+	results, err := searchDocuments(currentUser(r), query, r.URL.Query().Get("doctype"), searchLimit(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Search",
+		Content: struct {
+			Query   string
+			Results []SearchResult
+		}{
+			Query:   query,
+			Results: results,
+		},
+	}
+	renderTemplate(w, r, "search.html", data)
+}
+
+func apiSearch(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		RespondError(w, http.StatusUnauthorized, "Not logged in")
+		return
+	}
+
+	results, err := searchDocuments(user, r.URL.Query().Get("q"), r.URL.Query().Get("doctype"), searchLimit(r))
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchRanksResults(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title", Searchable: true},
+		Field{Name: "notes", Type: "text", Label: "Notes", Searchable: true},
+	)
+	docs := []map[string]interface{}{
+		{"title": "Pear tart", "notes": "Fold in the pears"},
+		{"title": "Apple pie", "notes": "Slice the apples thinly, then bake the apples"},
+		{"title": "Fruit salad", "notes": "Mix " + strings.Repeat("berries and melon, ", 20) + "then one apple"},
+	}
+	var ids []int
+	for _, data := range docs {
+		doc := Document{DoctypeName: dt.Name, Data: data}
+		err := createDocument(&doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, doc.ID)
+	}
+
+	results, err := searchDocuments(createTestUser(t, "User", false), "apple", dt.Name, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].ID != ids[1] || results[1].ID != ids[2] {
+		t.Errorf("results = %+v, want the pie before the salad", results)
+	}
+}
+
+func TestSearchDetectsIndexType(t *testing.T) {
+	var definition string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'search_index'").Scan(&definition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(definition, "fts5") != searchUsesFTS5 {
+		t.Errorf("searchUsesFTS5 = %v for %s", searchUsesFTS5, definition)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+    "net/http"
+    "os"
+
     "github.com/gorilla/sessions"
 )
 
@@ -15,5 +18,9 @@ func init() {
         Path:     "/",
         MaxAge:   86400 * 7, // 7 days
         HttpOnly: true,
+        // Browsers do not send the cookie with posts from other sites
+        SameSite: http.SameSiteLaxMode,
+        // Set SECURE_COOKIES=1 when serving over HTTPS
+        Secure: os.Getenv("SECURE_COOKIES") == "1",
     }
 }
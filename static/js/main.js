@@ -45,4 +45,180 @@ document.addEventListener('DOMContentLoaded', function() {
             e.target.parentNode.remove();
         }
     });
+
+    // Realtime updates: tell the reader when the document list changes,
+    // without reloading away their selection and filters, and warn when
+    // the open document is changed or deleted by someone else
+    const realtimeList = document.querySelector('[data-realtime-doctype]');
+    if (realtimeList && window.EventSource) {
+        const doctype = realtimeList.dataset.realtimeDoctype;
+        const events = new EventSource('/api/realtime?doctype=' + encodeURIComponent(doctype));
+        let changes = 0;
+        const notify = function(e) {
+            const change = JSON.parse(e.data);
+            if (change.event == 'delete') {
+                const box = document.querySelector('.bulk-form [name="id"][value="' + change.id + '"]');
+                if (box) {
+                    box.checked = false;
+                    box.disabled = true;
+                    box.closest('tr').classList.add('realtime-deleted');
+                }
+            }
+            changes++;
+            let banner = document.getElementById('realtime-warning');
+            if (!banner) {
+                banner = document.createElement('div');
+                banner.id = 'realtime-warning';
+                banner.className = 'realtime-warning';
+                realtimeList.parentNode.insertBefore(banner, realtimeList.nextSibling);
+            }
+            banner.textContent = (changes == 1 ? '1 change' : changes + ' changes') + ' since you opened this list. ';
+            const link = document.createElement('a');
+            link.href = window.location.href;
+            link.textContent = 'Reload';
+            banner.appendChild(link);
+        };
+        ['insert', 'update', 'delete'].forEach(function(name) {
+            events.addEventListener(name, notify);
+        });
+    }
+
+    const realtimeForm = document.querySelector('[data-realtime-document]');
+    if (realtimeForm && window.EventSource) {
+        const key = realtimeForm.dataset.realtimeDocument;
+        const events = new EventSource('/api/realtime?document=' + encodeURIComponent(key));
+        const warn = function(e) {
+            const change = JSON.parse(e.data);
+            let banner = document.getElementById('realtime-warning');
+            if (!banner) {
+                banner = document.createElement('div');
+                banner.id = 'realtime-warning';
+                banner.className = 'realtime-warning';
+                realtimeForm.parentNode.insertBefore(banner, realtimeForm);
+            }
+            const who = change.user ? ' by ' + change.user : '';
+            if (change.event == 'delete') {
+                banner.textContent = 'This document was deleted' + who + '.';
+                events.close();
+                return;
+            }
+            banner.textContent = 'This document was changed' + who + ' since you opened it. ';
+            const link = document.createElement('a');
+            link.href = window.location.href;
+            link.textContent = 'Reload';
+            banner.appendChild(link);
+        };
+        ['update', 'submit', 'cancel', 'delete'].forEach(function(name) {
+            events.addEventListener(name, warn);
+        });
+    }
+
+    // Kanban boards: dropping a card on another column sets the board's
+    // field to the column's value
+    const board = document.querySelector('[data-kanban-board]');
+    if (board) {
+        let dragged = null;
+        board.addEventListener('dragstart', function(e) {
+            dragged = e.target.closest('.kanban-card');
+            e.dataTransfer.effectAllowed = 'move';
+        });
+        board.querySelectorAll('.kanban-column[data-value]').forEach(function(column) {
+            column.addEventListener('dragover', function(e) {
+                if (dragged) {
+                    e.preventDefault();
+                }
+            });
+            column.addEventListener('drop', function(e) {
+                e.preventDefault();
+                const card = dragged;
+                const from = card.parentNode;
+                dragged = null;
+                if (from === column) {
+                    return;
+                }
+                column.appendChild(card);
+                fetch('/api/kanban/' + encodeURIComponent(board.dataset.kanbanBoard) + '/move', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({id: parseInt(card.dataset.id, 10), value: column.dataset.value})
+                }).then(function(response) {
+                    if (!response.ok) {
+                        return response.json().then(function(body) {
+                            throw new Error(body.error || response.statusText);
+                        });
+                    }
+                }).catch(function(err) {
+                    from.appendChild(card);
+                    alert('Could not move card: ' + err.message);
+                });
+            });
+        });
+    }
+
+    // Calendars: dropping an event on another day moves its start to that
+    // day, keeping the time of day
+    const calendar = document.querySelector('[data-calendar]');
+    if (calendar) {
+        let dragged = null;
+        calendar.addEventListener('dragstart', function(e) {
+            dragged = e.target.closest('.calendar-event');
+            e.dataTransfer.effectAllowed = 'move';
+        });
+        calendar.querySelectorAll('.calendar-day').forEach(function(day) {
+            day.addEventListener('dragover', function(e) {
+                if (dragged) {
+                    e.preventDefault();
+                }
+            });
+            day.addEventListener('drop', function(e) {
+                e.preventDefault();
+                const event = dragged;
+                dragged = null;
+                const start = day.dataset.date + event.dataset.start.slice(10);
+                if (start == event.dataset.start) {
+                    return;
+                }
+                fetch('/api/calendar/' + encodeURIComponent(calendar.dataset.calendar) + '/move', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({id: parseInt(event.dataset.id, 10), start: start})
+                }).then(function(response) {
+                    return response.json().then(function(body) {
+                        if (!response.ok) {
+                            throw new Error(body.error || response.statusText);
+                        }
+                        window.location.reload();
+                    });
+                }).catch(function(err) {
+                    alert('Could not move event: ' + err.message);
+                });
+            });
+        });
+    }
+
+    // Bulk actions: select all rows, show the inputs the chosen action
+    // needs, and confirm before deleting
+    const bulkForm = document.querySelector('.bulk-form');
+    if (bulkForm) {
+        const action = bulkForm.querySelector('[name="action"]');
+        const showInputs = function() {
+            bulkForm.querySelectorAll('[data-bulk-action]').forEach(function(input) {
+                input.hidden = input.dataset.bulkAction != action.value;
+            });
+        };
+        action.addEventListener('change', showInputs);
+        showInputs();
+
+        bulkForm.querySelector('.select-all').addEventListener('change', function(e) {
+            bulkForm.querySelectorAll('[name="id"]').forEach(function(box) {
+                box.checked = e.target.checked;
+            });
+        });
+
+        bulkForm.addEventListener('submit', function(e) {
+            if (action.value == 'delete' && !confirm('Delete the selected documents?')) {
+                e.preventDefault();
+            }
+        });
+    }
 });
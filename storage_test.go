@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory stand-in for an S3 bucket that serves PUT, GET
+// and DELETE on path-style object URLs.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+s.bucket+"/")
+	if !ok {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		s.objects[key] = body
+		s.types[key] = r.Header.Get("Content-Type")
+	case http.MethodGet:
+		body, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", s.types[key])
+		w.Write(body)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := &fakeS3{bucket: "files", objects: map[string][]byte{}, types: map[string]string{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s := &S3Storage{Endpoint: server.URL, Region: "us-east-1", Bucket: "files", AccessKey: "key", SecretKey: "secret"}
+	err := s.Put("ab/report.txt", strings.NewReader("hello"), 5, "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(fake.objects["ab/report.txt"]); got != "hello" || fake.types["ab/report.txt"] != "text/plain" {
+		t.Errorf("stored %q as %q", got, fake.types["ab/report.txt"])
+	}
+
+	rc, err := s.Get("ab/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(body) != "hello" {
+		t.Errorf("Get = %q, want hello", body)
+	}
+
+	err = s.Delete("ab/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["ab/report.txt"]; ok {
+		t.Error("object still stored after Delete")
+	}
+	_, err = s.Get("ab/report.txt")
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Get after Delete: err = %v, want 404", err)
+	}
+
+	s.SecretKey = ""
+	s.AccessKey = "other"
+	err = s.Put("ab/x.txt", strings.NewReader("x"), 1, "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put with wrong key: err = %v, want 403", err)
+	}
+}
+
+func TestUploadChecksFieldPermission(t *testing.T) {
+	dt := createTestDoctype(t, nil,
+		Field{Name: "title", Type: "string", Label: "Title"},
+		Field{Name: "contract", Type: "attach", Label: "Contract", Permissions: []string{"HR"}},
+	)
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(key string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("doctype", dt.Name)
+		mw.WriteField("doc_id", fmt.Sprint(doc.ID))
+		mw.WriteField("field", "contract")
+		fw, _ := mw.CreateFormFile("file", "contract.txt")
+		fw.Write([]byte("signed"))
+		mw.Close()
+
+		req := newAPIRequest("POST", "/api/files", key, "")
+		req.Body = io.NopCloser(&body)
+		req.ContentLength = int64(body.Len())
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return serveAPIRequest(req)
+	}
+
+	w := upload(createTestAPIKey(t, createTestUser(t, "User", false)))
+	expectStatus(t, w, http.StatusForbidden)
+	got, err := getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEmptyValue(got.Data["contract"]) {
+		t.Errorf("contract = %v after a denied upload", got.Data["contract"])
+	}
+
+	w = upload(createTestAPIKey(t, createTestUser(t, "HR", false)))
+	expectStatus(t, w, http.StatusCreated)
+	got, err = getDocumentByID(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fmt.Sprint(got.Data["contract"]), "/files/") {
+		t.Errorf("contract = %v, want a file URL", got.Data["contract"])
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// DocumentTag is a free-form label on a document.
+type DocumentTag struct {
+	ID        int64  `json:"id"`
+	Doctype   string `json:"doctype"`
+	DocID     int    `json:"doc_id"`
+	Tag       string `json:"tag"`
+	AddedBy   string `json:"added_by"`
+	CreatedAt string `json:"created_at"`
+}
+
+func init() {
+	registerDocumentHook(tagCleanupHook)
+}
+
+func createTagTables() error {
+	createTagTable := `
+	CREATE TABLE IF NOT EXISTS document_tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		doc_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		added_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		UNIQUE (doctype, doc_id, tag)
+	);`
+
+	_, err := db.Exec(createTagTable)
+	return err
+}
+
+// addDocumentTag tags a document. Adding a tag the document already has is
+// a no-op.
+func addDocumentTag(t *DocumentTag) error {
+	t.Tag = strings.TrimSpace(t.Tag)
+	if t.Tag == "" {
+		return &ValidationError{Fields: map[string]string{"tag": "is required"}}
+	}
+
+	t.CreatedAt = nowTimestamp()
+	result, err := db.Exec("INSERT OR IGNORE INTO document_tags (doctype, doc_id, tag, added_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		t.Doctype, t.DocID, t.Tag, t.AddedBy, t.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return db.QueryRow("SELECT id, added_by, created_at FROM document_tags WHERE doctype = ? AND doc_id = ? AND tag = ?",
+			t.Doctype, t.DocID, t.Tag).Scan(&t.ID, &t.AddedBy, &t.CreatedAt)
+	}
+	t.ID, _ = result.LastInsertId()
+	return nil
+}
+
+func removeDocumentTag(doctypeName string, docID int, tag string) error {
+	result, err := db.Exec("DELETE FROM document_tags WHERE doctype = ? AND doc_id = ? AND tag = ?", doctypeName, docID, tag)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return &NotFoundError{What: "tag"}
+	}
+	return nil
+}
+
+func getDocumentTags(doctypeName string, docID int) ([]DocumentTag, error) {
+	rows, err := db.Query("SELECT id, doctype, doc_id, tag, added_by, created_at FROM document_tags WHERE doctype = ? AND doc_id = ? ORDER BY tag",
+		doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []DocumentTag{}
+	for rows.Next() {
+		var t DocumentTag
+		if err := rows.Scan(&t.ID, &t.Doctype, &t.DocID, &t.Tag, &t.AddedBy, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// tagCleanupHook removes the tags of deleted documents.
+func tagCleanupHook(event string, doc *Document) error {
+	if event != DocEventDelete {
+		return nil
+	}
+	_, err := db.Exec("DELETE FROM document_tags WHERE doctype = ? AND doc_id = ?", doc.DoctypeName, doc.ID)
+	return err
+}
+
+func documentTagHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	docID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	doctype, err := getDoctypeByName(name)
+	if err != nil {
+		http.Error(w, "Doctype not found", http.StatusNotFound)
+		return
+	}
+	user := currentUser(r)
+	if !canReadDoctype(user, doctype) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+	if _, err := readDocument(db, doctype, vars["id"]); err != nil {
+		http.Error(w, err.Error(), statusForError(err, http.StatusInternalServerError))
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	if remove := r.FormValue("remove"); remove != "" {
+		err = removeDocumentTag(name, docID, remove)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		t := DocumentTag{Doctype: name, DocID: docID, Tag: r.FormValue("tag"), AddedBy: username(user)}
+		err = addDocumentTag(&t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/doctype/%s/document/%d", name, docID), http.StatusSeeOther)
+}
+
+func apiListTags(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	tags, err := getDocumentTags(mux.Vars(r)["doctype"], docID)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, tags)
+}
+
+func apiAddTag(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	var body struct {
+		Tag string `json:"tag"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	t := DocumentTag{Doctype: mux.Vars(r)["doctype"], DocID: docID, Tag: body.Tag, AddedBy: username(currentUser(r))}
+	err = addDocumentTag(&t)
+	if err != nil {
+		RespondAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondJSON(w, http.StatusCreated, t)
+}
+
+func apiRemoveTag(w http.ResponseWriter, r *http.Request) {
+	docID, status, err := loadDocumentForComments(r)
+	if err != nil {
+		RespondAPIError(w, status, err)
+		return
+	}
+
+	err = removeDocumentTag(mux.Vars(r)["doctype"], docID, mux.Vars(r)["tag"])
+	if err != nil {
+		RespondAPIError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDocumentTags(t *testing.T) {
+	dt := createTestDoctype(t, []string{"HR"}, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/documents/%s/%d/tags", dt.Name, doc.ID)
+	key := createTestAPIKey(t, createTestUser(t, "HR", false))
+	outsiderKey := createTestAPIKey(t, createTestUser(t, "User", false))
+
+	expectStatus(t, apiRequest(t, "POST", path, key, `{"tag": " urgent "}`), http.StatusCreated)
+	expectStatus(t, apiRequest(t, "POST", path, key, `{"tag": "urgent"}`), http.StatusCreated)
+	expectStatus(t, apiRequest(t, "POST", path, key, `{"tag": ""}`), http.StatusBadRequest)
+	expectStatus(t, apiRequest(t, "POST", path, outsiderKey, `{"tag": "mine"}`), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "POST", fmt.Sprintf("/api/documents/%s/999999/tags", dt.Name), key, `{"tag": "lost"}`), http.StatusNotFound)
+
+	w := apiRequest(t, "GET", path, key, "")
+	expectStatus(t, w, http.StatusOK)
+	var tags []DocumentTag
+	json.Unmarshal(w.Body.Bytes(), &tags)
+	if len(tags) != 1 || tags[0].Tag != "urgent" {
+		t.Errorf("tags = %+v, want urgent once", tags)
+	}
+
+	expectStatus(t, apiRequest(t, "DELETE", path+"/urgent", outsiderKey, ""), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "DELETE", path+"/urgent", key, ""), http.StatusNoContent)
+	expectStatus(t, apiRequest(t, "DELETE", path+"/urgent", key, ""), http.StatusNotFound)
+
+	// Tags go with their document
+	expectStatus(t, apiRequest(t, "POST", path, key, `{"tag": "old"}`), http.StatusCreated)
+	err = deleteDocument(dt.Name, fmt.Sprint(doc.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := getDocumentTags(dt.Name, doc.ID); err != nil || len(tags) != 0 {
+		t.Errorf("tags = %+v, %v after delete, want none", tags, err)
+	}
+}
+
+func TestDocumentTagForm(t *testing.T) {
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+	s := newTestSession(t, server, createTestUser(t, "User", false))
+
+	resp := s.post(fmt.Sprintf("/doctype/%s/document/%d/tags", dt.Name, doc.ID), url.Values{"tag": {"urgent"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("add: status = %d, want %d", resp.StatusCode, http.StatusSeeOther)
+	}
+	resp = s.post(fmt.Sprintf("/doctype/%s/document/999999/tags", dt.Name), url.Values{"tag": {"lost"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("add to a missing document: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	resp = s.post(fmt.Sprintf("/doctype/%s/document/%d/tags", uniqueName("Missing"), doc.ID), url.Values{"tag": {"lost"}})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("add to a missing doctype: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if tags, _ := getDocumentTags(dt.Name, 999999); len(tags) != 0 {
+		t.Errorf("tags = %+v on a missing document", tags)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ValidationError collects the problems found with a document, keyed by
+// field name.
+type ValidationError struct {
+	Fields map[string]string `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e.Fields[name])
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+var dateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// validateDocument checks the document data against the doctype's fields
+// and converts values to the field types. With partial set, fields missing
+// from the data are left alone, as for an update that only sends changes.
+func validateDocument(doctype Doctype, data map[string]interface{}, partial bool) error {
+	errs := map[string]string{}
+
+	for _, field := range doctype.Fields {
+		value, ok := data[field.Name]
+		if field.Type == "table" {
+			// Child rows are documents of their own doctype
+			if ok && !isEmptyValue(value) {
+				errs[field.Name] = fmt.Sprintf("rows are %s documents, not a value", field.Options)
+			}
+			continue
+		}
+		if !ok && partial {
+			continue
+		}
+
+		if isEmptyValue(value) {
+			if field.Required {
+				errs[field.Name] = "is required"
+			} else if ok && !isTextFieldType(field.Type) {
+				// Store blank numbers and dates as NULL rather than ''
+				data[field.Name] = nil
+			}
+			continue
+		}
+
+		converted, err := coerceFieldValue(field, value)
+		if err != nil {
+			errs[field.Name] = err.Error()
+			continue
+		}
+		data[field.Name] = converted
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+func isEmptyValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if s, ok := value.(string); ok {
+		return strings.TrimSpace(s) == ""
+	}
+	return false
+}
+
+func isTextFieldType(fieldType string) bool {
+	switch fieldType {
+	case "integer", "float", "boolean", "date", "datetime", "link":
+		return false
+	}
+	return true
+}
+
+// coerceFieldValue converts a raw value (usually a string from a form or a
+// file) to the Go type stored for the field type.
+func coerceFieldValue(field Field, value interface{}) (interface{}, error) {
+	s, isString := value.(string)
+	if isString {
+		s = strings.TrimSpace(s)
+	}
+
+	switch field.Type {
+	case "integer", "link":
+		switch v := value.(type) {
+		case int, int64:
+			return v, nil
+		case float64:
+			if v != float64(int64(v)) {
+				return nil, fmt.Errorf("must be a whole number")
+			}
+			return int64(v), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a whole number")
+		}
+		return n, nil
+	case "float":
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return f, nil
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int64:
+			return v != 0, nil
+		case float64:
+			return v != 0, nil
+		}
+		switch strings.ToLower(s) {
+		case "1", "true", "yes", "on":
+			return true, nil
+		case "0", "false", "no", "off":
+			return false, nil
+		}
+		return nil, fmt.Errorf("must be true or false")
+	case "date":
+		if !isString {
+			return nil, fmt.Errorf("must be a date (YYYY-MM-DD)")
+		}
+		if _, err := time.Parse("2006-01-02", s); err != nil {
+			return nil, fmt.Errorf("must be a date (YYYY-MM-DD)")
+		}
+		return s, nil
+	case "datetime":
+		if !isString {
+			return nil, fmt.Errorf("must be a date and time")
+		}
+		for _, layout := range dateTimeLayouts {
+			if _, err := time.Parse(layout, s); err == nil {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("must be a date and time")
+	default:
+		if isString {
+			return value, nil
+		}
+		return fmt.Sprint(value), nil
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// FieldChange is a single field value changed by a document write.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// Version is a snapshot of a document taken after each write, with the
+// fields that changed since the previous snapshot.
+type Version struct {
+	ID        int64                  `json:"id"`
+	Doctype   string                 `json:"doctype"`
+	DocID     int                    `json:"doc_id"`
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data"`
+	Changes   []FieldChange          `json:"changes"`
+	User      string                 `json:"user"`
+	CreatedAt string                 `json:"created_at"`
+}
+
+func init() {
+	registerDocumentHook(versionHook)
+}
+
+func createVersionTables() error {
+	createVersionTable := `
+	CREATE TABLE IF NOT EXISTS document_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doctype TEXT NOT NULL,
+		doc_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		data TEXT NOT NULL,
+		changes TEXT NOT NULL,
+		user TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createVersionTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_document_versions_doc ON document_versions (doctype, doc_id)")
+	return err
+}
+
+// versionHook records a version for every insert and for updates that
+// actually changed something.
+func versionHook(event string, doc *Document) error {
+	if event != DocEventInsert && event != DocEventUpdate {
+		return nil
+	}
+
+	stored, err := getDocumentByID(doc.DoctypeName, strconv.Itoa(doc.ID))
+	if err != nil {
+		return err
+	}
+	// Never keep copies of secrets such as password hashes in the history
+	stored = hideSecretFields(stored)
+
+	previous, err := getLatestVersion(doc.DoctypeName, doc.ID)
+	if err != nil {
+		return err
+	}
+
+	var changes []FieldChange
+	for name, value := range stored.Data {
+		var old interface{}
+		if previous != nil {
+			old = previous.Data[name]
+		}
+		if fmt.Sprint(normalizeVersionValue(old)) != fmt.Sprint(normalizeVersionValue(value)) {
+			changes = append(changes, FieldChange{Field: name, Old: old, New: value})
+		}
+	}
+	if event == DocEventUpdate && len(changes) == 0 {
+		return nil
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+
+	data, _ := json.Marshal(stored.Data)
+	changed, _ := json.Marshal(changes)
+	_, err = db.Exec("INSERT INTO document_versions (doctype, doc_id, event, data, changes, user, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		doc.DoctypeName, doc.ID, event, string(data), string(changed), doc.ModifiedBy, nowTimestamp())
+	return err
+}
+
+// normalizeVersionValue makes values read back from JSON comparable with
+// values scanned from the database.
+func normalizeVersionValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	case []byte:
+		return string(v)
+	}
+	return value
+}
+
+func scanVersion(scanner interface{ Scan(...interface{}) error }) (Version, error) {
+	var v Version
+	var data, changes string
+	err := scanner.Scan(&v.ID, &v.Doctype, &v.DocID, &v.Event, &data, &changes, &v.User, &v.CreatedAt)
+	if err != nil {
+		return v, err
+	}
+	json.Unmarshal([]byte(data), &v.Data)
+	json.Unmarshal([]byte(changes), &v.Changes)
+	return v, nil
+}
+
+func getLatestVersion(doctypeName string, docID int) (*Version, error) {
+	v, err := scanVersion(db.QueryRow(`SELECT id, doctype, doc_id, event, data, changes, user, created_at
+		FROM document_versions WHERE doctype = ? AND doc_id = ? ORDER BY id DESC LIMIT 1`, doctypeName, docID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// getVersions returns the versions of a document, oldest first.
+func getVersions(doctypeName string, docID int) ([]Version, error) {
+	rows, err := db.Query(`SELECT id, doctype, doc_id, event, data, changes, user, created_at
+		FROM document_versions WHERE doctype = ? AND doc_id = ? ORDER BY id`, doctypeName, docID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []Version
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WebhookDoctype is the doctype holding outgoing webhooks. Each webhook
+// names a doctype and event, the URL to POST to, extra headers as
+// "Name: Value" lines, an optional JSON body template and a signing secret.
+// Body templates use text/template syntax with a json function, e.g.
+//
+//	{"id": {{.ID}}, "status": {{json .Doc.status}}}
+//
+// Without a template the body is the event, doctype, id and document data.
+const WebhookDoctype = "Webhook"
+
+// Webhook delivery statuses
+const (
+	WebhookPending = "Pending"
+	WebhookSuccess = "Success"
+	WebhookFailed  = "Failed"
+)
+
+// maxWebhookAttempts is how many times a delivery is tried before it is
+// marked as failed.
+const maxWebhookAttempts = 6
+
+// webhookClient sends webhook requests.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// WebhookDelivery is a request to send to a webhook, queued when the
+// document event happened.
+type WebhookDelivery struct {
+	ID            int64             `json:"id"`
+	WebhookID     int               `json:"webhook_id"`
+	WebhookName   string            `json:"webhook_name"`
+	Event         string            `json:"event"`
+	Doctype       string            `json:"doctype"`
+	DocID         int               `json:"doc_id"`
+	URL           string            `json:"url"`
+	Headers       map[string]string `json:"headers"`
+	Body          string            `json:"body"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt string            `json:"next_attempt_at"`
+	CreatedAt     string            `json:"created_at"`
+	Log           []WebhookAttempt  `json:"log,omitempty"`
+}
+
+// WebhookAttempt records one try at sending a delivery.
+type WebhookAttempt struct {
+	ID              int64  `json:"id"`
+	DeliveryID      int64  `json:"delivery_id"`
+	Attempt         int    `json:"attempt"`
+	ResponseStatus  int    `json:"response_status"`
+	ResponseHeaders string `json:"response_headers"`
+	ResponseBody    string `json:"response_body"`
+	Error           string `json:"error"`
+	DurationMs      int64  `json:"duration_ms"`
+	CreatedAt       string `json:"created_at"`
+}
+
+// WebhookContext is the data webhook body templates are rendered with.
+type WebhookContext struct {
+	Event     string                 `json:"event"`
+	Doctype   string                 `json:"doctype"`
+	ID        int                    `json:"id"`
+	Doc       map[string]interface{} `json:"data"`
+	User      string                 `json:"user"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+func init() {
+	registerDocumentHook(webhookHook)
+}
+
+// createWebhookDoctype creates the Webhook doctype unless it already exists.
+func createWebhookDoctype() error {
+	if _, err := getDoctypeByName(WebhookDoctype); err == nil {
+		return nil
+	}
+
+	webhookDoctype := Doctype{
+		Name: WebhookDoctype,
+		Fields: []Field{
+			{Name: "name", Type: "string", Label: "Name", Required: true},
+			{Name: "document_type", Type: "string", Label: "Document Type", Required: true},
+			{Name: "event", Type: "string", Label: "Event (insert, update, delete, submit or cancel)", Required: true},
+			{Name: "url", Type: "string", Label: "URL", Required: true},
+			{Name: "headers", Type: "text", Label: "Headers (one Name: Value per line)", Required: false},
+			{Name: "body_template", Type: "text", Label: "JSON Body Template", Required: false},
+			{Name: "secret", Type: "string", Label: "Signing Secret", Required: false},
+			{Name: "enabled", Type: "boolean", Label: "Enabled", Required: false},
+		},
+		Permissions: []string{"admin"},
+	}
+
+	return createDoctype(&webhookDoctype)
+}
+
+func createWebhookTables() error {
+	createDeliveryTable := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		webhook_name TEXT NOT NULL,
+		event TEXT NOT NULL,
+		doctype TEXT NOT NULL,
+		doc_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		headers TEXT NOT NULL,
+		body TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(createDeliveryTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_status ON webhook_deliveries (status, next_attempt_at)")
+	if err != nil {
+		return err
+	}
+
+	createAttemptTable := `
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id INTEGER NOT NULL,
+		attempt INTEGER NOT NULL,
+		response_status INTEGER NOT NULL DEFAULT 0,
+		response_headers TEXT NOT NULL DEFAULT '',
+		response_body TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id)
+	);`
+
+	_, err = db.Exec(createAttemptTable)
+	return err
+}
+
+// webhookHook queues a delivery for every enabled webhook matching the
+// document event. Requests are sent by background jobs, so slow endpoints
+// never hold up the write.
+func webhookHook(event string, doc *Document) error {
+	if doc.DoctypeName == WebhookDoctype {
+		return nil
+	}
+
+	webhooks, err := findEventRules(WebhookDoctype, doc.DoctypeName, event)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	data, err := hookDocumentData(event, doc)
+	if err != nil {
+		return err
+	}
+	data = hideSecretFields(Document{DoctypeName: doc.DoctypeName, Data: data}).Data
+
+	ctx := WebhookContext{
+		Event:     event,
+		Doctype:   doc.DoctypeName,
+		ID:        doc.ID,
+		Doc:       data,
+		User:      doc.ModifiedBy,
+		Timestamp: nowTimestamp(),
+	}
+
+	var errs []string
+	for _, webhook := range webhooks {
+		d, err := newWebhookDelivery(webhook, ctx)
+		if err == nil {
+			err = queueWebhookDelivery(d)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("webhook %q: %v", ruleString(webhook, "name"), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func copyWithout(data map[string]interface{}, key string) map[string]interface{} {
+	c := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if k != key {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// newWebhookDelivery renders the request for a webhook. Deliveries are
+// signed when they are sent, see signWebhookRequest.
+func newWebhookDelivery(webhook Document, ctx WebhookContext) (*WebhookDelivery, error) {
+	var body []byte
+	if text := ruleString(webhook, "body_template"); text != "" {
+		t, err := template.New("body").Funcs(template.FuncMap{"json": toJSON}).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, ctx); err != nil {
+			return nil, err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("body template did not produce valid JSON")
+		}
+		body = buf.Bytes()
+	} else {
+		var err error
+		body, err = json.Marshal(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	headers, err := parseWebhookHeaders(ruleString(webhook, "headers"))
+	if err != nil {
+		return nil, err
+	}
+	headers["Content-Type"] = "application/json"
+	headers["X-Webhook-Event"] = ctx.Event
+
+	return &WebhookDelivery{
+		WebhookID:   webhook.ID,
+		WebhookName: ruleString(webhook, "name"),
+		Event:       ctx.Event,
+		Doctype:     ctx.Doctype,
+		DocID:       ctx.ID,
+		URL:         ruleString(webhook, "url"),
+		Headers:     headers,
+		Body:        string(body),
+	}, nil
+}
+
+// signWebhookRequest signs a delivery with the secret of its webhook, if it
+// has one. The signature is the hex HMAC-SHA256 of the X-Webhook-Timestamp
+// header, a dot and the body, so receivers can reject old deliveries that
+// are sent again.
+func signWebhookRequest(req *http.Request, d WebhookDelivery, now time.Time) error {
+	webhook, err := getDocumentByID(WebhookDoctype, strconv.Itoa(d.WebhookID))
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	secret := ruleString(webhook, "secret")
+	if secret == "" {
+		return nil
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(secret), timestamp+"."+d.Body)))
+	return nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// parseWebhookHeaders reads "Name: Value" lines.
+func parseWebhookHeaders(text string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header line %q", line)
+		}
+		headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// WebhookJob is the payload of the background job that sends a webhook
+// delivery.
+type WebhookJob struct {
+	DeliveryID int64 `json:"delivery_id"`
+}
+
+var webhookJob JobType[WebhookJob]
+
+func init() {
+	webhookJob = defineJob("webhook_delivery", JobOptions{MaxAttempts: maxWebhookAttempts, RetryDelay: webhookRetryDelay, Timeout: time.Minute}, sendWebhookDelivery)
+}
+
+func queueWebhookDelivery(d *WebhookDelivery) error {
+	headers, _ := json.Marshal(d.Headers)
+	d.Status = WebhookPending
+	d.CreatedAt = nowTimestamp()
+	d.NextAttemptAt = d.CreatedAt
+	result, err := db.Exec(`INSERT INTO webhook_deliveries (webhook_id, webhook_name, event, doctype, doc_id, url, headers, body, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.WebhookID, d.WebhookName, d.Event, d.Doctype, d.DocID, d.URL, string(headers), d.Body, d.Status, d.NextAttemptAt, d.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	d.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = webhookJob.Enqueue(WebhookJob{DeliveryID: d.ID})
+	return err
+}
+
+const webhookDeliveryColumns = "id, webhook_id, webhook_name, event, doctype, doc_id, url, headers, body, status, attempts, next_attempt_at, created_at"
+
+func scanWebhookDelivery(scanner interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var headers string
+	err := scanner.Scan(&d.ID, &d.WebhookID, &d.WebhookName, &d.Event, &d.Doctype, &d.DocID, &d.URL, &headers, &d.Body, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.CreatedAt)
+	if err != nil {
+		return d, err
+	}
+	json.Unmarshal([]byte(headers), &d.Headers)
+	return d, nil
+}
+
+// getWebhookDelivery returns a delivery with its attempt log.
+func getWebhookDelivery(id int64) (WebhookDelivery, error) {
+	d, err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id))
+	if err != nil {
+		return d, err
+	}
+
+	rows, err := db.Query(`SELECT id, delivery_id, attempt, response_status, response_headers, response_body, error, duration_ms, created_at
+		FROM webhook_attempts WHERE delivery_id = ? ORDER BY id`, id)
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a WebhookAttempt
+		err := rows.Scan(&a.ID, &a.DeliveryID, &a.Attempt, &a.ResponseStatus, &a.ResponseHeaders, &a.ResponseBody, &a.Error, &a.DurationMs, &a.CreatedAt)
+		if err != nil {
+			return d, err
+		}
+		d.Log = append(d.Log, a)
+	}
+	return d, rows.Err()
+}
+
+// getWebhookDeliveries lists deliveries, newest first, optionally only
+// those of one webhook.
+func getWebhookDeliveries(webhookID int, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries"
+	var args []interface{}
+	if webhookID != 0 {
+		query += " WHERE webhook_id = ?"
+		args = append(args, webhookID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// webhookRetryDelay is the wait before the next attempt after the given
+// number of failed attempts: 30 seconds, doubling each time.
+func webhookRetryDelay(attempts int) time.Duration {
+	return 30 * time.Second << (attempts - 1)
+}
+
+// sendWebhookDelivery makes one attempt at sending the delivery and records
+// it in the delivery log. A failure is returned so the job is retried.
+func sendWebhookDelivery(ctx context.Context, p WebhookJob) error {
+	d, err := scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", p.DeliveryID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d.Status != WebhookPending {
+		return nil
+	}
+
+	d.Attempts++
+	attempt := WebhookAttempt{DeliveryID: d.ID, Attempt: d.Attempts}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, strings.NewReader(d.Body))
+	if err == nil {
+		for name, value := range d.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+		err = signWebhookRequest(req, d, start)
+	}
+	if err == nil {
+		var resp *http.Response
+		resp, err = webhookClient.Do(req)
+		if err == nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			attempt.ResponseStatus = resp.StatusCode
+			attempt.ResponseHeaders = formatHeaders(resp.Header)
+			attempt.ResponseBody = string(body)
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				err = fmt.Errorf("unexpected response %s", resp.Status)
+			}
+		}
+	}
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	attempt.CreatedAt = nowTimestamp()
+
+	status := WebhookSuccess
+	next := d.NextAttemptAt
+	if err != nil {
+		attempt.Error = err.Error()
+		status = WebhookPending
+		if d.Attempts >= maxWebhookAttempts {
+			status = WebhookFailed
+		}
+		next = time.Now().UTC().Add(webhookRetryDelay(d.Attempts)).Format(timestampLayout)
+	}
+
+	_, dbErr := db.Exec(`INSERT INTO webhook_attempts (delivery_id, attempt, response_status, response_headers, response_body, error, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		attempt.DeliveryID, attempt.Attempt, attempt.ResponseStatus, attempt.ResponseHeaders, attempt.ResponseBody, attempt.Error, attempt.DurationMs, attempt.CreatedAt)
+	if dbErr != nil {
+		return dbErr
+	}
+	_, dbErr = db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ? WHERE id = ?",
+		status, d.Attempts, next, d.ID)
+	if dbErr != nil {
+		return dbErr
+	}
+	if err != nil {
+		return fmt.Errorf("webhook delivery %d to %s: %w", d.ID, d.URL, err)
+	}
+	return nil
+}
+
+func formatHeaders(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range h[name] {
+			fmt.Fprintf(&b, "%s: %s\n", name, value)
+		}
+	}
+	return b.String()
+}
+
+// retryWebhookDelivery queues a delivery to be sent again right away.
+func retryWebhookDelivery(id int64) error {
+	result, err := db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ?",
+		WebhookPending, nowTimestamp(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = webhookJob.Enqueue(WebhookJob{DeliveryID: id})
+	return err
+}
+
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	webhookID, _ := strconv.Atoi(r.URL.Query().Get("webhook"))
+	deliveries, err := getWebhookDeliveries(webhookID, 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := PageData{
+		Title: "Webhook Deliveries",
+		Content: struct {
+			Deliveries []WebhookDelivery
+		}{
+			Deliveries: deliveries,
+		},
+	}
+	renderTemplate(w, r, "webhook_deliveries.html", data)
+}
+
+func webhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err = retryWebhookDelivery(id)
+		if err != nil {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/webhooks/deliveries/%d", id), http.StatusSeeOther)
+		return
+	}
+
+	d, err := getWebhookDelivery(id)
+	if err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	data := PageData{
+		Title:   fmt.Sprintf("Webhook Delivery %d", d.ID),
+		Content: d,
+	}
+	renderTemplate(w, r, "webhook_delivery.html", data)
+}
+
+func apiListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	webhookID, _ := strconv.Atoi(r.URL.Query().Get("webhook"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	deliveries, err := getWebhookDeliveries(webhookID, limit)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, deliveries)
+}
+
+func apiGetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	d, err := getWebhookDelivery(id)
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "Delivery not found")
+		return
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, d)
+}
+
+func apiRetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	if !isAdminUser(currentUser(r)) {
+		RespondError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	err = retryWebhookDelivery(id)
+	if err == sql.ErrNoRows {
+		RespondError(w, http.StatusNotFound, "Delivery not found")
+		return
+	}
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	d, err := getWebhookDelivery(id)
+	if err != nil {
+		RespondAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondJSON(w, http.StatusOK, d)
+}
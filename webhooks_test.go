@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests sent to it and answers with the
+// queued statuses, then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	statuses []int
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, string(body))
+	status := http.StatusOK
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func createTestWebhook(t *testing.T, doctype, url string, data map[string]interface{}) Document {
+	t.Helper()
+	webhook := Document{DoctypeName: WebhookDoctype, Data: map[string]interface{}{
+		"name":          uniqueName("hook"),
+		"document_type": doctype,
+		"event":         DocEventInsert,
+		"url":           url,
+		"enabled":       true,
+	}}
+	for k, v := range data {
+		webhook.Data[k] = v
+	}
+	err := createDocument(&webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	rec := &webhookReceiver{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	createTestWebhook(t, dt.Name, server.URL, map[string]interface{}{
+		"secret":        "s3cret",
+		"headers":       "X-Team: ops",
+		"body_template": `{"id": {{.ID}}, "title": {{json .Doc.title}}}`,
+	})
+	createTestWebhook(t, dt.Name, server.URL, map[string]interface{}{"event": DocEventDelete})
+
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": `say "hi"`}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runQueuedJobs(t)
+
+	if len(rec.requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(rec.requests))
+	}
+	req, body := rec.requests[0], rec.bodies[0]
+	if want := fmt.Sprintf(`{"id": %d, "title": "say \"hi\""}`, doc.ID); body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+	if req.Header.Get("X-Team") != "ops" || req.Header.Get("X-Webhook-Event") != DocEventInsert || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v", req.Header)
+	}
+
+	timestamp := req.Header.Get("X-Webhook-Timestamp")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("X-Webhook-Timestamp = %q", timestamp)
+	}
+	want := "sha256=" + hex.EncodeToString(hmacSHA256([]byte("s3cret"), timestamp+"."+body))
+	if got := req.Header.Get("X-Webhook-Signature"); got != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", got, want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rec := &webhookReceiver{statuses: []int{http.StatusBadGateway}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	dt := createTestDoctype(t, nil, Field{Name: "title", Type: "string", Label: "Title"})
+	webhook := createTestWebhook(t, dt.Name, server.URL, nil)
+	doc := Document{DoctypeName: dt.Name, Data: map[string]interface{}{"title": "a"}}
+	err := createDocument(&doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runQueuedJobs(t)
+
+	deliveries, err := getWebhookDeliveries(webhook.ID, 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("deliveries = %v, %v", deliveries, err)
+	}
+	d, err := getWebhookDelivery(deliveries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != WebhookPending || d.Attempts != 1 || len(d.Log) != 1 || d.Log[0].ResponseStatus != http.StatusBadGateway {
+		t.Errorf("after a failure: %+v", d)
+	}
+	if d.Headers["X-Webhook-Signature"] != "" {
+		t.Errorf("signature stored with the delivery")
+	}
+
+	// The retry waits for its backoff, so send it again by hand
+	err = retryWebhookDelivery(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runQueuedJobs(t)
+	d, err = getWebhookDelivery(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != WebhookSuccess || len(d.Log) != 2 || d.Log[1].ResponseStatus != http.StatusOK {
+		t.Errorf("after a retry: %+v", d)
+	}
+	if len(rec.requests) != 2 || rec.requests[1].Header.Get("X-Webhook-Delivery") != strconv.FormatInt(d.ID, 10) {
+		t.Errorf("%d requests, want 2", len(rec.requests))
+	}
+
+	if got := webhookRetryDelay(3); got != 2*time.Minute {
+		t.Errorf("webhookRetryDelay(3) = %s, want 2m", got)
+	}
+}
+
+func TestWebhookDataHidesSecretFields(t *testing.T) {
+	rec := &webhookReceiver{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	webhook := createTestWebhook(t, "User", server.URL, nil)
+	defer updateDocument(&Document{ID: webhook.ID, DoctypeName: WebhookDoctype, Data: map[string]interface{}{"enabled": false}})
+	createTestUser(t, "User", false)
+	runQueuedJobs(t)
+
+	if len(rec.bodies) == 0 {
+		t.Fatal("no delivery")
+	}
+	for _, body := range rec.bodies {
+		var ctx WebhookContext
+		json.Unmarshal([]byte(body), &ctx)
+		if _, ok := ctx.Doc["password"]; ok || ctx.Doc["username"] == nil {
+			t.Errorf("body = %s", body)
+		}
+	}
+}
+
+func TestWebhooksAreAdminOnly(t *testing.T) {
+	key := createTestAPIKey(t, createTestUser(t, "User", false))
+	expectStatus(t, apiRequest(t, "GET", "/api/documents/"+WebhookDoctype, key, ""), http.StatusForbidden)
+	expectStatus(t, apiRequest(t, "GET", "/api/webhooks/deliveries", key, ""), http.StatusForbidden)
+	adminKey := createTestAPIKey(t, createTestUser(t, "User", true))
+	expectStatus(t, apiRequest(t, "GET", "/api/documents/"+WebhookDoctype, adminKey, ""), http.StatusOK)
+}